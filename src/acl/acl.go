@@ -0,0 +1,382 @@
+package acl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"mylog"
+	"net"
+	"netstat"
+	"packet"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+)
+
+// VidAcl is the acl of a vid: the rules are evaluated in order, the first
+// allow or drop rule matched decides, Policy decides if none matched.
+type VidAcl struct {
+	Vid    int    `toml:"vid"`
+	Policy string `toml:"policy"` //allow or drop, allow by default
+	Rules  []Rule `toml:"rules"`
+}
+
+// RuleInfo is a rule and the packets it matched
+type RuleInfo struct {
+	Rule
+	Hits uint64
+}
+
+// VidAclInfo is the acl of a vid and its counters
+type VidAclInfo struct {
+	Vid     int
+	Policy  string
+	Rules   []RuleInfo
+	Allowed uint64
+	Dropped uint64
+}
+
+type vidAcl struct {
+	//first, atomic 64-bit ops need them 8-byte aligned on 386 and arm
+	allowed  uint64
+	dropped  uint64
+	vid      int
+	policy   string
+	rules    []*rule //replaced as a whole on change, never changed in place
+	stateful bool
+}
+
+// pktInfo is what the rules match of a packet
+type pktInfo struct {
+	hasMac    bool
+	srcMac    packet.MAC
+	dstMac    packet.MAC
+	etherType uint16
+	isIP      bool
+	src       net.IP
+	dst       net.IP
+	proto     uint8
+	hasPorts  bool
+	sport     uint16
+	dport     uint16
+}
+
+var aclLock sync.RWMutex
+var acls = make(map[int]*vidAcl)
+var aclNum int32
+
+func parsePolicy(policy string) (string, error) {
+	switch strings.ToLower(policy) {
+	case "", ActionAllow:
+		return ActionAllow, nil
+	case ActionDrop:
+		return ActionDrop, nil
+	}
+	return "", fmt.Errorf("invalid policy %s", policy)
+}
+
+func compileRules(rules []Rule) ([]*rule, error) {
+	crs := make([]*rule, 0, len(rules))
+	for i, r := range rules {
+		cr, err := compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d %+v: %s", i, r, err.Error())
+		}
+		crs = append(crs, cr)
+	}
+	return crs, nil
+}
+
+// setRules installs rules of va, the caller holds aclLock
+func (va *vidAcl) setRules(rules []*rule) {
+	va.rules = rules
+	va.stateful = false
+	for _, r := range rules {
+		if r.state != 0 {
+			va.stateful = true
+		}
+	}
+	if va.stateful {
+		//the state is looked up in the conntrack of netstat
+		netstat.SetNetZone(va.vid)
+	}
+}
+
+// Stateful reports whether the acl of vid matches the state, its packets
+// are tracked on the forwarding path then, see NetStatTrack.
+func Stateful(vid int) bool {
+	if atomic.LoadInt32(&aclNum) == 0 {
+		return false
+	}
+	aclLock.RLock()
+	va, ok := acls[vid]
+	stateful := ok && va.stateful
+	aclLock.RUnlock()
+	return stateful
+}
+
+func getVidAcl(vid int) *vidAcl {
+	va, ok := acls[vid]
+	if !ok {
+		va = &vidAcl{vid: vid, policy: ActionAllow}
+		acls[vid] = va
+		atomic.StoreInt32(&aclNum, int32(len(acls)))
+	}
+	return va
+}
+
+// SetVidAcl replaces the acl of a vid, nothing is changed if a rule is invalid
+func SetVidAcl(conf VidAcl) error {
+	policy, err := parsePolicy(conf.Policy)
+	if err != nil {
+		return err
+	}
+	rules, err := compileRules(conf.Rules)
+	if err != nil {
+		return err
+	}
+	aclLock.Lock()
+	va := getVidAcl(conf.Vid)
+	va.policy = policy
+	va.setRules(rules)
+	aclLock.Unlock()
+	mylog.Info("vid=%d acl: policy %s, %d rules\n", conf.Vid, policy, len(rules))
+	return nil
+}
+
+// SetAcls replaces all the acls, the vids not in confs have no acl any more
+func SetAcls(confs []VidAcl) error {
+	for _, conf := range confs {
+		if _, err := parsePolicy(conf.Policy); err != nil {
+			return fmt.Errorf("vid=%d: %s", conf.Vid, err.Error())
+		}
+		if _, err := compileRules(conf.Rules); err != nil {
+			return fmt.Errorf("vid=%d: %s", conf.Vid, err.Error())
+		}
+	}
+	keep := make(map[int]bool, len(confs))
+	for _, conf := range confs {
+		keep[conf.Vid] = true
+		SetVidAcl(conf)
+	}
+	aclLock.Lock()
+	for vid := range acls {
+		if !keep[vid] {
+			delete(acls, vid)
+		}
+	}
+	atomic.StoreInt32(&aclNum, int32(len(acls)))
+	aclLock.Unlock()
+	return nil
+}
+
+// DelVidAcl removes the acl of vid, all its packets are allowed
+func DelVidAcl(vid int) {
+	aclLock.Lock()
+	delete(acls, vid)
+	atomic.StoreInt32(&aclNum, int32(len(acls)))
+	aclLock.Unlock()
+}
+
+// SetPolicy sets the default policy of vid
+func SetPolicy(vid int, policy string) error {
+	policy, err := parsePolicy(policy)
+	if err != nil {
+		return err
+	}
+	aclLock.Lock()
+	getVidAcl(vid).policy = policy
+	aclLock.Unlock()
+	return nil
+}
+
+// AddRule inserts r at index of the rules of vid, it is appended if index is
+// out of range.
+func AddRule(vid int, index int, r Rule) error {
+	cr, err := compile(r)
+	if err != nil {
+		return err
+	}
+	aclLock.Lock()
+	defer aclLock.Unlock()
+	va := getVidAcl(vid)
+	if index < 0 || index > len(va.rules) {
+		index = len(va.rules)
+	}
+	rules := make([]*rule, 0, len(va.rules)+1)
+	rules = append(rules, va.rules[:index]...)
+	rules = append(rules, cr)
+	rules = append(rules, va.rules[index:]...)
+	va.setRules(rules)
+	return nil
+}
+
+// DelRule deletes the rule at index of the rules of vid
+func DelRule(vid int, index int) error {
+	aclLock.Lock()
+	defer aclLock.Unlock()
+	va, ok := acls[vid]
+	if !ok {
+		return fmt.Errorf("vid=%d has no acl", vid)
+	}
+	if index < 0 || index >= len(va.rules) {
+		return fmt.Errorf("vid=%d has no rule %d", vid, index)
+	}
+	rules := make([]*rule, 0, len(va.rules)-1)
+	rules = append(rules, va.rules[:index]...)
+	rules = append(rules, va.rules[index+1:]...)
+	va.setRules(rules)
+	return nil
+}
+
+// ShowAcls returns the acls sorted by vid
+func ShowAcls() []VidAclInfo {
+	aclLock.RLock()
+	defer aclLock.RUnlock()
+	infos := make([]VidAclInfo, 0, len(acls))
+	for vid, va := range acls {
+		info := VidAclInfo{
+			Vid:     vid,
+			Policy:  va.policy,
+			Allowed: atomic.LoadUint64(&va.allowed),
+			Dropped: atomic.LoadUint64(&va.dropped),
+		}
+		for _, r := range va.rules {
+			info.Rules = append(info.Rules, RuleInfo{r.Rule, atomic.LoadUint64(&r.hits)})
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Vid < infos[j].Vid })
+	return infos
+}
+
+// parsePkt parses the ether packet, or the ip packet if l3 is true
+func parsePkt(data []byte, l3 bool, p *pktInfo) {
+	network := data
+	if !l3 {
+		if len(data) < packet.EtherSize {
+			return
+		}
+		ether := packet.TranEther(data)
+		p.hasMac = true
+		p.srcMac, p.dstMac = ether.SrcMac, ether.DstMac
+		p.etherType = ether.GetProto()
+		network = data[packet.EtherSize:]
+	} else if len(data) > 0 {
+		switch data[0] >> 4 {
+		case 4:
+			p.etherType = etherTypeIPv4
+		case 6:
+			p.etherType = etherTypeIPv6
+		}
+	}
+
+	var offset int
+	switch p.etherType {
+	case etherTypeIPv4:
+		if len(network) < 20 || network[0]>>4 != 4 {
+			return
+		}
+		p.isIP = true
+		p.proto = network[9]
+		p.src, p.dst = net.IP(network[12:16]), net.IP(network[16:20])
+		if binary.BigEndian.Uint16(network[6:])&0x1fff != 0 {
+			//the ports are in the first fragment only
+			return
+		}
+		offset = int(network[0]&0x0f) << 2
+	case etherTypeIPv6:
+		if len(network) < packet.IPv6HeaderLen || network[0]>>4 != 6 {
+			return
+		}
+		p.isIP = true
+		p.src, p.dst = net.IP(network[8:24]), net.IP(network[24:40])
+		proto, off, ok := packet.IPv6Transport(network)
+		if !ok {
+			p.proto = network[6]
+			return
+		}
+		p.proto, offset = uint8(proto), off
+	default:
+		return
+	}
+	if (p.proto == 6 || p.proto == 17) && len(network) >= offset+4 {
+		p.hasPorts = true
+		p.sport = binary.BigEndian.Uint16(network[offset:])
+		p.dport = binary.BigEndian.Uint16(network[offset+2:])
+	}
+}
+
+func (p *pktInfo) String() string {
+	s := fmt.Sprintf("ethertype 0x%04x", p.etherType)
+	if p.hasMac {
+		s = fmt.Sprintf("%s > %s %s", p.srcMac.String(), p.dstMac.String(), s)
+	}
+	if p.isIP {
+		s += fmt.Sprintf(" %s > %s proto %d", p.src.String(), p.dst.String(), p.proto)
+	}
+	if p.hasPorts {
+		s += fmt.Sprintf(" sport %d dport %d", p.sport, p.dport)
+	}
+	return s
+}
+
+// Check evaluates the acl of the vid of pkt, it reports whether pkt is
+// allowed. The packets of a routed vid are ip packets, l3 is true for them.
+func Check(pkt *packet.PktBuf, l3 bool) bool {
+	if atomic.LoadInt32(&aclNum) == 0 {
+		return true
+	}
+	vid := int(pkt.GetPktVid())
+	aclLock.RLock()
+	va, ok := acls[vid]
+	var rules []*rule
+	var policy string
+	if ok {
+		rules, policy = va.rules, va.policy
+	}
+	aclLock.RUnlock()
+	if !ok {
+		return true
+	}
+
+	var p pktInfo
+	parsePkt(pkt.LoadUserData(), l3, &p)
+	state := -1
+	getState := func() int {
+		if state < 0 {
+			state = netstat.StateUntracked
+			if !l3 {
+				state = netstat.PktState(pkt)
+			}
+		}
+		return state
+	}
+	for i, r := range rules {
+		if !r.match(&p, getState) {
+			continue
+		}
+		atomic.AddUint64(&r.hits, 1)
+		switch r.Action {
+		case ActionLog:
+			mylog.Info("acl vid=%d rule %d: %s\n", vid, i, p.String())
+		case ActionAllow:
+			atomic.AddUint64(&va.allowed, 1)
+			return true
+		case ActionDrop:
+			atomic.AddUint64(&va.dropped, 1)
+			return false
+		}
+	}
+	if policy == ActionDrop {
+		atomic.AddUint64(&va.dropped, 1)
+		return false
+	}
+	atomic.AddUint64(&va.allowed, 1)
+	return true
+}
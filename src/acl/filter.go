@@ -0,0 +1,44 @@
+package acl
+
+// Filter matches the packets by the fields of its rules, a packet matches if
+// it matches any of them, or if there is no rule. The action and the state
+// of the rules are ignored, so a filter doesn't look up the conntrack.
+type Filter struct {
+	rules []*rule
+}
+
+// NewFilter compiles the rules of a filter
+func NewFilter(rules []Rule) (*Filter, error) {
+	f := &Filter{}
+	for _, r := range rules {
+		r.Action = ActionAllow
+		r.State = ""
+		cr, err := compile(r)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, cr)
+	}
+	return f, nil
+}
+
+// noState is never called, the state of the rules is cleared
+func noState() int {
+	return 0
+}
+
+// Match reports whether the ether packet data, or the ip packet if l3 is
+// true, matches f.
+func (f *Filter) Match(data []byte, l3 bool) bool {
+	if len(f.rules) == 0 {
+		return true
+	}
+	var p pktInfo
+	parsePkt(data, l3, &p)
+	for _, r := range f.rules {
+		if r.match(&p, noState) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"netstat"
+	"packet"
+	"strconv"
+	"strings"
+)
+
+const (
+	ActionAllow = "allow"
+	ActionDrop  = "drop"
+	ActionLog   = "log" //log the packet and go on to the next rule
+)
+
+// Rule matches the packets by its fields, the empty ones match any packet.
+// Proto is arp, ip, ip6, tcp, udp, icmp, icmpv6 or a protocol number;
+// the ports are "port" or "min-max", only for tcp and udp; State is a list
+// of new, established, invalid and untracked, like "new,established".
+//
+// The state is the one of the conntracks of netstat, so State needs
+// NetStatEnable. Only the l2 vids are tracked, all the packets of a routed
+// vid are untracked. A tcp connection is tracked only if its syn comes from
+// a tun of the node, the packets of one started from a conn are new in both
+// dirs.
+type Rule struct {
+	SrcMac string `toml:"srcmac"`
+	DstMac string `toml:"dstmac"`
+	Src    string `toml:"src"` //ip or prefix
+	Dst    string `toml:"dst"`
+	Proto  string `toml:"proto"`
+	Sport  string `toml:"sport"`
+	Dport  string `toml:"dport"`
+	State  string `toml:"state"`
+	Action string `toml:"action"`
+}
+
+type portRange struct {
+	min, max uint16
+}
+
+type rule struct {
+	hits uint64 //first, atomic 64-bit ops need it 8-byte aligned on 386 and arm
+	Rule
+	srcMac    *packet.MAC
+	dstMac    *packet.MAC
+	src       *net.IPNet
+	dst       *net.IPNet
+	etherType uint16
+	proto     int //-1 is any
+	sport     *portRange
+	dport     *portRange
+	state     int //mask of netstat.StateXXX, 0 is any
+}
+
+var protoNames = map[string]int{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"icmpv6": 58,
+}
+
+var stateNames = map[string]int{
+	"new":         netstat.StateNew,
+	"established": netstat.StateEstablished,
+	"invalid":     netstat.StateInvalid,
+	"untracked":   netstat.StateUntracked,
+}
+
+func parseMac(s string) (*packet.MAC, error) {
+	if s == "" {
+		return nil, nil
+	}
+	hw, err := net.ParseMAC(s)
+	if err != nil || len(hw) != len(packet.MAC{}) {
+		return nil, fmt.Errorf("invalid mac %s", s)
+	}
+	var mac packet.MAC
+	copy(mac[:], hw)
+	return &mac, nil
+}
+
+func parsePrefix(s string) (*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if strings.Contains(s, "/") {
+		_, prefix, err := net.ParseCIDR(s)
+		return prefix, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func parsePorts(s string) (*portRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	minStr, maxStr := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		minStr, maxStr = s[:i], s[i+1:]
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(minStr), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", s)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(maxStr), 10, 16)
+	if err != nil || max < min {
+		return nil, fmt.Errorf("invalid port %s", s)
+	}
+	return &portRange{uint16(min), uint16(max)}, nil
+}
+
+func (r *rule) parseProto(s string) error {
+	r.proto = -1
+	switch strings.ToLower(s) {
+	case "", "any":
+	case "arp":
+		r.etherType = 0x0806
+	case "ip":
+		r.etherType = 0x0800
+	case "ip6", "ipv6":
+		r.etherType = 0x86dd
+	default:
+		if p, ok := protoNames[strings.ToLower(s)]; ok {
+			r.proto = p
+			return nil
+		}
+		p, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid proto %s", s)
+		}
+		r.proto = int(p)
+	}
+	return nil
+}
+
+func parseState(s string) (int, error) {
+	state := 0
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		st, ok := stateNames[name]
+		if !ok {
+			return 0, fmt.Errorf("invalid state %s", name)
+		}
+		state |= st
+	}
+	return state, nil
+}
+
+// compile checks r and prepares it for matching
+func compile(r Rule) (*rule, error) {
+	cr := &rule{Rule: r}
+	var err error
+	switch strings.ToLower(r.Action) {
+	case ActionAllow, ActionDrop, ActionLog:
+		cr.Action = strings.ToLower(r.Action)
+	default:
+		return nil, fmt.Errorf("invalid action %s", r.Action)
+	}
+	if cr.srcMac, err = parseMac(r.SrcMac); err != nil {
+		return nil, err
+	}
+	if cr.dstMac, err = parseMac(r.DstMac); err != nil {
+		return nil, err
+	}
+	if cr.src, err = parsePrefix(r.Src); err != nil {
+		return nil, err
+	}
+	if cr.dst, err = parsePrefix(r.Dst); err != nil {
+		return nil, err
+	}
+	if err = cr.parseProto(r.Proto); err != nil {
+		return nil, err
+	}
+	if cr.sport, err = parsePorts(r.Sport); err != nil {
+		return nil, err
+	}
+	if cr.dport, err = parsePorts(r.Dport); err != nil {
+		return nil, err
+	}
+	if (cr.sport != nil || cr.dport != nil) && cr.proto != 6 && cr.proto != 17 {
+		return nil, fmt.Errorf("ports need proto tcp or udp")
+	}
+	if cr.state, err = parseState(r.State); err != nil {
+		return nil, err
+	}
+	if cr.state != 0 && !netstat.IsEnable() {
+		return nil, fmt.Errorf("state needs NetStatEnable, the state can't be known without it")
+	}
+	return cr, nil
+}
+
+func (pr *portRange) match(port uint16) bool {
+	return pr == nil || (port >= pr.min && port <= pr.max)
+}
+
+func matchPrefix(prefix *net.IPNet, ip net.IP) bool {
+	return prefix == nil || (ip != nil && prefix.Contains(ip))
+}
+
+// match reports whether p matches r, the state is looked up only if the
+// other fields match, state() is called at most once for a packet.
+func (r *rule) match(p *pktInfo, state func() int) bool {
+	if r.srcMac != nil && (!p.hasMac || *r.srcMac != p.srcMac) {
+		return false
+	}
+	if r.dstMac != nil && (!p.hasMac || *r.dstMac != p.dstMac) {
+		return false
+	}
+	if r.etherType != 0 && r.etherType != p.etherType {
+		return false
+	}
+	if r.proto >= 0 && (!p.isIP || r.proto != int(p.proto)) {
+		return false
+	}
+	if !matchPrefix(r.src, p.src) || !matchPrefix(r.dst, p.dst) {
+		return false
+	}
+	if (r.sport != nil || r.dport != nil) && !p.hasPorts {
+		return false
+	}
+	if !r.sport.match(p.sport) || !r.dport.match(p.dport) {
+		return false
+	}
+	if r.state != 0 && r.state&state() == 0 {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,278 @@
+package fdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"packet"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// the fields of an ipv4 arp packet after the 14 bytes ether header
+const (
+	arpOp  = 14 + 6
+	arpSha = 14 + 8
+	arpSpa = 14 + 14
+	arpTha = 14 + 18
+	arpTpa = 14 + 24
+)
+
+// arpRemoteAging is the seconds the entries advertised by a peer are kept
+// without being advertised again, 3 advertisements of the peer.
+const arpRemoteAging = 3 * 30
+
+var arpIpv4Head = []byte{0x00, 0x01, 0x08, 0x00, 6, 4} //ether, ipv4, hlen, plen
+
+// ArpEntry is an ip to mac binding as it is advertised to the peers
+type ArpEntry struct {
+	IP  [4]byte
+	Mac packet.MAC
+}
+
+// arpNode is the mac of an ip, snooped on pio or advertised by the peer pio
+type arpNode struct {
+	pio    portIO
+	mac    packet.MAC
+	ft     uint64
+	remote bool
+}
+
+// arpTable is the arp proxy of an fdb: the arp packets are snooped into it,
+// and the requests of the ips in it are answered on behalf of their hosts
+// instead of being flooded. It is allocated by pointer so the counters,
+// first for the atomic 64-bit ops, are 8-byte aligned on 386 and arm.
+type arpTable struct {
+	replies uint64
+	misses  uint64
+	sync.RWMutex
+	proxy   bool
+	entries map[[4]byte]*arpNode
+}
+
+// ArpInfo is an entry of the arp proxy, Age is the seconds since it is seen
+type ArpInfo struct {
+	IP     string
+	Mac    string
+	Port   string
+	Remote bool
+	Age    uint64
+}
+
+var arpChan = make(chan struct{}, 1)
+
+// ArpUpdates notifies that an arp proxy snooped a new ip or mac, its entries
+// should be advertised.
+func ArpUpdates() <-chan struct{} {
+	return arpChan
+}
+
+func triggerArpUpdate() {
+	select {
+	case arpChan <- struct{}{}:
+	default:
+	}
+}
+
+func (f *FDB) setArpProxy(proxy bool) {
+	f.arps.Lock()
+	f.arps.proxy = proxy
+	if !proxy || f.arps.entries == nil {
+		f.arps.entries = make(map[[4]byte]*arpNode)
+	}
+	f.arps.Unlock()
+}
+
+// IsArpProxy reports whether f answers the arp requests of the ips it knows
+func (f *FDB) IsArpProxy() bool {
+	f.arps.RLock()
+	proxy := f.arps.proxy
+	f.arps.RUnlock()
+	return proxy
+}
+
+// arpFields returns the sender and the target of the ipv4 arp packet data
+func arpFields(data []byte) (op uint16, spa, tpa [4]byte, sha packet.MAC, ok bool) {
+	if len(data) < packet.EtherSize+packet.ArpPacketSize || !bytes.Equal(data[packet.EtherSize:arpOp], arpIpv4Head) {
+		return
+	}
+	op = binary.BigEndian.Uint16(data[arpOp:])
+	copy(sha[:], data[arpSha:])
+	copy(spa[:], data[arpSpa:])
+	copy(tpa[:], data[arpTpa:])
+	return op, spa, tpa, sha, true
+}
+
+// arpSnoop learns the sender of an arp packet from pio
+func (f *FDB) arpSnoop(pio portIO, spa [4]byte, sha packet.MAC) {
+	if spa == [4]byte{} {
+		//a probe of duplicate address detection
+		return
+	}
+	at := f.arps
+	at.Lock()
+	an, ok := at.entries[spa]
+	if ok && !an.remote && an.pio == pio && an.mac == sha {
+		an.ft = FdbTick
+		at.Unlock()
+		return
+	}
+	at.entries[spa] = &arpNode{pio: pio, mac: sha, ft: FdbTick}
+	at.Unlock()
+	triggerArpUpdate()
+}
+
+// arpProxy answers the broadcast arp request pkt from pio if the mac of the
+// target is known on another port, true if it is answered, it isn't flooded.
+func (f *FDB) arpProxy(pio portIO, pkt *packet.PktBuf) bool {
+	data := pkt.LoadUserData()
+	op, spa, tpa, sha, ok := arpFields(data)
+	if !ok {
+		return false
+	}
+	at := f.arps
+	at.RLock()
+	if !at.proxy {
+		at.RUnlock()
+		return false
+	}
+	at.RUnlock()
+	if op == uint16(packet.OperationReply) || op == uint16(packet.OperationRequest) {
+		f.arpSnoop(pio, spa, sha)
+	}
+	if op != uint16(packet.OperationRequest) || !packet.TranEther(data).IsBroadcast() || spa == [4]byte{} || spa == tpa {
+		//only the requests of the hosts, not the probes or the gratuitous arps
+		return false
+	}
+	at.RLock()
+	an, ok := at.entries[tpa]
+	var mac packet.MAC
+	if ok {
+		ok = an.pio != pio && an.mac != sha
+		mac = an.mac
+	}
+	at.RUnlock()
+	if !ok {
+		atomic.AddUint64(&at.misses, 1)
+		return false
+	}
+
+	//the packet may be held by a mirror, the reply is a copy of it
+	reply := pkt.Clone()
+	rd := reply.LoadUserData()
+	copy(rd[0:6], sha[:])
+	copy(rd[6:12], mac[:])
+	binary.BigEndian.PutUint16(rd[arpOp:], uint16(packet.OperationReply))
+	copy(rd[arpSha:], mac[:])
+	copy(rd[arpSpa:], tpa[:])
+	copy(rd[arpTha:], sha[:])
+	copy(rd[arpTpa:], spa[:])
+	pio.PutPktToChan(reply)
+	packet.PutPktToPool(reply)
+	atomic.AddUint64(&at.replies, 1)
+	return true
+}
+
+// SetPortArps replaces the entries advertised by pio, the ones snooped here
+// stay. The entries of an advertisement in several msgs are added with first
+// false but the first msg.
+func (f *FDB) SetPortArps(pio portIO, entries []ArpEntry, first bool) {
+	at := f.arps
+	at.Lock()
+	defer at.Unlock()
+	if !at.proxy {
+		return
+	}
+	if first {
+		for ip, an := range at.entries {
+			if an.remote && an.pio == pio {
+				delete(at.entries, ip)
+			}
+		}
+	}
+	for _, e := range entries {
+		if an, ok := at.entries[e.IP]; ok && !an.remote {
+			continue
+		}
+		at.entries[e.IP] = &arpNode{pio: pio, mac: e.Mac, ft: FdbTick, remote: true}
+	}
+}
+
+// ExportArps returns the entries snooped here to advertise to the peer
+// except, not the ones snooped on except itself.
+func (f *FDB) ExportArps(except portIO) []ArpEntry {
+	at := f.arps
+	at.RLock()
+	defer at.RUnlock()
+	var entries []ArpEntry
+	for ip, an := range at.entries {
+		if an.remote || an.pio == except {
+			continue
+		}
+		entries = append(entries, ArpEntry{IP: ip, Mac: an.mac})
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].IP[:], entries[j].IP[:]) < 0 })
+	return entries
+}
+
+// ageArps deletes the entries snooped but not seen for aging, and the ones
+// the peer stopped advertising.
+func (f *FDB) ageArps(aging uint64) {
+	at := f.arps
+	at.Lock()
+	for ip, an := range at.entries {
+		if an.remote && FdbTick-an.ft > arpRemoteAging || !an.remote && FdbTick-an.ft > aging {
+			delete(at.entries, ip)
+		}
+	}
+	at.Unlock()
+}
+
+// arpRelease deletes the entries of pio, which is released
+func (f *FDB) arpRelease(pio portIO) {
+	at := f.arps
+	at.Lock()
+	for ip, an := range at.entries {
+		if an.pio == pio {
+			delete(at.entries, ip)
+		}
+	}
+	at.Unlock()
+}
+
+// FlushArps deletes all the entries of the arp proxy
+func (f *FDB) FlushArps() {
+	at := f.arps
+	at.Lock()
+	at.entries = make(map[[4]byte]*arpNode)
+	at.Unlock()
+}
+
+// ArpStats returns the entries, and the requests answered or flooded
+func (f *FDB) ArpStats() (entries int, replies, misses uint64) {
+	at := f.arps
+	at.RLock()
+	entries = len(at.entries)
+	at.RUnlock()
+	return entries, atomic.LoadUint64(&at.replies), atomic.LoadUint64(&at.misses)
+}
+
+// ShowArps returns the entries of the arp proxy
+func (f *FDB) ShowArps() []ArpInfo {
+	at := f.arps
+	at.RLock()
+	infos := make([]ArpInfo, 0, len(at.entries))
+	for ip, an := range at.entries {
+		infos = append(infos, ArpInfo{
+			IP:     net.IP(ip[:]).String(),
+			Mac:    an.mac.String(),
+			Port:   an.pio.String(),
+			Remote: an.remote,
+			Age:    FdbTick - an.ft,
+		})
+	}
+	at.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].IP < infos[j].IP })
+	return infos
+}
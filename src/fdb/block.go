@@ -0,0 +1,55 @@
+package fdb
+
+import (
+	"sync/atomic"
+)
+
+// SetPortBlocked blocks or unblocks pio, for the loop prevention: a blocked
+// port gets no flood and the packets received from it are dropped. The macs
+// learned on it are deleted when it is blocked.
+func (f *FDB) SetPortBlocked(pio portIO, blocked bool) {
+	f.portMap.Lock()
+	if f.portMap.blocked == nil {
+		f.portMap.blocked = make(map[portIO]bool)
+	}
+	was := f.portMap.blocked[pio]
+	if blocked && !was {
+		f.portMap.blocked[pio] = true
+		atomic.AddInt32(&f.portMap.blockedNum, 1)
+	} else if !blocked && was {
+		delete(f.portMap.blocked, pio)
+		atomic.AddInt32(&f.portMap.blockedNum, -1)
+	}
+	f.portMap.Unlock()
+	if blocked && !was {
+		f.DelFmnByPortIO(pio)
+	}
+}
+
+// IsPortBlocked reports whether pio is blocked
+func (f *FDB) IsPortBlocked(pio portIO) bool {
+	if atomic.LoadInt32(&f.portMap.blockedNum) == 0 {
+		return false
+	}
+	f.portMap.RLock()
+	blocked := f.portMap.blocked[pio]
+	f.portMap.RUnlock()
+	return blocked
+}
+
+// BlockedPortNum returns the number of blocked ports
+func (f *FDB) BlockedPortNum() int {
+	return int(atomic.LoadInt32(&f.portMap.blockedNum))
+}
+
+// Flush deletes all the learned macs, they are learned again after the
+// topology changes. The static macs stay.
+func (f *FDB) Flush() {
+	f.lock.Lock()
+	for m, fmn := range f.mactable {
+		if fmn.kind != MacStatic {
+			f.del(m, fmn)
+		}
+	}
+	f.lock.Unlock()
+}
@@ -0,0 +1,278 @@
+package fdb
+
+import (
+	"fmt"
+	"mylog"
+	"net"
+	"packet"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// the actions when a port has more than MaxMacs macs: drop the packets of
+// the new macs, or shut the port down.
+const (
+	ViolationDrop = iota
+	ViolationShutdown
+)
+
+var violationNames = []string{"drop", "shutdown"}
+
+// StaticMac is a mac pinned to a port, Port is the name of a client: a tun
+// dev, a remote addr or a peer id. The packets to the mac are dropped while
+// the port is down, and the mac is never learned on another port.
+type StaticMac struct {
+	Mac  string `toml:"mac"`
+	Port string `toml:"port"`
+}
+
+// FdbConf is the mac learning of a vid
+type FdbConf struct {
+	Vid       int         `toml:"vid"`
+	Aging     int         `toml:"aging"`     //second, ExpireTime if 0
+	Sticky    bool        `toml:"sticky"`    //a learned mac doesn't move to another port until it ages
+	MaxMacs   int         `toml:"maxmacs"`   //the learned macs of a port, 0 is no limit
+	Violation string      `toml:"violation"` //drop or shutdown, drop by default
+	Static    []StaticMac `toml:"static"`
+	Storm     StormConf   `toml:"storm"`
+	ArpProxy  bool        `toml:"arpproxy"` //answer the arp requests of the ips snooped here or advertised by the peers
+	Igmp      IgmpConf    `toml:"igmp"`
+}
+
+// MacEntry is a mac of an fdb, Age is the seconds since it is seen
+type MacEntry struct {
+	Mac  string
+	Port string
+	Type string
+	Age  uint64
+}
+
+// FdbInfo is the config and the macs of an fdb
+type FdbInfo struct {
+	Vid        int
+	Aging      uint64
+	Sticky     bool
+	MaxMacs    int
+	Violation  string
+	Violations uint64
+	Storm      StormConf
+	StormDrops StormStats
+	StormPorts []StormStats
+	ArpProxy   bool
+	ArpReplies uint64
+	ArpMisses  uint64
+	Macs       []MacEntry
+}
+
+var fdbConfLock sync.Mutex
+var fdbConfs = make(map[int]FdbConf)
+
+func getFdbConf(vid int) (FdbConf, bool) {
+	fdbConfLock.Lock()
+	conf, ok := fdbConfs[vid]
+	fdbConfLock.Unlock()
+	return conf, ok
+}
+
+func parseViolation(s string) (int, error) {
+	switch s {
+	case "", "drop":
+		return ViolationDrop, nil
+	case "shutdown":
+		return ViolationShutdown, nil
+	}
+	return 0, fmt.Errorf("violation %s is invalid, it is drop or shutdown", s)
+}
+
+// ParseMac parses the mac s
+func ParseMac(s string) (packet.MAC, error) {
+	var m packet.MAC
+	hw, err := net.ParseMAC(s)
+	if err != nil || len(hw) != len(m) {
+		return m, fmt.Errorf("mac %s is invalid", s)
+	}
+	copy(m[:], hw)
+	return m, nil
+}
+
+// CheckFdbConf checks conf before it is applied
+func CheckFdbConf(conf *FdbConf) error {
+	if conf.Vid < 0 || conf.Vid > 4095 {
+		return fmt.Errorf("vid %d is invalid", conf.Vid)
+	}
+	if conf.Aging < 0 {
+		return fmt.Errorf("vid=%d aging %d is invalid", conf.Vid, conf.Aging)
+	}
+	if conf.MaxMacs < 0 {
+		return fmt.Errorf("vid=%d maxmacs %d is invalid", conf.Vid, conf.MaxMacs)
+	}
+	if _, err := parseViolation(conf.Violation); err != nil {
+		return fmt.Errorf("vid=%d %s", conf.Vid, err.Error())
+	}
+	if err := checkStormConf(&conf.Storm); err != nil {
+		return fmt.Errorf("vid=%d %s", conf.Vid, err.Error())
+	}
+	if err := checkIgmpConf(&conf.Igmp); err != nil {
+		return fmt.Errorf("vid=%d %s", conf.Vid, err.Error())
+	}
+	for _, sm := range conf.Static {
+		if _, err := ParseMac(sm.Mac); err != nil {
+			return fmt.Errorf("vid=%d static %s", conf.Vid, err.Error())
+		}
+		if sm.Port == "" {
+			return fmt.Errorf("vid=%d static mac %s has no port", conf.Vid, sm.Mac)
+		}
+	}
+	return nil
+}
+
+// SetFdbConfs replaces the configs of the vids, the fdbs of the vids not in
+// confs go back to the defaults. The static macs of the fdbs are replaced,
+// they are bound to the ports by BindStatic.
+func SetFdbConfs(confs []FdbConf) error {
+	newConfs := make(map[int]FdbConf, len(confs))
+	for i := range confs {
+		if err := CheckFdbConf(&confs[i]); err != nil {
+			return err
+		}
+		if _, ok := newConfs[confs[i].Vid]; ok {
+			return fmt.Errorf("vid %d is configured twice", confs[i].Vid)
+		}
+		newConfs[confs[i].Vid] = confs[i]
+	}
+	fdbConfLock.Lock()
+	oldConfs := fdbConfs
+	fdbConfs = newConfs
+	fdbConfLock.Unlock()
+
+	for vid := range oldConfs {
+		if _, ok := newConfs[vid]; !ok {
+			if f, ok := GetFdbById(vid); ok {
+				f.setConf(&FdbConf{Vid: vid})
+			}
+		}
+	}
+	for vid, conf := range newConfs {
+		if f, ok := GetFdbById(vid); ok {
+			f.setConf(&conf)
+		}
+	}
+	return nil
+}
+
+// setConf applies the checked conf to f
+func (f *FDB) setConf(conf *FdbConf) {
+	violation, _ := parseViolation(conf.Violation)
+	f.lock.Lock()
+	f.aging = ExpireTime
+	if conf.Aging > 0 {
+		f.aging = uint64(conf.Aging)
+	}
+	f.sticky = conf.Sticky
+	f.maxMacs = conf.MaxMacs
+	f.violation = violation
+	for m, fmn := range f.mactable {
+		if fmn.kind == MacStatic {
+			f.del(m, fmn)
+		}
+	}
+	f.lock.Unlock()
+	f.setStormConf(conf.Storm)
+	f.setArpProxy(conf.ArpProxy)
+	f.setIgmpConf(conf.Igmp)
+	for _, sm := range conf.Static {
+		m, _ := ParseMac(sm.Mac)
+		f.AddStatic(m, sm.Port, nil)
+	}
+	mylog.Info("fdb vid=%d aging %d, sticky %v, maxmacs %d, violation %s, %d static macs, storm %+v, arpproxy %v, igmp %+v\n",
+		conf.Vid, f.aging, conf.Sticky, conf.MaxMacs, violationNames[violation], len(conf.Static), conf.Storm, conf.ArpProxy, conf.Igmp)
+}
+
+// AddStatic pins m to the port named port, pio is the port if it is up
+func (f *FDB) AddStatic(m packet.MAC, port string, pio portIO) {
+	fmn := NewFdbMacNode(m, pio)
+	fmn.kind = MacStatic
+	fmn.port = port
+	f.Set(m, fmn)
+}
+
+// BindStatic binds pio to the static macs of the port which match reports
+// pio is.
+func (f *FDB) BindStatic(pio portIO, match func(port string) bool) {
+	f.lock.Lock()
+	for _, fmn := range f.mactable {
+		if fmn.kind == MacStatic && fmn.pio == nil && match(fmn.port) {
+			fmn.pio = pio
+		}
+	}
+	f.lock.Unlock()
+}
+
+// unbindStatic unbinds the static macs of pio, which is released
+func (f *FDB) unbindStatic(pio portIO) {
+	f.lock.Lock()
+	for _, fmn := range f.mactable {
+		if fmn.kind == MacStatic && fmn.pio == pio {
+			fmn.pio = nil
+		}
+	}
+	f.lock.Unlock()
+}
+
+// violate counts that pio exceeded the mac limit, and shuts it down if it
+// is the action, the packet is dropped.
+func (f *FDB) violate(pio portIO, m packet.MAC) bool {
+	n := atomic.AddUint64(&f.violations, 1)
+	f.lock.RLock()
+	violation, maxMacs := f.violation, f.maxMacs
+	f.lock.RUnlock()
+	if violation == ViolationShutdown {
+		if pc, ok := pio.(portCloser); ok {
+			mylog.Warning("port %s has more than %d macs, mac=%s, shut it down\n", pio.String(), maxMacs, m.String())
+			go pc.Close()
+			return false
+		}
+	}
+	if n&1023 == 1 {
+		mylog.Warning("port %s has more than %d macs, drop mac=%s, %d violations\n", pio.String(), maxMacs, m.String(), n)
+	}
+	return false
+}
+
+// ShowFdb returns the config and the macs of f, of port only if it isn't
+// empty.
+func (f *FDB) ShowFdb(vid int, port string) FdbInfo {
+	f.lock.RLock()
+	info := FdbInfo{
+		Vid:        vid,
+		Aging:      f.aging,
+		Sticky:     f.sticky,
+		MaxMacs:    f.maxMacs,
+		Violation:  violationNames[f.violation],
+		Violations: atomic.LoadUint64(&f.violations),
+		Macs:       make([]MacEntry, 0, len(f.mactable)),
+	}
+	for m, fmn := range f.mactable {
+		name := fmn.portName()
+		if port != "" && name != port {
+			continue
+		}
+		info.Macs = append(info.Macs, MacEntry{
+			Mac:  m.String(),
+			Port: name,
+			Type: macTypeNames[fmn.kind],
+			Age:  FdbTick - fmn.ft,
+		})
+	}
+	f.lock.RUnlock()
+	sort.Slice(info.Macs, func(i, j int) bool { return info.Macs[i].Mac < info.Macs[j].Mac })
+	f.storm.Lock()
+	info.Storm = f.storm.conf
+	f.storm.Unlock()
+	info.StormDrops, info.StormPorts = f.StormStats()
+	sort.Slice(info.StormPorts, func(i, j int) bool { return info.StormPorts[i].Port < info.StormPorts[j].Port })
+	info.ArpProxy = f.IsArpProxy()
+	_, info.ArpReplies, info.ArpMisses = f.ArpStats()
+	return info
+}
@@ -4,24 +4,50 @@ import (
 	"log"
 	"packet"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	ExpireTime    = 300 //5*60
+	ExpireTime    = 300 //5*60, the default aging
 	DefMacNodeNum = 256
+	agingEvery    = 16 //second
 )
 
+// the types of the mac entries: a sticky mac doesn't move to another port
+// until it ages, a static one is from the config, it never ages or moves.
+const (
+	MacDynamic = iota
+	MacSticky
+	MacStatic
+)
+
+var macTypeNames = []string{"dynamic", "sticky", "static"}
+
 type FdbMacNode struct {
-	pio portIO
-	mac packet.MAC
-	ft  uint64
+	pio  portIO //nil if the port of a static mac isn't up
+	mac  packet.MAC
+	ft   uint64
+	kind int
+	port string //the port name of a static mac
 }
 type FDB struct {
-	lock     *sync.RWMutex
-	mactable map[packet.MAC]*FdbMacNode
-	portPool portPools
-	portMap  portMaps
+	//first, atomic 64-bit ops need them 8-byte aligned on 386 and arm
+	floods     uint64
+	violations uint64
+	lock       *sync.RWMutex
+	mactable   map[packet.MAC]*FdbMacNode
+	portMacs   map[portIO]int //the learned macs of the ports
+	portPool   portPools
+	portMap    portMaps
+	routes     routeTable
+	aging      uint64
+	sticky     bool
+	maxMacs    int
+	violation  int
+	storm      stormControl
+	arps       *arpTable
+	igmp       igmpTable
 }
 
 type FdbMaps struct {
@@ -40,6 +66,18 @@ func NewFdbMacNode(m packet.MAC, pio portIO) *FdbMacNode {
 		ft:  FdbTick,
 	}
 }
+
+// counted reports whether fmn is in the learned macs of its port
+func (fmn *FdbMacNode) counted() bool {
+	return fmn.kind != MacStatic && fmn.pio != nil
+}
+
+func (fmn *FdbMacNode) portName() string {
+	if fmn.pio == nil {
+		return fmn.port
+	}
+	return fmn.pio.String()
+}
 func (fmn *FdbMacNode) GetPortIO() portIO {
 	return fmn.pio
 }
@@ -64,9 +102,18 @@ func NewFdb(fdbId int) *FDB {
 		fdb = &FDB{
 			lock:     new(sync.RWMutex),
 			mactable: make(map[packet.MAC]*FdbMacNode, DefMacNodeNum),
+			portMacs: make(map[portIO]int),
+			aging:    ExpireTime,
+			arps:     new(arpTable),
 		}
 		fdb.initPortPool()
 		fdb.initPortMap()
+		fdb.initRouteTable()
+		fdb.setArpProxy(false)
+		fdb.setIgmpConf(IgmpConf{})
+		if conf, ok := getFdbConf(fdbId); ok {
+			fdb.setConf(&conf)
+		}
 		FdbMap.fdbs[fdbId] = fdb
 	}
 	FdbMap.Unlock()
@@ -107,26 +154,36 @@ func fdbtick() {
 	tt := time.Tick(time.Second)
 	for _ = range tt {
 		FdbTick = FdbTick + 1
-		if FdbTick&63 == 0 {
+		if FdbTick%agingEvery == 0 {
+			FdbMap.RLock()
+			fdbs := make([]*FDB, 0, len(FdbMap.fdbs))
 			for _, f := range FdbMap.fdbs {
-				if len(f.FdbMacTable()) > 128 {
-					for mac, fmn := range f.FdbMacTable() {
-						if FdbTick-fmn.ft > ExpireTime {
-							f.Del(mac)
-						}
-					}
-				}
+				fdbs = append(fdbs, f)
+			}
+			FdbMap.RUnlock()
+			for _, f := range fdbs {
+				f.age()
 			}
 		}
 	}
 }
 
-func (fmn *FdbMacNode) updateTime() {
-	fmn.ft = FdbTick
+// age deletes the macs and the snooped arps not seen for the aging time of f,
+// but the static macs
+func (f *FDB) age() {
+	f.lock.Lock()
+	for mac, fmn := range f.mactable {
+		if fmn.kind != MacStatic && FdbTick-fmn.ft > f.aging {
+			f.del(mac, fmn)
+		}
+	}
+	aging := f.aging
+	f.lock.Unlock()
+	f.ageArps(aging)
 }
 
-func (fmn *FdbMacNode) updatePio(pio portIO) {
-	fmn.pio = pio
+func (fmn *FdbMacNode) updateTime() {
+	fmn.ft = FdbTick
 }
 
 func (fmn *FdbMacNode) maybeExpire() bool {
@@ -144,7 +201,13 @@ func (f *FDB) Set(m packet.MAC, fmn *FdbMacNode) {
 		log.Panicf("m=%s, fmn.mac=%s\n", m.String(), fmn.mac.String())
 	}
 	f.lock.Lock()
+	if old, ok := f.mactable[m]; ok {
+		f.del(m, old)
+	}
 	f.mactable[m] = fmn
+	if fmn.counted() {
+		f.portMacs[fmn.pio]++
+	}
 	f.lock.Unlock()
 }
 func (f *FDB) Add(m packet.MAC, pio portIO) {
@@ -153,15 +216,75 @@ func (f *FDB) Add(m packet.MAC, pio portIO) {
 }
 func (f *FDB) Del(m packet.MAC) {
 	f.lock.Lock()
-	delete(f.mactable, m)
+	if fmn, ok := f.mactable[m]; ok {
+		f.del(m, fmn)
+	}
 	f.lock.Unlock()
 }
+
+// del deletes fmn of m, f.lock is held
+func (f *FDB) del(m packet.MAC, fmn *FdbMacNode) {
+	delete(f.mactable, m)
+	if fmn.counted() {
+		if f.portMacs[fmn.pio]--; f.portMacs[fmn.pio] <= 0 {
+			delete(f.portMacs, fmn.pio)
+		}
+	}
+}
+
+// DelFmnByPortIO deletes the macs learned on pio, the static ones stay
 func (f *FDB) DelFmnByPortIO(pio portIO) {
-	for m, fmn := range f.FdbMacTable() {
-		if fmn.pio == pio {
-			f.Del(m)
+	f.lock.Lock()
+	for m, fmn := range f.mactable {
+		if fmn.pio == pio && fmn.kind != MacStatic {
+			f.del(m, fmn)
 		}
 	}
+	f.lock.Unlock()
+}
+
+// learn adds m learned on pio, false if pio has MaxMacs already. m may be
+// learned by another packet since the caller missed it: it is kept if it is
+// on pio or isn't dynamic, or it is moved to pio.
+func (f *FDB) learn(m packet.MAC, pio portIO) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	old, ok := f.mactable[m]
+	if ok && (old.pio == pio || old.kind != MacDynamic) {
+		return true
+	}
+	if f.maxMacs > 0 && f.portMacs[pio] >= f.maxMacs {
+		return false
+	}
+	if ok {
+		f.del(m, old)
+	}
+	fmn := NewFdbMacNode(m, pio)
+	if f.sticky {
+		fmn.kind = MacSticky
+	}
+	f.mactable[m] = fmn
+	f.portMacs[pio]++
+	return true
+}
+
+// move moves the learned fmn to pio, false if pio has MaxMacs already
+func (f *FDB) move(fmn *FdbMacNode, pio portIO) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.maxMacs > 0 && f.portMacs[pio] >= f.maxMacs {
+		return false
+	}
+	if cur, ok := f.mactable[fmn.mac]; !ok || cur != fmn {
+		//aged or flushed meanwhile
+		return true
+	}
+	f.del(fmn.mac, fmn)
+	fmn.pio = pio
+	fmn.updateTime()
+	f.mactable[fmn.mac] = fmn
+	f.portMacs[pio]++
+	return true
 }
 
 func ShowClientMac() map[int]map[int][]string {
@@ -169,7 +292,7 @@ func ShowClientMac() map[int]map[int][]string {
 	for fdbId, fdb := range FdbMap.fdbs {
 		portmac := make(map[int][]string)
 		for portId, pio := range fdb.portMap.ports {
-			//Fdb().lock.RLock()
+			fdb.lock.RLock()
 			portmac[portId] = append(portmac[portId], pio.String())
 			for m, fmn := range fdb.mactable {
 				if fmn.pio == pio {
@@ -179,7 +302,7 @@ func ShowClientMac() map[int]map[int][]string {
 					portmac[portId] = append(portmac[portId], m.String())
 				}
 			}
-			//Fdb().lock.RUnlock()
+			fdb.lock.RUnlock()
 		}
 		fdbInfo[fdbId] = portmac
 	}
@@ -187,3 +310,46 @@ func ShowClientMac() map[int]map[int][]string {
 	//log.Println(mt)
 	return fdbInfo
 }
+
+// FdbStat is the size and flood count of one fdb, for metrics
+type FdbStat struct {
+	Vid        int
+	Macs       int
+	Ports      int
+	Routes     int
+	Floods     uint64
+	Violations uint64
+	Storm      StormStats
+	Arps       int
+	ArpReplies uint64
+	ArpMisses  uint64
+	IgmpGroups int
+	Igmp       IgmpStats
+}
+
+func FdbStats() []FdbStat {
+	var stats []FdbStat
+	FdbMap.RLock()
+	defer FdbMap.RUnlock()
+	for fdbId, f := range FdbMap.fdbs {
+		st := FdbStat{
+			Vid:        fdbId,
+			Ports:      f.getPortNum(),
+			Floods:     atomic.LoadUint64(&f.floods),
+			Violations: atomic.LoadUint64(&f.violations),
+		}
+		st.Storm, _ = f.StormStats()
+		st.Arps, st.ArpReplies, st.ArpMisses = f.ArpStats()
+		st.IgmpGroups, st.Igmp = f.IgmpStats()
+		f.lock.RLock()
+		st.Macs = len(f.mactable)
+		f.lock.RUnlock()
+		f.routes.RLock()
+		for plen := range f.routes.routes {
+			st.Routes += len(f.routes.routes[plen])
+		}
+		f.routes.RUnlock()
+		stats = append(stats, st)
+	}
+	return stats
+}
@@ -4,12 +4,17 @@ import (
 	"log"
 	"mylog"
 	"packet"
+	"sync/atomic"
 )
 
 func (f *FDB) flood(pio portIO, pkt *packet.PktBuf) (fwd bool) {
 	//log.Printf("-------------- flooding  ------------\n")
+	atomic.AddUint64(&f.floods, 1)
 	f.portMap.RLock()
 	for _, p := range f.portMap.ports {
+		if f.portMap.blocked[p] {
+			continue
+		}
 		if p != pio {
 			p.PutPktToChan(pkt)
 			fwd = true
@@ -28,26 +33,41 @@ func (f *FDB) Forward(pio portIO, pkt *packet.PktBuf) bool {
 	//len := len(pkt)
 	data := pkt.LoadUserData()
 	ether := packet.TranEther(data)
-	if !ether.IsArp() && !ether.IsIpPtk() {
+	if !ether.IsArp() && !ether.IsIpPtk() && !ether.IsIp6Pkt() {
+		return false
+	}
+	if f.IsPortBlocked(pio) {
+		return false
+	}
+	if f.stormSuspended(pio) {
 		return false
 	}
 
 	if fmn, ok := f.Get(ether.SrcMac); ok {
 		if fmn.pio == pio {
 			fmn.updateTime()
+		} else if fmn.kind != MacDynamic {
+			//a static or sticky mac doesn't move
+			mylog.Debug("DROP, %s mac=%s is on port %s, recv from port %s\n", macTypeNames[fmn.kind], ether.SrcMac.String(), fmn.portName(), pio.String())
+			return false
 		} else {
 			if fmn.maybeExpire() || packet.IsArpRelpy(data) {
-				log.Printf("-------------- update mac=%s, change port: %s to %s  ------------\n", ether.SrcMac.String(), fmn.pio.String(), pio.String())
-				fmn.updatePio(pio)
-				fmn.updateTime()
+				log.Printf("-------------- update mac=%s, change port: %s to %s  ------------\n", ether.SrcMac.String(), fmn.portName(), pio.String())
+				if !f.move(fmn, pio) {
+					return f.violate(pio, ether.SrcMac)
+				}
 				//Fdb().Set(ether.SrcMac, fmn) //update mactable
 			} else {
-				log.Printf("-------------- DROP, maybe loop, mac=%s, org port: %s, now recve from port %s ----------\n", ether.SrcMac.String(), fmn.pio.String(), pio.String())
+				log.Printf("-------------- DROP, maybe loop, mac=%s, org port: %s, now recve from port %s ----------\n", ether.SrcMac.String(), fmn.portName(), pio.String())
 				return false
 			}
 		}
-	} else {
-		f.Add(ether.SrcMac, pio)
+	} else if !f.learn(ether.SrcMac, pio) {
+		return f.violate(pio, ether.SrcMac)
+	}
+	if ether.IsArp() && f.arpProxy(pio, pkt) {
+		//answered on behalf of the target
+		return true
 	}
 	//arp broadcast
 	if ether.IsArp() && ether.IsBroadcast() {
@@ -55,18 +75,31 @@ func (f *FDB) Forward(pio portIO, pkt *packet.PktBuf) bool {
 		log.Printf("dst  mac %s\n", ether.DstMac.String())
 		log.Printf("src  mac %s\n", ether.SrcMac.String())
 		//flood(c, pkt, len)
-		return f.flood(pio, pkt)
+		return f.stormFlood(pio, pkt, stormBroadcast)
+	} else if ether.IsMulticast() {
+		if ether.IsIpPtk() {
+			if fwd, snooped := f.igmpForward(pio, pkt); snooped {
+				return fwd
+			}
+		}
+		//ipv6 ndp and other multicast, there is no mld snooping
+		return f.stormFlood(pio, pkt, stormClass(ether))
 	} else {
 		//it is ip packet or unicast arp
 		if fmn, ok := f.Get(ether.DstMac); ok {
-			if fmn.pio != pio {
-				fmn.pio.PutPktToChan(pkt)
+			dst := fmn.pio
+			if dst == nil {
+				//the port of the static mac is down
+				return false
+			}
+			if dst != pio {
+				dst.PutPktToChan(pkt)
 			}
 			return true
 		} else {
 			log.Printf("%s ,src mac %s ,dst mac %s, vid=%d, dst mac is unkown ,so flood\n", pio.String(), ether.DstMac.String(), ether.SrcMac.String(), pkt.GetPktVid())
 			//flood(pio, pkt, len)
-			return f.flood(pio, pkt)
+			return f.stormFlood(pio, pkt, stormUnknown)
 		}
 	}
 }
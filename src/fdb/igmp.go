@@ -0,0 +1,427 @@
+package fdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"mylog"
+	"net"
+	"packet"
+	"sort"
+	"sync"
+	"time"
+	"timer"
+)
+
+const (
+	igmpProto          = 2
+	igmpQuery          = 0x11
+	igmpV1Report       = 0x12
+	igmpV2Report       = 0x16
+	igmpV2Leave        = 0x17
+	igmpV3Report       = 0x22
+	DefIgmpMembership  = 260 //second, 2 query intervals + the max response time
+	DefIgmpRouterAge   = 255 //second, like the querier interval of linux bridge
+	igmpLastMemberTime = 2   //second, the last member query time after a leave
+)
+
+// the group record types of an igmpv3 report
+const (
+	igmpModeIsInclude = iota + 1
+	igmpModeIsExclude
+	igmpChangeToInclude
+	igmpChangeToExclude
+	igmpAllowNewSources
+	igmpBlockOldSources
+)
+
+// IgmpConf is the igmp snooping of a vid: the ipv4 multicast is forwarded
+// only to the ports of the group members and to the querier ports, not
+// flooded. The groups of 224.0.0.0/24 are always flooded, the ones without a
+// member go to the querier ports only, or are flooded if there is no querier.
+type IgmpConf struct {
+	Snooping   bool `toml:"snooping"`
+	Membership int  `toml:"membership"` //second, a port leaves a group if no report, DefIgmpMembership if 0
+	RouterAge  int  `toml:"routerage"`  //second, a querier port is kept since its last query, DefIgmpRouterAge if 0
+	FastLeave  bool `toml:"fastleave"`  //a port leaves a group at once on a leave, it has a host only
+}
+
+// IgmpStats is the igmp snooping of an fdb
+type IgmpStats struct {
+	Queries   uint64
+	Reports   uint64
+	Leaves    uint64
+	Forwarded uint64 //the multicast sent to the members and the queriers only
+	Flooded   uint64 //the multicast of 224.0.0.0/24, or without a querier
+	Dropped   uint64 //the multicast no port wants
+}
+
+// igmpMember is the membership of a port in a group, or a querier port, it
+// is replaced on every report or query, so a timer fired late finds it gone.
+type igmpMember struct {
+	timer   *timer.Timer
+	expires time.Time
+}
+
+type igmpTable struct {
+	sync.Mutex
+	conf    IgmpConf
+	groups  map[[4]byte]map[portIO]*igmpMember
+	routers map[portIO]*igmpMember
+	stats   IgmpStats
+}
+
+// IgmpPort is a member port of a group or a querier port, Expires is the
+// seconds left
+type IgmpPort struct {
+	Port    string
+	Expires int
+}
+
+// IgmpGroup is a group and its member ports
+type IgmpGroup struct {
+	Group string
+	Ports []IgmpPort
+}
+
+// IgmpInfo is the igmp snooping of an fdb
+type IgmpInfo struct {
+	Conf    IgmpConf
+	Stats   IgmpStats
+	Routers []IgmpPort
+	Groups  []IgmpGroup
+}
+
+func checkIgmpConf(conf *IgmpConf) error {
+	if conf.Membership < 0 || conf.RouterAge < 0 {
+		return fmt.Errorf("igmp %+v is invalid", *conf)
+	}
+	return nil
+}
+
+func (f *FDB) setIgmpConf(conf IgmpConf) {
+	it := &f.igmp
+	it.Lock()
+	if !conf.Snooping || it.groups == nil {
+		it.clear()
+	}
+	it.conf = conf
+	it.Unlock()
+}
+
+// clear deletes the groups and the queriers, it.Lock is held
+func (it *igmpTable) clear() {
+	for _, ports := range it.groups {
+		for _, m := range ports {
+			m.timer.Stop()
+		}
+	}
+	for _, m := range it.routers {
+		m.timer.Stop()
+	}
+	it.groups = make(map[[4]byte]map[portIO]*igmpMember)
+	it.routers = make(map[portIO]*igmpMember)
+}
+
+// IsIgmpSnooping reports whether f forwards the ipv4 multicast by group
+func (f *FDB) IsIgmpSnooping() bool {
+	f.igmp.Lock()
+	snooping := f.igmp.conf.Snooping
+	f.igmp.Unlock()
+	return snooping
+}
+
+func (it *igmpTable) membership() time.Duration {
+	if it.conf.Membership > 0 {
+		return time.Second * time.Duration(it.conf.Membership)
+	}
+	return time.Second * DefIgmpMembership
+}
+
+func (it *igmpTable) routerAge() time.Duration {
+	if it.conf.RouterAge > 0 {
+		return time.Second * time.Duration(it.conf.RouterAge)
+	}
+	return time.Second * DefIgmpRouterAge
+}
+
+func newIgmpMember(d time.Duration, f func(time.Time, ...interface{}), arg ...interface{}) *igmpMember {
+	m := &igmpMember{expires: time.Now().Add(d)}
+	m.timer = timer.NewTimerFunc(d, f, append(arg, m)...)
+	return m
+}
+
+// join adds pio to group for d, or refreshes it, it.Lock is held
+func (f *FDB) igmpJoin(group [4]byte, pio portIO, d time.Duration) {
+	it := &f.igmp
+	ports, ok := it.groups[group]
+	if !ok {
+		ports = make(map[portIO]*igmpMember)
+		it.groups[group] = ports
+		mylog.Info("igmp snooping: %s joins group %s\n", pio.String(), net.IP(group[:]).String())
+	}
+	if m, ok := ports[pio]; ok {
+		m.timer.Stop()
+	}
+	ports[pio] = newIgmpMember(d, igmpMemberTimeout, f, group, pio)
+}
+
+// igmpLeave makes pio leave group after d, or at once if d is 0, it.Lock is
+// held
+func (f *FDB) igmpLeave(group [4]byte, pio portIO, d time.Duration) {
+	it := &f.igmp
+	ports := it.groups[group]
+	m, ok := ports[pio]
+	if !ok {
+		return
+	}
+	m.timer.Stop()
+	if d > 0 {
+		ports[pio] = newIgmpMember(d, igmpMemberTimeout, f, group, pio)
+		return
+	}
+	it.delMember(group, pio)
+}
+
+// delMember deletes pio from group, it.Lock is held
+func (it *igmpTable) delMember(group [4]byte, pio portIO) {
+	ports := it.groups[group]
+	delete(ports, pio)
+	if len(ports) == 0 {
+		delete(it.groups, group)
+		mylog.Info("igmp snooping: group %s has no member\n", net.IP(group[:]).String())
+	}
+}
+
+func igmpMemberTimeout(t time.Time, args ...interface{}) {
+	f, ok := args[0].(*FDB)
+	group, ok2 := args[1].([4]byte)
+	pio, ok3 := args[2].(portIO)
+	m, ok4 := args[3].(*igmpMember)
+	if !ok || !ok2 || !ok3 || !ok4 {
+		log.Panicf("%v\n", args)
+	}
+	it := &f.igmp
+	it.Lock()
+	if it.groups[group][pio] == m {
+		it.delMember(group, pio)
+	}
+	it.Unlock()
+}
+
+func igmpRouterTimeout(t time.Time, args ...interface{}) {
+	f, ok := args[0].(*FDB)
+	pio, ok2 := args[1].(portIO)
+	m, ok3 := args[2].(*igmpMember)
+	if !ok || !ok2 || !ok3 {
+		log.Panicf("%v\n", args)
+	}
+	it := &f.igmp
+	it.Lock()
+	if it.routers[pio] == m {
+		delete(it.routers, pio)
+		mylog.Info("igmp snooping: querier port %s ages\n", pio.String())
+	}
+	it.Unlock()
+}
+
+// igmpRouter makes pio a querier port, or refreshes it, it.Lock is held
+func (f *FDB) igmpRouter(pio portIO) {
+	it := &f.igmp
+	m, ok := it.routers[pio]
+	if ok {
+		m.timer.Stop()
+	} else {
+		mylog.Info("igmp snooping: querier on port %s\n", pio.String())
+	}
+	it.routers[pio] = newIgmpMember(it.routerAge(), igmpRouterTimeout, f, pio)
+}
+
+// igmpSnoop learns the igmp msg of ip from pio, it returns whether the msg
+// goes to the querier ports only, like the reports and the leaves.
+func (f *FDB) igmpSnoop(pio portIO, ip []byte) (toRouters bool) {
+	hl := int(ip[0]&0x0f) << 2
+	if hl < packet.HeaderLen || len(ip) < hl+8 {
+		return false
+	}
+	msg := ip[hl:]
+	it := &f.igmp
+	it.Lock()
+	defer it.Unlock()
+	var group [4]byte
+	copy(group[:], msg[4:8])
+	switch msg[0] {
+	case igmpQuery:
+		it.stats.Queries++
+		f.igmpRouter(pio)
+		return false
+	case igmpV1Report, igmpV2Report:
+		it.stats.Reports++
+		if net.IP(group[:]).IsMulticast() {
+			f.igmpJoin(group, pio, it.membership())
+		}
+	case igmpV2Leave:
+		it.stats.Leaves++
+		if it.conf.FastLeave {
+			f.igmpLeave(group, pio, 0)
+		} else {
+			f.igmpLeave(group, pio, time.Second*igmpLastMemberTime)
+		}
+	case igmpV3Report:
+		it.stats.Reports++
+		f.igmpV3Report(pio, msg)
+	default:
+		return false
+	}
+	return true
+}
+
+// igmpV3Report learns the group records of a v3 report, the sources aren't
+// tracked: a record of no source to include is a leave, the others but
+// block are joins. it.Lock is held.
+func (f *FDB) igmpV3Report(pio portIO, msg []byte) {
+	it := &f.igmp
+	n := int(binary.BigEndian.Uint16(msg[6:8]))
+	off := 8
+	for i := 0; i < n && off+8 <= len(msg); i++ {
+		rtype, auxLen := msg[off], int(msg[off+1])
+		nsrc := int(binary.BigEndian.Uint16(msg[off+2 : off+4]))
+		var group [4]byte
+		copy(group[:], msg[off+4:off+8])
+		off += 8 + nsrc*4 + auxLen*4
+		if !net.IP(group[:]).IsMulticast() {
+			continue
+		}
+		switch rtype {
+		case igmpModeIsInclude, igmpChangeToInclude:
+			if nsrc == 0 {
+				if it.conf.FastLeave {
+					f.igmpLeave(group, pio, 0)
+				} else {
+					f.igmpLeave(group, pio, time.Second*igmpLastMemberTime)
+				}
+				continue
+			}
+			f.igmpJoin(group, pio, it.membership())
+		case igmpModeIsExclude, igmpChangeToExclude, igmpAllowNewSources:
+			f.igmpJoin(group, pio, it.membership())
+		}
+	}
+}
+
+// igmpForward forwards the ipv4 multicast pkt from pio by the group members,
+// the igmp msgs are snooped. snooped is false if it isn't an ipv4 multicast
+// or f has no igmp snooping, the caller floods it.
+func (f *FDB) igmpForward(pio portIO, pkt *packet.PktBuf) (fwd bool, snooped bool) {
+	data := pkt.LoadUserData()
+	if len(data) < packet.EtherSize+packet.HeaderLen {
+		return false, false
+	}
+	ip := data[packet.EtherSize:]
+	if ip[0]>>4 != packet.Version || !f.IsIgmpSnooping() {
+		return false, false
+	}
+	var group [4]byte
+	copy(group[:], ip[16:20])
+	if !net.IP(group[:]).IsMulticast() {
+		return false, false
+	}
+	toRouters := false
+	if ip[9] == igmpProto {
+		toRouters = f.igmpSnoop(pio, ip)
+	}
+	if !f.stormAllow(pio, stormMulticast) {
+		return false, true
+	}
+
+	it := &f.igmp
+	it.Lock()
+	//the reports go to the queriers, even the ones to 224.0.0.22, the rest of
+	//the local network control block is flooded
+	localNet := group[0] == 224 && group[1] == 0 && group[2] == 0
+	flood := len(it.routers) == 0 && (toRouters || len(it.groups[group]) == 0) || !toRouters && localNet
+	var dsts []portIO
+	if !flood {
+		for p := range it.routers {
+			dsts = append(dsts, p)
+		}
+		if !toRouters {
+			for p := range it.groups[group] {
+				if _, ok := it.routers[p]; !ok {
+					dsts = append(dsts, p)
+				}
+			}
+		}
+	}
+	if flood {
+		it.stats.Flooded++
+	}
+	it.Unlock()
+	if flood {
+		return f.flood(pio, pkt), true
+	}
+
+	f.portMap.RLock()
+	for _, p := range dsts {
+		if p != pio && !f.portMap.blocked[p] {
+			p.PutPktToChan(pkt)
+			fwd = true
+		}
+	}
+	f.portMap.RUnlock()
+	it.Lock()
+	if fwd {
+		it.stats.Forwarded++
+	} else {
+		it.stats.Dropped++
+	}
+	it.Unlock()
+	return fwd, true
+}
+
+// igmpRelease deletes the memberships of pio and its querier, it is released
+func (f *FDB) igmpRelease(pio portIO) {
+	it := &f.igmp
+	it.Lock()
+	for group, ports := range it.groups {
+		if m, ok := ports[pio]; ok {
+			m.timer.Stop()
+			it.delMember(group, pio)
+		}
+	}
+	if m, ok := it.routers[pio]; ok {
+		m.timer.Stop()
+		delete(it.routers, pio)
+	}
+	it.Unlock()
+}
+
+// IgmpStats returns the groups and the counts of the igmp snooping of f
+func (f *FDB) IgmpStats() (int, IgmpStats) {
+	f.igmp.Lock()
+	defer f.igmp.Unlock()
+	return len(f.igmp.groups), f.igmp.stats
+}
+
+// ShowIgmp returns the igmp snooping of f
+func (f *FDB) ShowIgmp() IgmpInfo {
+	it := &f.igmp
+	now := time.Now()
+	it.Lock()
+	info := IgmpInfo{Conf: it.conf, Stats: it.stats, Groups: make([]IgmpGroup, 0, len(it.groups))}
+	igmpPorts := func(ports map[portIO]*igmpMember) []IgmpPort {
+		ips := make([]IgmpPort, 0, len(ports))
+		for p, m := range ports {
+			ips = append(ips, IgmpPort{Port: p.String(), Expires: int(m.expires.Sub(now) / time.Second)})
+		}
+		sort.Slice(ips, func(i, j int) bool { return ips[i].Port < ips[j].Port })
+		return ips
+	}
+	info.Routers = igmpPorts(it.routers)
+	for group, ports := range it.groups {
+		info.Groups = append(info.Groups, IgmpGroup{Group: net.IP(group[:]).String(), Ports: igmpPorts(ports)})
+	}
+	it.Unlock()
+	sort.Slice(info.Groups, func(i, j int) bool { return info.Groups[i].Group < info.Groups[j].Group })
+	return info
+}
@@ -15,6 +15,11 @@ type portIO interface {
 	String() string
 }
 
+// portCloser is a port which can be shut down, for the mac limit violation
+type portCloser interface {
+	Close() error
+}
+
 type portPools struct {
 	sync.Mutex
 	portIdPool [MAXPORT]int
@@ -25,7 +30,9 @@ type portPools struct {
 
 type portMaps struct {
 	sync.RWMutex
-	ports map[int]portIO
+	ports      map[int]portIO
+	blocked    map[portIO]bool
+	blockedNum int32
 }
 
 //var portMap map[int]portIO
@@ -116,6 +123,12 @@ func (f *FDB) ReleaseFwdPort(portId int, dec bool) {
 	}
 	if pio, ok := f.getPortMap(portId); ok {
 		f.DelFmnByPortIO(pio)
+		f.unbindStatic(pio)
+		f.stormRelease(pio)
+		f.arpRelease(pio)
+		f.igmpRelease(pio)
+		f.DelRoutesByPortIO(pio)
+		f.SetPortBlocked(pio, false)
 		f.delPortMap(portId)
 		f.portIdFree(portId)
 		if dec {
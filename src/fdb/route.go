@@ -0,0 +1,239 @@
+package fdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"packet"
+	"sort"
+	"sync"
+)
+
+const (
+	RouteMetricMax = 16 //unreachable, like rip
+	routePlenMax   = 32
+)
+
+// RouteEntry is one prefix of a routed fdb as it is advertised to the peers
+type RouteEntry struct {
+	Prefix net.IPNet
+	Metric int
+}
+
+type RouteNode struct {
+	pio    portIO
+	metric int
+	local  bool
+}
+
+func (rn *RouteNode) GetPortIO() portIO {
+	return rn.pio
+}
+
+// routeTable is the ip routing table of a routed fdb, lookup is longest prefix
+// match: routes[plen] maps the masked prefix to its candidates, the candidates
+// are sorted by metric, so the first one is the best.
+type routeTable struct {
+	sync.RWMutex
+	routed bool
+	routes [routePlenMax + 1]map[uint32][]*RouteNode
+}
+
+func (f *FDB) initRouteTable() {
+	for plen := 0; plen <= routePlenMax; plen++ {
+		f.routes.routes[plen] = make(map[uint32][]*RouteNode)
+	}
+}
+
+func prefixMask(plen int) uint32 {
+	if plen == 0 {
+		return 0
+	}
+	return ^uint32(0) << uint(32-plen)
+}
+
+func prefixKey(prefix *net.IPNet) (key uint32, plen int, err error) {
+	ip := prefix.IP.To4()
+	ones, bits := prefix.Mask.Size()
+	if ip == nil || bits != 32 {
+		return 0, 0, fmt.Errorf("prefix %s is not ipv4", prefix.String())
+	}
+	return binary.BigEndian.Uint32(ip) & prefixMask(ones), ones, nil
+}
+
+func keyPrefix(key uint32, plen int) net.IPNet {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, key)
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(plen, 32)}
+}
+
+// SetRouted makes the fdb forward by ip prefix instead of mac learning, it is
+// used by the vids of tun devices.
+func (f *FDB) SetRouted() {
+	f.routes.Lock()
+	f.routes.routed = true
+	f.routes.Unlock()
+}
+
+func (f *FDB) IsRouted() bool {
+	f.routes.RLock()
+	routed := f.routes.routed
+	f.routes.RUnlock()
+	return routed
+}
+
+func (rt *routeTable) add(key uint32, plen int, rn *RouteNode) {
+	rns := rt.routes[plen][key]
+	for i, old := range rns {
+		if old.pio == rn.pio {
+			rns = append(rns[:i], rns[i+1:]...)
+			break
+		}
+	}
+	rns = append(rns, rn)
+	sort.SliceStable(rns, func(i, j int) bool { return rns[i].metric < rns[j].metric })
+	rt.routes[plen][key] = rns
+}
+
+// delByPortIO deletes the routes through pio, local ones too if local is true
+func (rt *routeTable) delByPortIO(pio portIO, local bool) (changed bool) {
+	for plen := 0; plen <= routePlenMax; plen++ {
+		for key, rns := range rt.routes[plen] {
+			for i, rn := range rns {
+				if rn.pio == pio && (local || !rn.local) {
+					rns = append(rns[:i], rns[i+1:]...)
+					changed = true
+					break
+				}
+			}
+			if len(rns) == 0 {
+				delete(rt.routes[plen], key)
+			} else {
+				rt.routes[plen][key] = rns
+			}
+		}
+	}
+	return
+}
+
+// AddLocalRoute adds a prefix reachable through pio itself, like a tun device
+func (f *FDB) AddLocalRoute(prefix *net.IPNet, pio portIO) error {
+	key, plen, err := prefixKey(prefix)
+	if err != nil {
+		return err
+	}
+	f.routes.Lock()
+	f.routes.add(key, plen, &RouteNode{pio: pio, local: true})
+	f.routes.Unlock()
+	return nil
+}
+
+// SetPortRoutes replaces the routes learned from pio with its advertisement,
+// the metrics have been increased by the caller already.
+func (f *FDB) SetPortRoutes(pio portIO, entries []RouteEntry) (changed bool) {
+	f.routes.Lock()
+	defer f.routes.Unlock()
+	old := f.exportRoutes(nil)
+	f.routes.delByPortIO(pio, false)
+	for i := range entries {
+		key, plen, err := prefixKey(&entries[i].Prefix)
+		if err != nil || entries[i].Metric >= RouteMetricMax {
+			continue
+		}
+		f.routes.add(key, plen, &RouteNode{pio: pio, metric: entries[i].Metric})
+	}
+	return !sameRoutes(old, f.exportRoutes(nil))
+}
+
+func (f *FDB) DelRoutesByPortIO(pio portIO) bool {
+	f.routes.Lock()
+	changed := f.routes.delByPortIO(pio, true)
+	f.routes.Unlock()
+	return changed
+}
+
+// ExportRoutes returns the best route of every prefix for an advertisement to
+// except, the routes learned from except itself are left out (split horizon).
+func (f *FDB) ExportRoutes(except portIO) []RouteEntry {
+	f.routes.RLock()
+	defer f.routes.RUnlock()
+	return f.exportRoutes(except)
+}
+
+func (f *FDB) exportRoutes(except portIO) []RouteEntry {
+	var entries []RouteEntry
+	for plen := 0; plen <= routePlenMax; plen++ {
+		for key, rns := range f.routes.routes[plen] {
+			if except != nil && rns[0].pio == except {
+				continue
+			}
+			entries = append(entries, RouteEntry{Prefix: keyPrefix(key, plen), Metric: rns[0].metric})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Prefix.String() < entries[j].Prefix.String() })
+	return entries
+}
+
+func sameRoutes(a, b []RouteEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Prefix.String() != b[i].Prefix.String() || a[i].Metric != b[i].Metric {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FDB) lookupRoute(dst uint32) (*RouteNode, bool) {
+	f.routes.RLock()
+	defer f.routes.RUnlock()
+	for plen := routePlenMax; plen >= 0; plen-- {
+		if len(f.routes.routes[plen]) == 0 {
+			continue
+		}
+		if rns, ok := f.routes.routes[plen][dst&prefixMask(plen)]; ok {
+			return rns[0], true
+		}
+	}
+	return nil, false
+}
+
+// Route forwards the ip packet in pkt by its destination address
+func (f *FDB) Route(pio portIO, pkt *packet.PktBuf) bool {
+	data := pkt.LoadUserData()
+	if len(data) < packet.HeaderLen || data[0]>>4 != packet.Version {
+		return false
+	}
+	rn, ok := f.lookupRoute(binary.BigEndian.Uint32(data[16:20]))
+	if !ok || rn.pio == pio {
+		return false
+	}
+	rn.pio.PutPktToChan(pkt)
+	return true
+}
+
+func ShowRoutes() map[int][]string {
+	rtInfo := make(map[int][]string)
+	FdbMap.RLock()
+	defer FdbMap.RUnlock()
+	for fdbId, f := range FdbMap.fdbs {
+		if !f.IsRouted() {
+			continue
+		}
+		var rts []string
+		f.routes.RLock()
+		for plen := routePlenMax; plen >= 0; plen-- {
+			for key, rns := range f.routes.routes[plen] {
+				prefix := keyPrefix(key, plen)
+				for _, rn := range rns {
+					rts = append(rts, fmt.Sprintf("%s via %s metric %d local %v", prefix.String(), rn.pio.String(), rn.metric, rn.local))
+				}
+			}
+		}
+		f.routes.RUnlock()
+		rtInfo[fdbId] = rts
+	}
+	return rtInfo
+}
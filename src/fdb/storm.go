@@ -0,0 +1,197 @@
+package fdb
+
+import (
+	"fmt"
+	"mylog"
+	"packet"
+	"sync"
+	"sync/atomic"
+)
+
+// the classes of the flooded packets
+const (
+	stormBroadcast = iota
+	stormUnknown   //unicast to an unknown mac
+	stormMulticast
+	stormClasses
+)
+
+var stormClassNames = []string{"broadcast", "unknown", "multicast"}
+
+// StormConf limits the packets a port floods in a vid, packets per second of
+// every class, 0 is no limit. A port over a limit is suspended for Suspend
+// seconds, all its packets are dropped, or just the flood over the limit is
+// dropped if Suspend is 0.
+type StormConf struct {
+	Broadcast int `toml:"broadcast"`
+	Unknown   int `toml:"unknown"`
+	Multicast int `toml:"multicast"`
+	Suspend   int `toml:"suspend"` //second
+}
+
+// StormStats is the storm control of a port, or of an fdb if Port is empty
+type StormStats struct {
+	Port      string `json:",omitempty"`
+	Broadcast uint64
+	Unknown   uint64
+	Multicast uint64
+	Suspended uint64 //the packets dropped as the port is suspended
+	Suspends  uint64
+}
+
+// stormPort counts the flood of a port in the second of tick
+type stormPort struct {
+	tick         uint64
+	count        [stormClasses]int
+	suspendUntil uint64
+	stats        StormStats
+}
+
+type stormControl struct {
+	sync.Mutex
+	conf         StormConf
+	limits       [stormClasses]int
+	ports        map[portIO]*stormPort
+	suspendedNum int32
+	stats        StormStats
+}
+
+func checkStormConf(conf *StormConf) error {
+	if conf.Broadcast < 0 || conf.Unknown < 0 || conf.Multicast < 0 || conf.Suspend < 0 {
+		return fmt.Errorf("storm %+v is invalid", *conf)
+	}
+	return nil
+}
+
+func (f *FDB) setStormConf(conf StormConf) {
+	sc := &f.storm
+	sc.Lock()
+	sc.conf = conf
+	sc.limits = [stormClasses]int{conf.Broadcast, conf.Unknown, conf.Multicast}
+	if sc.ports == nil {
+		sc.ports = make(map[portIO]*stormPort)
+	}
+	if conf.Suspend == 0 {
+		for _, sp := range sc.ports {
+			sp.suspendUntil = 0
+		}
+		atomic.StoreInt32(&sc.suspendedNum, 0)
+	}
+	sc.Unlock()
+}
+
+// stormClass returns the class of a flooded packet
+func stormClass(ether *packet.Ether) int {
+	if ether.IsBroadcast() {
+		return stormBroadcast
+	}
+	if ether.IsMulticast() {
+		return stormMulticast
+	}
+	return stormUnknown
+}
+
+// stormSuspended reports whether pio is suspended, its packets are dropped
+func (f *FDB) stormSuspended(pio portIO) bool {
+	sc := &f.storm
+	if atomic.LoadInt32(&sc.suspendedNum) == 0 {
+		return false
+	}
+	sc.Lock()
+	defer sc.Unlock()
+	sp, ok := sc.ports[pio]
+	if !ok || sp.suspendUntil == 0 {
+		return false
+	}
+	if FdbTick < sp.suspendUntil {
+		sp.stats.Suspended++
+		sc.stats.Suspended++
+		return true
+	}
+	sp.suspendUntil = 0
+	atomic.AddInt32(&sc.suspendedNum, -1)
+	mylog.Notice("storm control: port %s is resumed\n", pio.String())
+	return false
+}
+
+// stormAllow counts a packet of class flooded from pio, false if it is over
+// the limit of the class.
+func (f *FDB) stormAllow(pio portIO, class int) bool {
+	sc := &f.storm
+	sc.Lock()
+	defer sc.Unlock()
+	limit := sc.limits[class]
+	if limit == 0 {
+		return true
+	}
+	sp, ok := sc.ports[pio]
+	if !ok {
+		sp = &stormPort{}
+		sc.ports[pio] = sp
+	}
+	if sp.tick != FdbTick {
+		sp.tick = FdbTick
+		sp.count = [stormClasses]int{}
+	}
+	sp.count[class]++
+	if sp.count[class] <= limit {
+		return true
+	}
+	switch class {
+	case stormBroadcast:
+		sp.stats.Broadcast++
+		sc.stats.Broadcast++
+	case stormUnknown:
+		sp.stats.Unknown++
+		sc.stats.Unknown++
+	case stormMulticast:
+		sp.stats.Multicast++
+		sc.stats.Multicast++
+	}
+	if sc.conf.Suspend > 0 && sp.suspendUntil == 0 {
+		sp.suspendUntil = FdbTick + uint64(sc.conf.Suspend)
+		sp.stats.Suspends++
+		sc.stats.Suspends++
+		atomic.AddInt32(&sc.suspendedNum, 1)
+		mylog.Warning("storm control: port %s floods more than %d %s packets per second, suspend it %d seconds\n",
+			pio.String(), limit, stormClassNames[class], sc.conf.Suspend)
+	} else if sp.count[class] == limit+1 {
+		mylog.Info("storm control: port %s floods more than %d %s packets per second, drop\n", pio.String(), limit, stormClassNames[class])
+	}
+	return false
+}
+
+// stormFlood floods the packet of class from pio if the storm control allows
+func (f *FDB) stormFlood(pio portIO, pkt *packet.PktBuf, class int) bool {
+	if !f.stormAllow(pio, class) {
+		return false
+	}
+	return f.flood(pio, pkt)
+}
+
+// stormRelease forgets pio, which is released
+func (f *FDB) stormRelease(pio portIO) {
+	sc := &f.storm
+	sc.Lock()
+	if sp, ok := sc.ports[pio]; ok {
+		if sp.suspendUntil != 0 {
+			atomic.AddInt32(&sc.suspendedNum, -1)
+		}
+		delete(sc.ports, pio)
+	}
+	sc.Unlock()
+}
+
+// StormStats returns the drops of f and of its ports
+func (f *FDB) StormStats() (StormStats, []StormStats) {
+	sc := &f.storm
+	sc.Lock()
+	defer sc.Unlock()
+	ports := make([]StormStats, 0, len(sc.ports))
+	for pio, sp := range sc.ports {
+		st := sp.stats
+		st.Port = pio.String()
+		ports = append(ports, st)
+	}
+	return sc.stats, ports
+}
@@ -11,7 +11,10 @@ import (
 	_ "net/http/pprof"
 	"time"
 
+	"acl"
+	"fdb"
 	"mylog"
+	"nat"
 	"netstat"
 	"vnet"
 
@@ -24,6 +27,21 @@ type tlsConfig struct {
 	TlsSP     string
 }
 
+type authConfig struct {
+	AuthMode       string
+	AuthPsk        string
+	NodeKey        string
+	AuthorizedKeys []string
+}
+
+type natConfig struct {
+	Enable bool
+	SnatIP string
+	Zones  []int
+	Dnat   []nat.DnatRule
+	Frag   nat.FragConfig
+}
+
 type TunConfig struct {
 	Tuns []vnet.TunConf
 }
@@ -37,14 +55,18 @@ type HeartbeatConfig struct {
 type vnetConfig struct {
 	ListenAddr string
 	SerAddr    []string
+	Transport  string
 	CryptType  string
+	CryptKey   string
 	Vids       []int
 
 	BackupLinkAddr []string
 
 	HeartbeatConf HeartbeatConfig
 	TlsConf       tlsConfig
+	AuthConf      authConfig
 	TunConf       TunConfig
+	Nat           natConfig
 
 	UpRateLimit   int64
 	DownRateLimit int64
@@ -52,9 +74,15 @@ type vnetConfig struct {
 	LogLevel      string
 	ShowInfoAddr  string
 	RouteConf     string
+	RouteTable    int
 
 	CheckTunPkt   bool
 	NetStatEnable bool
+	FlowExport    netstat.FlowExportConfig
+	Acl           []acl.VidAcl
+	Mirror        []vnet.MirrorConf
+	Stp           vnet.StpConf
+	Fdb           []fdb.FdbConf
 
 	PprofEnable bool
 	PpAddr      string
@@ -70,16 +98,23 @@ var (
 	vnetConf    vnetConfig
 	showVersion = flag.Bool("v", false, "show version information")
 	listenAddr  = flag.String("listenAddr", "", " listen addr, like 203.156.34.98:7878")
+	transport   = flag.String("transport", "tcp", "link transport, tcp or udp")
 	tlsEnable   = flag.Bool("tls", false, "enable tls connect")
 	tlsSK       = flag.String("server.key", "./config/server.key", "tls server.key")
 	tlsSP       = flag.String("server.pem", "./config/server.pem", "tls server.pem")
 	configFile  = flag.String("c", "", "config file")
+	genNodeKey  = flag.Bool("genkey", false, "generate a ed25519 node key for AuthConf and exit")
 )
 
 func newListener() net.Listener {
 	var ln net.Listener
 	var err error
-	if *tlsEnable {
+	if *transport == "udp" {
+		if *tlsEnable {
+			log.Fatalln("tls is not supported by udp transport")
+		}
+		ln, err = vnet.ListenUdp(*listenAddr)
+	} else if *tlsEnable {
 		cert, err := tls.LoadX509KeyPair(*tlsSP, *tlsSK)
 		if err != nil {
 			log.Fatalln(err, *tlsSP, *tlsSK)
@@ -115,7 +150,9 @@ func (md *myDial) Connect(dialInfo interface{}) (conn net.Conn) {
 
 ReConnect:
 	mylog.Info("now connecting to  %s \n", serverAddr)
-	if *tlsEnable {
+	if *transport == "udp" {
+		conn, err = net.DialTimeout("udp4", serverAddr, time.Second*5)
+	} else if *tlsEnable {
 		tlsconf := &tls.Config{
 			InsecureSkipVerify: true,
 		}
@@ -144,23 +181,64 @@ func main() {
 		fmt.Println(version)
 		return
 	}
+	if *genNodeKey {
+		seed, pub, err := vnet.GenNodeKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("NodeKey = \"%s\"\nNodeId  = \"%s\"\n", seed, pub)
+		return
+	}
 	initConfig()
 	mylog.InitLog(vnetConf.LogLevel, vnetConf.LogFile)
 
 	log.Printf("appVersion=%s, goVersion=%s, buildTime=%s, commitId=%s\n", appVersion, goVersion, buildTime, commitId)
 
-	log.Printf("listenAddr=%s ,serAddr=%v, enable pprof %v, ppaddr=%s\n", *listenAddr, vnetConf.SerAddr, vnetConf.PprofEnable, vnetConf.PpAddr)
+	log.Printf("listenAddr=%s ,serAddr=%v, transport=%s, enable pprof %v, ppaddr=%s\n", *listenAddr, vnetConf.SerAddr, *transport, vnetConf.PprofEnable, vnetConf.PpAddr)
 	vnet.ShowBaseInfo()
 	vnet.SetVersion(version)
 	vnet.DebugInfoServe(vnetConf.ShowInfoAddr)
 	vnet.SetVids(vnetConf.Vids)
+	vnet.SetCryptKey(vnetConf.CryptKey)
+	AuthConf := vnetConf.AuthConf
+	vnet.SetAuth(AuthConf.AuthMode, AuthConf.AuthPsk, AuthConf.NodeKey, AuthConf.AuthorizedKeys)
 	vnet.SetDefaultCryptType(vnetConf.CryptType)
 	vnet.SetRateLimit(vnetConf.UpRateLimit, vnetConf.DownRateLimit)
 	vnet.SetRouteConf(vnetConf.RouteConf)
+	vnet.SetRouteTable(vnetConf.RouteTable)
 	vnet.SetCheckTunPkt(vnetConf.CheckTunPkt)
 	HeartbeatConf := vnetConf.HeartbeatConf
 	vnet.SetHeartbeat(HeartbeatConf.HeartbeatIdle, HeartbeatConf.HeartbeatCnt, HeartbeatConf.HeartbeatIntv)
 	netstat.Enable(vnetConf.NetStatEnable)
+	if err := netstat.SetFlowExport(vnetConf.FlowExport); err != nil {
+		log.Fatalf("FlowExport: %s\n", err.Error())
+	}
+	if err := acl.SetAcls(vnetConf.Acl); err != nil {
+		log.Fatalf("Acl: %s\n", err.Error())
+	}
+	if err := vnet.SetMirrors(vnetConf.Mirror); err != nil {
+		log.Fatalf("Mirror: %s\n", err.Error())
+	}
+	if err := vnet.SetStp(vnetConf.Stp); err != nil {
+		log.Fatalf("Stp: %s\n", err.Error())
+	}
+	if err := vnet.SetFdbConfs(vnetConf.Fdb); err != nil {
+		log.Fatalf("Fdb: %s\n", err.Error())
+	}
+	if vnetConf.Nat.Enable {
+		if vnetConf.Nat.SnatIP != "" {
+			nat.SetSnatIP(true, vnetConf.Nat.SnatIP)
+		}
+		nat.SetNetZones(vnetConf.Nat.Zones)
+		if err := nat.SetFragConfig(vnetConf.Nat.Frag); err != nil {
+			log.Fatalf("Nat.Frag: %s\n", err.Error())
+		}
+		for _, rule := range vnetConf.Nat.Dnat {
+			if err := nat.AddDnatRule(rule); err != nil {
+				log.Fatalf("Nat.Dnat rule %+v: %s\n", rule, err.Error())
+			}
+		}
+	}
 
 	if vnetConf.PprofEnable {
 		go func() {
@@ -168,8 +246,12 @@ func main() {
 		}()
 	}
 
+	vnet.SetReloadFunc(reloadConfig)
+	go reloadOnSignal()
+
 	if len(vnetConf.TunConf.Tuns) == 1 && len(vnetConf.SerAddr) == 1 && *listenAddr == "" {
 		mylog.Info("============ bind conn to tun, p2p ec mode============\n")
+		p2pMode = true
 		vnet.ConnBindTun(vnetConf.SerAddr[0], myDialer, vnetConf.TunConf.Tuns[0])
 		goto waitLoop
 	}
@@ -226,4 +308,10 @@ func initConfig() {
 	*tlsSK = vnetConf.TlsConf.TlsSK
 	*tlsSP = vnetConf.TlsConf.TlsSP
 	*listenAddr = vnetConf.ListenAddr
+	if vnetConf.Transport != "" {
+		*transport = vnetConf.Transport
+	}
+	if *transport != "tcp" && *transport != "udp" {
+		log.Fatalf("unknown Transport %s, must be tcp or udp\n", *transport)
+	}
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+
+	"acl"
+	"mylog"
+	"nat"
+	"netstat"
+	"vnet"
+
+	"github.com/BurntSushi/toml"
+)
+
+var reloadLock sync.Mutex
+var p2pMode bool
+
+func reloadOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		changes, err := reloadConfig()
+		for _, change := range changes {
+			log.Println("reload:", change)
+		}
+		if err != nil {
+			log.Printf("reload config err: %s\n", err.Error())
+		}
+	}
+}
+
+// diffStrings returns the ones in b but not in a, and the ones in a but not in b
+func diffStrings(a, b []string) (added, removed []string) {
+	am := make(map[string]bool, len(a))
+	bm := make(map[string]bool, len(b))
+	for _, s := range a {
+		am[s] = true
+	}
+	for _, s := range b {
+		bm[s] = true
+		if !am[s] {
+			added = append(added, s)
+		}
+	}
+	for _, s := range a {
+		if !bm[s] {
+			removed = append(removed, s)
+		}
+	}
+	return
+}
+
+func sameVids(a, b []int) bool {
+	a = append([]int(nil), a...)
+	b = append([]int(nil), b...)
+	sort.Ints(a)
+	sort.Ints(b)
+	return reflect.DeepEqual(a, b)
+}
+
+// reloadConfig re-reads the config file and applies the changes of log level,
+// rate limits, nat reassembly limits, dnat rules, flow export, acls, mirrors,
+// the spanning tree, the fdbs, SerAddr, Vids and new tuns; the conns they
+// don't affect keep working. The acls, mirrors, dnat rules and static macs
+// edited over http are replaced by the ones of the file. The other changes need a restart, they
+// are reported only.
+func reloadConfig() (changes []string, err error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	if *configFile == "" {
+		return nil, errors.New("no config file, start with -c")
+	}
+	var newConf vnetConfig
+	if _, err = toml.DecodeFile(*configFile, &newConf); err != nil {
+		return nil, err
+	}
+	changed := func(format string, a ...interface{}) {
+		changes = append(changes, fmt.Sprintf(format, a...))
+	}
+
+	if newConf.LogLevel != vnetConf.LogLevel {
+		if err := mylog.SetLogLevel(newConf.LogLevel); err != nil {
+			changed("LogLevel %s: %s", newConf.LogLevel, err.Error())
+		} else {
+			changed("LogLevel %s -> %s", vnetConf.LogLevel, newConf.LogLevel)
+			vnetConf.LogLevel = newConf.LogLevel
+		}
+	}
+
+	if newConf.UpRateLimit != vnetConf.UpRateLimit || newConf.DownRateLimit != vnetConf.DownRateLimit {
+		vnet.SetRateLimit(newConf.UpRateLimit, newConf.DownRateLimit)
+		changed("RateLimit up %d -> %d, down %d -> %d", vnetConf.UpRateLimit, newConf.UpRateLimit, vnetConf.DownRateLimit, newConf.DownRateLimit)
+		vnetConf.UpRateLimit = newConf.UpRateLimit
+		vnetConf.DownRateLimit = newConf.DownRateLimit
+	}
+
+	if newConf.Nat.Frag != vnetConf.Nat.Frag {
+		if err := nat.SetFragConfig(newConf.Nat.Frag); err != nil {
+			changed("Nat.Frag %+v: %s", newConf.Nat.Frag, err.Error())
+		} else {
+			changed("Nat.Frag %+v -> %+v", vnetConf.Nat.Frag, newConf.Nat.Frag)
+			vnetConf.Nat.Frag = newConf.Nat.Frag
+		}
+	}
+
+	if !reflect.DeepEqual(newConf.Nat.Dnat, vnetConf.Nat.Dnat) {
+		if err := nat.SetDnatRules(newConf.Nat.Dnat); err != nil {
+			changed("Nat.Dnat: %s", err.Error())
+		} else {
+			changed("Nat.Dnat reloaded, %d rules", len(newConf.Nat.Dnat))
+			vnetConf.Nat.Dnat = newConf.Nat.Dnat
+		}
+	}
+
+	if newConf.FlowExport != vnetConf.FlowExport {
+		if err := netstat.SetFlowExport(newConf.FlowExport); err != nil {
+			changed("FlowExport %+v: %s", newConf.FlowExport, err.Error())
+		} else {
+			changed("FlowExport %+v -> %+v", vnetConf.FlowExport, newConf.FlowExport)
+			vnetConf.FlowExport = newConf.FlowExport
+		}
+	}
+
+	if !reflect.DeepEqual(newConf.Acl, vnetConf.Acl) {
+		if err := acl.SetAcls(newConf.Acl); err != nil {
+			changed("Acl: %s", err.Error())
+		} else {
+			changed("Acl reloaded, %d vids", len(newConf.Acl))
+			vnetConf.Acl = newConf.Acl
+		}
+	}
+
+	if !reflect.DeepEqual(newConf.Mirror, vnetConf.Mirror) {
+		if err := vnet.SetMirrors(newConf.Mirror); err != nil {
+			changed("Mirror: %s", err.Error())
+		} else {
+			changed("Mirror reloaded, %d mirrors", len(newConf.Mirror))
+			vnetConf.Mirror = newConf.Mirror
+		}
+	}
+
+	if !reflect.DeepEqual(newConf.Stp, vnetConf.Stp) {
+		if err := vnet.SetStp(newConf.Stp); err != nil {
+			changed("Stp %+v: %s", newConf.Stp, err.Error())
+		} else {
+			changed("Stp %+v -> %+v", vnetConf.Stp, newConf.Stp)
+			vnetConf.Stp = newConf.Stp
+		}
+	}
+
+	if !reflect.DeepEqual(newConf.Fdb, vnetConf.Fdb) {
+		if err := vnet.SetFdbConfs(newConf.Fdb); err != nil {
+			changed("Fdb: %s", err.Error())
+		} else {
+			changed("Fdb reloaded, %d vids", len(newConf.Fdb))
+			vnetConf.Fdb = newConf.Fdb
+		}
+	}
+
+	if !sameVids(newConf.Vids, vnetConf.Vids) {
+		if err := vnet.UpdateVids(newConf.Vids); err != nil {
+			changed("Vids %v: %s", newConf.Vids, err.Error())
+		} else {
+			changed("Vids %v -> %v", vnetConf.Vids, newConf.Vids)
+			vnetConf.Vids = newConf.Vids
+		}
+	}
+
+	added, removed := diffStrings(vnetConf.SerAddr, newConf.SerAddr)
+	if len(added) > 0 || len(removed) > 0 {
+		if p2pMode {
+			changed("SerAddr %v: can't change in p2p mode without restart", newConf.SerAddr)
+		} else {
+			for _, addr := range removed {
+				vnet.DelPeer(addr)
+				changed("SerAddr del %s", addr)
+			}
+			for _, addr := range added {
+				vnet.AddPeer(addr, myDialer)
+				changed("SerAddr add %s", addr)
+			}
+			vnetConf.SerAddr = newConf.SerAddr
+		}
+	}
+
+	oldTuns := make(map[string]vnet.TunConf, len(vnetConf.TunConf.Tuns))
+	for _, tunconf := range vnetConf.TunConf.Tuns {
+		oldTuns[tunconf.TunName] = tunconf
+	}
+	var newTuns []vnet.TunConf
+	for _, tunconf := range newConf.TunConf.Tuns {
+		old, ok := oldTuns[tunconf.TunName]
+		delete(oldTuns, tunconf.TunName)
+		if !ok {
+			newTuns = append(newTuns, tunconf)
+		} else if !reflect.DeepEqual(old, tunconf) {
+			changed("tun %s changed: need restart", tunconf.TunName)
+		}
+	}
+	for name := range oldTuns {
+		changed("tun %s removed: need restart", name)
+	}
+	if len(newTuns) > 0 {
+		if p2pMode {
+			changed("add tuns: can't add in p2p mode without restart")
+		} else {
+			for _, tunconf := range newTuns {
+				if err := vnet.AddTun(tunconf); err != nil {
+					changed("tun %s add: %s", tunconf.TunName, err.Error())
+					continue
+				}
+				changed("tun %s add", tunconf.TunName)
+				vnetConf.TunConf.Tuns = append(vnetConf.TunConf.Tuns, tunconf)
+			}
+		}
+	}
+
+	if newConf.ListenAddr != vnetConf.ListenAddr || newConf.Transport != vnetConf.Transport ||
+		newConf.CryptType != vnetConf.CryptType || newConf.CryptKey != vnetConf.CryptKey ||
+		!reflect.DeepEqual(newConf.TlsConf, vnetConf.TlsConf) || !reflect.DeepEqual(newConf.AuthConf, vnetConf.AuthConf) ||
+		!reflect.DeepEqual(newConf.HeartbeatConf, vnetConf.HeartbeatConf) {
+		changed("listen, transport, crypt, tls, auth or heartbeat config changed: need restart")
+	}
+	if newConf.Nat.Enable != vnetConf.Nat.Enable || newConf.Nat.SnatIP != vnetConf.Nat.SnatIP ||
+		!sameVids(newConf.Nat.Zones, vnetConf.Nat.Zones) {
+		changed("Nat Enable, SnatIP or Zones changed: need restart")
+	}
+	if !reflect.DeepEqual(newConf.BackupLinkAddr, vnetConf.BackupLinkAddr) {
+		changed("BackupLinkAddr %v -> %v: need restart", vnetConf.BackupLinkAddr, newConf.BackupLinkAddr)
+	}
+	if newConf.RouteConf != vnetConf.RouteConf || newConf.RouteTable != vnetConf.RouteTable {
+		changed("RouteConf or RouteTable changed: need restart")
+	}
+	if newConf.NetStatEnable != vnetConf.NetStatEnable {
+		changed("NetStatEnable %v -> %v: need restart", vnetConf.NetStatEnable, newConf.NetStatEnable)
+	}
+	return changes, nil
+}
@@ -6,6 +6,8 @@
 // network protocol headers.
 package nat
 
+import "encoding/binary"
+
 // Checksum calculates the checksum (as defined in RFC 1071) of the bytes in the
 // given byte array.
 func Checksum(buf []byte, initial uint16) uint16 {
@@ -52,6 +54,18 @@ func ChecksumCombine(a, b uint16) uint16 {
   17.     return uint16(^sum)
   18. }
 */
+// ChecksumUpdate returns the checksum xsum after the 16-bit aligned field old
+// is replaced by new, it is the incremental update of RFC 1624:
+// HC' = ~(~HC + ~m + m')
+func ChecksumUpdate(xsum uint16, old []byte, new []byte) uint16 {
+	v := ^xsum
+	for i := 0; i+1 < len(old); i += 2 {
+		v = ChecksumCombine(v, ^binary.BigEndian.Uint16(old[i:]))
+		v = ChecksumCombine(v, binary.BigEndian.Uint16(new[i:]))
+	}
+	return ^v
+}
+
 // PseudoHeaderChecksum calculates the pseudo-header checksum for the
 // given destination protocol and network address, ignoring the length
 // field. Pseudo-headers are needed by transport layers when calculating
@@ -5,6 +5,7 @@ import (
 	"log"
 	"mylog"
 	"sync"
+	"tcpstate"
 	"time"
 	"timer"
 )
@@ -24,13 +25,10 @@ const (
 	CT_ESTABLISHED = 2
 	CT_DEL         = 3
 
-	CT_TCP_SYN_TIMEOUT         = 3
-	CT_TCP_SYN_RCVD_TIMEOUT    = 3
-	CT_TCP_ESTABLISHED_TIMEOUT = 240 //20 test
-	CT_TCP_FIN_TIMEOUT         = 10
 	CT_DEL_TIMEOUT             = 10
 	CT_UDP_NEW_TIMEOUT         = 15
 	CT_UDP_ESTABLISHED_TIMEOUT = 120
+	CT_ICMP_TIMEOUT            = 30
 
 	snatFlag byte = 1
 	dnatFlag byte = 2
@@ -57,6 +55,7 @@ type conntrack struct {
 	reported bool
 	outBound bool
 	natFlag  byte
+	tcp      tcpstate.Tracker
 }
 
 type netConntrack struct {
@@ -131,11 +130,20 @@ func (nct *netConntrack) findConntrack(t ctTuple) (*conntrack, bool) {
 	return ct, ok
 }
 
-func (nct *netConntrack) addConntrack(ct *conntrack) {
+// tryAddConntrack adds ct if none of its tuples is used by another
+// conntrack, the check and the add are under one lock.
+func (nct *netConntrack) tryAddConntrack(ct *conntrack) bool {
 	nct.Lock()
+	defer nct.Unlock()
+	if _, ok := nct.conntracks[ct.tuple[ctOrigin]]; ok {
+		return false
+	}
+	if _, ok := nct.conntracks[ct.tuple[ctReply]]; ok {
+		return false
+	}
 	nct.conntracks[ct.tuple[ctOrigin]] = ct
 	nct.conntracks[ct.tuple[ctReply]] = ct
-	nct.Unlock()
+	return true
 }
 
 func (nct *netConntrack) delConntrack(ct *conntrack) {
@@ -185,8 +193,9 @@ func (nct *netConntrack) CreateConntrack(t ctTuple) (ct *conntrack, err error) {
 	return
 }
 
-func (ct *conntrack) ctConfirm() {
-	ct.nct.addConntrack(ct)
+// ctConfirm adds ct to its zone, false if one of its tuples is used already
+func (ct *conntrack) ctConfirm() bool {
+	return ct.nct.tryAddConntrack(ct)
 }
 
 func ctTCPHandShakeTimeout(t time.Time, args ...interface{}) {
@@ -239,12 +248,47 @@ func ctESTABLISHEDTimeout(t time.Time, args ...interface{}) {
 	ct.timer = timer.NewTimerFunc(time.Second*CT_DEL_TIMEOUT, ctTimeoutDel, ct)
 }
 
+// tcpStatus returns the status of a conntrack in the tcp state, a half
+// closed connection is still established.
+func tcpStatus(state tcpstate.State) uint8 {
+	switch state {
+	case tcpstate.None, tcpstate.SynSent:
+		return CT_NEW
+	case tcpstate.SynRecv:
+		return CT_REPLY
+	case tcpstate.TimeWait, tcpstate.Close:
+		return CT_DEL
+	}
+	return CT_ESTABLISHED
+}
+
+// tcpStateTimer moves ct to state and arms its timer for the timeout of the
+// state, the caller holds ct. Nothing is changed if the timer has fired, the
+// conntrack is being deleted.
+func (ct *conntrack) tcpStateTimer(state tcpstate.State) {
+	if ct.timer != nil && !ct.timer.Stop() {
+		return
+	}
+	ct.status = tcpStatus(state)
+	timeout := tcpstate.Timeout(state)
+	if state == tcpstate.Established {
+		ct.timer = timer.NewTimerFunc(timeout, ctESTABLISHEDTimeout, ct, ct.stats)
+		return
+	}
+	if ct.status == CT_DEL {
+		ct.lastTime = time.Now().UTC()
+	}
+	ct.timer = timer.NewTimerFunc(timeout, ctTimeoutDel, ct)
+}
+
 func getProtoEstablishTimeout(p uint8) time.Duration {
 	switch transportProtoNum(p) {
 	case TCPProtocolNumber:
-		return CT_TCP_ESTABLISHED_TIMEOUT
+		return tcpstate.Timeout(tcpstate.Established) / time.Second
 	case UDPProtocolNumber:
 		return CT_UDP_ESTABLISHED_TIMEOUT
+	case ICMPProtocolNumber:
+		return CT_ICMP_TIMEOUT
 	default:
 		panic("unknow proto")
 	}
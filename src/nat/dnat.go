@@ -0,0 +1,187 @@
+package nat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"mylog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DnatRule publishes To at Dst: the new connections of Proto to Dst in the
+// zone are translated to To, like "iptables -t nat -j DNAT".
+type DnatRule struct {
+	Zone  int    `toml:"zone"`
+	Proto string `toml:"proto"` //tcp or udp
+	Dst   string `toml:"dst"`   //ip:port
+	To    string `toml:"to"`    //ip:port
+}
+
+type dnatKey struct {
+	zone  uint16
+	proto uint8
+	daddr uint32
+	dport uint16
+}
+
+type dnatRule struct {
+	hits uint64 //first, atomic 64-bit ops need it 8-byte aligned on 386 and arm
+	DnatRule
+	toIP   uint32
+	toPort uint16
+}
+
+// DnatRuleInfo is a rule and the connections it translated
+type DnatRuleInfo struct {
+	DnatRule
+	Hits uint64
+}
+
+var dnatLock sync.RWMutex
+var dnatRules = make(map[dnatKey]*dnatRule)
+var dnatNum int32
+
+func dnatEnabled() bool {
+	return atomic.LoadInt32(&dnatNum) > 0
+}
+
+func parseIPPort(s string) (uint32, uint16, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return 0, 0, fmt.Errorf("%s isn't ipv4", host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return 0, 0, fmt.Errorf("invalid port %s", portStr)
+	}
+	return binary.BigEndian.Uint32(ip), uint16(port), nil
+}
+
+func parseProto(proto string) (transportProtoNum, error) {
+	switch strings.ToLower(proto) {
+	case "tcp":
+		return TCPProtocolNumber, nil
+	case "udp":
+		return UDPProtocolNumber, nil
+	}
+	return 0, fmt.Errorf("unsupported proto %s, must be tcp or udp", proto)
+}
+
+func (r *DnatRule) parse() (dnatKey, *dnatRule, error) {
+	var key dnatKey
+	if r.Zone <= 0 || r.Zone > 0xffff {
+		return key, nil, fmt.Errorf("invalid zone %d", r.Zone)
+	}
+	proto, err := parseProto(r.Proto)
+	if err != nil {
+		return key, nil, err
+	}
+	daddr, dport, err := parseIPPort(r.Dst)
+	if err != nil {
+		return key, nil, fmt.Errorf("dst %s: %s", r.Dst, err.Error())
+	}
+	toIP, toPort, err := parseIPPort(r.To)
+	if err != nil {
+		return key, nil, fmt.Errorf("to %s: %s", r.To, err.Error())
+	}
+	key = dnatKey{zone: uint16(r.Zone), proto: uint8(proto), daddr: daddr, dport: dport}
+	return key, &dnatRule{DnatRule: *r, toIP: toIP, toPort: toPort}, nil
+}
+
+// AddDnatRule adds or replaces the rule of r.Dst, the zone is tracked by nat.
+// The connections translated already keep their destination.
+func AddDnatRule(r DnatRule) error {
+	key, rule, err := r.parse()
+	if err != nil {
+		return err
+	}
+	SetNetZone(r.Zone)
+	dnatLock.Lock()
+	if _, ok := dnatRules[key]; !ok {
+		atomic.AddInt32(&dnatNum, 1)
+	}
+	dnatRules[key] = rule
+	dnatLock.Unlock()
+	mylog.Info("add dnat rule: zone=%d, %s %s -> %s\n", r.Zone, r.Proto, r.Dst, r.To)
+	return nil
+}
+
+func DelDnatRule(r DnatRule) error {
+	key, _, err := r.parse()
+	if err != nil {
+		return err
+	}
+	dnatLock.Lock()
+	defer dnatLock.Unlock()
+	if _, ok := dnatRules[key]; !ok {
+		return fmt.Errorf("dnat rule of zone %d, %s %s isn't exist", r.Zone, r.Proto, r.Dst)
+	}
+	delete(dnatRules, key)
+	atomic.AddInt32(&dnatNum, -1)
+	mylog.Info("del dnat rule: zone=%d, %s %s\n", r.Zone, r.Proto, r.Dst)
+	return nil
+}
+
+// SetDnatRules replaces all the rules with rules, none is changed if one of
+// them is invalid. A rule which is kept keeps its hits.
+func SetDnatRules(rules []DnatRule) error {
+	newRules := make(map[dnatKey]*dnatRule, len(rules))
+	for i := range rules {
+		key, rule, err := rules[i].parse()
+		if err != nil {
+			return fmt.Errorf("rule %+v: %s", rules[i], err.Error())
+		}
+		if _, ok := newRules[key]; ok {
+			return fmt.Errorf("rule %+v: dst is duplicated", rules[i])
+		}
+		newRules[key] = rule
+	}
+	for _, r := range rules {
+		SetNetZone(r.Zone)
+	}
+	dnatLock.Lock()
+	for key, rule := range newRules {
+		if old, ok := dnatRules[key]; ok && old.DnatRule == rule.DnatRule {
+			newRules[key] = old
+		}
+	}
+	dnatRules = newRules
+	atomic.StoreInt32(&dnatNum, int32(len(newRules)))
+	dnatLock.Unlock()
+	mylog.Info("set dnat rules: %d rules\n", len(newRules))
+	return nil
+}
+
+func lookupDnatRule(zone uint16, t ctTuple) (*dnatRule, bool) {
+	if !dnatEnabled() {
+		return nil, false
+	}
+	dnatLock.RLock()
+	rule, ok := dnatRules[dnatKey{zone: zone, proto: t.proto, daddr: t.daddr, dport: t.dport}]
+	dnatLock.RUnlock()
+	return rule, ok
+}
+
+func ShowDnatRules() []DnatRuleInfo {
+	dnatLock.RLock()
+	infos := make([]DnatRuleInfo, 0, len(dnatRules))
+	for _, rule := range dnatRules {
+		infos = append(infos, DnatRuleInfo{DnatRule: rule.DnatRule, Hits: atomic.LoadUint64(&rule.hits)})
+	}
+	dnatLock.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Zone != infos[j].Zone {
+			return infos[i].Zone < infos[j].Zone
+		}
+		return infos[i].Dst < infos[j].Dst
+	})
+	return infos
+}
@@ -1,11 +1,14 @@
 package nat
 
 import (
+	"fmt"
 	"ilist"
 	"log"
+	"mylog"
 	"packet"
 	"sync"
 	"time"
+	"timer"
 )
 
 const (
@@ -13,9 +16,64 @@ const (
 	FRAG_COMPLETE
 )
 
+const (
+	DefFragTimeout   = 30 //second, like ipfrag_time
+	DefFragMaxQueues = 1024
+	DefFragMaxBytes  = 4 << 20 //like ipfrag_high_thresh
+
+	// FragOverlapDrop drops the datagram when its fragments overlap, like
+	// RFC 5722 for ipv6; FragOverlapFirst keeps the data received first and
+	// drops the overlapping fragment only.
+	FragOverlapDrop  = "drop"
+	FragOverlapFirst = "first"
+
+	ipv4MaxPayload = 65535 - IPv4MinimumSize
+)
+
+// FragConfig bounds the reassembly of every zone: a datagram which doesn't
+// complete in Timeout seconds is dropped, the oldest ones are evicted when a
+// zone holds more than MaxQueues datagrams or MaxBytes of fragments.
+type FragConfig struct {
+	Timeout   int    `toml:"timeout"`
+	MaxQueues int    `toml:"maxqueues"`
+	MaxBytes  int    `toml:"maxbytes"`
+	Overlap   string `toml:"overlap"` //drop or first
+}
+
+// FragStats is the reassembly state and counters of a zone
+type FragStats struct {
+	Queues      int
+	Bytes       int
+	Reassembled uint64
+	Timeouts    uint64
+	Evicted     uint64
+	Overlaps    uint64
+	Dropped     uint64
+}
+
+type fragResult int
+
+const (
+	fragInserted fragResult = iota
+	fragDup                 //the same as a fragment held, it is retransmitted
+	fragOverlap
+	fragInvalid
+)
+
+var fragConfLock sync.RWMutex
+var fragConf = FragConfig{
+	Timeout:   DefFragTimeout,
+	MaxQueues: DefFragMaxQueues,
+	MaxBytes:  DefFragMaxBytes,
+	Overlap:   FragOverlapDrop,
+}
+
 type fragTable struct {
-	sync.RWMutex
+	sync.Mutex
 	fragQueueMap map[fragInfo]*fragQueue
+	lru          ilist.List //the queues, the oldest at front
+	bytes        int
+	stats        FragStats
 }
 
 type fragInfo struct {
@@ -26,102 +84,142 @@ type fragInfo struct {
 }
 
 type fragQueue struct {
+	ilist.Entry
+	fi         fragInfo
 	list       ilist.List
-	qLen       uint16
-	meat       uint16
+	qLen       int
+	meat       int
+	bytes      int
 	flag       uint8
 	createTime time.Time
+	timer      *timer.Timer
 }
 
 type fragment struct {
 	ilist.Entry
-	offset uint16
-	len    uint16
-	last   uint16
+	offset int
+	len    int
+	last   int
 	more   bool
 	pkb    *packet.PktBuf
 }
 
+// SetFragConfig sets the reassembly bounds, the zero fields are the defaults.
+// The queues held already keep their timeout.
+func SetFragConfig(conf FragConfig) error {
+	if conf.Timeout < 0 || conf.MaxQueues < 0 || conf.MaxBytes < 0 {
+		return fmt.Errorf("negative frag config %+v", conf)
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = DefFragTimeout
+	}
+	if conf.MaxQueues == 0 {
+		conf.MaxQueues = DefFragMaxQueues
+	}
+	if conf.MaxBytes == 0 {
+		conf.MaxBytes = DefFragMaxBytes
+	}
+	switch conf.Overlap {
+	case "":
+		conf.Overlap = FragOverlapDrop
+	case FragOverlapDrop, FragOverlapFirst:
+	default:
+		return fmt.Errorf("overlap %s isn't %s or %s", conf.Overlap, FragOverlapDrop, FragOverlapFirst)
+	}
+	fragConfLock.Lock()
+	fragConf = conf
+	fragConfLock.Unlock()
+	mylog.Info("frag config: %+v\n", conf)
+	return nil
+}
+
+func getFragConfig() FragConfig {
+	fragConfLock.RLock()
+	conf := fragConf
+	fragConfLock.RUnlock()
+	return conf
+}
+
 func newfragTable() *fragTable {
-	return &fragTable{
+	ft := &fragTable{
 		fragQueueMap: make(map[fragInfo]*fragQueue),
 	}
+	ft.lru.Reset()
+	return ft
 }
 
-func newfragQueue() *fragQueue {
+func newfragQueue(fi fragInfo) *fragQueue {
 	fq := new(fragQueue)
+	fq.fi = fi
 	fq.list.Reset()
 	fq.createTime = time.Now()
 	return fq
 }
 
-func createFragment(offset, len uint16, more bool, pkb *packet.PktBuf) *fragment {
+func createFragment(offset, len int, more bool, pkb *packet.PktBuf) *fragment {
 	return &fragment{offset: offset, len: len, last: offset + len, more: more, pkb: pkb}
 }
 
-func (fq *fragQueue) ProcessFragment(offset, len uint16, more bool, pkb *packet.PktBuf) (ok, done bool) {
+// insert puts the fragment in offset order, the fragments held are never
+// changed, so an overlapping one is refused as a whole.
+func (fq *fragQueue) insert(offset, len int, more bool, pkb *packet.PktBuf) fragResult {
 	if fq.flag&FRAG_COMPLETE != 0 {
-		//panic ? have completed
-		return false, false
+		return fragInvalid
 	}
-
 	nfrag := createFragment(offset, len, more, pkb)
-	log.Printf("-------nfrag=%#v----------\n", nfrag)
-	log.Printf("-------nfrag.offset=%d, len=%d, last=%d----------\n", nfrag.offset, nfrag.len, nfrag.last)
+	if fq.flag&FRAG_LAST_IN != 0 {
+		//the length of the datagram is known
+		if nfrag.last > fq.qLen || (!more && nfrag.last != fq.qLen) {
+			return fragOverlap
+		}
+	} else if !more && nfrag.last < fq.qLen {
+		return fragOverlap
+	}
 
-	if fq.list.Empty() {
-		fq.list.PushFront(nfrag)
-		fq.meat += nfrag.len
-		fq.qLen = nfrag.last
-		return true, false
+	var prev ilist.Element
+	for e := fq.list.Back(); e != nil; e = e.Prev() {
+		if e.(*fragment).offset <= nfrag.offset {
+			prev = e
+			break
+		}
+	}
+	next := fq.list.Front()
+	if prev != nil {
+		if f := prev.(*fragment); f.offset == nfrag.offset && f.last == nfrag.last {
+			return fragDup
+		}
+		if prev.(*fragment).last > nfrag.offset {
+			return fragOverlap
+		}
+		next = prev.Next()
+	}
+	if next != nil && nfrag.last > next.(*fragment).offset {
+		return fragOverlap
 	}
 
+	if prev == nil {
+		fq.list.PushFront(nfrag)
+	} else {
+		fq.list.InsertAfter(prev, nfrag)
+	}
 	if !more {
 		fq.flag |= FRAG_LAST_IN
-		if tail := fq.list.Back(); tail != nil {
-			if tail.(*fragment).last > nfrag.offset {
-				log.Panicf("over overlapped, tail.last=%d, nfrag.offset=%d\n", tail.(*fragment).last, nfrag.offset)
-			}
-		}
-		fq.list.PushBack(nfrag)
-		fq.meat += nfrag.len
+	}
+	if fq.qLen < nfrag.last {
 		fq.qLen = nfrag.last
-		if fq.qLen == fq.meat {
-			fq.flag |= FRAG_COMPLETE
-			return true, true
-		}
-		return true, false
 	}
-
-	for e := fq.list.Back(); e != nil; e = e.Prev() {
-		frag, _ := e.(*fragment)
-		if nfrag.offset >= frag.last {
-			if next := e.Next(); next != nil {
-				if nfrag.last > next.(*fragment).offset {
-					log.Panicf("over overlapped, nfrag.last=%d, next.offset=%d\n", nfrag.last, next.(*fragment).offset)
-					return false, false
-				}
-			}
-			fq.list.InsertAfter(e, nfrag)
-			if fq.qLen < nfrag.last {
-				fq.qLen = nfrag.last
-			}
-			fq.meat += len
-			if fq.flag&FRAG_LAST_IN != 0 && fq.qLen == fq.meat {
-				fq.flag |= FRAG_COMPLETE
-				return true, true
-			}
-			return true, false
-		}
+	fq.meat += nfrag.len
+	//no overlap, so all the data from 0 is in
+	if fq.flag&FRAG_LAST_IN != 0 && fq.meat == fq.qLen {
+		fq.flag |= FRAG_COMPLETE
 	}
-	return false, false
+	return fragInserted
 }
 
 func (fq *fragQueue) completed() (first_pkb *packet.PktBuf) {
 	if fq.flag&FRAG_COMPLETE == 0 {
 		log.Panicf("frag uncompleted")
 	}
-	log.Println("completed")
 	var prev, npkb *packet.PktBuf
 	first := true
 	for e := fq.list.Front(); e != nil; e = e.Next() {
@@ -137,21 +235,151 @@ func (fq *fragQueue) completed() (first_pkb *packet.PktBuf) {
 	return
 }
 
-func (nct *netConntrack) fragQueueFind(fi fragInfo) (fq *fragQueue, ok bool) {
-	nct.fragTables.RLock()
-	fq, ok = nct.fragTables.fragQueueMap[fi]
-	nct.fragTables.RUnlock()
-	return
+// release releases the fragments the queue holds
+func (fq *fragQueue) release() {
+	for e := fq.list.Front(); e != nil; e = e.Next() {
+		e.(*fragment).pkb.PutPktToPool()
+	}
+	fq.list.Reset()
 }
 
-func (nct *netConntrack) fragQueueAdd(fi fragInfo, fq *fragQueue) {
-	nct.fragTables.Lock()
-	nct.fragTables.fragQueueMap[fi] = fq
-	nct.fragTables.Unlock()
+// process queues the fragment pkb of the datagram fi. If it completes the
+// datagram, the first fragment is returned with ACCEPT, the others are
+// chained by Next(); STOLEN means pkb is held by the queue.
+func (ft *fragTable) process(fi fragInfo, offset, dataLen int, more bool, pkb *packet.PktBuf) (*packet.PktBuf, int) {
+	conf := getFragConfig()
+	ft.Lock()
+	defer ft.Unlock()
+	if offset+dataLen > ipv4MaxPayload || (more && dataLen == 0) {
+		ft.stats.Dropped++
+		return nil, DROP
+	}
+
+	fq, ok := ft.fragQueueMap[fi]
+	if !ok {
+		for len(ft.fragQueueMap) >= conf.MaxQueues {
+			if !ft.evictOldest(nil) {
+				break
+			}
+		}
+		fq = newfragQueue(fi)
+		ft.fragQueueMap[fi] = fq
+		ft.lru.PushBack(fq)
+		fq.timer = timer.NewTimerFunc(time.Second*time.Duration(conf.Timeout), fragTimeout, ft, fq)
+	}
+	size := int(pkb.GetDataLen())
+	for ft.bytes+size > conf.MaxBytes {
+		if !ft.evictOldest(fq) {
+			ft.destroy(fq)
+			ft.stats.Evicted++
+			return nil, DROP
+		}
+	}
+
+	switch fq.insert(offset, dataLen, more, pkb) {
+	case fragDup:
+		ft.stats.Dropped++
+		return nil, DROP
+	case fragOverlap:
+		ft.stats.Overlaps++
+		if conf.Overlap == FragOverlapDrop || fq.list.Empty() {
+			ft.destroy(fq)
+		}
+		return nil, DROP
+	case fragInvalid:
+		ft.stats.Dropped++
+		ft.destroy(fq)
+		return nil, DROP
+	}
+	//in the queue, so hold
+	pkb.HoldPktBuf()
+	fq.bytes += size
+	ft.bytes += size
+	if fq.flag&FRAG_COMPLETE == 0 {
+		return nil, STOLEN
+	}
+	ft.unlink(fq)
+	ft.stats.Reassembled++
+	return fq.completed(), ACCEPT
+}
+
+// evictOldest destroys the oldest queue except keep, it returns false if
+// there is none.
+func (ft *fragTable) evictOldest(keep *fragQueue) bool {
+	e := ft.lru.Front()
+	if e != nil && e.(*fragQueue) == keep {
+		e = e.Next()
+	}
+	if e == nil {
+		return false
+	}
+	fq := e.(*fragQueue)
+	mylog.Debug("evict frag queue %+v, created at %v\n", fq.fi, fq.createTime)
+	ft.destroy(fq)
+	ft.stats.Evicted++
+	return true
+}
+
+// unlink takes fq out of the table, the fragments are still held by it
+func (ft *fragTable) unlink(fq *fragQueue) {
+	if fq.timer != nil {
+		fq.timer.Stop()
+		fq.timer = nil
+	}
+	delete(ft.fragQueueMap, fq.fi)
+	ft.lru.Remove(fq)
+	ft.bytes -= fq.bytes
+}
+
+func (ft *fragTable) destroy(fq *fragQueue) {
+	ft.unlink(fq)
+	fq.release()
 }
 
-func (nct *netConntrack) fragQueueDel(fi fragInfo) {
-	nct.fragTables.Lock()
-	delete(nct.fragTables.fragQueueMap, fi)
-	nct.fragTables.Unlock()
+func fragTimeout(t time.Time, args ...interface{}) {
+	ft, ok := args[0].(*fragTable)
+	fq, ok2 := args[1].(*fragQueue)
+	if !ok || !ok2 {
+		log.Panicf("%v\n", args)
+	}
+	ft.Lock()
+	defer ft.Unlock()
+	if ft.fragQueueMap[fq.fi] != fq {
+		//completed or evicted already
+		return
+	}
+	fq.timer = nil
+	ft.destroy(fq)
+	ft.stats.Timeouts++
+	mylog.Debug("frag queue %+v timeout, created at %v\n", fq.fi, fq.createTime)
+}
+
+func (ft *fragTable) getStats() FragStats {
+	ft.Lock()
+	stats := ft.stats
+	stats.Queues = len(ft.fragQueueMap)
+	stats.Bytes = ft.bytes
+	ft.Unlock()
+	return stats
+}
+
+// ShowFragStats returns the reassembly stats of every zone
+func ShowFragStats() map[uint16]FragStats {
+	globalCtLock.RLock()
+	defer globalCtLock.RUnlock()
+	stats := make(map[uint16]FragStats, len(globalConntrack))
+	for zone, nct := range globalConntrack {
+		stats[zone] = nct.fragTables.getStats()
+	}
+	return stats
+}
+
+// releaseFragChain releases the fragments of a reassembled datagram nat holds
+func releaseFragChain(pkb *packet.PktBuf) {
+	for p := pkb; p != nil; {
+		dropPkb := p
+		p = p.Next()
+		dropPkb.SetNext(nil)
+		dropPkb.PutPktToPool()
+	}
 }
@@ -0,0 +1,252 @@
+package nat
+
+import (
+	"encoding/binary"
+	"packet"
+	"testing"
+	"time"
+)
+
+const fragTestProto = 253 //for experiment, no transport handler
+
+var fragTestPool = packet.NewPktBufPool()
+
+// newFragPkb builds an ether frame of the fragment [offset, offset+dataLen)
+// of the datagram ipID from 10.0.0.1 to 10.0.0.2.
+func newFragPkb(zone uint16, ipID uint16, offset int, dataLen int, more bool) *packet.PktBuf {
+	frame := make([]byte, packet.EtherSize+IPv4MinimumSize+dataLen)
+	binary.BigEndian.PutUint16(frame[12:], uint16(IPv4ProtocolNumber))
+	ip := IPv4(frame[packet.EtherSize:])
+	ip[versIHL] = 0x45
+	binary.BigEndian.PutUint16(ip[totalLen:], uint16(IPv4MinimumSize+dataLen))
+	binary.BigEndian.PutUint16(ip[id:], ipID)
+	fo := uint16(offset >> 3)
+	if more {
+		fo |= uint16(IPv4FlagMoreFragments) << 13
+	}
+	binary.BigEndian.PutUint16(ip[flagsFO:], fo)
+	ip[ttl] = 64
+	ip[protocol] = fragTestProto
+	ip.SetSourceAddress(0x0a000001)
+	ip.SetDestinationAddress(0x0a000002)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	for i := IPv4MinimumSize; i < len(ip); i++ {
+		ip[i] = byte(offset + i)
+	}
+
+	pkb := packet.GetPktFromPool(fragTestPool)
+	pkb.StoreData(frame)
+	pkb.SetPktVid(zone)
+	pkb.SetNetworkHeader(packet.EtherSize)
+	return pkb
+}
+
+type fragStep struct {
+	offset  int
+	dataLen int
+	more    bool
+	verdict int
+}
+
+// feedFrags feeds the fragments of one datagram through ipHandler, it
+// returns the head of the reassembled chain and the fragments fed.
+func feedFrags(t *testing.T, zone uint16, ipID uint16, steps []fragStep) (*packet.PktBuf, []*packet.PktBuf) {
+	var head *packet.PktBuf
+	var pkbs []*packet.PktBuf
+	for i, s := range steps {
+		pkb := newFragPkb(zone, ipID, s.offset, s.dataLen, s.more)
+		pkbs = append(pkbs, pkb)
+		ppkb := pkb
+		if v := ipHandler(&ppkb); v != s.verdict {
+			t.Fatalf("step %d %+v: verdict %d", i, s, v)
+		}
+		if s.verdict == ACCEPT {
+			head = ppkb
+		}
+	}
+	return head, pkbs
+}
+
+func chainOffsets(head *packet.PktBuf) []int {
+	var offsets []int
+	for p := head; p != nil; p = p.Next() {
+		offsets = append(offsets, int(IPv4(p.LoadNetworkData()).FragmentOffset()))
+	}
+	return offsets
+}
+
+func checkOffsets(t *testing.T, head *packet.PktBuf, want ...int) {
+	got := chainOffsets(head)
+	if len(got) != len(want) {
+		t.Fatalf("chain offsets %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("chain offsets %v, want %v", got, want)
+		}
+	}
+}
+
+func fragTestZone(t *testing.T, zone uint16, conf FragConfig) *fragTable {
+	if err := SetFragConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	DelNetZone(int(zone))
+	SetNetZone(int(zone))
+	nct, _ := GetNctByZone(zone)
+	return nct.fragTables
+}
+
+func TestFragInOrder(t *testing.T) {
+	defer SetFragConfig(FragConfig{})
+	ft := fragTestZone(t, 100, FragConfig{})
+	head, _ := feedFrags(t, 100, 1, []fragStep{
+		{0, 16, true, STOLEN},
+		{16, 16, true, STOLEN},
+		{32, 5, false, ACCEPT},
+	})
+	checkOffsets(t, head, 0, 16, 32)
+	st := ft.getStats()
+	if st.Reassembled != 1 || st.Queues != 0 || st.Bytes != 0 {
+		t.Fatalf("stats %+v", st)
+	}
+	releaseFragChain(head)
+}
+
+func TestFragOutOfOrder(t *testing.T) {
+	defer SetFragConfig(FragConfig{})
+	ft := fragTestZone(t, 101, FragConfig{})
+	head, _ := feedFrags(t, 101, 1, []fragStep{
+		{32, 5, false, STOLEN},
+		{0, 16, true, STOLEN},
+		{16, 16, true, ACCEPT},
+	})
+	checkOffsets(t, head, 0, 16, 32)
+	if st := ft.getStats(); st.Reassembled != 1 {
+		t.Fatalf("stats %+v", st)
+	}
+	releaseFragChain(head)
+}
+
+func TestFragDuplicate(t *testing.T) {
+	defer SetFragConfig(FragConfig{})
+	ft := fragTestZone(t, 102, FragConfig{})
+	head, _ := feedFrags(t, 102, 1, []fragStep{
+		{0, 16, true, STOLEN},
+		{0, 16, true, DROP},
+		{16, 8, false, ACCEPT},
+	})
+	checkOffsets(t, head, 0, 16)
+	if st := ft.getStats(); st.Dropped != 1 || st.Overlaps != 0 || st.Reassembled != 1 {
+		t.Fatalf("stats %+v", st)
+	}
+	releaseFragChain(head)
+}
+
+func TestFragOverlapDrop(t *testing.T) {
+	defer SetFragConfig(FragConfig{})
+	ft := fragTestZone(t, 103, FragConfig{Overlap: FragOverlapDrop})
+	_, pkbs := feedFrags(t, 103, 1, []fragStep{
+		{0, 16, true, STOLEN},
+		{8, 16, true, DROP},
+		//the datagram is dropped, so this one starts a new queue
+		{16, 8, false, STOLEN},
+	})
+	st := ft.getStats()
+	if st.Overlaps != 1 || st.Queues != 1 || st.Bytes != int(pkbs[2].GetDataLen()) {
+		t.Fatalf("stats %+v", st)
+	}
+	//the queue doesn't hold the first fragment any more
+	if ref := pkbs[0].ReleasePktBuf(); ref != 0 {
+		t.Fatalf("ref of the dropped fragment %d", ref)
+	}
+}
+
+func TestFragOverlapFirst(t *testing.T) {
+	defer SetFragConfig(FragConfig{})
+	ft := fragTestZone(t, 104, FragConfig{Overlap: FragOverlapFirst})
+	head, _ := feedFrags(t, 104, 1, []fragStep{
+		{0, 16, true, STOLEN},
+		{8, 16, true, DROP},
+		{24, 8, false, STOLEN},
+		{16, 8, true, ACCEPT},
+	})
+	checkOffsets(t, head, 0, 16, 24)
+	if st := ft.getStats(); st.Overlaps != 1 || st.Reassembled != 1 {
+		t.Fatalf("stats %+v", st)
+	}
+	releaseFragChain(head)
+}
+
+func TestFragInvalidLength(t *testing.T) {
+	defer SetFragConfig(FragConfig{})
+	ft := fragTestZone(t, 105, FragConfig{})
+	feedFrags(t, 105, 1, []fragStep{
+		{16, 8, false, STOLEN},
+		//past the end of the datagram
+		{24, 8, true, DROP},
+	})
+	feedFrags(t, 105, 2, []fragStep{
+		{65512, 16, true, DROP},
+	})
+	if st := ft.getStats(); st.Overlaps != 1 || st.Dropped != 1 || st.Queues != 0 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestFragMaxQueues(t *testing.T) {
+	defer SetFragConfig(FragConfig{})
+	ft := fragTestZone(t, 106, FragConfig{MaxQueues: 2})
+	for id := uint16(1); id <= 3; id++ {
+		feedFrags(t, 106, id, []fragStep{{0, 16, true, STOLEN}})
+	}
+	st := ft.getStats()
+	if st.Queues != 2 || st.Evicted != 1 {
+		t.Fatalf("stats %+v", st)
+	}
+	//the oldest one is evicted, its last fragment starts a new queue
+	feedFrags(t, 106, 1, []fragStep{{16, 8, false, STOLEN}})
+	head, _ := feedFrags(t, 106, 3, []fragStep{{16, 8, false, ACCEPT}})
+	checkOffsets(t, head, 0, 16)
+	releaseFragChain(head)
+}
+
+func TestFragMaxBytes(t *testing.T) {
+	defer SetFragConfig(FragConfig{})
+	size := packet.EtherSize + IPv4MinimumSize + 16
+	ft := fragTestZone(t, 107, FragConfig{MaxBytes: 2 * size})
+	feedFrags(t, 107, 1, []fragStep{{0, 16, true, STOLEN}})
+	feedFrags(t, 107, 2, []fragStep{{0, 16, true, STOLEN}})
+	feedFrags(t, 107, 3, []fragStep{{0, 16, true, STOLEN}})
+	st := ft.getStats()
+	if st.Queues != 2 || st.Bytes != 2*size || st.Evicted != 1 {
+		t.Fatalf("stats %+v", st)
+	}
+	//the others are evicted first, then a datagram larger than the limit
+	//is dropped
+	feedFrags(t, 107, 3, []fragStep{{16, 16, true, STOLEN}})
+	feedFrags(t, 107, 3, []fragStep{{32, 16, true, DROP}})
+	st = ft.getStats()
+	if st.Queues != 0 || st.Bytes != 0 || st.Evicted != 3 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestFragTimeout(t *testing.T) {
+	defer SetFragConfig(FragConfig{})
+	ft := fragTestZone(t, 108, FragConfig{Timeout: 1})
+	_, pkbs := feedFrags(t, 108, 1, []fragStep{{0, 16, true, STOLEN}})
+	deadline := time.Now().Add(3 * time.Second)
+	for ft.getStats().Timeouts == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no timeout, stats %+v", ft.getStats())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if st := ft.getStats(); st.Queues != 0 || st.Bytes != 0 {
+		t.Fatalf("stats %+v", st)
+	}
+	if ref := pkbs[0].ReleasePktBuf(); ref != 0 {
+		t.Fatalf("ref of the timeout fragment %d", ref)
+	}
+}
@@ -0,0 +1,241 @@
+package nat
+
+import (
+	"encoding/binary"
+	"mylog"
+	"packet"
+	"time"
+	"timer"
+	"unsafe"
+)
+
+const (
+	icmpType     = 0
+	icmpCode     = 1
+	icmpChecksum = 2
+	icmpIdent    = 4
+	icmpSeq      = 6
+
+	// ICMPMinimumSize is the size of the header of echo and error messages.
+	ICMPMinimumSize = 8
+
+	ICMPEchoReply       = 0
+	ICMPDestUnreachable = 3
+	ICMPSourceQuench    = 4
+	ICMPEchoRequest     = 8
+	ICMPTimeExceeded    = 11
+	ICMPParamProblem    = 12
+)
+
+// ICMP represents an ICMP header stored in a byte array.
+type ICMP []byte
+
+// Type returns the "type" field of the icmp header.
+func (b ICMP) Type() uint8 {
+	return b[icmpType]
+}
+
+// Code returns the "code" field of the icmp header.
+func (b ICMP) Code() uint8 {
+	return b[icmpCode]
+}
+
+// Checksum returns the "checksum" field of the icmp header.
+func (b ICMP) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[icmpChecksum:])
+}
+
+// SetChecksum sets the "checksum" field of the icmp header.
+func (b ICMP) SetChecksum(checksum uint16) {
+	binary.BigEndian.PutUint16(b[icmpChecksum:], checksum)
+}
+
+// Ident returns the "identifier" field of an echo request or reply.
+func (b ICMP) Ident() uint16 {
+	return binary.BigEndian.Uint16(b[icmpIdent:])
+}
+
+// natIdent sets the identifier of an echo, the icmp checksum has no pseudo
+// header, so only the identifier is updated.
+func (b ICMP) natIdent(id uint16) {
+	old := b[icmpIdent : icmpIdent+2]
+	var newId [2]byte
+	binary.BigEndian.PutUint16(newId[:], id)
+	if old[0] == newId[0] && old[1] == newId[1] {
+		return
+	}
+	xsum := ChecksumUpdate(b.Checksum(), old, newId[:])
+	copy(old, newId[:])
+	b.SetChecksum(xsum)
+}
+
+func (b ICMP) isEcho() (echo bool, request bool) {
+	switch b.Type() {
+	case ICMPEchoRequest:
+		return true, true
+	case ICMPEchoReply:
+		return true, false
+	}
+	return false, false
+}
+
+// isError reports whether b embeds the header of the packet causing it
+func (b ICMP) isError() bool {
+	switch b.Type() {
+	case ICMPDestUnreachable, ICMPSourceQuench, ICMPTimeExceeded, ICMPParamProblem:
+		return true
+	}
+	return false
+}
+
+// echoTuple returns the tuple of an echo, the identifier is the sport of a
+// request and the dport of a reply, so both of them find the same conntrack.
+func echoTuple(saddr, daddr uint32, id uint16, request bool) ctTuple {
+	if request {
+		return ctTuple{saddr, daddr, id, 0, uint8(ICMPProtocolNumber)}
+	}
+	return ctTuple{saddr, daddr, 0, id, uint8(ICMPProtocolNumber)}
+}
+
+// icmpHandler translates the echo like udp, the identifier is the port; the
+// errors of a nat connection are translated by icmpErrorHandler.
+func icmpHandler(pkb *packet.PktBuf) int {
+	icmpHeader := ICMP(pkb.LoadTransportData())
+	if icmpHeader.isError() {
+		return icmpErrorHandler(pkb)
+	}
+	echo, request := icmpHeader.isEcho()
+	if !echo {
+		return ACCEPT
+	}
+
+	pktLen := uint64(pkb.GetDataLen())
+	ipHeader := IPv4(pkb.LoadNetworkData())
+	tuple := echoTuple(ipHeader.SourceAddress(), ipHeader.DestinationAddress(), icmpHeader.Ident(), request)
+	zone := pkb.GetPktVid()
+	nct, ok := GetNctByZone(zone)
+	if !ok {
+		return DROP
+	}
+
+	ct, ok := nct.findConntrack(tuple)
+	if !ok {
+		if !request {
+			return ACCEPT
+		}
+		ct, _ = nct.CreateConntrack(tuple)
+		if !setupNat(ct) {
+			return ACCEPT
+		}
+		pkb.SetCt((unsafe.Pointer)(ct))
+		pkb.SetDir(ctOrigin)
+		//ct isn't seen by the others until getUniqueTuple confirms it, the
+		//reply of another goroutine may stop its timer right after
+		ct.stats[ctOrigin] += pktLen
+		ct.timer = timer.NewTimerFunc(time.Second*CT_ICMP_TIMEOUT, ctTimeoutDel, ct)
+		if !getUniqueTuple(pkb) {
+			ct.timer.Stop()
+			return DROP
+		}
+		doNat(pkb)
+		return ACCEPT
+	}
+
+	dir := ct.Dir(tuple)
+	pkb.SetCt((unsafe.Pointer)(ct))
+	pkb.SetDir(dir)
+	doNat(pkb)
+	ct.Lock()
+	defer ct.Unlock()
+	ct.stats[dir] += pktLen
+	if ct.status == CT_ESTABLISHED || ct.status == CT_DEL {
+		return ACCEPT
+	}
+	if dir == ctReply {
+		if ct.timer.Stop() {
+			ct.status = CT_ESTABLISHED
+			ct.timer = timer.NewTimerFunc(time.Second*CT_ICMP_TIMEOUT, ctESTABLISHEDTimeout, ct, ct.stats)
+		}
+	}
+	return ACCEPT
+}
+
+// innerTuple returns the tuple of the header embedded in an icmp error,
+// only the first 8 bytes of its transport header are sure to be there.
+func innerTuple(inner IPv4) (ctTuple, bool) {
+	if len(inner) < IPv4MinimumSize || !inner.IsIPv4() || inner.HeaderLength() < IPv4MinimumSize ||
+		len(inner) < int(inner.HeaderLength())+ICMPMinimumSize || inner.FragmentOffset() != 0 {
+		return ctTuple{}, false
+	}
+	l4 := inner[inner.HeaderLength():]
+	saddr, daddr := inner.SourceAddress(), inner.DestinationAddress()
+	switch transportProtoNum(inner.Protocol()) {
+	case TCPProtocolNumber, UDPProtocolNumber:
+		sport := binary.BigEndian.Uint16(l4[0:])
+		dport := binary.BigEndian.Uint16(l4[2:])
+		return ctTuple{saddr, daddr, sport, dport, inner.Protocol()}, true
+	case ICMPProtocolNumber:
+		if echo, request := ICMP(l4).isEcho(); echo {
+			return echoTuple(saddr, daddr, ICMP(l4).Ident(), request), true
+		}
+	}
+	return ctTuple{}, false
+}
+
+// icmpErrorHandler translates an icmp error about a nat connection. The
+// embedded packet went in one dir after nat, it is restored to the tuple
+// before nat; the error goes in the other dir, its outer addresses are
+// translated like the packets of that dir.
+func icmpErrorHandler(pkb *packet.PktBuf) int {
+	if pkb.Next() != nil {
+		//an icmp error is small, it is never fragmented by a sane router
+		return ACCEPT
+	}
+	ipHeader := IPv4(pkb.LoadNetworkData())
+	icmpHeader := ICMP(pkb.LoadTransportData()[:ipHeader.TotalLength()-uint16(ipHeader.HeaderLength())])
+	inner := IPv4(icmpHeader[ICMPMinimumSize:])
+	it, ok := innerTuple(inner)
+	if !ok {
+		return ACCEPT
+	}
+	nct, ok := GetNctByZone(pkb.GetPktVid())
+	if !ok {
+		return DROP
+	}
+	ct, ok := nct.findConntrack(invert(it))
+	if !ok || ct.natFlag == 0 {
+		return ACCEPT
+	}
+	dir := ct.Dir(invert(it))
+	innerTarget := ct.tuple[rDir(dir)]
+	target := invert(innerTarget)
+
+	//the outer source is kept, unless it is the translated peer itself
+	outer := target
+	outer.saddr = ipHeader.SourceAddress()
+	if outer.saddr == ct.tuple[dir].saddr {
+		outer.saddr = target.saddr
+	}
+	natAddrs(ipHeader, outer)
+
+	oldAddrs, newAddrs := natAddrs(inner, innerTarget)
+	l4 := inner[inner.HeaderLength():]
+	switch transportProtoNum(innerTarget.proto) {
+	case TCPProtocolNumber:
+		natPorts(l4, tcpChecksum, false, oldAddrs, newAddrs, innerTarget)
+	case UDPProtocolNumber:
+		natPorts(l4, udpChecksum, true, oldAddrs, newAddrs, innerTarget)
+	case ICMPProtocolNumber:
+		if _, request := ICMP(l4).isEcho(); request {
+			ICMP(l4).natIdent(innerTarget.sport)
+		} else {
+			ICMP(l4).natIdent(innerTarget.dport)
+		}
+	}
+
+	//the embedded packet is in the icmp checksum, it is small, just recalculate
+	icmpHeader.SetChecksum(0)
+	icmpHeader.SetChecksum(^Checksum(icmpHeader, 0))
+	mylog.Debug("icmp error type=%d of %s, translated to %s\n", icmpHeader.Type(), it.String(), innerTarget.String())
+	return ACCEPT
+}
@@ -27,6 +27,8 @@ func ctProtoString(p uint8) string {
 		return "TCP"
 	case 17:
 		return "UDP"
+	case 1:
+		return "ICMP"
 	default:
 		return "unknown"
 	}
@@ -53,7 +55,11 @@ func (t ctTuple) String() string {
 }
 
 func (ct *conntrack) String() string {
-	return fmt.Sprintf("status:%s origin:%s(bytes:%d), reply:%s(bytes:%d),outBound=%v, netZone=%d", ctStatusString(ct.status),
+	status := ctStatusString(ct.status)
+	if transportProtoNum(ct.tuple[ctOrigin].proto) == TCPProtocolNumber {
+		status += "(" + ct.tcp.State().String() + ")"
+	}
+	return fmt.Sprintf("status:%s origin:%s(bytes:%d), reply:%s(bytes:%d),outBound=%v, netZone=%d", status,
 		ct.tuple[ctOrigin].String(), ct.stats[ctOrigin], ct.tuple[ctReply].String(), ct.stats[ctReply], ct.outBound, ct.nct.netZone)
 }
 
@@ -2,11 +2,12 @@ package nat
 
 import (
 	"encoding/binary"
-	"fmt"
 	"log"
 	"mylog"
 	"net"
 	"packet"
+	"sync/atomic"
+	"tcpstate"
 	"time"
 	"timer"
 	"unsafe"
@@ -18,6 +19,11 @@ const (
 	STOLEN = 2
 )
 
+const (
+	snatPortMin = 1024
+	snatPortNum = 65536 - snatPortMin
+)
+
 var snatEnable bool
 var snatIP uint32
 
@@ -123,8 +129,21 @@ func getUDPTuple(pkb *packet.PktBuf) ctTuple {
 // 	}
 // }
 
+// IsNatZone reports whether the packets of zone need DoNat
+func IsNatZone(zone uint16) bool {
+	if !snatEnable && !dnatEnabled() {
+		return false
+	}
+	_, ok := GetNctByZone(zone)
+	return ok
+}
+
+// DoNat translates the ether packet *pkb in its zone. If a fragment completes
+// a datagram, *pkb is changed to the first fragment, and the others are
+// chained by Next(), each of them is held once by nat. STOLEN means the
+// fragment is held by nat until the datagram completes.
 func DoNat(pkb **packet.PktBuf) int {
-	if snatIP == 0 {
+	if !snatEnable && !dnatEnabled() {
 		return ACCEPT
 	}
 	return etherPktHandle(pkb)
@@ -133,11 +152,14 @@ func DoNat(pkb **packet.PktBuf) int {
 func etherPktHandle(ppkb **packet.PktBuf) int {
 	pkb := *ppkb
 	etherData := pkb.LoadUserData()
+	if len(etherData) < packet.EtherSize {
+		return DROP
+	}
 	etherHeader := packet.TranEther(etherData)
 	handler, ok := networkProtos[networkProtoNum(etherHeader.GetProto())]
 	if !ok {
-		//TODO
-		return DROP
+		//only ipv4 is translated, the others pass through
+		return ACCEPT
 	}
 	pkb.SetNetworkHeader(packet.EtherSize)
 	return handler.handle(ppkb)
@@ -149,95 +171,185 @@ func arpHandler(pkb **packet.PktBuf) int {
 
 func ipHandler(ppkb **packet.PktBuf) int {
 	pkb := *ppkb
+	if pkb.NetworkDataLen() < IPv4MinimumSize {
+		return DROP
+	}
 	ipHeader := IPv4(pkb.LoadNetworkData())
 	if !ipHeader.IsIPv4() {
 		return DROP
 	}
+	//the ether frame may be padded
+	if ipHeader.HeaderLength() < IPv4MinimumSize || pkb.NetworkDataLen() < ipHeader.TotalLength() {
+		return DROP
+	}
 	offset := ipHeader.FragmentOffset()
 	more := (ipHeader.Flags() & IPv4FlagMoreFragments) != 0
-	log.Printf("more:%v\n", more)
 	if offset != 0 || more {
-		log.Printf("=========Fragment FragmentOffset FragmentOffset============\n")
-		// ipHeader.SetSourceAddress(snatIP) //ct.tuple[rdir].daddr
-		// ipHeader.SetChecksum(0)
-		// ipHeader.SetChecksum(^ipHeader.CalculateChecksum())
-		if pkb.NetworkDataLen() != ipHeader.TotalLength() {
-			log.Panicf("pkb.NetworkDataLen() =%d, ipHeader.TotalLength()=%d\n", pkb.NetworkDataLen(), ipHeader.TotalLength())
-		}
+		mylog.Debug("fragment offset=%d, more=%v\n", offset, more)
 		ipDataLen := ipHeader.TotalLength() - uint16(ipHeader.HeaderLength())
 
 		zone := pkb.GetPktVid()
 		nct, ok := GetNctByZone(zone)
 		if !ok {
-			fmt.Println("GetNctByZone fail, zone=%d\n", zone)
+			mylog.Error("GetNctByZone fail, zone=%d\n", zone)
 			return DROP
 		}
 		fc := fragInfo{sip: ipHeader.SourceAddress(), dip: ipHeader.DestinationAddress(), id: ipHeader.ID(), proto: ipHeader.Protocol()}
-		fq, ok := nct.fragQueueFind(fc)
-		if !ok {
-			//frag := createFragment(offset, ipDataLen, pkb)
-			fq = newfragQueue()
-			nct.fragQueueAdd(fc, fq)
-		}
-		ok, done := fq.ProcessFragment(offset, ipDataLen, more, pkb)
-		if !ok {
-			//overlapped ? TODO: delete fq
-			return DROP
-		}
-		//in the fraqueue, so hold
-		pkb.HoldPktBuf()
-
-		if !done {
-			return STOLEN
+		head, verdict := nct.fragTables.process(fc, int(offset), int(ipDataLen), more, pkb)
+		if verdict != ACCEPT {
+			return verdict
 		}
 		//done ,defrag completed, return head
-		*ppkb = fq.completed()
+		*ppkb = head
 		pkb = *ppkb
+		ipHeader = IPv4(pkb.LoadNetworkData())
 	}
 	handler, ok := transportProtos[transportProtoNum(ipHeader.Protocol())]
 	if !ok {
-		if pkb.Next() != nil { //frag_liist
-			for p := pkb; p != nil; {
-				dropPkb := p
-				p = p.Next()
-				dropPkb.PutPktToPool()
-			}
+		return ACCEPT
+	}
+	if ipHeader.TotalLength() < uint16(ipHeader.HeaderLength())+transportMinSize(transportProtoNum(ipHeader.Protocol())) {
+		if pkb.Next() != nil {
+			releaseFragChain(pkb)
 		}
 		return DROP
 	}
 	pkb.SetTransportHeader(int(ipHeader.HeaderLength()))
-	return handler.handle(pkb)
+	verdict := handler.handle(pkb)
+	if verdict == DROP && pkb.Next() != nil {
+		releaseFragChain(pkb)
+	}
+	return verdict
 }
 
-func icmpHandler(pkb *packet.PktBuf) int {
-	return ACCEPT
+func transportMinSize(proto transportProtoNum) uint16 {
+	switch proto {
+	case TCPProtocolNumber:
+		return TCPMinimumSize
+	case UDPProtocolNumber:
+		return UDPMinimumSize
+	case ICMPProtocolNumber:
+		return ICMPMinimumSize
+	}
+	return 0
+}
+
+// tcpSegLen returns the length of the tcp segment of pkb by its ip header
+func tcpSegLen(pkb *packet.PktBuf) int {
+	ipHeader := IPv4(pkb.LoadNetworkData())
+	return int(ipHeader.TotalLength()) - int(ipHeader.HeaderLength())
 }
+
+// tcpHandler tracks the tcp connection like netstat does, a syn creates the
+// conntrack and allocates the snat port, every packet of it is translated
+// until the conntrack times out in its state.
 func tcpHandler(pkb *packet.PktBuf) int {
-	log.Printf("unsuport tcp for now")
+	pktLen := uint64(pkb.GetDataLen())
+	tuple := getTCPTuple(pkb)
+	zone := pkb.GetPktVid()
+	nct, ok := GetNctByZone(zone)
+	if !ok {
+		mylog.Error("GetNctByZone fail, zone=%d\n", zone)
+		return DROP
+	}
+
+	seg, ok := tcpstate.ParseSegment(pkb.LoadTransportData(), tcpSegLen(pkb))
+	if !ok {
+		mylog.Debug("bad tcp header, tuple:%s\n", tuple.String())
+		return DROP
+	}
+	ct, ok := nct.findConntrack(tuple)
+	if ok && IsSyn(seg.Flags) && ct.status == CT_DEL && ct.Dir(tuple) == ctOrigin {
+		//the port is reused by a new connection, the old one is finished
+		ct.Lock()
+		if ct.timer != nil {
+			ct.timer.Stop()
+		}
+		ct.Unlock()
+		nct.delConntrack(ct)
+		ok = false
+	}
+
+	//SYN-SENT
+	if !ok {
+		if !IsSyn(seg.Flags) {
+			//it isn't a connection started after nat, leave it alone
+			mylog.Debug("can't find tuple:%s, zone=%d, and pkb is not syn\n", tuple.String(), zone)
+			return ACCEPT
+		}
+		mylog.Debug("SYN-SENT: syn packet,tuple:%s\n", tuple.String())
+		ct, _ = nct.CreateConntrack(tuple)
+		if !setupNat(ct) {
+			return ACCEPT
+		}
+		pkb.SetCt((unsafe.Pointer)(ct))
+		pkb.SetDir(ctOrigin)
+		if !getUniqueTuple(pkb) {
+			mylog.Error("getUniqueTuple fail, tuple:%s\n", tuple.String())
+			return DROP
+		}
+		doNat(pkb)
+		tcpStateUpdate(ct, ctOrigin, &seg, pktLen)
+		return ACCEPT
+	}
+
+	dir := ct.Dir(tuple)
+	pkb.SetCt((unsafe.Pointer)(ct))
+	pkb.SetDir(dir)
+	doNat(pkb)
+	tcpStateUpdate(ct, dir, &seg, pktLen)
 	return ACCEPT
 }
 
+// tcpStateUpdate counts the pktLen bytes of dir, moves ct by the segment seg,
+// and resets its timer to the timeout of the new state. The segments which
+// are invalid for the state or out of the window are still translated, but
+// don't move ct.
+func tcpStateUpdate(ct *conntrack, dir int, seg *tcpstate.Segment, pktLen uint64) {
+	ct.Lock()
+	defer ct.Unlock()
+	ct.stats[dir] += pktLen
+	if ct.status == CT_DEL {
+		return
+	}
+
+	old := ct.tcp.State()
+	state, res := ct.tcp.Update(dir, seg)
+	if res == tcpstate.Invalid {
+		mylog.Debug("invalid tcp packet in %s, flags=%#x, tuple=%s\n", old, seg.Flags, ct.tuple[dir].String())
+		return
+	}
+	if state != old {
+		mylog.Debug("tcp %s -> %s, tuple=%s\n", old, state, ct.tuple[dir].String())
+	}
+	//the established one is checked lazily by ctESTABLISHEDTimeout
+	if state != old || state != tcpstate.Established {
+		ct.tcpStateTimer(state)
+	}
+}
+
 func udpHandler(pkb *packet.PktBuf) int {
 	pktLen := uint64(pkb.GetDataLen())
-	fmt.Printf("-----------------udp udp ----------\n")
 	tuple := getUDPTuple(pkb)
 	zone := pkb.GetPktVid()
 	nct, ok := GetNctByZone(zone)
 	if !ok {
-		fmt.Println("GetNctByZone fail, zone=%d\n", zone)
+		mylog.Error("GetNctByZone fail, zone=%d\n", zone)
 		return DROP
 	}
 
 	ct, ok := nct.findConntrack(tuple)
 	if !ok {
 		ct, _ = nct.CreateConntrack(tuple)
+		if !setupNat(ct) {
+			return ACCEPT
+		}
 		pkb.SetCt((unsafe.Pointer)(ct))
-		//if pkb.TryNat() {
+		pkb.SetDir(ctOrigin)
 		if !getUniqueTuple(pkb) {
-			log.Panic("getUniqueTuple fail")
+			mylog.Error("getUniqueTuple fail, tuple:%s\n", tuple.String())
 			return DROP
 		}
-		//}
 		doNat(pkb)
 
 		ct.stats[ctOrigin] += pktLen
@@ -273,6 +385,11 @@ func rDir(dir int) (rdir int) {
 	}
 	return
 }
+
+// doNat rewrites pkb to the tuple the other side expects: the packet of dir
+// leaves with the inverse of the tuple of the other dir. The checksums are
+// updated incrementally, so the payload and the other fragments of the
+// datagram needn't be read again.
 func doNat(pkb *packet.PktBuf) {
 	ct := (*conntrack)(pkb.GetCt()) //ct := (*conntrack)(nil) is ok, type data
 	if ct == nil {
@@ -281,81 +398,116 @@ func doNat(pkb *packet.PktBuf) {
 	if ct.natFlag == 0 {
 		return
 	}
-	var doSnat bool
 	dir := pkb.GetDir()
-	rdir := rDir(dir)
-	if ct.natFlag == snatFlag {
-		if dir == ctOrigin {
-			doSnat = true
+	target := invert(ct.tuple[rDir(dir)])
+
+	ipHeader := IPv4(pkb.LoadNetworkData())
+	oldAddrs, newAddrs := natAddrs(ipHeader, target)
+	switch transportProtoNum(ct.tuple[ctOrigin].proto) {
+	case TCPProtocolNumber:
+		natPorts(TCP(pkb.LoadTransportData()), tcpChecksum, false, oldAddrs, newAddrs, target)
+	case UDPProtocolNumber:
+		natPorts(pkb.LoadTransportData(), udpChecksum, true, oldAddrs, newAddrs, target)
+	case ICMPProtocolNumber:
+		icmpHeader := ICMP(pkb.LoadTransportData())
+		if _, request := icmpHeader.isEcho(); request {
+			icmpHeader.natIdent(target.sport)
+		} else {
+			icmpHeader.natIdent(target.dport)
 		}
-	} else {
+	}
+
+	for npkb := pkb.Next(); npkb != nil; npkb = npkb.Next() {
+		natAddrs(IPv4(npkb.LoadNetworkData()), target)
+	}
+	mylog.Debug("nat dir=%d, %s -> %s\n", dir, ct.tuple[dir].String(), target.String())
+}
+
+// natAddrs rewrites the addresses of ipHeader to the ones of target, the old
+// and new addresses are returned for the pseudo header checksum.
+func natAddrs(ipHeader IPv4, target ctTuple) (oldAddrs, newAddrs [8]byte) {
+	copy(oldAddrs[:], ipHeader[srcAddr:srcAddr+8])
+	binary.BigEndian.PutUint32(newAddrs[0:], target.saddr)
+	binary.BigEndian.PutUint32(newAddrs[4:], target.daddr)
+	if oldAddrs != newAddrs {
+		copy(ipHeader[srcAddr:srcAddr+8], newAddrs[:])
+		ipHeader.SetChecksum(ChecksumUpdate(ipHeader.Checksum(), oldAddrs[:], newAddrs[:]))
+	}
+	return
+}
+
+// natPorts rewrites the ports of a tcp or udp header to the ones of target,
+// the checksum at xsumOff covers the pseudo header, so the addresses too.
+// A zero udp checksum means the sender doesn't use it.
+func natPorts(transportHeader []byte, xsumOff int, isUdp bool, oldAddrs, newAddrs [8]byte, target ctTuple) {
+	var oldField, newField [12]byte
+	copy(oldField[:8], oldAddrs[:])
+	copy(oldField[8:], transportHeader[:4])
+	copy(newField[:8], newAddrs[:])
+	binary.BigEndian.PutUint16(newField[8:], target.sport)
+	binary.BigEndian.PutUint16(newField[10:], target.dport)
+	if oldField == newField {
 		return
 	}
-	if ct.tuple[ctOrigin].proto == uint8(UDPProtocolNumber) {
-		ipHeader := IPv4(pkb.LoadNetworkData())
-		length := ipHeader.TotalLength() - uint16(ipHeader.HeaderLength())
-
-		// if flag := ipHeader.Flags(); flag&IPv4FlagMoreFragments != 0 {
-		// 	//save sip, dip , id -->ct
-		// 	fc := fragInfo{sip: ipHeader.SetSourceAddress(), dip: ipHeader.DestinationAddress(), id: ipHeader.ID(), proto: ipHeader.Protocol()}
-		// 	ct.nct.fragMapAdd(fc, ct)
-		// }
-
-		udpheader := UDP(pkb.LoadTransportData())
-		if doSnat {
-			ipHeader.SetSourceAddress(ct.tuple[rdir].daddr)
-
-			if ct.tuple[dir].sport != ct.tuple[rdir].dport {
-				udpheader.SetSourcePort(ct.tuple[rdir].dport)
-			}
-			log.Printf("do snat, change sip %s, sport %d \n", ipString(ct.tuple[rdir].daddr), ct.tuple[rdir].dport)
-		} else { //dnat
-			ipHeader.SetDestinationAddress(ct.tuple[rdir].saddr)
-			udpheader.SetDestinationPort(ct.tuple[rdir].sport)
-		}
-		ipHeader.SetChecksum(0)
-		ipHeader.SetChecksum(^ipHeader.CalculateChecksum())
-		udpheader.SetChecksum(0)
-		xsum := PseudoHeaderChecksum(uint8(UDPProtocolNumber), ipHeader.SourceAddrBuf(), ipHeader.DestinationAddrBuf())
-		xsum = udpheader.CalculateChecksum(xsum, length)
-		xsum = udpheader.CalChecksum(xsum, length)
-		log.Printf("--------------udp.Length()=%d-------------\n", udpheader.Length())
-
-		i := 0
-		for npkb := pkb.Next(); npkb != nil; npkb = npkb.Next() {
-			i++
-			log.Printf("frag Checksum i=%d\n", i)
-			ipHeader = IPv4(npkb.LoadNetworkData())
-			ipHeader.SetSourceAddress(ct.tuple[rdir].daddr)
-			ipHeader.SetChecksum(0)
-			ipHeader.SetChecksum(^ipHeader.CalculateChecksum())
-			npkb.SetTransportHeader(int(ipHeader.HeaderLength()))
-
-			xsum = Checksum(npkb.LoadTransportData(), xsum)
-			log.Printf(" finish frag Checksum i=%d\n", i)
-		}
+	copy(transportHeader[:4], newField[8:])
+	if len(transportHeader) < xsumOff+2 {
+		//the header embedded in an icmp error may be truncated
+		return
+	}
+	xsum := binary.BigEndian.Uint16(transportHeader[xsumOff:])
+	if isUdp && xsum == 0 {
+		return
+	}
+	xsum = ChecksumUpdate(xsum, oldField[:], newField[:])
+	if isUdp && xsum == 0 {
+		xsum = 0xffff
+	}
+	binary.BigEndian.PutUint16(transportHeader[xsumOff:], xsum)
+}
 
-		//udpheader.SetChecksum(^xsum)
-		udpheader.SetChecksum(0)
+// setupNat decides the nat of a new conntrack: dnat by the rules of its zone,
+// then snat if it is enabled; the reply tuple is what the packets of the
+// reply dir look like. It returns false if ct needn't nat.
+func setupNat(ct *conntrack) bool {
+	origin := ct.tuple[ctOrigin]
+	if rule, ok := lookupDnatRule(ct.nct.netZone, origin); ok {
+		ct.tuple[ctReply].saddr = rule.toIP
+		ct.tuple[ctReply].sport = rule.toPort
+		ct.natFlag |= dnatFlag
+		atomic.AddUint64(&rule.hits, 1)
+	}
+	if snatEnable && snatIP != 0 {
+		ct.tuple[ctReply].daddr = snatIP
+		ct.natFlag |= snatFlag
 	}
+	return ct.natFlag != 0
 }
 
+// getUniqueTuple allocates the snat port: the reply tuple to snatIP must not
+// be used by another conntrack, the port of the origin is tried first.
 func getUniqueTuple(pkb *packet.PktBuf) bool {
 	ct := (*conntrack)(pkb.GetCt()) //ct := (*conntrack)(nil) is ok, type data
 	if ct == nil {
 		log.Panic("ct == nil")
 	}
 	replyTuple := &ct.tuple[ctReply]
-	replyTuple.daddr = snatIP
-	for {
-		_, ok := ct.nct.findConntrack(*replyTuple)
-		if !ok {
-			ct.natFlag = snatFlag
-			log.Printf("getUniqueTuple ok,origin:%s, reply:%s\n", ct.tuple[ctOrigin].String(), ct.tuple[ctReply].String())
-			ct.ctConfirm()
-			log.Printf("all ct: %v\n", ShowConntrack())
+	if ct.natFlag&snatFlag == 0 {
+		//dnat only, the port of the origin is kept
+		return ct.ctConfirm()
+	}
+	for i := 0; i < snatPortNum; i++ {
+		if replyTuple.dport < snatPortMin {
+			replyTuple.dport = snatPortMin
+		}
+		//the port is checked and taken under one lock, another flow can't take it too
+		if ct.ctConfirm() {
+			mylog.Debug("getUniqueTuple ok,origin:%s, reply:%s\n", ct.tuple[ctOrigin].String(), ct.tuple[ctReply].String())
 			return true
 		}
+		if _, ok := ct.nct.findConntrack(ct.tuple[ctOrigin]); ok {
+			//the same flow is confirmed by another packet
+			return false
+		}
 		replyTuple.dport++
 	}
 	return false
@@ -3,6 +3,7 @@ package netstat
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"strconv"
 )
 
@@ -27,13 +28,17 @@ func ctProtoString(p uint8) string {
 		return "TCP"
 	case 17:
 		return "UDP"
+	case 1:
+		return "ICMP"
+	case 58:
+		return "ICMPv6"
 	default:
 		return "unknown"
 	}
 }
 
-func ipString(ipaddr uint32) string {
-	return fmt.Sprintf("%d.%d.%d.%d", byte(ipaddr>>24), byte(ipaddr>>16), byte(ipaddr>>8), byte(ipaddr))
+func ipString(ipaddr ipAddr) string {
+	return net.IP(ipaddr[:]).String()
 }
 
 func (t ctTuple) String() string {
@@ -53,7 +58,11 @@ func (t ctTuple) String() string {
 }
 
 func (ct *conntrack) String() string {
-	return fmt.Sprintf("status:%s origin:%s(bytes:%d), reply:%s(bytes:%d),outBound=%v, netZone=%d", ctStatusString(ct.status),
+	status := ctStatusString(ct.status)
+	if transportProtoNum(ct.tuple[ctOrigin].proto) == TCPProtocolNumber {
+		status += "(" + ct.tcp.State().String() + ")"
+	}
+	return fmt.Sprintf("status:%s origin:%s(bytes:%d), reply:%s(bytes:%d),outBound=%v, netZone=%d", status,
 		ct.tuple[ctOrigin].String(), ct.stats[ctOrigin], ct.tuple[ctReply].String(), ct.stats[ctReply], ct.outBound, ct.nct.netZone)
 }
 
@@ -78,3 +87,17 @@ func ShowConntrack() map[uint16]map[uint32]string {
 	}
 	return conntrackInfo
 }
+
+// ConntrackCounts returns the number of conntracks of every zone
+func ConntrackCounts() map[uint16]int {
+	counts := make(map[uint16]int)
+	globalCtLock.RLock()
+	defer globalCtLock.RUnlock()
+	for zone, nct := range globalConntrack {
+		nct.RLock()
+		//every conntrack is indexed by its origin and reply tuple
+		counts[zone] = len(nct.conntracks) / 2
+		nct.RUnlock()
+	}
+	return counts
+}
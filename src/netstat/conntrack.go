@@ -4,6 +4,7 @@ import (
 	"errors"
 	"log"
 	"sync"
+	"tcpstate"
 	"time"
 	"timer"
 	"mylog"
@@ -25,18 +26,15 @@ const (
 	CT_ESTABLISHED = 2
 	CT_DEL         = 3
 
-	CT_TCP_SYN_TIMEOUT         = 3
-	CT_TCP_SYN_RCVD_TIMEOUT    = 3
-	CT_TCP_ESTABLISHED_TIMEOUT = 240 //20 test
-	CT_TCP_FIN_TIMEOUT         = 10
 	CT_DEL_TIMEOUT             = 10
 	CT_UDP_NEW_TIMEOUT         = 15
 	CT_UDP_ESTABLISHED_TIMEOUT = 120
+	CT_ICMP_TIMEOUT            = 30
 )
 
 type ctTuple struct {
-	saddr uint32
-	daddr uint32
+	saddr ipAddr
+	daddr ipAddr
 	sport uint16
 	dport uint16
 	proto uint8
@@ -52,8 +50,17 @@ type conntrack struct {
 	nct      *netConntrack
 	time     time.Time
 	lastTime time.Time //finish time
-	reported bool
+	reported bool      //the end of the flow has been exported
 	outBound bool
+
+	pkts         [ctDirMax]uint64
+	lastSeen     time.Time //time of the last packet
+	fin          bool      //ended by fin or rst, not by timeout
+	exported     [ctDirMax]uint64
+	exportedPkts [ctDirMax]uint64
+	exportTime   time.Time //the flow before it has been exported
+
+	tcp tcpstate.Tracker
 }
 
 type netConntrack struct {
@@ -143,9 +150,20 @@ func (nct *netConntrack) addConntrack(ct *conntrack) {
 
 func (nct *netConntrack) delConntrack(ct *conntrack) {
 	nct.Lock()
+	_, ok := nct.conntracks[ct.tuple[ctOrigin]]
 	delete(nct.conntracks, ct.tuple[ctOrigin])
 	delete(nct.conntracks, ct.tuple[ctReply])
 	nct.Unlock()
+	if ok {
+		flowEnd(ct)
+	}
+}
+
+// account counts a packet of dir, ct.Lock is held
+func (ct *conntrack) account(dir int, pktLen uint64) {
+	ct.stats[dir] += pktLen
+	ct.pkts[dir]++
+	ct.lastSeen = time.Now().UTC()
 }
 
 func (ct *conntrack) Dir(t ctTuple) int {
@@ -240,12 +258,48 @@ func ctESTABLISHEDTimeout(t time.Time, args ...interface{}) {
 	ct.timer = timer.NewTimerFunc(time.Second*CT_DEL_TIMEOUT, ctTimeoutDel, ct)
 }
 
+// tcpStatus returns the status of a conntrack in the tcp state, a half
+// closed connection is still established.
+func tcpStatus(state tcpstate.State) uint8 {
+	switch state {
+	case tcpstate.None, tcpstate.SynSent:
+		return CT_NEW
+	case tcpstate.SynRecv:
+		return CT_REPLY
+	case tcpstate.TimeWait, tcpstate.Close:
+		return CT_DEL
+	}
+	return CT_ESTABLISHED
+}
+
+// tcpStateTimer moves ct to state and arms its timer for the timeout of the
+// state, the caller holds ct. Nothing is changed if the timer has fired, the
+// conntrack is being deleted.
+func (ct *conntrack) tcpStateTimer(state tcpstate.State) {
+	if ct.timer != nil && !ct.timer.Stop() {
+		return
+	}
+	ct.status = tcpStatus(state)
+	timeout := tcpstate.Timeout(state)
+	if state == tcpstate.Established {
+		ct.timer = timer.NewTimerFunc(timeout, ctESTABLISHEDTimeout, ct, ct.stats)
+		return
+	}
+	if ct.status == CT_DEL {
+		ct.fin = true
+		ct.lastTime = time.Now().UTC() // record die timout time
+	}
+	ct.timer = timer.NewTimerFunc(timeout, ctTimeoutDel, ct)
+}
+
 func getProtoEstablishTimeout(p uint8) time.Duration {
 	switch transportProtoNum(p) {
 	case TCPProtocolNumber:
-		return CT_TCP_ESTABLISHED_TIMEOUT
+		return tcpstate.Timeout(tcpstate.Established) / time.Second
 	case UDPProtocolNumber:
 		return CT_UDP_ESTABLISHED_TIMEOUT
+	case ICMPProtocolNumber, ICMPv6ProtocolNumber:
+		return CT_ICMP_TIMEOUT
 	default:
 		panic("unknow proto")
 	}
@@ -0,0 +1,522 @@
+package netstat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"mylog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FlowExportIPFIX    = "ipfix"
+	FlowExportNetflow9 = "netflow9"
+
+	DefFlowActiveTimeout   = 60 //second
+	DefFlowTemplateRefresh = 60 //second
+
+	ipfixVersion        = 10
+	netflow9Version     = 9
+	ipfixHeaderLen      = 16
+	netflow9HeaderLen   = 20
+	ipfixTemplateSet    = 2
+	netflow9TemplateSet = 0
+	templateIPv4        = 256
+	templateIPv6        = 257
+	flowMsgMaxSize      = 1400 //fit in the mtu of the path to the collector
+	flowRecordQueue     = 4096
+
+	// flowEndReason of ipfix
+	flowEndIdle   = 1
+	flowEndActive = 2
+	flowEndFin    = 3
+	flowEndForced = 4
+
+	flowDirIngress = 0
+	flowDirEgress  = 1
+)
+
+// FlowExportConfig sends a record of every flow of the conntrack to
+// Collector, when it ends and every ActiveTimeout seconds while it lasts.
+type FlowExportConfig struct {
+	Enable          bool   `toml:"enable"`
+	Collector       string `toml:"collector"`       //host:port of udp
+	Protocol        string `toml:"protocol"`        //ipfix or netflow9
+	ActiveTimeout   int    `toml:"activetimeout"`   //second
+	TemplateRefresh int    `toml:"templaterefresh"` //second
+	DomainId        uint32 `toml:"domainid"`        //observation domain id, source id of netflow9
+}
+
+// FlowExportStats is what the exporter has sent
+type FlowExportStats struct {
+	Records    uint64
+	Messages   uint64
+	Dropped    uint64
+	SendErrors uint64
+}
+
+// flowRecord is the traffic of one dir of a conntrack in a period
+type flowRecord struct {
+	zone      uint16
+	tuple     ctTuple
+	direction uint8
+	octets    uint64
+	pkts      uint64
+	start     time.Time
+	end       time.Time
+	reason    uint8
+}
+
+// ieField is an information element of a template, the ids are the same in
+// ipfix and netflow9.
+type ieField struct {
+	id     uint16
+	length uint16
+}
+
+type flowExporter struct {
+	conf         FlowExportConfig
+	ipfix        bool
+	conn         net.Conn
+	records      chan flowRecord
+	quit         chan struct{}
+	done         chan struct{}
+	startTime    time.Time //sysUptime of netflow9
+	seq          uint32
+	pending      []flowRecord
+	lastTemplate time.Time
+	sendErr      bool
+}
+
+var flowExpLock sync.RWMutex
+var flowExp *flowExporter
+var flowStats FlowExportStats
+
+// SetFlowExport starts the exporter of conf, the running one is stopped
+// after it sends the records it has.
+func SetFlowExport(conf FlowExportConfig) error {
+	var fe *flowExporter
+	if conf.Enable {
+		var err error
+		if fe, err = newFlowExporter(conf); err != nil {
+			return err
+		}
+	}
+	flowExpLock.Lock()
+	old := flowExp
+	flowExp = fe
+	flowExpLock.Unlock()
+	if old != nil {
+		close(old.quit)
+		<-old.done
+	}
+	if fe != nil {
+		go fe.run()
+		if !IsEnable() {
+			mylog.Warning("flow export to %s, but netstat isn't enabled, no flow is tracked\n", conf.Collector)
+		}
+		mylog.Info("flow export: %+v\n", fe.conf)
+	}
+	return nil
+}
+
+func newFlowExporter(conf FlowExportConfig) (*flowExporter, error) {
+	switch strings.ToLower(conf.Protocol) {
+	case "", FlowExportIPFIX:
+		conf.Protocol = FlowExportIPFIX
+	case FlowExportNetflow9:
+		conf.Protocol = FlowExportNetflow9
+	default:
+		return nil, fmt.Errorf("protocol %s isn't %s or %s", conf.Protocol, FlowExportIPFIX, FlowExportNetflow9)
+	}
+	if conf.ActiveTimeout < 0 || conf.TemplateRefresh < 0 {
+		return nil, fmt.Errorf("negative timeout %+v", conf)
+	}
+	if conf.ActiveTimeout == 0 {
+		conf.ActiveTimeout = DefFlowActiveTimeout
+	}
+	if conf.TemplateRefresh == 0 {
+		conf.TemplateRefresh = DefFlowTemplateRefresh
+	}
+	conn, err := net.Dial("udp", conf.Collector)
+	if err != nil {
+		return nil, fmt.Errorf("collector %s: %s", conf.Collector, err.Error())
+	}
+	return &flowExporter{
+		conf:      conf,
+		ipfix:     conf.Protocol == FlowExportIPFIX,
+		conn:      conn,
+		records:   make(chan flowRecord, flowRecordQueue),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+		startTime: time.Now(),
+	}, nil
+}
+
+func getFlowExporter() *flowExporter {
+	flowExpLock.RLock()
+	fe := flowExp
+	flowExpLock.RUnlock()
+	return fe
+}
+
+// ShowFlowExportStats returns the counters of the exporters
+func ShowFlowExportStats() FlowExportStats {
+	return FlowExportStats{
+		Records:    atomic.LoadUint64(&flowStats.Records),
+		Messages:   atomic.LoadUint64(&flowStats.Messages),
+		Dropped:    atomic.LoadUint64(&flowStats.Dropped),
+		SendErrors: atomic.LoadUint64(&flowStats.SendErrors),
+	}
+}
+
+// direction returns the flowDirection of dir, the origin of an outBound
+// conntrack leaves by the tun.
+func (ct *conntrack) direction(dir int) uint8 {
+	if (dir == ctOrigin) == ct.outBound {
+		return flowDirEgress
+	}
+	return flowDirIngress
+}
+
+// flowRecords returns the traffic since the last export, the caller holds ct
+func (ct *conntrack) flowRecords(reason uint8, now time.Time) []flowRecord {
+	start := ct.exportTime
+	if start.IsZero() {
+		start = ct.time
+	}
+	end := ct.lastSeen
+	if end.Before(start) {
+		end = start
+	}
+	var recs []flowRecord
+	for dir := ctOrigin; dir < ctDirMax; dir++ {
+		pkts := ct.pkts[dir] - ct.exportedPkts[dir]
+		if pkts == 0 {
+			continue
+		}
+		recs = append(recs, flowRecord{
+			zone:      ct.nct.netZone,
+			tuple:     ct.tuple[dir],
+			direction: ct.direction(dir),
+			octets:    ct.stats[dir] - ct.exported[dir],
+			pkts:      pkts,
+			start:     start,
+			end:       end,
+			reason:    reason,
+		})
+		ct.exported[dir] = ct.stats[dir]
+		ct.exportedPkts[dir] = ct.pkts[dir]
+	}
+	ct.exportTime = now
+	return recs
+}
+
+// flowEnd exports the rest of the flow when ct is deleted
+func flowEnd(ct *conntrack) {
+	fe := getFlowExporter()
+	if fe == nil {
+		return
+	}
+	ct.Lock()
+	if ct.reported {
+		ct.Unlock()
+		return
+	}
+	ct.reported = true
+	reason := uint8(flowEndIdle)
+	if ct.fin {
+		reason = flowEndFin
+	}
+	recs := ct.flowRecords(reason, time.Now().UTC())
+	ct.Unlock()
+	for _, rec := range recs {
+		select {
+		case fe.records <- rec:
+		default:
+			atomic.AddUint64(&flowStats.Dropped, 1)
+		}
+	}
+}
+
+func (fe *flowExporter) run() {
+	defer close(fe.done)
+	defer fe.conn.Close()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case rec := <-fe.records:
+			fe.pending = append(fe.pending, rec)
+		case now := <-tick.C:
+			fe.activeTimeout(now.UTC())
+			fe.flush(now)
+		case <-fe.quit:
+			for len(fe.records) > 0 {
+				fe.pending = append(fe.pending, <-fe.records)
+			}
+			fe.activeTimeout(time.Time{})
+			fe.flush(time.Now())
+			return
+		}
+	}
+}
+
+// activeTimeout exports the flows which have lasted ActiveTimeout since the
+// last export, all of them are exported if now is zero, as the exporter stops.
+func (fe *flowExporter) activeTimeout(now time.Time) {
+	reason := uint8(flowEndActive)
+	if now.IsZero() {
+		now, reason = time.Now().UTC(), flowEndForced
+	}
+	timeout := time.Duration(fe.conf.ActiveTimeout) * time.Second
+	var cts []*conntrack
+	globalCtLock.RLock()
+	for _, nct := range globalConntrack {
+		nct.RLock()
+		for tuple, ct := range nct.conntracks {
+			if tuple == ct.tuple[ctOrigin] {
+				cts = append(cts, ct)
+			}
+		}
+		nct.RUnlock()
+	}
+	globalCtLock.RUnlock()
+
+	for _, ct := range cts {
+		ct.Lock()
+		last := ct.exportTime
+		if last.IsZero() {
+			last = ct.time
+		}
+		if !ct.reported && (reason == flowEndForced || now.Sub(last) >= timeout) {
+			fe.pending = append(fe.pending, ct.flowRecords(reason, now)...)
+		}
+		ct.Unlock()
+	}
+}
+
+func (fe *flowExporter) fields(v6 bool) []ieField {
+	fields := []ieField{{8, 4}, {12, 4}} //sourceIPv4Address, destinationIPv4Address
+	if v6 {
+		fields = []ieField{{27, 16}, {28, 16}}
+	}
+	//transport ports, protocolIdentifier, octetDeltaCount, packetDeltaCount
+	fields = append(fields, ieField{7, 2}, ieField{11, 2}, ieField{4, 1}, ieField{1, 8}, ieField{2, 8})
+	if fe.ipfix {
+		//flowStartMilliseconds, flowEndMilliseconds
+		fields = append(fields, ieField{152, 8}, ieField{153, 8})
+	} else {
+		//FIRST_SWITCHED, LAST_SWITCHED of sysUptime
+		fields = append(fields, ieField{22, 4}, ieField{21, 4})
+	}
+	//vlanId is the zone, flowDirection
+	fields = append(fields, ieField{58, 2}, ieField{61, 1})
+	if fe.ipfix {
+		fields = append(fields, ieField{136, 1}) //flowEndReason
+	}
+	return fields
+}
+
+func recordSize(fields []ieField) int {
+	size := 0
+	for _, f := range fields {
+		size += int(f.length)
+	}
+	return size
+}
+
+func (fe *flowExporter) uptime(t time.Time) uint32 {
+	if t.Before(fe.startTime) {
+		return 0
+	}
+	return uint32(t.Sub(fe.startTime) / time.Millisecond)
+}
+
+func (fe *flowExporter) encodeRecord(buf *bytes.Buffer, rec *flowRecord, v6 bool) {
+	var b [8]byte
+	if v6 {
+		buf.Write(rec.tuple.saddr[:])
+		buf.Write(rec.tuple.daddr[:])
+	} else {
+		buf.Write(rec.tuple.saddr[12:])
+		buf.Write(rec.tuple.daddr[12:])
+	}
+	binary.BigEndian.PutUint16(b[:], rec.tuple.sport)
+	binary.BigEndian.PutUint16(b[2:], rec.tuple.dport)
+	b[4] = rec.tuple.proto
+	buf.Write(b[:5])
+	binary.BigEndian.PutUint64(b[:], rec.octets)
+	buf.Write(b[:])
+	binary.BigEndian.PutUint64(b[:], rec.pkts)
+	buf.Write(b[:])
+	if fe.ipfix {
+		binary.BigEndian.PutUint64(b[:], uint64(rec.start.UnixNano()/int64(time.Millisecond)))
+		buf.Write(b[:])
+		binary.BigEndian.PutUint64(b[:], uint64(rec.end.UnixNano()/int64(time.Millisecond)))
+		buf.Write(b[:])
+	} else {
+		binary.BigEndian.PutUint32(b[:], fe.uptime(rec.start))
+		binary.BigEndian.PutUint32(b[4:], fe.uptime(rec.end))
+		buf.Write(b[:])
+	}
+	binary.BigEndian.PutUint16(b[:], rec.zone)
+	b[2] = rec.direction
+	b[3] = rec.reason
+	if fe.ipfix {
+		buf.Write(b[:4])
+	} else {
+		buf.Write(b[:3])
+	}
+}
+
+// flowMsg is an ipfix or netflow9 message being built
+type flowMsg struct {
+	buf         bytes.Buffer
+	records     int //all the records, the count of netflow9
+	dataRecords int
+}
+
+func (fe *flowExporter) newMsg() *flowMsg {
+	msg := &flowMsg{}
+	if fe.ipfix {
+		msg.buf.Write(make([]byte, ipfixHeaderLen))
+	} else {
+		msg.buf.Write(make([]byte, netflow9HeaderLen))
+	}
+	return msg
+}
+
+// beginSet writes the header of a set, it returns where the set begins
+func (msg *flowMsg) beginSet(setId uint16) int {
+	begin := msg.buf.Len()
+	var b [4]byte
+	binary.BigEndian.PutUint16(b[:], setId)
+	msg.buf.Write(b[:])
+	return begin
+}
+
+// endSet pads the set to 4 bytes and writes its length
+func (msg *flowMsg) endSet(begin int) {
+	for msg.buf.Len()%4 != 0 {
+		msg.buf.WriteByte(0)
+	}
+	binary.BigEndian.PutUint16(msg.buf.Bytes()[begin+2:], uint16(msg.buf.Len()-begin))
+}
+
+func (fe *flowExporter) addTemplates(msg *flowMsg) {
+	setId := uint16(ipfixTemplateSet)
+	if !fe.ipfix {
+		setId = netflow9TemplateSet
+	}
+	begin := msg.beginSet(setId)
+	var b [4]byte
+	for _, v6 := range []bool{false, true} {
+		tid := uint16(templateIPv4)
+		if v6 {
+			tid = templateIPv6
+		}
+		fields := fe.fields(v6)
+		binary.BigEndian.PutUint16(b[:], tid)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(fields)))
+		msg.buf.Write(b[:])
+		for _, f := range fields {
+			binary.BigEndian.PutUint16(b[:], f.id)
+			binary.BigEndian.PutUint16(b[2:], f.length)
+			msg.buf.Write(b[:])
+		}
+		msg.records++
+	}
+	msg.endSet(begin)
+}
+
+func (fe *flowExporter) send(msg *flowMsg) {
+	data := msg.buf.Bytes()
+	now := time.Now()
+	if fe.ipfix {
+		binary.BigEndian.PutUint16(data[0:], ipfixVersion)
+		binary.BigEndian.PutUint16(data[2:], uint16(len(data)))
+		binary.BigEndian.PutUint32(data[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(data[8:], fe.seq) //data records sent before
+		binary.BigEndian.PutUint32(data[12:], fe.conf.DomainId)
+		fe.seq += uint32(msg.dataRecords)
+	} else {
+		binary.BigEndian.PutUint16(data[0:], netflow9Version)
+		binary.BigEndian.PutUint16(data[2:], uint16(msg.records))
+		binary.BigEndian.PutUint32(data[4:], fe.uptime(now))
+		binary.BigEndian.PutUint32(data[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(data[12:], fe.seq) //packets sent before
+		binary.BigEndian.PutUint32(data[16:], fe.conf.DomainId)
+		fe.seq++
+	}
+	if _, err := fe.conn.Write(data); err != nil {
+		atomic.AddUint64(&flowStats.SendErrors, 1)
+		if !fe.sendErr {
+			mylog.Error("flow export to %s err: %s\n", fe.conf.Collector, err.Error())
+		}
+		fe.sendErr = true
+		return
+	}
+	fe.sendErr = false
+	atomic.AddUint64(&flowStats.Messages, 1)
+	atomic.AddUint64(&flowStats.Records, uint64(msg.dataRecords))
+}
+
+// flush sends the pending records, the templates are sent with them every
+// TemplateRefresh seconds, as udp may lose them.
+func (fe *flowExporter) flush(now time.Time) {
+	sendTemplates := now.Sub(fe.lastTemplate) >= time.Duration(fe.conf.TemplateRefresh)*time.Second
+	if len(fe.pending) == 0 && !sendTemplates {
+		return
+	}
+	msg := fe.newMsg()
+	if sendTemplates {
+		fe.addTemplates(msg)
+		fe.lastTemplate = now
+	}
+	for _, v6 := range []bool{false, true} {
+		var recs []*flowRecord
+		for i := range fe.pending {
+			if isV6Addr(fe.pending[i].tuple.saddr) == v6 {
+				recs = append(recs, &fe.pending[i])
+			}
+		}
+		tid := uint16(templateIPv4)
+		if v6 {
+			tid = templateIPv6
+		}
+		size := recordSize(fe.fields(v6))
+		for len(recs) > 0 {
+			//the set header and the padding
+			n := (flowMsgMaxSize - msg.buf.Len() - 4 - 3) / size
+			if n <= 0 {
+				fe.send(msg)
+				msg = fe.newMsg()
+				continue
+			}
+			if n > len(recs) {
+				n = len(recs)
+			}
+			begin := msg.beginSet(tid)
+			for _, rec := range recs[:n] {
+				fe.encodeRecord(&msg.buf, rec, v6)
+			}
+			msg.endSet(begin)
+			msg.records += n
+			msg.dataRecords += n
+			recs = recs[n:]
+		}
+	}
+	if msg.records > 0 {
+		fe.send(msg)
+	}
+	fe.pending = fe.pending[:0]
+}
+
+func isV6Addr(addr ipAddr) bool {
+	return !bytes.Equal(addr[:12], v4InV6Prefix[:])
+}
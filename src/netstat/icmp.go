@@ -0,0 +1,51 @@
+package netstat
+
+import "encoding/binary"
+
+const (
+	icmpType     = 0
+	icmpCode     = 1
+	icmpChecksum = 2
+	icmpIdent    = 4
+	icmpSeq      = 6
+
+	// ICMPMinimumSize is the size of the header of echo and error messages.
+	ICMPMinimumSize = 8
+
+	ICMPEchoReply     = 0
+	ICMPEchoRequest   = 8
+	ICMPv6EchoRequest = 128
+	ICMPv6EchoReply   = 129
+)
+
+// ICMP represents an ICMP or ICMPv6 header stored in a byte array.
+type ICMP []byte
+
+// Type returns the "type" field of the icmp header.
+func (b ICMP) Type() uint8 {
+	return b[icmpType]
+}
+
+// Code returns the "code" field of the icmp header.
+func (b ICMP) Code() uint8 {
+	return b[icmpCode]
+}
+
+// Ident returns the "identifier" field of an echo request or reply.
+func (b ICMP) Ident() uint16 {
+	return binary.BigEndian.Uint16(b[icmpIdent:])
+}
+
+// isEcho reports whether the icmp message of proto is an echo request or an
+// echo reply.
+func (b ICMP) isEcho(proto transportProtoNum) (echo bool, request bool) {
+	switch {
+	case proto == ICMPProtocolNumber && b.Type() == ICMPEchoRequest,
+		proto == ICMPv6ProtocolNumber && b.Type() == ICMPv6EchoRequest:
+		return true, true
+	case proto == ICMPProtocolNumber && b.Type() == ICMPEchoReply,
+		proto == ICMPv6ProtocolNumber && b.Type() == ICMPv6EchoReply:
+		return true, false
+	}
+	return false, false
+}
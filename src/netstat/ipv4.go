@@ -106,6 +106,11 @@ func (b IPv4) DestinationAddress() uint32 {
 	return binary.BigEndian.Uint32(b[dstAddr : dstAddr+IPv4AddressSize])
 }
 
+// TotalLength returns the "total length" field of the ipv4 header.
+func (b IPv4) TotalLength() uint16 {
+	return binary.BigEndian.Uint16(b[totalLen:])
+}
+
 // FragmentOffset returns the "fragment offset" field of the ipv4 header.
 func (b IPv4) FragmentOffset() uint16 {
 	return binary.BigEndian.Uint16(b[flagsFO:]) << 3
@@ -0,0 +1,69 @@
+package netstat
+
+import (
+	"encoding/binary"
+	"packet"
+)
+
+const (
+	ip6PayloadLen = 4
+	ip6NextHeader = 6
+	ip6SrcAddr    = 8
+	ip6DstAddr    = 24
+
+	// IPv6MinimumSize is the size of the fixed ipv6 header.
+	IPv6MinimumSize = 40
+
+	// IPv6AddressSize is the size, in bytes, of an IPv6 address.
+	IPv6AddressSize = 16
+
+	// IPv6Version is the version of the ipv6 protocol.
+	IPv6Version = 6
+)
+
+type IPv6 []byte
+
+// ipAddr is the address of a tuple, ipv4 is kept as ipv4-mapped ipv6 address
+type ipAddr [IPv6AddressSize]byte
+
+var v4InV6Prefix = [12]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+func ipv4Addr(addr uint32) (ip ipAddr) {
+	copy(ip[:], v4InV6Prefix[:])
+	ip[12] = byte(addr >> 24)
+	ip[13] = byte(addr >> 16)
+	ip[14] = byte(addr >> 8)
+	ip[15] = byte(addr)
+	return
+}
+
+func (b IPv6) IsIPv6() bool {
+	return len(b) >= IPv6MinimumSize && b[versIHL]>>4 == IPv6Version
+}
+
+// PayloadLength returns the "payload length" field of the fixed ipv6 header.
+func (b IPv6) PayloadLength() uint16 {
+	return binary.BigEndian.Uint16(b[ip6PayloadLen:])
+}
+
+// NextHeader returns the "next header" field of the fixed ipv6 header.
+func (b IPv6) NextHeader() uint8 {
+	return b[ip6NextHeader]
+}
+
+func (b IPv6) SourceAddress() (ip ipAddr) {
+	copy(ip[:], b[ip6SrcAddr:ip6SrcAddr+IPv6AddressSize])
+	return
+}
+
+func (b IPv6) DestinationAddress() (ip ipAddr) {
+	copy(ip[:], b[ip6DstAddr:ip6DstAddr+IPv6AddressSize])
+	return
+}
+
+// Transport returns the upper layer protocol and its offset, ok is false for
+// the non-first fragments.
+func (b IPv6) Transport() (proto uint8, offset int, ok bool) {
+	p, off, ok := packet.IPv6Transport(b)
+	return uint8(p), off, ok
+}
@@ -1,9 +1,9 @@
 package netstat
 
 import (
-	"log"
 	"mylog"
 	"packet"
+	"tcpstate"
 	"time"
 	"timer"
 )
@@ -12,10 +12,13 @@ type networkProtoNum uint16
 type transportProtoNum uint8
 
 const (
-	IPv4ProtocolNumber networkProtoNum   = 0x0800
-	ARPProtocolNumber  networkProtoNum   = 0X0806
-	TCPProtocolNumber  transportProtoNum = 6
-	UDPProtocolNumber  transportProtoNum = 17
+	IPv4ProtocolNumber   networkProtoNum   = 0x0800
+	IPv6ProtocolNumber   networkProtoNum   = 0x86DD
+	ARPProtocolNumber    networkProtoNum   = 0X0806
+	ICMPProtocolNumber   transportProtoNum = 1
+	TCPProtocolNumber    transportProtoNum = 6
+	UDPProtocolNumber    transportProtoNum = 17
+	ICMPv6ProtocolNumber transportProtoNum = 58
 )
 
 type networkHandler struct {
@@ -34,10 +37,13 @@ var transportProtos map[transportProtoNum]*transportHandler
 var networkHandlers []*networkHandler = []*networkHandler{
 	&networkHandler{IPv4ProtocolNumber, ipHandler},
 	&networkHandler{ARPProtocolNumber, arpHandler},
+	&networkHandler{IPv6ProtocolNumber, ip6Handler},
 }
 var transportHandlers []*transportHandler = []*transportHandler{
 	&transportHandler{TCPProtocolNumber, tcpHandler},
 	&transportHandler{UDPProtocolNumber, udpHandler},
+	&transportHandler{ICMPProtocolNumber, icmpHandler},
+	&transportHandler{ICMPv6ProtocolNumber, icmpHandler},
 }
 
 func init() {
@@ -61,11 +67,20 @@ func registerTransportProto() {
 	}
 }
 
+// getIPAddrs returns the addresses of the ipv4 or ipv6 header
+func getIPAddrs(pkb *packet.PktBuf) (saddr, daddr ipAddr) {
+	network := pkb.LoadNetworkData()
+	if IPVersion(network) == IPv6Version {
+		ip6Header := IPv6(network)
+		return ip6Header.SourceAddress(), ip6Header.DestinationAddress()
+	}
+	ipHeader := IPv4(network)
+	return ipv4Addr(ipHeader.SourceAddress()), ipv4Addr(ipHeader.DestinationAddress())
+}
+
 func getTCPTuple(pkb *packet.PktBuf) ctTuple {
-	ipHeader := IPv4(pkb.LoadNetworkData())
-	saddr := ipHeader.SourceAddress()
-	daddr := ipHeader.DestinationAddress()
-	proto := ipHeader.Protocol()
+	saddr, daddr := getIPAddrs(pkb)
+	proto := uint8(TCPProtocolNumber)
 	transportHeader := TCP(pkb.LoadTransportData())
 	sport := transportHeader.SourcePort()
 	dport := transportHeader.DestinationPort()
@@ -73,21 +88,37 @@ func getTCPTuple(pkb *packet.PktBuf) ctTuple {
 }
 
 func getUDPTuple(pkb *packet.PktBuf) ctTuple {
-	ipHeader := IPv4(pkb.LoadNetworkData())
-	saddr := ipHeader.SourceAddress()
-	daddr := ipHeader.DestinationAddress()
-	proto := ipHeader.Protocol()
+	saddr, daddr := getIPAddrs(pkb)
+	proto := uint8(UDPProtocolNumber)
 	transportHeader := UDP(pkb.LoadTransportData())
 	sport := transportHeader.SourcePort()
 	dport := transportHeader.DestinationPort()
 	return ctTuple{saddr, daddr, sport, dport, proto}
 }
 
+// getICMPTuple returns the tuple of an echo, the identifier is the sport of
+// a request and the dport of a reply, so both of them find the same conntrack.
+func getICMPTuple(pkb *packet.PktBuf, proto transportProtoNum, request bool) ctTuple {
+	saddr, daddr := getIPAddrs(pkb)
+	id := ICMP(pkb.LoadTransportData()).Ident()
+	if request {
+		return ctTuple{saddr, daddr, id, 0, uint8(proto)}
+	}
+	return ctTuple{saddr, daddr, 0, id, uint8(proto)}
+}
+
 func NetStatPut(pkb *packet.PktBuf) {
 	pkb.HoldPktBuf()
 	netStatQueue <- pkb
 }
 
+// NetStatTrack tracks pkb right away on the forwarding path instead of
+// queueing it, the state of the next packet of its connection is known
+// then, a reply can't get ahead of the packet it replies to.
+func NetStatTrack(pkb *packet.PktBuf) {
+	etherPktHandle(pkb)
+}
+
 func netStatHandle() {
 	for pkb := range netStatQueue {
 		etherPktHandle(pkb)
@@ -113,7 +144,7 @@ func arpHandler(pkb *packet.PktBuf) {
 
 func ipHandler(pkb *packet.PktBuf) {
 	ipHeader := IPv4(pkb.LoadNetworkData())
-	if !ipHeader.IsIPv4() {
+	if int(pkb.NetworkDataLen()) < IPv4MinimumSize || !ipHeader.IsIPv4() {
 		return
 	}
 	if ipHeader.FragmentOffset() != 0 {
@@ -124,10 +155,52 @@ func ipHandler(pkb *packet.PktBuf) {
 	if !ok {
 		return
 	}
-	pkb.SetTransportHeader(int(ipHeader.HeaderLength()))
+	//the ports of tcp and udp, the identifier of icmp echo
+	offset := int(ipHeader.HeaderLength())
+	if offset < IPv4MinimumSize || offset+8 > int(pkb.NetworkDataLen()) {
+		return
+	}
+	pkb.SetTransportHeader(offset)
 	handler.handle(pkb)
 }
 
+func ip6Handler(pkb *packet.PktBuf) {
+	ip6Header := IPv6(pkb.LoadNetworkData()[:pkb.NetworkDataLen()])
+	if len(ip6Header) < IPv6MinimumSize || !ip6Header.IsIPv6() {
+		return
+	}
+	proto, offset, ok := ip6Header.Transport()
+	if !ok || offset+8 > int(pkb.NetworkDataLen()) {
+		return
+	}
+
+	handler, ok := transportProtos[transportProtoNum(proto)]
+	if !ok {
+		return
+	}
+	pkb.SetTransportHeader(offset)
+	handler.handle(pkb)
+}
+
+// tcpSegLen returns the length of the tcp segment of pkb by its ip header,
+// the padding of a short ether frame isn't a part of it. It is bounded by
+// the frame, a truncated segment is shorter than its ip header says.
+func tcpSegLen(pkb *packet.PktBuf) (segLen int) {
+	network := pkb.LoadNetworkData()
+	offset := len(network) - len(pkb.LoadTransportData())
+	if IPVersion(network) == IPv6Version {
+		segLen = IPv6MinimumSize + int(IPv6(network).PayloadLength()) - offset
+	} else {
+		segLen = int(IPv4(network).TotalLength()) - offset
+	}
+	if frameLen := int(pkb.NetworkDataLen()) - offset; segLen > frameLen {
+		segLen = frameLen
+	}
+	return
+}
+
+// tcpHandler tracks the connections started by an outbound syn, the state
+// is moved by tcpstate, which checks the flags as bitmask and the window.
 func tcpHandler(pkb *packet.PktBuf) {
 	pktLen := uint64(pkb.GetDataLen())
 
@@ -138,103 +211,116 @@ func tcpHandler(pkb *packet.PktBuf) {
 		return
 	}
 
-	tcpHeader := TCP(pkb.LoadTransportData())
-	tcpFlag := tcpHeader.Flags()
-
-	ct, ok := nct.findConntrack(tuple)
-	//SYN-SENT
-	if IsSyn(tcpFlag) {
-		//TODO: add a conntrack
-		if ct == nil {
-			if !pkb.IsOutBound() {
-				return
-			}
-			//log.Printf("SYN-SENT: syn packet,tuple:%s\n", tuple.String())
-			mylog.Debug("SYN-SENT: syn packet,tuple:%s\n", tuple.String())
-			ct, _ = nct.CreateConntrack(tuple)
-			ct.outBound = true
-			ct.stats[ctOrigin] += pktLen
-			ct.timer = timer.NewTimerFunc(time.Second*CT_TCP_SYN_TIMEOUT, ctTimeoutDel, ct) //ctTCPHandShakeTimeout
-		} else { //repeat syn ??
-			log.Printf("repeat SYN-SENT ??: syn packet,tuple:%s\n", tuple.String())
-			if ct.status == CT_NEW {
-				//if ctTimeoutDel have invoking , this maybe lunch ctTimeoutDel later, del one conntrack twice is ok
-				ct.timer.Reset(time.Second * CT_TCP_SYN_TIMEOUT)
-			}
-		}
+	segLen := tcpSegLen(pkb)
+	if segLen < 0 {
 		return
 	}
-	//if ct is nil, pkb isn't syn,
+	seg, ok := tcpstate.ParseSegment(pkb.LoadTransportData()[:segLen], segLen)
 	if !ok {
-		//log.Printf("can't find tuple:%v, zone=%d, and pkb is not syn\n", tuple, zone)
-		return
-	}
-
-	if ct.status == CT_DEL {
 		return
 	}
 
-	dir := ct.Dir(tuple)
-	ct.stats[dir] += pktLen
-
-	if tcpFlag&TCPFlagRst != 0 || tcpFlag&TCPFlagFin != 0 {
-		//log.Printf("CT_DEL: rst or fin packet,tuple=%s\n", tuple.String())
-		mylog.Debug("CT_DEL: rst or fin packet,tuple=%s\n", tuple.String())
-		ct.Lock()
-		if ct.status == CT_DEL { //ctESTABLISHEDTimeout have invoke,
-			ct.Unlock()
+	ct, ok := nct.findConntrack(tuple)
+	if ok && ct.status == CT_DEL {
+		if !tcpstate.IsSyn(seg.Flags) || ct.Dir(tuple) != ctOrigin {
 			return
 		}
-		ct.status = CT_DEL
-		ct.lastTime = time.Now().UTC() // record die timout time
+		//the port is reused by a new connection, the old one is finished
+		ct.Lock()
 		if ct.timer != nil {
-			if ct.timer.Stop() { //ctESTABLISHEDTimeout可能正在执行, return true, 表明成功删除了定时器，即连接没有因超时而被删除
-				ct.timer = timer.NewTimerFunc(time.Second*CT_DEL_TIMEOUT, ctTimeoutDel, ct) //如果此时ctESTABLISHEDTimeout也执行了, 所以要加锁
-			}
+			ct.timer.Stop()
 		}
 		ct.Unlock()
+		nct.delConntrack(ct)
+		ok = false
+	}
+	//SYN-SENT
+	if !ok {
+		if !tcpstate.IsSyn(seg.Flags) || !pkb.IsOutBound() {
+			return
+		}
+		mylog.Debug("SYN-SENT: syn packet,tuple:%s\n", tuple.String())
+		ct, _ = nct.CreateConntrack(tuple)
+		ct.outBound = true
+	}
+
+	dir := ct.Dir(tuple)
+	ct.Lock()
+	defer ct.Unlock()
+	ct.account(dir, pktLen)
+	old := ct.tcp.State()
+	state, res := ct.tcp.Update(dir, &seg)
+	if res == tcpstate.Invalid {
+		mylog.Debug("invalid tcp packet in %s, flags=%#x, tuple=%s\n", old, seg.Flags, tuple.String())
 		return
 	}
+	if state != old {
+		mylog.Debug("tcp %s -> %s, tuple=%s\n", old, state, tuple.String())
+	}
+	//the established one is checked lazily by ctESTABLISHEDTimeout
+	if state != old || state != tcpstate.Established {
+		ct.tcpStateTimer(state)
+	}
+}
 
-	if ct.status == CT_ESTABLISHED {
+func udpHandler(pkb *packet.PktBuf) {
+	pktLen := uint64(pkb.GetDataLen())
+
+	tuple := getUDPTuple(pkb)
+	zone := pkb.GetPktVid()
+	nct, ok := GetNctByZone(zone)
+	if !ok {
 		return
 	}
 
-	//SYN-RCVD
-	if IsSynAck(tcpFlag) {
-		//TODO: change conntrack state
-		if dir != ctReply {
-			log.Printf("Error :SYN-RCVD but dir != ctReply,tuple=%s\n", tuple.String())
-			return
+	ct, ok := nct.findConntrack(tuple)
+	if !ok {
+		ct, _ = nct.CreateConntrack(tuple)
+		if pkb.IsOutBound() {
+			ct.outBound = true
 		}
-		//log.Printf("SYN-RCVD: SynAck packet,tuple=%s\n", tuple.String())
-		mylog.Debug("SYN-RCVD: SynAck packet,tuple=%s\n", tuple.String())
+		ct.Lock()
+		ct.account(ctOrigin, pktLen)
+		ct.Unlock()
+		ct.timer = timer.NewTimerFunc(time.Second*CT_UDP_NEW_TIMEOUT, ctTimeoutDel, ct, ct.stats)
+		return
+	}
 
-		if ct.timer.Reset(time.Second * CT_TCP_SYN_RCVD_TIMEOUT) { // syn ctTimeoutDel 并发执行的情况, 如果ctTimeoutDel先触发，就会删除这个连接跟踪，netstat丢失这个连接信息而已
-			// CT_TCP_SYN_RCVD_TIMEOUT会再次触发ctTimeoutDel,没有影响，
-			ct.status = CT_REPLY
-		}
+	if ct.status == CT_DEL {
 		return
 	}
 
-	if IsAck(tcpFlag) && ct.status == CT_REPLY {
-		//TODO: change conntrack state
-		//log.Printf("CT_ESTABLISHED: Ack packet,tuple=%s, ct.stats=%v\n", tuple.String(), ct.stats)
-		mylog.Info("CT_ESTABLISHED: Ack packet,tuple=%s, ct.stats=%v\n", tuple.String(), ct.stats)
-		//ct.timer.Reset(time.Second * 15) //testing
+	dir := ct.Dir(tuple)
+	ct.Lock()
+	ct.account(dir, pktLen)
+	ct.Unlock()
+	if ct.status == CT_ESTABLISHED {
+		return
+	}
 
-		if ct.timer.Stop() { // CT_TCP_SYN_RCVD_TIMEOUT  ctTimeoutDel 并发执行的情况，如果ctTimeoutDel先触发，就会删除这个连接跟踪，这里会返回false
+	if dir == ctReply {
+		//ct.Lock()
+		if ct.timer.Stop() {
 			ct.status = CT_ESTABLISHED
-			ct.timer = timer.NewTimerFunc(time.Second*CT_TCP_ESTABLISHED_TIMEOUT, ctESTABLISHEDTimeout, ct, ct.stats)
+			ct.timer = timer.NewTimerFunc(time.Second*CT_UDP_ESTABLISHED_TIMEOUT, ctESTABLISHEDTimeout, ct, ct.stats)
 		}
-		return
+		//ct.Unlock() // if check timer.Stop, if means there is no ctTimeoutDel handling at the same time, so don't need to Lock()
 	}
 }
 
-func udpHandler(pkb *packet.PktBuf) {
+// icmpHandler tracks the echo of icmp and icmpv6 like udp, by the identifier
+func icmpHandler(pkb *packet.PktBuf) {
 	pktLen := uint64(pkb.GetDataLen())
+	proto := ICMPProtocolNumber
+	if IPVersion(pkb.LoadNetworkData()) == IPv6Version {
+		proto = ICMPv6ProtocolNumber
+	}
+	echo, request := ICMP(pkb.LoadTransportData()).isEcho(proto)
+	if !echo {
+		return
+	}
 
-	tuple := getUDPTuple(pkb)
+	tuple := getICMPTuple(pkb, proto, request)
 	zone := pkb.GetPktVid()
 	nct, ok := GetNctByZone(zone)
 	if !ok {
@@ -243,12 +329,17 @@ func udpHandler(pkb *packet.PktBuf) {
 
 	ct, ok := nct.findConntrack(tuple)
 	if !ok {
+		if !request {
+			return
+		}
 		ct, _ = nct.CreateConntrack(tuple)
 		if pkb.IsOutBound() {
 			ct.outBound = true
 		}
-		ct.stats[ctOrigin] += pktLen
-		ct.timer = timer.NewTimerFunc(time.Second*CT_UDP_NEW_TIMEOUT, ctTimeoutDel, ct, ct.stats)
+		ct.Lock()
+		ct.account(ctOrigin, pktLen)
+		ct.Unlock()
+		ct.timer = timer.NewTimerFunc(time.Second*CT_ICMP_TIMEOUT, ctTimeoutDel, ct)
 		return
 	}
 
@@ -257,17 +348,17 @@ func udpHandler(pkb *packet.PktBuf) {
 	}
 
 	dir := ct.Dir(tuple)
-	ct.stats[dir] += pktLen
+	ct.Lock()
+	ct.account(dir, pktLen)
+	ct.Unlock()
 	if ct.status == CT_ESTABLISHED {
 		return
 	}
 
 	if dir == ctReply {
-		//ct.Lock()
 		if ct.timer.Stop() {
 			ct.status = CT_ESTABLISHED
-			ct.timer = timer.NewTimerFunc(time.Second*CT_UDP_ESTABLISHED_TIMEOUT, ctESTABLISHEDTimeout, ct, ct.stats)
+			ct.timer = timer.NewTimerFunc(time.Second*CT_ICMP_TIMEOUT, ctESTABLISHEDTimeout, ct, ct.stats)
 		}
-		//ct.Unlock() // if check timer.Stop, if means there is no ctTimeoutDel handling at the same time, so don't need to Lock()
 	}
 }
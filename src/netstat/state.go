@@ -0,0 +1,86 @@
+package netstat
+
+import (
+	"packet"
+)
+
+// the conntrack states of a packet, as masks for matching several of them
+const (
+	StateNew = 1 << iota
+	StateEstablished
+	StateInvalid
+	StateUntracked
+)
+
+// pktTuple returns the tuple of the ether packet pkb, the headers of pkb are
+// set like etherPktHandle does.
+func pktTuple(pkb *packet.PktBuf) (tuple ctTuple, ok bool) {
+	etherData := pkb.LoadUserData()
+	if len(etherData) < packet.EtherSize {
+		return
+	}
+	network := etherData[packet.EtherSize:]
+	var proto transportProtoNum
+	var offset int
+	switch networkProtoNum(packet.TranEther(etherData).GetProto()) {
+	case IPv4ProtocolNumber:
+		ipHeader := IPv4(network)
+		if len(network) < IPv4MinimumSize || !ipHeader.IsIPv4() || ipHeader.FragmentOffset() != 0 {
+			return
+		}
+		proto, offset = transportProtoNum(ipHeader.Protocol()), int(ipHeader.HeaderLength())
+	case IPv6ProtocolNumber:
+		if !IPv6(network).IsIPv6() {
+			return
+		}
+		p, off, transportOk := IPv6(network).Transport()
+		if !transportOk {
+			return
+		}
+		proto, offset = transportProtoNum(p), off
+	default:
+		return
+	}
+	//the ports of tcp and udp, the identifier of icmp echo
+	if len(network) < offset+8 {
+		return
+	}
+	pkb.SetNetworkHeader(packet.EtherSize)
+	pkb.SetTransportHeader(offset)
+	switch proto {
+	case TCPProtocolNumber:
+		return getTCPTuple(pkb), true
+	case UDPProtocolNumber:
+		return getUDPTuple(pkb), true
+	case ICMPProtocolNumber, ICMPv6ProtocolNumber:
+		if echo, request := ICMP(pkb.LoadTransportData()).isEcho(proto); echo {
+			return getICMPTuple(pkb, proto, request), true
+		}
+	}
+	return
+}
+
+// PktState returns the conntrack state of the ether packet pkb in its zone:
+// a packet of the reply dir, or of a conntrack which has been replied, is
+// established. The packets of the zones which aren't tracked are untracked.
+func PktState(pkb *packet.PktBuf) int {
+	if !IsEnable() {
+		return StateUntracked
+	}
+	nct, ok := GetNctByZone(pkb.GetPktVid())
+	if !ok {
+		return StateUntracked
+	}
+	tuple, ok := pktTuple(pkb)
+	if !ok {
+		return StateInvalid
+	}
+	ct, ok := nct.findConntrack(tuple)
+	if !ok {
+		return StateNew
+	}
+	if ct.Dir(tuple) == ctReply || ct.status != CT_NEW {
+		return StateEstablished
+	}
+	return StateNew
+}
@@ -1,6 +1,9 @@
 package netstat
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"tcpstate"
+)
 
 const (
 	srcPort     = 0
@@ -22,6 +25,8 @@ const (
 	TCPFlagPsh
 	TCPFlagAck
 	TCPFlagUrg
+	TCPFlagEce
+	TCPFlagCwr
 )
 
 // TCPFields contains the fields of a TCP packet. It is used to describe the
@@ -82,25 +87,27 @@ func (b TCP) Flags() uint8 {
 }
 
 func (b TCP) IsTCPFlagSyn() bool {
-	return b.Flags() == TCPFlagSyn
+	return tcpstate.IsSyn(b.Flags())
 }
 
 func (b TCP) IsTCPFlagFin() bool {
-	return b.Flags() == TCPFlagFin
+	return b.Flags()&TCPFlagFin != 0
 }
 
 func (b TCP) IsTCPFlagRst() bool {
-	return b.Flags() == TCPFlagRst
+	return b.Flags()&TCPFlagRst != 0
 }
 
+// IsSyn reports whether tcpFlag opens a connection, the other flags like
+// ECE and CWR are ignored.
 func IsSyn(tcpFlag uint8) bool {
-	return tcpFlag == TCPFlagSyn
+	return tcpstate.IsSyn(tcpFlag)
 }
 
 func IsAck(tcpFlag uint8) bool {
-	return tcpFlag == TCPFlagAck
+	return tcpstate.IsAck(tcpFlag)
 }
 
 func IsSynAck(tcpFlag uint8) bool {
-	return tcpFlag&TCPFlagSyn != 0 && tcpFlag&TCPFlagAck != 0
+	return tcpstate.IsSynAck(tcpFlag)
 }
@@ -0,0 +1,105 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	Version6      = 6  // ipv6 protocol version
+	IPv6HeaderLen = 40 // fixed header length without extension headers
+)
+
+// IPv6 next header values of the extension headers
+const (
+	IPv6HopByHop = 0
+	IPv6Routing  = 43
+	IPv6Fragment = 44
+	IPv6NoNext   = 59
+	IPv6DstOpts  = 60
+)
+
+// A IPv6Header represents the fixed header of an IPv6 packet.
+type IPv6Header struct {
+	Version      int    // protocol version
+	TrafficClass int    // traffic class
+	FlowLabel    int    // flow label
+	PayloadLen   int    // payload length
+	NextHeader   int    // next header
+	HopLimit     int    // hop limit
+	Src          net.IP // source address
+	Dst          net.IP // destination address
+}
+
+func (h *IPv6Header) String() string {
+	if h == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("ver=%d tclass=%#x flowlbl=%#x payloadlen=%d nxthdr=%d hoplim=%d src=%v dst=%v", h.Version, h.TrafficClass, h.FlowLabel, h.PayloadLen, h.NextHeader, h.HopLimit, h.Src, h.Dst)
+}
+
+// Parse parses b as an IPv6 header and stores the result in h.
+func (h *IPv6Header) Parse(b []byte) error {
+	if h == nil || len(b) < IPv6HeaderLen {
+		return errHeaderTooShort
+	}
+	h.Version = int(b[0] >> 4)
+	h.TrafficClass = int(b[0]&0x0f)<<4 | int(b[1]>>4)
+	h.FlowLabel = int(b[1]&0x0f)<<16 | int(b[2])<<8 | int(b[3])
+	h.PayloadLen = int(binary.BigEndian.Uint16(b[4:6]))
+	h.NextHeader = int(b[6])
+	h.HopLimit = int(b[7])
+	h.Src = make(net.IP, net.IPv6len)
+	copy(h.Src, b[8:24])
+	h.Dst = make(net.IP, net.IPv6len)
+	copy(h.Dst, b[24:40])
+	return nil
+}
+
+// ParseIPv6Header parses b as an IPv6 header.
+func ParseIPv6Header(b []byte) (*IPv6Header, error) {
+	h := new(IPv6Header)
+	if err := h.Parse(b); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// IPv6Transport skips the extension headers of the ipv6 packet b, it returns
+// the upper layer protocol and its offset in b. ok is false for a non-first
+// fragment, or a malformed packet. b may be longer than the packet, the
+// headers are bounded by the payload length.
+func IPv6Transport(b []byte) (proto int, offset int, ok bool) {
+	if len(b) < IPv6HeaderLen {
+		return 0, 0, false
+	}
+	if end := IPv6HeaderLen + int(binary.BigEndian.Uint16(b[4:6])); end < len(b) {
+		b = b[:end]
+	}
+	proto = int(b[6])
+	offset = IPv6HeaderLen
+	for {
+		switch proto {
+		case IPv6HopByHop, IPv6Routing, IPv6DstOpts:
+			if len(b) < offset+8 {
+				return 0, 0, false
+			}
+			proto = int(b[offset])
+			offset += (int(b[offset+1]) + 1) * 8
+		case IPv6Fragment:
+			if len(b) < offset+8 {
+				return 0, 0, false
+			}
+			if binary.BigEndian.Uint16(b[offset+2:offset+4])&0xfff8 != 0 {
+				return 0, 0, false
+			}
+			proto = int(b[offset])
+			offset += 8
+		case IPv6NoNext:
+			return 0, 0, false
+		default:
+			return proto, offset, offset <= len(b)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 var (
 	IpPtk         [2]byte = [...]byte{0x08, 0x00}
+	Ip6Pkt        [2]byte = [...]byte{0x86, 0xdd}
 	ArpPkt        [2]byte = [...]byte{0x08, 0x06}
 	BroadcastAddr [6]byte = [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 	EtherSize             = 14
@@ -46,6 +47,14 @@ func (e *Ether) IsArp() bool {
 func (e *Ether) IsIpPtk() bool {
 	return e.Proto == IpPtk
 }
+func (e *Ether) IsIp6Pkt() bool {
+	return e.Proto == Ip6Pkt
+}
+
+// IsMulticast is true for broadcast too, like ipv6 ndp 33:33:xx:xx:xx:xx
+func (e *Ether) IsMulticast() bool {
+	return e.DstMac[0]&0x01 != 0
+}
 
 func (p *Packet) GetDstMac() MAC {
 	return MAC{(*p)[0], (*p)[1], (*p)[2], (*p)[3], (*p)[4], (*p)[5]}
@@ -65,6 +74,9 @@ func (p *Packet) IsArp() bool {
 func (p *Packet) IsIpPtk() bool {
 	return p.GetProto() == IpPtk
 }
+func (p *Packet) IsIp6Pkt() bool {
+	return p.GetProto() == Ip6Pkt
+}
 
 func (m MAC) String() string {
 	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", m[0], m[1], m[2], m[3], m[4], m[5])
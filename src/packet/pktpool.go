@@ -4,10 +4,11 @@ import (
 	"log"
 	"sync"
 	"sync/atomic"
+	"unsafe"
 )
 
 const (
-	pktBufSize = 1528
+	pktBufSize = 1600 // 1514 + vnet header + aead nonce and tag
 )
 
 type PktBuf struct {
@@ -21,6 +22,9 @@ type PktBuf struct {
 	macHeader       int
 	networkHeader   int
 	transportHeader int
+	ct              unsafe.Pointer //conntrack of nat, the type is unknown here
+	dir             int            //direction of ct
+	next            *PktBuf        //next fragment of a reassembled datagram
 	buf             [pktBufSize]byte
 }
 
@@ -41,6 +45,9 @@ func GetPktFromPool(sp *sync.Pool) *PktBuf {
 		pb.pool = sp
 	}
 	pb.len = 0
+	pb.ct = nil
+	pb.dir = 0
+	pb.next = nil
 	pb.HoldPktBuf()
 	return pb
 }
@@ -57,6 +64,10 @@ func PutPktToPool(pb *PktBuf) {
 	}
 }
 
+func (pb *PktBuf) PutPktToPool() {
+	PutPktToPool(pb)
+}
+
 func (pb *PktBuf) HoldPktBuf() {
 	//fmt.Println("hold, ref:", atomic.AddInt32(&pkt.ref, 1))
 	atomic.AddInt32(&pb.ref, 1)
@@ -170,6 +181,10 @@ func (pb *PktBuf) LoadNetworkData() []byte {
 	return pb.buf[pb.networkHeader:]
 }
 
+func (pb *PktBuf) NetworkDataLen() uint16 {
+	return pb.len - uint16(pb.networkHeader)
+}
+
 func (pb *PktBuf) SetTransportHeader(offset int) {
 	pb.transportHeader = pb.networkHeader + offset
 }
@@ -185,3 +200,43 @@ func (pb *PktBuf) SetOutBound(b bool) {
 func (pb *PktBuf) IsOutBound() bool {
 	return pb.outBound
 }
+
+func (pb *PktBuf) SetCt(ct unsafe.Pointer) {
+	pb.ct = ct
+}
+
+func (pb *PktBuf) GetCt() unsafe.Pointer {
+	return pb.ct
+}
+
+func (pb *PktBuf) SetDir(dir int) {
+	pb.dir = dir
+}
+
+func (pb *PktBuf) GetDir() int {
+	return pb.dir
+}
+
+// Next returns the next fragment if pb is in the chain of a reassembled datagram
+func (pb *PktBuf) Next() *PktBuf {
+	return pb.next
+}
+
+func (pb *PktBuf) SetNext(next *PktBuf) {
+	pb.next = next
+}
+
+// Clone returns a copy of pb from the pool of pb, the data and the user data
+// offset, type, vid and direction of it, the caller holds the copy.
+func (pb *PktBuf) Clone() *PktBuf {
+	npb := GetPktFromPool(pb.pool)
+	npb.ptype = pb.ptype
+	npb.vid = pb.vid
+	npb.outBound = pb.outBound
+	npb.macHeader = pb.macHeader
+	npb.networkHeader = pb.networkHeader
+	npb.transportHeader = pb.transportHeader
+	npb.len = pb.len
+	copy(npb.buf[:pb.len], pb.buf[:pb.len])
+	return npb
+}
@@ -0,0 +1,220 @@
+// Package tcpstate tracks the state of a tcp connection by the segments of
+// both directions, it is shared by the conntrack of netstat and nat.
+package tcpstate
+
+import "time"
+
+// Flags of the tcp header, they are checked as a bitmask, so a syn with
+// ECE and CWR, or an ack with PSH, is still a syn or an ack.
+const (
+	FlagFin = 1 << iota
+	FlagSyn
+	FlagRst
+	FlagPsh
+	FlagAck
+	FlagUrg
+	FlagEce
+	FlagCwr
+)
+
+// directions of a segment, the same as ctOrigin and ctReply of conntrack
+const (
+	DirOrigin = 0
+	DirReply  = 1
+)
+
+// State is the state of a connection, like the tcp conntrack of linux
+type State uint8
+
+const (
+	None State = iota
+	SynSent
+	SynRecv
+	Established
+	FinWait   //one side has sent fin
+	CloseWait //the fin has been acked, the other side may still send data
+	LastAck   //both sides have sent fin
+	TimeWait  //both fins have been acked
+	Close     //reset
+	stateMax
+)
+
+var stateNames = [stateMax]string{
+	None:        "NONE",
+	SynSent:     "SYN_SENT",
+	SynRecv:     "SYN_RECV",
+	Established: "ESTABLISHED",
+	FinWait:     "FIN_WAIT",
+	CloseWait:   "CLOSE_WAIT",
+	LastAck:     "LAST_ACK",
+	TimeWait:    "TIME_WAIT",
+	Close:       "CLOSE",
+}
+
+func (s State) String() string {
+	if s >= stateMax {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+// Open reports whether data may still flow in the connection
+func (s State) Open() bool {
+	return s >= SynSent && s <= LastAck
+}
+
+// timeouts of every state, in seconds
+var timeouts = [stateMax]time.Duration{
+	None:        10,
+	SynSent:     3,
+	SynRecv:     3,
+	Established: 240,
+	FinWait:     10,
+	CloseWait:   60,
+	LastAck:     10,
+	TimeWait:    10,
+	Close:       10,
+}
+
+// Timeout returns how long a connection stays in s without any segment
+func Timeout(s State) time.Duration {
+	if s >= stateMax {
+		s = None
+	}
+	return time.Second * timeouts[s]
+}
+
+// Tracker is the state of a connection, it isn't safe for concurrent use,
+// the conntrack holding it must be locked.
+type Tracker struct {
+	state State
+	peer  [2]peer
+}
+
+// Result of an update
+type Result int
+
+const (
+	Accepted Result = iota
+	Invalid         //the segment doesn't fit the state or the window, state isn't changed
+)
+
+// IsSyn reports whether flags open a connection: syn without ack
+func IsSyn(flags uint8) bool {
+	return flags&(FlagSyn|FlagAck|FlagRst) == FlagSyn
+}
+
+// IsSynAck reports whether flags answer a syn
+func IsSynAck(flags uint8) bool {
+	return flags&(FlagSyn|FlagAck|FlagRst) == FlagSyn|FlagAck
+}
+
+// IsAck reports whether flags have ack, without syn and rst
+func IsAck(flags uint8) bool {
+	return flags&(FlagSyn|FlagAck|FlagRst) == FlagAck
+}
+
+// State returns the current state
+func (t *Tracker) State() State {
+	return t.state
+}
+
+// Update moves t by the segment seg of dir, it returns the state after it.
+// The segments out of the window don't change the state.
+func (t *Tracker) Update(dir int, seg *Segment) (State, Result) {
+	flags := seg.Flags
+	sender, receiver := &t.peer[dir], &t.peer[1-dir]
+
+	if flags&FlagRst != 0 {
+		if !t.inWindow(dir, seg) {
+			return t.state, Invalid
+		}
+		t.state = Close
+		return t.state, Accepted
+	}
+
+	switch t.state {
+	case None:
+		if !IsSyn(flags) || dir != DirOrigin {
+			return t.state, Invalid
+		}
+		t.state = SynSent
+	case SynSent:
+		switch {
+		case IsSyn(flags) && dir == DirOrigin:
+			//retransmission, the peer is started again
+			t.peer[dir] = peer{}
+		case IsSynAck(flags) && dir == DirReply:
+			t.state = SynRecv
+		case IsSyn(flags) && dir == DirReply:
+			//simultaneous open
+			t.state = SynRecv
+		default:
+			return t.state, Invalid
+		}
+	case SynRecv:
+		switch {
+		case IsSynAck(flags), IsSyn(flags):
+			//retransmission, or the syn ack of a simultaneous open
+		case flags&FlagAck != 0 && sender.synAcked:
+			//the syn of the sender has been answered
+			t.state = Established
+		default:
+			return t.state, Invalid
+		}
+	default:
+		if flags&FlagSyn != 0 {
+			if t.state >= TimeWait && IsSyn(flags) && dir == DirOrigin {
+				//the tuple is reused by a new connection
+				*t = Tracker{state: SynSent}
+				t.track(dir, seg)
+				return t.state, Accepted
+			}
+			if IsSynAck(flags) && dir == DirReply && t.state == Established {
+				//the syn ack is retransmitted, the ack is lost
+				break
+			}
+			return t.state, Invalid
+		}
+		if flags&FlagAck == 0 && flags&FlagFin == 0 {
+			return t.state, Invalid
+		}
+	}
+
+	if !t.inWindow(dir, seg) {
+		return t.state, Invalid
+	}
+	t.track(dir, seg)
+	if flags&FlagSyn != 0 && flags&FlagAck != 0 {
+		receiver.synAcked = true
+	}
+	t.closing(dir, seg)
+	return t.state, Accepted
+}
+
+// closing moves the state by the fins and the acks of them
+func (t *Tracker) closing(dir int, seg *Segment) {
+	if t.state < Established || t.state > LastAck {
+		return
+	}
+	sender, receiver := &t.peer[dir], &t.peer[1-dir]
+	if seg.Flags&FlagFin != 0 && !sender.finSent {
+		sender.finSent = true
+		sender.finEnd = seg.end()
+		if receiver.finSent {
+			t.state = LastAck
+		} else if t.state == Established {
+			t.state = FinWait
+		}
+	}
+	if seg.Flags&FlagAck != 0 && receiver.finSent && !receiver.finAcked && !before(seg.Ack, receiver.finEnd) {
+		receiver.finAcked = true
+	}
+	switch {
+	case t.peer[DirOrigin].finAcked && t.peer[DirReply].finAcked:
+		t.state = TimeWait
+	case t.state == FinWait && receiver.finAcked:
+		//half closed
+		t.state = CloseWait
+	}
+}
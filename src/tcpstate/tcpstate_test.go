@@ -0,0 +1,183 @@
+package tcpstate
+
+import "testing"
+
+const (
+	testWin   = 65535
+	testScale = 7
+)
+
+type tcpStep struct {
+	dir    int
+	seg    Segment
+	state  State
+	result Result
+}
+
+func syn(seq uint32, flags uint8) Segment {
+	return Segment{Seq: seq, Flags: FlagSyn | flags, Win: testWin, WScale: testScale}
+}
+
+func synAck(seq, ack uint32, flags uint8) Segment {
+	return Segment{Seq: seq, Ack: ack, Flags: FlagSyn | FlagAck | flags, Win: testWin, WScale: testScale}
+}
+
+// ack is a segment after the handshake, its window is scaled by testScale
+func ack(seq, ack uint32, flags uint8, dataLen int) Segment {
+	return Segment{Seq: seq, Ack: ack, Flags: FlagAck | flags, Win: testWin >> testScale, Len: dataLen, WScale: -1}
+}
+
+// feedSegs feeds the segments to t, every step must end in its state and
+// result.
+func feedSegs(t *testing.T, tr *Tracker, steps []tcpStep) {
+	for i, s := range steps {
+		state, res := tr.Update(s.dir, &s.seg)
+		if state != s.state || res != s.result {
+			t.Fatalf("step %d %+v: %s %d, want %s %d", i, s.seg, state, res, s.state, s.result)
+		}
+	}
+}
+
+// handshake opens a connection of the isns, the origin sends first
+func handshake(t *testing.T, isn, risn uint32) *Tracker {
+	tr := &Tracker{}
+	feedSegs(t, tr, []tcpStep{
+		{DirOrigin, syn(isn, 0), SynSent, Accepted},
+		{DirReply, synAck(risn, isn+1, 0), SynRecv, Accepted},
+		{DirOrigin, ack(isn+1, risn+1, 0, 0), Established, Accepted},
+	})
+	return tr
+}
+
+func TestTcpHandshake(t *testing.T) {
+	tr := handshake(t, 1000, 5000)
+	feedSegs(t, tr, []tcpStep{
+		{DirOrigin, ack(1001, 5001, FlagPsh, 100), Established, Accepted},
+		{DirReply, ack(5001, 1101, FlagPsh, 200), Established, Accepted},
+	})
+}
+
+func TestTcpNotSyn(t *testing.T) {
+	tr := &Tracker{}
+	feedSegs(t, tr, []tcpStep{
+		{DirOrigin, ack(1000, 5000, 0, 0), None, Invalid},
+		//the reply can't open a connection
+		{DirReply, syn(5000, 0), None, Invalid},
+		{DirOrigin, syn(1000, 0), SynSent, Accepted},
+		{DirOrigin, ack(1001, 5001, 0, 0), SynSent, Invalid},
+	})
+}
+
+func TestTcpSimultaneousOpen(t *testing.T) {
+	tr := &Tracker{}
+	feedSegs(t, tr, []tcpStep{
+		{DirOrigin, syn(1000, 0), SynSent, Accepted},
+		{DirReply, syn(5000, 0), SynRecv, Accepted},
+		{DirOrigin, synAck(1000, 5001, 0), SynRecv, Accepted},
+		{DirReply, synAck(5000, 1001, 0), SynRecv, Accepted},
+		{DirOrigin, ack(1001, 5001, 0, 0), Established, Accepted},
+	})
+}
+
+func TestTcpSynRetransmission(t *testing.T) {
+	tr := &Tracker{}
+	feedSegs(t, tr, []tcpStep{
+		{DirOrigin, syn(1000, 0), SynSent, Accepted},
+		{DirOrigin, syn(1000, 0), SynSent, Accepted},
+		{DirReply, synAck(5000, 1001, 0), SynRecv, Accepted},
+		//the syn ack is retransmitted, the ack is lost
+		{DirReply, synAck(5000, 1001, 0), SynRecv, Accepted},
+		{DirOrigin, ack(1001, 5001, 0, 0), Established, Accepted},
+		{DirReply, synAck(5000, 1001, 0), Established, Accepted},
+		//a syn of the origin doesn't start an established one again
+		{DirOrigin, syn(9000, 0), Established, Invalid},
+	})
+}
+
+func TestTcpClose(t *testing.T) {
+	tr := handshake(t, 1000, 5000)
+	feedSegs(t, tr, []tcpStep{
+		{DirOrigin, ack(1001, 5001, FlagFin, 0), FinWait, Accepted},
+		{DirReply, ack(5001, 1002, 0, 0), CloseWait, Accepted},
+		//half closed, the reply may still send data
+		{DirReply, ack(5001, 1002, FlagPsh, 100), CloseWait, Accepted},
+		{DirReply, ack(5101, 1002, FlagFin, 0), LastAck, Accepted},
+		{DirOrigin, ack(1002, 5102, 0, 0), TimeWait, Accepted},
+		//the tuple is reused by a new connection
+		{DirOrigin, syn(90000, 0), SynSent, Accepted},
+	})
+}
+
+func TestTcpRst(t *testing.T) {
+	tr := handshake(t, 1000, 5000)
+	seq := uint32(5001)
+	feedSegs(t, tr, []tcpStep{
+		//past the window the origin advertised
+		{DirReply, Segment{Seq: seq + 200000, Flags: FlagRst}, Established, Invalid},
+		{DirReply, Segment{Seq: seq - 200000, Flags: FlagRst}, Established, Invalid},
+		{DirReply, Segment{Seq: seq, Flags: FlagRst}, Close, Accepted},
+	})
+	if tr.State().Open() {
+		t.Fatalf("%s is open", tr.State())
+	}
+}
+
+func TestTcpWindow(t *testing.T) {
+	tr := handshake(t, 1000, 5000)
+	feedSegs(t, tr, []tcpStep{
+		//the window of the syn ack isn't scaled, the data after it is out
+		{DirOrigin, ack(1001+testWin+1, 5001, 0, 10), Established, Invalid},
+		//the ack of data the reply hasn't sent
+		{DirOrigin, ack(1001, 5001+100, 0, 0), Established, Invalid},
+		{DirOrigin, ack(1001+testWin-10, 5001, 0, 10), Established, Accepted},
+	})
+}
+
+func TestTcpSeqWrap(t *testing.T) {
+	if !before(0xfffffff0, 0x10) || after(0xfffffff0, 0x10) {
+		t.Fatal("0xfffffff0 isn't before 0x10")
+	}
+	if !after(0x10, 0xfffffff0) || before(0x10, 0xfffffff0) {
+		t.Fatal("0x10 isn't after 0xfffffff0")
+	}
+	if before(5, 5) || after(5, 5) {
+		t.Fatal("5 is before or after itself")
+	}
+	tr := handshake(t, 0xfffffffe, 0xffffff00)
+	rseq := uint32(0xffffff01)
+	feedSegs(t, tr, []tcpStep{
+		//the data of both wraps the sequence space
+		{DirOrigin, ack(0xffffffff, rseq, FlagPsh, 100), Established, Accepted},
+		{DirReply, ack(rseq, 99, FlagPsh, 1000), Established, Accepted},
+		{DirOrigin, ack(99, rseq+1000, FlagFin, 0), FinWait, Accepted},
+		{DirReply, ack(rseq+1000, 100, FlagFin, 0), LastAck, Accepted},
+		{DirOrigin, ack(100, rseq+1001, 0, 0), TimeWait, Accepted},
+	})
+}
+
+func TestTcpEcn(t *testing.T) {
+	if !IsSyn(FlagSyn|FlagEce|FlagCwr) || !IsSynAck(FlagSyn|FlagAck|FlagEce) || !IsAck(FlagAck|FlagPsh) {
+		t.Fatal("ECE, CWR or PSH changes the type of a segment")
+	}
+	tr := &Tracker{}
+	feedSegs(t, tr, []tcpStep{
+		{DirOrigin, syn(1000, FlagEce|FlagCwr), SynSent, Accepted},
+		{DirReply, synAck(5000, 1001, FlagEce|FlagPsh), SynRecv, Accepted},
+		{DirOrigin, ack(1001, 5001, FlagPsh|FlagCwr, 10), Established, Accepted},
+	})
+}
+
+func TestParseSegment(t *testing.T) {
+	hdr := make([]byte, 28)
+	hdr[12] = 7 << 4
+	hdr[13] = FlagSyn
+	hdr[15] = 0xff
+	copy(hdr[20:], []byte{optNop, optWScale, 3, 20, optEnd})
+	seg, ok := ParseSegment(hdr, 28+10)
+	if !ok || seg.Flags != FlagSyn || seg.Win != 0xff || seg.Len != 10 || seg.WScale != maxWindowScale {
+		t.Fatalf("%v %+v", ok, seg)
+	}
+	if _, ok := ParseSegment(hdr, 20); ok {
+		t.Fatal("the segment is shorter than the header")
+	}
+}
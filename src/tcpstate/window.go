@@ -0,0 +1,172 @@
+package tcpstate
+
+import "encoding/binary"
+
+const (
+	minHeaderSize  = 20
+	maxWindowScale = 14
+	minAckWindow   = 66000 //like MAXACKWINDOW of linux
+
+	optEnd    = 0
+	optNop    = 1
+	optWScale = 3
+)
+
+// Segment is what the tracker needs of a tcp segment
+type Segment struct {
+	Seq    uint32
+	Ack    uint32
+	Win    uint16
+	Flags  uint8
+	Len    int //length of the payload
+	WScale int //window scale option of a syn, -1 if there is none
+}
+
+// peer is what has been seen of one side of the connection
+type peer struct {
+	init     bool
+	end      uint32 //the highest seq + len sent
+	maxEnd   uint32 //the highest seq the other side allows to send
+	maxWin   uint32 //the largest window advertised, scaled
+	scale    uint8
+	wscale   bool //the window scale option is in the syn
+	synAcked bool
+	finSent  bool
+	finAcked bool
+	finEnd   uint32
+}
+
+// before reports whether seq a is before b, in the sequence space
+func before(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func after(a, b uint32) bool {
+	return before(b, a)
+}
+
+// end returns the seq after the segment, syn and fin take one
+func (seg *Segment) end() uint32 {
+	end := seg.Seq + uint32(seg.Len)
+	if seg.Flags&FlagSyn != 0 {
+		end++
+	}
+	if seg.Flags&FlagFin != 0 {
+		end++
+	}
+	return end
+}
+
+// ParseSegment parses the tcp header hdr of a segment of segLen bytes, the
+// header and the payload. segLen is from the ip header, hdr may have the
+// padding of the ether frame after the segment.
+func ParseSegment(hdr []byte, segLen int) (seg Segment, ok bool) {
+	if len(hdr) < minHeaderSize {
+		return
+	}
+	dataOff := int(hdr[12]>>4) * 4
+	if dataOff < minHeaderSize || dataOff > len(hdr) || segLen < dataOff {
+		return
+	}
+	seg.Seq = binary.BigEndian.Uint32(hdr[4:])
+	seg.Ack = binary.BigEndian.Uint32(hdr[8:])
+	seg.Flags = hdr[13]
+	seg.Win = binary.BigEndian.Uint16(hdr[14:])
+	seg.Len = segLen - dataOff
+	seg.WScale = -1
+	if seg.Flags&FlagSyn != 0 {
+		seg.WScale = windowScale(hdr[minHeaderSize:dataOff])
+	}
+	return seg, true
+}
+
+// windowScale returns the window scale option, -1 if there is none
+func windowScale(opts []byte) int {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case optEnd:
+			return -1
+		case optNop:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return -1
+		}
+		if opts[0] == optWScale && opts[1] == 3 {
+			if opts[2] > maxWindowScale {
+				return maxWindowScale
+			}
+			return int(opts[2])
+		}
+		opts = opts[opts[1]:]
+	}
+	return -1
+}
+
+// inWindow checks seg of dir against what has been seen of both sides,
+// like tcp_in_window of linux: the data must be in the window the receiver
+// advertised, and the ack must be of the data the receiver has sent.
+func (t *Tracker) inWindow(dir int, seg *Segment) bool {
+	sender, receiver := &t.peer[dir], &t.peer[1-dir]
+	if !sender.init || !receiver.init || seg.Flags&FlagSyn != 0 {
+		//nothing to check against, or the syn starts the sender again
+		return true
+	}
+	end := seg.end()
+	if after(seg.Seq, sender.maxEnd) || !after(end, sender.end-receiver.maxWin-1) {
+		return false
+	}
+	if seg.Flags&FlagAck != 0 {
+		ackWin := sender.maxWin
+		if ackWin < minAckWindow {
+			ackWin = minAckWindow
+		}
+		if after(seg.Ack, receiver.end) || !after(seg.Ack, receiver.end-ackWin-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// track records seg of dir, which is in the window
+func (t *Tracker) track(dir int, seg *Segment) {
+	sender, receiver := &t.peer[dir], &t.peer[1-dir]
+	end := seg.end()
+	win := uint32(seg.Win)
+	if seg.Flags&FlagSyn != 0 {
+		//the window of a syn isn't scaled
+		sender.wscale = seg.WScale >= 0
+		sender.scale = 0
+		if sender.wscale {
+			sender.scale = uint8(seg.WScale)
+		}
+		if seg.Flags&FlagAck != 0 && !(sender.wscale && receiver.wscale) {
+			//the scale is used only if both sides have the option
+			sender.scale, receiver.scale = 0, 0
+		}
+	} else {
+		win <<= sender.scale
+	}
+
+	if !sender.init {
+		sender.init = true
+		sender.end = end
+		sender.maxEnd = end
+	}
+	if after(end, sender.end) {
+		sender.end = end
+	}
+	if win == 0 {
+		win = 1
+	}
+	if win > sender.maxWin {
+		sender.maxWin = win
+	}
+	if seg.Flags&FlagAck != 0 {
+		//the receiver may send up to the window the sender advertised
+		if maxEnd := seg.Ack + win; !receiver.init || after(maxEnd, receiver.maxEnd) {
+			receiver.maxEnd = maxEnd
+		}
+	}
+}
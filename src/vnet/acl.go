@@ -0,0 +1,78 @@
+package vnet
+
+import (
+	"acl"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// aclRuleFromQuery reads a rule from the query like the fields of the config
+func aclRuleFromQuery(query url.Values) acl.Rule {
+	return acl.Rule{
+		SrcMac: query.Get("srcmac"),
+		DstMac: query.Get("dstmac"),
+		Src:    query.Get("src"),
+		Dst:    query.Get("dst"),
+		Proto:  query.Get("proto"),
+		Sport:  query.Get("sport"),
+		Dport:  query.Get("dport"),
+		State:  query.Get("state"),
+		Action: query.Get("action"),
+	}
+}
+
+// showAcl shows the acls, or edits the acl of a vid:
+// /acl?op=add&vid=100[&index=0]&proto=tcp&dport=22&action=drop
+// /acl?op=del&vid=100&index=0
+// /acl?op=policy&vid=100&policy=drop
+// /acl?op=flush&vid=100
+func showAcl(w http.ResponseWriter, req *http.Request) {
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	op := query.Get("op")
+	if op == "" {
+		acls, err := json.MarshalIndent(acl.ShowAcls(), "", "\t")
+		if err != nil {
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write(acls)
+		return
+	}
+
+	vid, err := strconv.Atoi(query.Get("vid"))
+	if err != nil {
+		fmt.Fprintf(w, "invalid vid %s\n", query.Get("vid"))
+		return
+	}
+	index := -1
+	if s := query.Get("index"); s != "" {
+		if index, err = strconv.Atoi(s); err != nil {
+			fmt.Fprintf(w, "invalid index %s\n", s)
+			return
+		}
+	}
+	switch op {
+	case "add":
+		err = acl.AddRule(vid, index, aclRuleFromQuery(query))
+	case "del":
+		err = acl.DelRule(vid, index)
+	case "policy":
+		err = acl.SetPolicy(vid, query.Get("policy"))
+	case "flush":
+		acl.DelVidAcl(vid)
+	default:
+		err = fmt.Errorf("unknown op %s, op=add|del|policy|flush", op)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err.Error())
+		return
+	}
+	fmt.Fprintf(w, "acl %s vid=%d success\n", op, vid)
+}
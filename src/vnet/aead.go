@@ -0,0 +1,238 @@
+package vnet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	aeadKeySize     = 32
+	aeadSaltSize    = 16
+	aeadSeqSize     = 8
+	aeadNonceSize   = aeadSaltSize + aeadSeqSize //the nonce carried in a frame
+	aeadCipherNonce = 12                         //the nonce of the cipher, the tail of the frame nonce
+	aeadTagSize     = 16
+	aeadOverhead    = aeadNonceSize + aeadTagSize
+	aeadStaticInfo  = "govnet aead static key "
+	frameBufSize    = 2048
+	maxAeadFrameLen = L2PktMaxSize + aeadOverhead
+)
+
+var (
+	errAeadOpen     = errors.New("aead open fail, bad tag")
+	errAeadTooShort = errors.New("aead frame too short")
+	errAeadNoKey    = errors.New("no aead key")
+	errAeadSalt     = errors.New("aead salt isn't the one of the peer")
+
+	aeadStaticKey []byte
+
+	staticSaltsLock  sync.Mutex
+	staticSalts      = make(map[[aeadSaltSize]byte]bool) //replaced as a whole on change
+	staticSaltsValue atomic.Value                        //staticSalts for the readers
+)
+
+// aeadCrypt seals every frame with a fresh nonce: a random per-instance salt
+// followed by a 64-bit counter. The nonce is carried in front of the
+// ciphertext and the PktHeader is the additional data, so a tampered header
+// or payload fails to open. With the static key the key of an instance is
+// derived from its salt, the counters of all the instances, which all start
+// at 1, never share a key, even across restarts.
+type aeadCrypt struct {
+	ct      byte
+	aead    cipher.AEAD
+	opener  cipher.AEAD //a session has a key per direction, nil for the static key
+	salt    [aeadSaltSize]byte
+	seq     uint64
+	session bool
+}
+
+// staticOpener keeps the key derived from the salt of the peer, the peer
+// seals all the frames of a conn with one salt. It is only used by the
+// reader of the client, so there is no lock.
+type staticOpener struct {
+	ct   byte
+	salt [aeadSaltSize]byte
+	aead cipher.AEAD
+}
+
+func isAeadType(ct byte) bool {
+	return ct == CRY_AESGCM || ct == CRY_CHACHA20
+}
+
+func newAead(ct byte, key []byte) (cipher.AEAD, error) {
+	switch ct {
+	case CRY_AESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CRY_CHACHA20:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("crypt type %d is not aead", ct)
+}
+
+func newAeadCrypt(ct byte) (*aeadCrypt, error) {
+	ac := &aeadCrypt{ct: ct}
+	if _, err := io.ReadFull(rand.Reader, ac.salt[:]); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
+
+// newStaticAead seals with the static key derived for a random salt
+func newStaticAead(ct byte) (*aeadCrypt, error) {
+	ac, err := newAeadCrypt(ct)
+	if err != nil {
+		return nil, err
+	}
+	if ac.aead, err = newAead(ct, staticAeadKey(ct, ac.salt[:])); err != nil {
+		return nil, err
+	}
+	setStaticSalt(ac.salt, true)
+	return ac, nil
+}
+
+// setStaticSalt adds or deletes a salt of the static aeads of the node, a
+// frame of any of them is sent back to the node by a peer or a loop.
+func setStaticSalt(salt [aeadSaltSize]byte, add bool) {
+	staticSaltsLock.Lock()
+	salts := make(map[[aeadSaltSize]byte]bool, len(staticSalts)+1)
+	for s := range staticSalts {
+		salts[s] = true
+	}
+	if add {
+		salts[salt] = true
+	} else {
+		delete(salts, salt)
+	}
+	staticSalts = salts
+	staticSaltsValue.Store(salts)
+	staticSaltsLock.Unlock()
+}
+
+func isStaticSalt(salt []byte) bool {
+	salts, _ := staticSaltsValue.Load().(map[[aeadSaltSize]byte]bool)
+	var s [aeadSaltSize]byte
+	copy(s[:], salt)
+	return salts[s]
+}
+
+// release forgets the salt of a static aead which seals no more
+func (ac *aeadCrypt) release() {
+	if ac != nil && !ac.session {
+		setStaticSalt(ac.salt, false)
+	}
+}
+
+// newSessionAead seals with txKey and opens with rxKey, the keys come from the handshake
+func newSessionAead(ct byte, txKey, rxKey []byte) (*aeadCrypt, error) {
+	ac, err := newAeadCrypt(ct)
+	if err != nil {
+		return nil, err
+	}
+	if ac.aead, err = newAead(ct, txKey); err != nil {
+		return nil, err
+	}
+	if ac.opener, err = newAead(ct, rxKey); err != nil {
+		return nil, err
+	}
+	ac.session = true
+	return ac, nil
+}
+
+func deriveKey(secret, salt []byte, info string) []byte {
+	key := make([]byte, aeadKeySize)
+	kdf := hkdf.New(sha256.New, secret, salt, []byte(info))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func staticAeadKey(ct byte, salt []byte) []byte {
+	return deriveKey(aeadStaticKey, salt, aeadStaticInfo+CRYtoString[ct])
+}
+
+// cipherNonce is the nonce of the cipher in the frame nonce, the salt is in
+// the key already with the static key, the counter is unique per key.
+func cipherNonce(nonce []byte) []byte {
+	return nonce[aeadNonceSize-aeadCipherNonce : aeadNonceSize]
+}
+
+// seal encrypts plain into frame[PktHeaderSize:] as nonce|ciphertext|tag, and
+// fixes up pktLen and pktCrypt of the header in frame[:PktHeaderSize] first
+// since the header is authenticated.
+func (ac *aeadCrypt) seal(frame []byte, plain []byte) []byte {
+	hdr := frame[:PktHeaderSize]
+	nonce := frame[PktHeaderSize : PktHeaderSize+aeadNonceSize]
+	copy(nonce, ac.salt[:])
+	binary.BigEndian.PutUint64(nonce[aeadSaltSize:], atomic.AddUint64(&ac.seq, 1))
+
+	setPktLen(hdr, aeadNonceSize+len(plain)+aeadTagSize)
+	setCryptoType(hdr, ac.ct)
+	sealed := ac.aead.Seal(frame[PktHeaderSize+aeadNonceSize:PktHeaderSize+aeadNonceSize], cipherNonce(nonce), plain, hdr)
+	return frame[:PktHeaderSize+aeadNonceSize+len(sealed)]
+}
+
+// openFrame decrypts the frame payload in place and returns the plaintext,
+// which starts aeadNonceSize bytes after the payload.
+func openFrame(aead cipher.AEAD, hdr []byte, payload []byte) ([]byte, error) {
+	nonce := payload[:aeadNonceSize]
+	ciphertext := payload[aeadNonceSize:]
+	plain, err := aead.Open(ciphertext[:0], cipherNonce(nonce), ciphertext, hdr)
+	if err != nil {
+		return nil, errAeadOpen
+	}
+	return plain, nil
+}
+
+// getOpenAead returns the aead used to open the frame payload of crypt type ct
+func (c *Client) getOpenAead(ct byte, payload []byte) (cipher.AEAD, error) {
+	if len(payload) < aeadOverhead {
+		return nil, errAeadTooShort
+	}
+	if c.aead != nil && c.aead.session {
+		//a session never falls back to the static key
+		if c.aead.ct != ct {
+			return nil, errAeadNoKey
+		}
+		return c.aead.opener, nil
+	}
+	if aeadStaticKey == nil {
+		return nil, errAeadNoKey
+	}
+	//no key is derived for a salt the replay filter would drop anyway
+	salt := payload[:aeadSaltSize]
+	if c.replay.saltSet && !bytes.Equal(c.replay.salt[:], salt) {
+		return nil, errAeadSalt
+	}
+	return c.staticOpen.get(ct, salt)
+}
+
+func (so *staticOpener) get(ct byte, salt []byte) (cipher.AEAD, error) {
+	if so.aead != nil && so.ct == ct && bytes.Equal(so.salt[:], salt) {
+		return so.aead, nil
+	}
+	aead, err := newAead(ct, staticAeadKey(ct, salt))
+	if err != nil {
+		return nil, err
+	}
+	so.ct = ct
+	copy(so.salt[:], salt)
+	so.aead = aead
+	return aead, nil
+}
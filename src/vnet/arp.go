@@ -0,0 +1,208 @@
+package vnet
+
+import (
+	"encoding/json"
+	"fdb"
+	"fmt"
+	"io"
+	"mylog"
+	"net/http"
+	"net/url"
+	"packet"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// the ArpMsg of a vid is a flags byte and the ip, mac entries snooped by the
+// arp proxy of the node, the peers answer the arp requests of the ips
+// instead of flooding them. A node only sends it for the vids of arpproxy,
+// all the nodes of such a vid must know ArpMsg.
+const (
+	ArpAdvIntv       = 30 //second
+	arpEntrySize     = 10 //ip, mac
+	arpMsgFirst      = 0x01
+	arpMsgMaxEntries = (L2PktMaxSize - 1) / arpEntrySize
+)
+
+// arpAdvertise sends the arp entries to all conn clients periodically, and
+// whenever an arp proxy snooped a new one.
+func arpAdvertise() {
+	tick := time.Tick(time.Second * ArpAdvIntv)
+	for {
+		select {
+		case <-tick:
+		case <-fdb.ArpUpdates():
+			//the arps snooped in a burst go in one advertisement
+			time.Sleep(time.Second)
+		}
+		ConnClientsLock.Lock()
+		clients := make([]*Client, 0, len(ConnClients))
+		for _, c := range ConnClients {
+			clients = append(clients, c)
+		}
+		ConnClientsLock.Unlock()
+		for _, c := range clients {
+			c.reportArpMsg()
+		}
+	}
+}
+
+// reportArpMsg advertises the arp entries of every arp proxy fdb the client
+// joined, but the ones snooped on the client itself. The entries of a vid
+// replace the ones the peer has from the client, in several ArpMsg if they
+// are more than one holds, an empty one withdraws all of them.
+func (c *Client) reportArpMsg() {
+	master := c
+	if c.master != nil {
+		master = c.master
+	}
+	master.RLock()
+	var fps []fdbPort
+	var vids []int
+	for vid, fp := range master.fdbJoined {
+		if fp.fdb.IsArpProxy() {
+			fps = append(fps, fp)
+			vids = append(vids, vid)
+		}
+	}
+	master.RUnlock()
+
+	for i, fp := range fps {
+		entries := fp.fdb.ExportArps(master)
+		flags := byte(arpMsgFirst)
+		for {
+			n := len(entries)
+			if n > arpMsgMaxEntries {
+				n = arpMsgMaxEntries
+			}
+			pb := c.getPktBuf()
+			buf := pb.LoadBuf()
+			msg := append(buf[PktHeaderSize:PktHeaderSize], flags)
+			for _, e := range entries[:n] {
+				msg = append(msg, e.IP[:]...)
+				msg = append(msg, e.Mac[:]...)
+			}
+			assemblePktHead(ArpMsg, buf[:PktHeaderSize], len(msg), vids[i])
+			pb.SetDataLen(PktHeaderSize + len(msg))
+			pb.SetUserDataOff(PktHeaderSize)
+			c.PutPktToChan2(pb)
+			putPktBuf(pb)
+			entries = entries[n:]
+			if len(entries) == 0 {
+				break
+			}
+			flags = 0
+		}
+	}
+}
+
+func (c *Client) handleArpMsg(vid int, msg []byte) error {
+	if len(msg) < 1 || (len(msg)-1)%arpEntrySize != 0 {
+		return fmt.Errorf("len(msg)=%d, -1 %%%d != 0 ", len(msg), arpEntrySize)
+	}
+	port := c
+	if c.master != nil {
+		port = c.master
+	}
+	fp, ok := port.GetFdbById(vid)
+	if !ok {
+		mylog.Warning("%s advertise arps of vid=%d, but it don't join\n", c.String(), vid)
+		return nil
+	}
+
+	entries := make([]fdb.ArpEntry, 0, (len(msg)-1)/arpEntrySize)
+	for off := 1; off < len(msg); off += arpEntrySize {
+		var e fdb.ArpEntry
+		copy(e.IP[:], msg[off:off+4])
+		copy(e.Mac[:], msg[off+4:off+arpEntrySize])
+		entries = append(entries, e)
+	}
+	fp.fdb.SetPortArps(port, entries, msg[0]&arpMsgFirst != 0)
+	return nil
+}
+
+func ArpMsgPktHandle(c *Client, cr io.Reader, pb *packet.PktBuf, ph *PktHeader) (rn int, err error) {
+	pktLen := ph.pktLen
+	if int(pktLen) > L2PktMaxSize+aeadOverhead {
+		err = fmt.Errorf("ArpMsgPktHandle: recv pktLen =%d is invalid", pktLen)
+		return
+	}
+
+	pkt, _, err := c.readPayload(cr, pb, ph)
+	if err != nil || pkt == nil {
+		return
+	}
+	rn = int(pktLen)
+
+	if err = c.handleArpMsg(int(ph.vid), pkt); err != nil {
+		mylog.Error("handleArpMsg: %s \n", err.Error())
+		return
+	}
+	return
+}
+
+// ArpProxyInfo is the arp proxy of a vid
+type ArpProxyInfo struct {
+	Vid     int
+	Replies uint64
+	Misses  uint64
+	Entries []fdb.ArpInfo
+}
+
+// showArp shows the arp proxies: /arp, /arp?vid=3, /arp?op=flush&vid=3
+func showArp(w http.ResponseWriter, req *http.Request) {
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var ids []int
+	if s := query.Get("vid"); s != "" {
+		vid, err := strconv.Atoi(s)
+		if err != nil {
+			fmt.Fprintf(w, "invalid vid %s\n", s)
+			return
+		}
+		ids = []int{vid}
+	} else if query.Get("op") != "" {
+		fmt.Fprintf(w, "no vid\n")
+		return
+	} else {
+		ids = fdb.GetFdbIds()
+		sort.Ints(ids)
+	}
+
+	switch op := query.Get("op"); op {
+	case "":
+	case "flush":
+		f, ok := fdb.GetFdbById(ids[0])
+		if !ok {
+			fmt.Fprintf(w, "no fdb of vid %d\n", ids[0])
+			return
+		}
+		f.FlushArps()
+		fmt.Fprintf(w, "arp vid=%d flush success\n", ids[0])
+		return
+	default:
+		fmt.Fprintf(w, "unknown op %s, op=flush\n", op)
+		return
+	}
+
+	infos := make([]ArpProxyInfo, 0, len(ids))
+	for _, vid := range ids {
+		f, ok := fdb.GetFdbById(vid)
+		if !ok || !f.IsArpProxy() {
+			continue
+		}
+		info := ArpProxyInfo{Vid: vid, Entries: f.ShowArps()}
+		_, info.Replies, info.Misses = f.ArpStats()
+		infos = append(infos, info)
+	}
+	buf, err := json.MarshalIndent(infos, "", "\t")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(buf)
+}
@@ -7,10 +7,15 @@ import (
 	"packet"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type backupLink struct {
+	//first, atomic 64-bit ops need it 8-byte aligned on 386 and arm
+	txDropBytes uint64
+	rxDropBytes uint64
+	failovers   uint64
 	c           *Client
 	activeSlave *Client
 	sync.Mutex
@@ -19,8 +24,7 @@ type backupLink struct {
 	recvQueue     chan *packet.PktBuf
 	rxBytes       uint64
 	txBytes       uint64
-	rxDropBytes   uint64
-	txDropBytes   uint64
+	everActive    bool
 }
 
 var wg sync.WaitGroup
@@ -61,7 +65,7 @@ func (bl *backupLink) Write(pkt *packet.PktBuf) (n int, err error) {
 		n = int(pkt.GetDataLen())
 		bl.txBytes += uint64(n)
 	} else {
-		bl.txDropBytes += uint64(pkt.GetDataLen())
+		atomic.AddUint64(&bl.txDropBytes, uint64(pkt.GetDataLen()))
 	}
 	return
 }
@@ -146,9 +150,17 @@ func (master *Client) BackupClient(isReconnet bool, dialer Dialer, ncInfo interf
 	for {
 		conn := dialer.Connect(ncInfo)
 		slave, _ := CreateConnClient(conn)
+		if err := slave.authenticate(true); err != nil {
+			mylog.Error("%s, so Close %s\n", err.Error(), slave.String())
+			slave.cio.Close()
+			time.Sleep(time.Second * 2)
+			continue
+		}
+		slave.setCryptType(CryptType)
 		master.addBackup(slave)
 		slave.Working()
 		slave.reportFdbMsg()
+		slave.reportRouteMsg()
 
 		if !isReconnet {
 			break
@@ -218,6 +230,10 @@ func (c *Client) MasterWorking() {
 		bc.Lock()
 		if !bc.IsClose() {
 			bl.activeSlave = bc
+			if bl.everActive {
+				atomic.AddUint64(&bl.failovers, 1)
+			}
+			bl.everActive = true
 			wg.Add(1)
 		}
 		bc.Unlock()
@@ -0,0 +1,317 @@
+package vnet
+
+import (
+	"acl"
+	"fdb"
+	"fmt"
+	"mylog"
+	"net/http"
+	"net/url"
+	"packet"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lab11/go-tuntap/tuntap"
+)
+
+const (
+	defCaptureCount   = 1000
+	defCaptureBytes   = 16 << 20
+	maxCaptureBytes   = 256 << 20 //the hard cap of a capture
+	defCaptureSeconds = 60
+	maxCaptureSeconds = 3600
+	defCaptureSnapLen = 65535
+	captureQueueLen   = 1024
+	captureFlushEvery = 100 * time.Millisecond
+)
+
+// captureRecord is a packet tapped for a capture, data is a copy
+type captureRecord struct {
+	ifc      captureIf
+	ts       time.Time
+	data     []byte
+	origLen  int
+	outBound bool
+}
+
+// captureSession is a capture of the packets forwarded, the records are
+// queued to the http handler which writes them, they are dropped if the
+// queue is full.
+type captureSession struct {
+	vid     int //-1 is any
+	client  string
+	filter  *acl.Filter
+	snapLen int
+	records chan captureRecord
+	dropped uint64
+}
+
+var captureLock sync.Mutex
+var captures []*captureSession //replaced as a whole on change
+var captureValue atomic.Value  //captures for the forwarding path
+
+func addCapture(cs *captureSession) {
+	captureLock.Lock()
+	captures = append(captures[:len(captures):len(captures)], cs)
+	captureValue.Store(captures)
+	captureLock.Unlock()
+}
+
+func delCapture(cs *captureSession) {
+	captureLock.Lock()
+	sessions := make([]*captureSession, 0, len(captures))
+	for _, s := range captures {
+		if s != cs {
+			sessions = append(sessions, s)
+		}
+	}
+	captures = sessions
+	captureValue.Store(captures)
+	captureLock.Unlock()
+}
+
+// captureL3 reports whether the packets of c in vid are ip packets: the
+// routed vids, or a tun without vid.
+func captureL3(c *Client, vid int) bool {
+	if fp, ok := c.GetFdbById(vid); ok {
+		return fp.fdb.IsRouted()
+	}
+	return *TunType != int(tuntap.DevTap)
+}
+
+// captureLinkType is the link type captureL3 implies for the packets of vid,
+// ethernet for any vid.
+func captureLinkType(vid int) uint16 {
+	if vid < 0 {
+		return linkTypeEthernet
+	}
+	if f, ok := fdb.GetFdbById(vid); ok {
+		if f.IsRouted() {
+			return linkTypeRaw
+		}
+		return linkTypeEthernet
+	}
+	if *TunType != int(tuntap.DevTap) {
+		return linkTypeRaw
+	}
+	return linkTypeEthernet
+}
+
+// captureTap copies pkt to the captures it matches, it is called by
+// ForwardPkt for every packet, so it does nothing if there is no capture.
+func captureTap(c *Client, pkt *packet.PktBuf) {
+	sessions, _ := captureValue.Load().([]*captureSession)
+	if len(sessions) == 0 {
+		return
+	}
+	vid := int(pkt.GetPktVid())
+	data := pkt.LoadUserData()
+	name := c.String()
+	l3 := captureL3(c, vid)
+	for _, cs := range sessions {
+		if cs.vid >= 0 && cs.vid != vid {
+			continue
+		}
+		if cs.client != "" && !strings.Contains(name, cs.client) {
+			continue
+		}
+		if !cs.filter.Match(data, l3) {
+			continue
+		}
+		rec := captureRecord{
+			ifc:      captureIf{client: name, vid: vid, linkType: linkTypeEthernet},
+			ts:       time.Now(),
+			origLen:  len(data),
+			outBound: pkt.IsOutBound(),
+		}
+		if l3 {
+			rec.ifc.linkType = linkTypeRaw
+		}
+		n := len(data)
+		if n > cs.snapLen {
+			n = cs.snapLen
+		}
+		rec.data = append([]byte(nil), data[:n]...)
+		select {
+		case cs.records <- rec:
+		default:
+			atomic.AddUint64(&cs.dropped, 1)
+		}
+	}
+}
+
+// captureFilter builds the filter of the query, host and port match either
+// side of a packet, like tcpdump.
+func captureFilter(query url.Values) (*acl.Filter, error) {
+	base := acl.Rule{
+		SrcMac: query.Get("srcmac"),
+		DstMac: query.Get("dstmac"),
+		Src:    query.Get("src"),
+		Dst:    query.Get("dst"),
+		Proto:  query.Get("proto"),
+		Sport:  query.Get("sport"),
+		Dport:  query.Get("dport"),
+	}
+	if base == (acl.Rule{}) && query.Get("host") == "" && query.Get("port") == "" {
+		return acl.NewFilter(nil)
+	}
+	rules := []acl.Rule{base}
+	if host := query.Get("host"); host != "" {
+		var hostRules []acl.Rule
+		for _, r := range rules {
+			src, dst := r, r
+			src.Src, dst.Dst = host, host
+			hostRules = append(hostRules, src, dst)
+		}
+		rules = hostRules
+	}
+	if port := query.Get("port"); port != "" {
+		var portRules []acl.Rule
+		for _, r := range rules {
+			for _, proto := range []string{"tcp", "udp"} {
+				if r.Proto != "" && !strings.EqualFold(r.Proto, proto) {
+					continue
+				}
+				src, dst := r, r
+				src.Proto, dst.Proto = proto, proto
+				src.Sport, dst.Dport = port, port
+				portRules = append(portRules, src, dst)
+			}
+		}
+		if len(portRules) == 0 {
+			return nil, fmt.Errorf("port needs proto tcp or udp")
+		}
+		rules = portRules
+	}
+	return acl.NewFilter(rules)
+}
+
+func queryInt(query url.Values, key string, def, min, max int) (int, error) {
+	s := query.Get(key)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("invalid %s %s, it is %d-%d", key, s, min, max)
+	}
+	return v, nil
+}
+
+// showCapture streams the packets of ForwardPkt as a pcapng file, or a pcap
+// file of the link type of vid with format=pcap, until count packets, bytes
+// of the file or seconds:
+// /capture?vid=3&client=10.0.0.1&count=1000&bytes=1048576&seconds=60&snaplen=128
+// and the filter: srcmac, dstmac, src, dst, host, proto, sport, dport, port
+func showCapture(w http.ResponseWriter, req *http.Request) {
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	vid, err := queryInt(query, "vid", -1, 0, 4095)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err.Error())
+		return
+	}
+	count, err := queryInt(query, "count", defCaptureCount, 1, 1<<30)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err.Error())
+		return
+	}
+	maxBytes, err := queryInt(query, "bytes", defCaptureBytes, 1, maxCaptureBytes)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err.Error())
+		return
+	}
+	seconds, err := queryInt(query, "seconds", defCaptureSeconds, 1, maxCaptureSeconds)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err.Error())
+		return
+	}
+	snapLen, err := queryInt(query, "snaplen", defCaptureSnapLen, 14, defCaptureSnapLen)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err.Error())
+		return
+	}
+	filter, err := captureFilter(query)
+	if err != nil {
+		fmt.Fprintf(w, "invalid filter: %s\n", err.Error())
+		return
+	}
+	var enc captureEncoder
+	switch query.Get("format") {
+	case "", "pcapng":
+		enc = newPcapngEncoder(snapLen)
+	case "pcap":
+		enc = newPcapEncoder(snapLen, captureLinkType(vid))
+	default:
+		fmt.Fprintf(w, "invalid format %s, format=pcapng|pcap\n", query.Get("format"))
+		return
+	}
+
+	cs := &captureSession{
+		vid:     vid,
+		client:  query.Get("client"),
+		filter:  filter,
+		snapLen: snapLen,
+		records: make(chan captureRecord, captureQueueLen),
+	}
+	addCapture(cs)
+	defer delCapture(cs)
+	mylog.Info("capture start: %s from %s\n", req.URL.RawQuery, req.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename="+enc.fileName())
+	flusher, _ := w.(http.Flusher)
+	written := 0
+	write := func(b []byte) bool {
+		if written+len(b) > maxBytes {
+			return false
+		}
+		if _, err := w.Write(b); err != nil {
+			return false
+		}
+		written += len(b)
+		return true
+	}
+	if !write(enc.header()) {
+		return
+	}
+
+	deadline := time.NewTimer(time.Second * time.Duration(seconds))
+	defer deadline.Stop()
+	flush := time.NewTicker(captureFlushEvery)
+	defer flush.Stop()
+	pkts := 0
+	reason := "count"
+loop:
+	for pkts < count {
+		select {
+		case rec := <-cs.records:
+			b := enc.encode(&rec)
+			if b == nil {
+				continue
+			}
+			if !write(b) {
+				reason = "bytes"
+				break loop
+			}
+			pkts++
+		case <-flush.C:
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-deadline.C:
+			reason = "seconds"
+			break loop
+		case <-req.Context().Done():
+			reason = "closed"
+			break loop
+		}
+	}
+	mylog.Info("capture end by %s: %d packets, %d bytes, %d dropped\n", reason, pkts, written, atomic.LoadUint64(&cs.dropped))
+}
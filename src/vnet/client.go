@@ -1,11 +1,14 @@
 package vnet
 
 import (
+	"acl"
 	"errors"
+	"fdb"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"nat"
 	"net"
 	"netstat"
 	"os"
@@ -53,6 +56,8 @@ type Client struct {
 	sync.RWMutex
 	rx_bytes      uint64
 	tx_bytes      uint64
+	rx_pkts       uint64
+	tx_pkts       uint64
 	last_rx_bytes uint64
 	last_tx_bytes uint64
 	minSize       int
@@ -65,10 +70,22 @@ type Client struct {
 	isClient      bool
 	fdbJoined     map[int]fdbPort
 	cryptType     byte
+	aead          *aeadCrypt
+	cryptDrops    uint64
+	replayDrops   uint64
+	replay        replayFilter
+	staticOpen    staticOpener
+	hs            *handshake
+	authed        bool
+	peerId        string
+	peerVids      []int
 }
 
 var ClientMasterLock sync.Mutex
 var ClientMaster map[string]*Client
+var ConnClientsLock sync.Mutex
+var ConnClients map[string]*Client
+var TunClients map[string]*Client
 var VnetStats map[string]*Stats
 
 type Stats struct {
@@ -91,9 +108,13 @@ type VnetIO interface {
 
 func init() {
 	ClientMaster = make(map[string]*Client)
+	ConnClients = make(map[string]*Client)
+	TunClients = make(map[string]*Client)
 	tcMap = make(map[string]*Client)
 	VnetStats = make(map[string]*Stats)
 	go vnetRoute()
+	go routeAdvertise()
+	go arpAdvertise()
 }
 
 func NewClient(cio VnetIO) *Client {
@@ -117,12 +138,15 @@ func NewPktBufPool() *sync.Pool {
 }
 
 func CreateConnClient(conn net.Conn) (*Client, error) {
+	if isPacketConn(conn) {
+		return NewClient(NewVnetUdpConn(conn)), nil
+	}
 	vc := NewVnetConn(conn)
 	return NewClient(vc), nil
 }
 
 func CreateTunClient(auto bool) (*Client, error) {
-	tun, err := OpenTun(*Br, *TunName, *TunType, *Ipstr, *Mac, *Vid, auto)
+	tun, err := OpenTun(*Br, *TunName, *TunType, *Ipstr, *Mac, *Mtu, *Vid, auto)
 	if err != nil {
 		return nil, err
 	}
@@ -133,7 +157,19 @@ func CreateTunClient(auto bool) (*Client, error) {
 }
 
 func (c *Client) setCryptType(ct byte) {
+	//the handshake already set the session crypt
+	if c.authed {
+		return
+	}
 	c.cryptType = ct
+	if isAeadType(ct) {
+		ac, err := newStaticAead(ct)
+		if err != nil {
+			log.Panicf("%s newStaticAead fail: %s\n", c.String(), err.Error())
+		}
+		c.aead.release()
+		c.aead = ac
+	}
 }
 
 func (c1 *Client) bindPeer(c2 *Client) {
@@ -190,6 +226,32 @@ func ClientMasterDel(c *Client) {
 	ClientMasterLock.Unlock()
 }
 
+func connClientAdd(c *Client) {
+	ConnClientsLock.Lock()
+	ConnClients[c.String()] = c
+	ConnClientsLock.Unlock()
+}
+
+func connClientDel(c *Client) {
+	ConnClientsLock.Lock()
+	delete(ConnClients, c.String())
+	ConnClientsLock.Unlock()
+}
+
+func tunClientAdd(c *Client) {
+	ConnClientsLock.Lock()
+	TunClients[c.String()] = c
+	ConnClientsLock.Unlock()
+}
+
+func tunClientDel(c *Client) {
+	ConnClientsLock.Lock()
+	if TunClients[c.String()] == c {
+		delete(TunClients, c.String())
+	}
+	ConnClientsLock.Unlock()
+}
+
 type Dialer interface {
 	Connect(dialInfo interface{}) net.Conn
 }
@@ -197,7 +259,7 @@ type Dialer interface {
 func ConnBindTun(dialInfo interface{}, dialer Dialer, tunconf TunConf) {
 	*TunName = tunconf.TunName
 	mylog.Info("----------set *TunName=%s -----\n", *TunName)
-	tun, err := OpenTun(tunconf.Br, tunconf.TunName, tunconf.TunType, tunconf.Ipstr, tunconf.Mac, tunconf.Vid, false)
+	tun, err := OpenTun(tunconf.Br, tunconf.TunName, tunconf.TunType, tunconf.Ipstr, tunconf.Mac, tunconf.Mtu, tunconf.Vid, false)
 	if err != nil {
 		log.Panicf("======OpenTunfail, tun=%s============\n", tunconf.TunName)
 	}
@@ -215,6 +277,12 @@ func ConnBindTun(dialInfo interface{}, dialer Dialer, tunconf TunConf) {
 	for {
 		conn := dialer.Connect(dialInfo)
 		vcc, _ := CreateConnClient(conn)
+		if err = vcc.authenticate(true); err != nil {
+			mylog.Error("%s, so Close %s\n", err.Error(), vcc.String())
+			vcc.cio.Close()
+			time.Sleep(time.Second * 2)
+			continue
+		}
 
 		mylog.Info("binding %s to %s", vtc.String(), vcc.String())
 		bindPairClient(vcc, vtc)
@@ -228,6 +296,7 @@ func ConnBindTun(dialInfo interface{}, dialer Dialer, tunconf TunConf) {
 			ClientMasterAdd(vcc)
 			vcc.JoinAllFdb()
 			vcc.reportFdbMsg()
+			vcc.reportRouteMsg()
 			<-vcc.reconnect
 			ClientMasterDel(vcc)
 			close(vcc.reconnect)
@@ -243,18 +312,26 @@ func ConnectNc(dialInfo interface{}, dialer Dialer) {
 		panic("dis.Kind() != reflect.Slice")
 	}
 	for i := 0; i < dis.Len(); i++ {
-		di := dis.Index(i).Interface()
-		go func() {
-			for {
-				conn := dialer.Connect(di)
-				HandleConn(conn, true)
-			}
-		}()
+		AddPeer(dis.Index(i).Interface(), dialer)
 	}
 }
 
 func HandleConn(conn net.Conn, isClient bool) {
+	handleConn(conn, isClient, nil)
+}
+
+// handleConn works the conn until it closes, pl is the peer it connects to
+// if it is a socket client
+func handleConn(conn net.Conn, isClient bool, pl *peerLink) {
 	vcc, _ := CreateConnClient(conn)
+	if err := vcc.authenticate(isClient); err != nil {
+		mylog.Error("%s, so Close %s\n", err.Error(), vcc.String())
+		vcc.cio.Close()
+		if isClient {
+			time.Sleep(time.Second * 2)
+		}
+		return
+	}
 	if *BindTun {
 		//if is socket client, tun dev name should auto generate
 		/*
@@ -284,6 +361,11 @@ func HandleConn(conn net.Conn, isClient bool) {
 		*/
 	}
 	vcc.setCryptType(CryptType)
+	if pl != nil && !pl.setClient(vcc) {
+		mylog.Info("peer %s has been deleted, so Close %s\n", pl.addr, vcc.String())
+		vcc.cio.Close()
+		return
+	}
 	vcc.Working()
 	vcc.isClient = isClient
 
@@ -293,6 +375,7 @@ func HandleConn(conn net.Conn, isClient bool) {
 		vcc.JoinAllFdb()
 		//TODO, send all fdb id; clientMaster连接成功后,无论是否设置了Vids，都会发fdbIdsMsg消息给上级,因为不知道上级什么情况
 		vcc.reportFdbMsg()
+		vcc.reportRouteMsg()
 		<-vcc.reconnect
 		ClientMasterDel(vcc)
 		close(vcc.reconnect)
@@ -312,8 +395,8 @@ func HandleConn(conn net.Conn, isClient bool) {
 func HandleTuns(vtuns []TunConf) {
 	setFlag := 0
 	for _, tunconf := range vtuns {
-		if tunconf.TunType != int(tuntap.DevTap) {
-			mylog.Error("===== only create tap, tun=%s, type =%d============\n", tunconf.TunName, tunconf.TunType)
+		if tunconf.TunType != int(tuntap.DevTap) && tunconf.TunType != int(tuntap.DevTun) {
+			mylog.Error("===== only create tap or tun, tun=%s, type =%d============\n", tunconf.TunName, tunconf.TunType)
 			continue
 		}
 		if setFlag == 0 && tunconf.Br == "" {
@@ -321,27 +404,62 @@ func HandleTuns(vtuns []TunConf) {
 			*TunName = tunconf.TunName
 			mylog.Info("----------set *TunName=%s -----\n", *TunName)
 		}
-		tun, err := OpenTun(tunconf.Br, tunconf.TunName, tunconf.TunType, tunconf.Ipstr, tunconf.Mac, tunconf.Vid, false)
-		if err != nil {
-			log.Panicf("======OpenTunfail, tun=%s============\n", tunconf.TunName)
-			continue
+		if err := handleTun(tunconf); err != nil {
+			log.Panicf("======handle tun=%s fail: %s============\n", tunconf.TunName, err.Error())
 		}
+	}
+}
 
-		vtc := NewClient(tun)
-		//tun don't need to check, just valid == true
-		vtc.valid = true
-
-		if err = vtc.joinFdbById(tun.vid); err != nil {
-			panic(err)
+// AddTun creates the tun of tunconf on a running node, on reload. Unlike
+// HandleTuns it returns the error, the dev is deleted again if it fails.
+func AddTun(tunconf TunConf) error {
+	if tunconf.TunType != int(tuntap.DevTap) && tunconf.TunType != int(tuntap.DevTun) {
+		return fmt.Errorf("only create tap or tun, type=%d", tunconf.TunType)
+	}
+	ConnClientsLock.Lock()
+	for _, c := range TunClients {
+		if tun, ok := c.cio.(*mytun); ok && tun.Name() == tunconf.TunName {
+			ConnClientsLock.Unlock()
+			return fmt.Errorf("dev %s is in use", tunconf.TunName)
 		}
-		if netstat.IsEnable() {
-			netstat.SetNetZone(tun.vid)
+	}
+	ConnClientsLock.Unlock()
+	return handleTun(tunconf)
+}
+
+func handleTun(tunconf TunConf) error {
+	tun, err := OpenTun(tunconf.Br, tunconf.TunName, tunconf.TunType, tunconf.Ipstr, tunconf.Mac, tunconf.Mtu, tunconf.Vid, false)
+	if err != nil {
+		return err
+	}
+
+	vtc := NewClient(tun)
+	//tun don't need to check, just valid == true
+	vtc.valid = true
+
+	if err = vtc.joinFdbById(tun.vid); err != nil {
+		tun.Close()
+		if len(getVids()) == 0 {
+			fdb.TryToDelFdbById(tun.vid)
 		}
-		vtc.Working()
+		return err
+	}
+	if tunconf.TunType == int(tuntap.DevTun) {
+		setTunRoutes(vtc, tunconf)
+	}
+	if netstat.IsEnable() {
+		netstat.SetNetZone(tun.vid)
 	}
+	vtc.Working()
+	return nil
 }
 
 func (c *Client) Working() {
+	if c.isConnIO() {
+		connClientAdd(c)
+	} else if _, ok := c.cio.(*mytun); ok {
+		tunClientAdd(c)
+	}
 	go c.ReadForward()
 	go c.WriteFromChan()
 	go c.HeartBeat()
@@ -372,11 +490,21 @@ func (c *Client) RemoteAddr() string {
 	if c.cio == nil {
 		return fmt.Sprintf("Client cio is unknown")
 	}
-	vconn, ok := c.cio.(*vnetConn)
-	if !ok {
-		return ""
+	switch vconn := c.cio.(type) {
+	case *vnetConn:
+		return vconn.RemoteAddr()
+	case *vnetUdpConn:
+		return vconn.RemoteAddr()
+	}
+	return ""
+}
+
+func (c *Client) isConnIO() bool {
+	switch c.cio.(type) {
+	case *vnetConn, *vnetUdpConn:
+		return true
 	}
-	return vconn.RemoteAddr()
+	return false
 }
 
 func (c *Client) IsClose() bool {
@@ -393,11 +521,17 @@ func (c *Client) Close() error {
 		c.hbTimerReset(time.Millisecond * 10)
 		close(c.pktchan)
 		c.cio.Close()
+		c.aead.release()
+		connClientDel(c)
+		tunClientDel(c)
+		mirrorClientClosed(c)
 		c.quitAllFdb()
+		stpClientClosed(c)
+		triggerRouteAdv()
 		//fdb.ReleaseFwdPort(c.fdbPortId)
 
 		//if not set custom vid, and c isn't ClientMaster, updateMasterFdb and reportFdbMsg
-		if len(Vids) == 0 && !c.isClient {
+		if len(getVids()) == 0 && !c.isClient {
 			updateMasterFdb()
 		}
 
@@ -421,23 +555,21 @@ func (c *Client) Reconnect() {
 
 func UserDataPktHandle(c *Client, cr io.Reader, pb *packet.PktBuf, ph *PktHeader) (rn int, err error) {
 	pktLen := int(ph.pktLen)
-	if pktLen < c.minSize || pktLen > c.maxSize {
-		mylog.Error("parase pktLen=%d out of range:%d-%d\n", pktLen, c.minSize, c.maxSize)
-		err = fmt.Errorf("parase pktLen=%d out of range:%d-%d\n", pktLen, c.minSize, c.maxSize)
+	if isAeadType(ph.pktCrypt) {
+		pktLen -= aeadOverhead
+	}
+	minSize, maxSize := c.pktRange(ph.vid)
+	if pktLen < minSize || pktLen > maxSize {
+		mylog.Error("parase pktLen=%d out of range:%d-%d\n", pktLen, minSize, maxSize)
+		err = fmt.Errorf("parase pktLen=%d out of range:%d-%d\n", pktLen, minSize, maxSize)
 		return
 	}
 	return DataPktHandle(c, cr, pb, ph)
 }
 
 func DataPktHandle(c *Client, cr io.Reader, pb *packet.PktBuf, ph *PktHeader) (rn int, err error) {
-	pktLen := ph.pktLen
-	offset := pb.GetDataLen()
-	//pkt := pb.LoadBuf()
-	pkt := pb.LoadAndUseBuf(pktLen)
-
-	rn, err = io.ReadFull(cr, pkt)
-	if err != nil {
-		mylog.Error("ReadFull fail: %s, rn=%d, want=%d\n", err.Error(), rn, pktLen)
+	pkt, offset, err := c.readPayload(cr, pb, ph)
+	if err != nil || pkt == nil {
 		return
 	}
 
@@ -446,25 +578,13 @@ func DataPktHandle(c *Client, cr io.Reader, pb *packet.PktBuf, ph *PktHeader) (r
 		return
 	}
 
-	if ph.pktCrypt != 0 {
-		block, ok := crypts[ph.pktCrypt]
-		if !ok {
-			err = fmt.Errorf("crypType =%d, not support\n", ph.pktCrypt)
-			return
-		}
-		cryptLock.Lock()
-		block.Decrypt(pkt, pkt)
-		cryptLock.Unlock()
-		setCryptoType(pb.LoadData(), 0)
-	}
-
 	if *DebugEn {
 		ShowPktInfo(pkt, "conn read")
 	}
 
 	pb.SetPktType(ph.pktType)
 	pb.SetPktVid(ph.vid)
-	pb.SetUserDataOff(int(offset))
+	pb.SetUserDataOff(offset)
 
 	ForwardPkt(c, pb)
 	rn = int(pb.GetDataLen())
@@ -473,7 +593,7 @@ func DataPktHandle(c *Client, cr io.Reader, pb *packet.PktBuf, ph *PktHeader) (r
 
 func HearbeatPktHandle(c *Client, cr io.Reader, pb *packet.PktBuf, ph *PktHeader) (rn int, err error) {
 	pktLen := ph.pktLen
-	if int(pktLen) > c.maxSize {
+	if int(pktLen) > c.maxSize+aeadOverhead {
 		err = fmt.Errorf("HearbeatPktHandle: recv pktLen =%d is invalid", pktLen)
 		return
 	}
@@ -482,24 +602,15 @@ func HearbeatPktHandle(c *Client, cr io.Reader, pb *packet.PktBuf, ph *PktHeader
 		err = fmt.Errorf("HearbeatPktHandle: recv pktType =%d is invalid", ph.pktType)
 		return
 	}
-	pkt := pb.LoadAndUseBuf(pktLen)
 
-	rn, err = io.ReadFull(cr, pkt)
-	if err != nil {
-		mylog.Error("ReadFull fail: %s, rn=%d, want=%d\n", err.Error(), rn, pktLen)
+	pkt, _, err := c.readPayload(cr, pb, ph)
+	if err != nil || pkt == nil {
 		return
 	}
-
-	if ph.pktCrypt != 0 {
-		log.Printf("HearbeatPktHandle :ph.pktCrypt=%d\n", ph.pktCrypt)
-		block, ok := crypts[ph.pktCrypt]
-		if !ok {
-			err = fmt.Errorf("crypType =%d, not support\n", ph.pktCrypt)
-			return
-		}
-		cryptLock.Lock()
-		block.Decrypt(pkt, pkt)
-		cryptLock.Unlock()
+	rn = int(pktLen)
+	if len(pkt) < HBIDSize {
+		mylog.Error("HearbeatPktHandle: recv heartbeat len =%d is invalid\n", len(pkt))
+		return
 	}
 
 	if !c.checkHeartBeat(pkt) {
@@ -520,6 +631,7 @@ func (c *Client) ReadForward() {
 			return
 		}
 		atomic.AddUint64(&c.rx_bytes, uint64(rn))
+		atomic.AddUint64(&c.rx_pkts, 1)
 		putPktBuf(pb)
 	}
 }
@@ -544,6 +656,7 @@ func (c *Client) WriteFromChan() {
 			return
 		}
 		atomic.AddUint64(&c.tx_bytes, uint64(wn))
+		atomic.AddUint64(&c.tx_pkts, 1)
 		putPktBuf(pkt)
 	}
 	mylog.Notice(" %s WriteFromChan quit \n", c.String())
@@ -556,6 +669,8 @@ func (c *Client) FwdToPeer(pkt *packet.PktBuf) {
 }
 
 func ForwardPkt(c *Client, pkt *packet.PktBuf) {
+	captureTap(c, pkt)
+	mirrorTap(c, pkt)
 	if c.p2pFwd {
 		c.FwdToPeer(pkt)
 		if netstat.IsEnable() {
@@ -569,9 +684,31 @@ func ForwardPkt(c *Client, pkt *packet.PktBuf) {
 	}
 	//TODO FDB FORWARD
 	if fp, ok := c.GetFdbById(int(pkt.GetPktVid())); ok {
-		if fp.fdb.Forward(c, pkt) && netstat.IsEnable() {
-			netstat.NetStatPut(pkt)
+		routed := fp.fdb.IsRouted()
+		if !acl.Check(pkt, routed) {
+			return
+		}
+		if routed {
+			fp.fdb.Route(c, pkt)
+			return
+		}
+		if nat.IsNatZone(pkt.GetPktVid()) {
+			natForward(c, fp, pkt)
+			return
 		}
+		fdbForward(c, fp, pkt)
+	}
+}
+
+func fdbForward(c *Client, fp fdbPort, pkt *packet.PktBuf) {
+	//the acl matches the state, the packet is tracked before it goes out so
+	//its reply can't get ahead of it
+	stateful := netstat.IsEnable() && acl.Stateful(int(pkt.GetPktVid()))
+	if stateful {
+		netstat.NetStatTrack(pkt)
+	}
+	if fp.fdb.Forward(c, pkt) && netstat.IsEnable() && !stateful {
+		netstat.NetStatPut(pkt)
 	}
 }
 
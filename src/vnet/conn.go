@@ -7,20 +7,23 @@ import (
 	"mylog"
 	"net"
 	"packet"
-
-	"github.com/juju/ratelimit"
+	"time"
 )
 
 type vnetConn struct {
-	conn net.Conn
-	cr   *bufio.Reader
-	cw   io.Writer
-	c    *Client
+	conn  net.Conn
+	cr    *bufio.Reader
+	cw    io.Writer
+	c     *Client
+	limit *connLimit
+	wbuf  [frameBufSize]byte
 }
 
+// SetRateLimit sets the rate limit of the new conns and the working ones
 func SetRateLimit(up, down int64) {
 	*UpRateLimit = up
 	*DownRateLimit = down
+	applyRateLimit()
 	mylog.Info("========SetRateLimit up=%d, down=%d ========\n", *UpRateLimit, *DownRateLimit)
 }
 
@@ -29,28 +32,13 @@ func (vconn *vnetConn) setClient(c *Client) {
 }
 
 func NewVnetConn(conn net.Conn) *vnetConn {
-	var cr *bufio.Reader
-	var cw io.Writer
-	if *DownRateLimit != 0 {
-		bk := ratelimit.NewBucketWithRate(float64(*DownRateLimit), int64(*DownRateLimit))
-		rd := ratelimit.Reader(conn, bk)
-		cr = bufio.NewReader(rd)
-	} else {
-		cr = bufio.NewReader(conn)
-	}
-
-	if *UpRateLimit != 0 {
-		bk := ratelimit.NewBucketWithRate(float64(*UpRateLimit), int64(*UpRateLimit))
-		cw = ratelimit.Writer(conn, bk)
-	} else {
-		cw = conn
-	}
-
+	limit := newConnLimit()
 	setTcpSockOpt(conn)
 	return &vnetConn{
-		conn: conn,
-		cr:   cr,
-		cw:   cw,
+		conn:  conn,
+		cr:    bufio.NewReader(&limitReader{r: conn, cl: limit}),
+		cw:    &limitWriter{w: conn, cl: limit},
+		limit: limit,
 	}
 }
 
@@ -68,6 +56,9 @@ func (vconn *vnetConn) Read(pb *packet.PktBuf) (rn int, err error) {
 	}
 
 	parsePktHeader(pkt, &ph)
+	if err = vconn.c.checkAuthed(&ph); err != nil {
+		return
+	}
 	if handlePkt, ok := pktHandles[ph.pktType]; ok {
 		if rn, err = handlePkt(vconn.c, vconn.cr, pb, &ph); err != nil {
 			return
@@ -77,20 +68,55 @@ func (vconn *vnetConn) Read(pb *packet.PktBuf) (rn int, err error) {
 }
 
 func (vc *vnetConn) Write(pb *packet.PktBuf) (n int, err error) {
-	if vc.c.cryptType != 0 {
-		ct := vc.c.cryptType
+	frame, err := vc.c.encodeFrame(pb, vc.wbuf[:])
+	if err != nil {
+		return
+	}
+	return vc.cw.Write(frame)
+}
+
+// encodeFrame returns the frame to send for pb. pb may be shared by several
+// clients (flood), so it is never encrypted in place, the frame is built in
+// wbuf, which belongs to the writer of the client.
+func (c *Client) encodeFrame(pb *packet.PktBuf, wbuf []byte) ([]byte, error) {
+	data := pb.LoadData()
+	userPkt := pb.LoadUserData()
+	ct := c.cryptType
+	if ct == 0 && len(data)-len(userPkt) == PktHeaderSize {
+		return data, nil
+	}
+
+	copy(wbuf[:PktHeaderSize], data[:PktHeaderSize])
+	if isAeadType(ct) {
+		if c.aead == nil {
+			return nil, fmt.Errorf("%s crypType =%d, but aead isn't ready", c.String(), ct)
+		}
+		return c.aead.seal(wbuf, userPkt), nil
+	}
+
+	frame := wbuf[:PktHeaderSize+len(userPkt)]
+	setPktLen(frame, len(userPkt))
+	setCryptoType(frame, 0)
+	copy(frame[PktHeaderSize:], userPkt)
+	if ct != 0 {
 		block, ok := crypts[ct]
 		if !ok {
-			err = fmt.Errorf("vc.c.crypType =%d, not support\n", ct)
-			return
+			return nil, fmt.Errorf("c.crypType =%d, not support\n", ct)
 		}
-		userPkt := pb.LoadUserData()
 		cryptLock.Lock()
-		block.Encrypt(userPkt, userPkt)
+		block.Encrypt(frame[PktHeaderSize:], frame[PktHeaderSize:])
 		cryptLock.Unlock()
-		setCryptoType(pb.LoadData(), ct)
+		setCryptoType(frame, ct)
 	}
-	return vc.cw.Write(pb.LoadData())
+	return frame, nil
+}
+
+func (vc *vnetConn) setRateLimit(up, down int64) {
+	vc.limit.set(up, down)
+}
+
+func (vc *vnetConn) setDeadline(t time.Time) error {
+	return vc.conn.SetDeadline(t)
 }
 
 func (vc *vnetConn) Close() error {
@@ -2,8 +2,13 @@ package vnet
 
 import (
 	"crypto"
+	"fmt"
+	"io"
 	"log"
+	"mylog"
+	"packet"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -20,7 +25,9 @@ const (
 	CRY_3DES     = byte(0x9)
 	CRY_XTEA     = byte(0xA)
 	CRY_SALSA20  = byte(0xB)
-	CRY_END      = byte(0xC)
+	CRY_AESGCM   = byte(0xC) // aead, per-packet nonce and tag
+	CRY_CHACHA20 = byte(0xD) // aead, per-packet nonce and tag
+	CRY_END      = byte(0xE)
 )
 
 var crypts = make(map[byte]crypto.BlockCrypt)
@@ -41,16 +48,34 @@ func init() {
 	CRYtoString[CRY_3DES] = "3des"
 	CRYtoString[CRY_XTEA] = "xtea"
 	CRYtoString[CRY_SALSA20] = "salsa20"
+	CRYtoString[CRY_AESGCM] = "aes-gcm"
+	CRYtoString[CRY_CHACHA20] = "chacha20-poly1305"
 
 	for c := byte(1); c < CRY_END; c++ {
+		if isAeadType(c) {
+			continue
+		}
 		crypts[c], _ = crypto.NewBlockCrypt(CRYtoString[c])
 	}
 	//log.Printf("crypto init ok\n")
 }
 
+// SetCryptKey sets the pre-shared secret the aead keys are derived from,
+// it should be a high entropy string, like 32 random bytes in base64.
+func SetCryptKey(key string) {
+	if key == "" {
+		return
+	}
+	aeadStaticKey = []byte(key)
+	log.Printf("=========set aead crypt key ok==========\n")
+}
+
 func SetDefaultCryptType(cts string) {
 	for ct, s := range CRYtoString {
 		if s == cts {
+			if isAeadType(byte(ct)) && aeadStaticKey == nil && !authEnabled() {
+				log.Panicf("crypt type %s need CryptKey or AuthMode\n", cts)
+			}
 			CryptType = byte(ct)
 			log.Printf("=========set default crypto type ok, cts=%s, ct=%d==========\n", cts, ct)
 			return
@@ -58,3 +83,71 @@ func SetDefaultCryptType(cts string) {
 	}
 	log.Panicf("no support %s, just support %v\n", cts, CRYtoString)
 }
+
+// readPayload reads the pktLen bytes behind the PktHeader and decrypts them.
+// It returns the plaintext and its offset in pb; pkt is nil if the frame is
+// dropped: bad tag, replayed, or not encrypted the way this client requires.
+func (c *Client) readPayload(cr io.Reader, pb *packet.PktBuf, ph *PktHeader) (pkt []byte, offset int, err error) {
+	var rn int
+	pktLen := ph.pktLen
+	offset = int(pb.GetDataLen())
+	hdr := pb.LoadData()[offset-PktHeaderSize : offset]
+	payload := pb.LoadAndUseBuf(pktLen)
+
+	rn, err = io.ReadFull(cr, payload)
+	if err != nil {
+		mylog.Error("ReadFull fail: %s, rn=%d, want=%d\n", err.Error(), rn, pktLen)
+		return
+	}
+
+	// fail closed, an aead client never accepts frames it can't authenticate
+	if isAeadType(c.cryptType) && ph.pktCrypt != c.cryptType {
+		atomic.AddUint64(&c.cryptDrops, 1)
+		mylog.Warning("%s drop frame, pktCrypt=%d, but need %d\n", c.String(), ph.pktCrypt, c.cryptType)
+		return
+	}
+
+	switch {
+	case ph.pktCrypt == 0:
+		pkt = payload
+	case isAeadType(ph.pktCrypt):
+		if c.isReflected(payload) {
+			atomic.AddUint64(&c.replayDrops, 1)
+			mylog.Warning("%s drop reflected frame\n", c.String())
+			return
+		}
+		aead, e := c.getOpenAead(ph.pktCrypt, payload)
+		if e != nil {
+			atomic.AddUint64(&c.cryptDrops, 1)
+			mylog.Warning("%s drop frame, pktCrypt=%d: %s\n", c.String(), ph.pktCrypt, e.Error())
+			return
+		}
+		plain, e := openFrame(aead, hdr, payload)
+		if e != nil {
+			atomic.AddUint64(&c.cryptDrops, 1)
+			mylog.Warning("%s drop frame: %s\n", c.String(), e.Error())
+			return
+		}
+		// only an authenticated counter may move the window
+		if !c.replay.accept(payload[:aeadNonceSize]) {
+			atomic.AddUint64(&c.replayDrops, 1)
+			mylog.Warning("%s drop replayed frame, seq=%d\n", c.String(), nonceSeq(payload))
+			return
+		}
+		offset += aeadNonceSize
+		pb.SetDataLen(offset + len(plain))
+		pkt = plain
+	default:
+		block, ok := crypts[ph.pktCrypt]
+		if !ok {
+			err = fmt.Errorf("crypType =%d, not support\n", ph.pktCrypt)
+			return
+		}
+		cryptLock.Lock()
+		block.Decrypt(payload, payload)
+		cryptLock.Unlock()
+		pkt = payload
+	}
+	setCryptoType(hdr, 0)
+	return
+}
@@ -0,0 +1,183 @@
+package vnet
+
+import (
+	"fmt"
+	"mylog"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	DefTxQueueLen = 5000
+)
+
+// devSetup configures a tun/tap device through netlink, every step which
+// changed something pushes its undo, so a failed setup leaves nothing behind.
+type devSetup struct {
+	undo []func() error
+}
+
+func (ds *devSetup) pushUndo(f func() error) {
+	ds.undo = append(ds.undo, f)
+}
+
+func (ds *devSetup) rollback() {
+	for i := len(ds.undo) - 1; i >= 0; i-- {
+		if err := ds.undo[i](); err != nil {
+			mylog.Warning("rollback dev setup err: %s\n", err.Error())
+		}
+	}
+	ds.undo = nil
+}
+
+// parseDevAddr parses ipstr like "10.0.0.1/24", "10.0.0.1 netmask 255.255.255.0",
+// or "10.0.0.1" with the default mask of its class, as ifconfig does.
+func parseDevAddr(ipstr string) (*netlink.Addr, error) {
+	fields := strings.Fields(ipstr)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty ipstr")
+	}
+	if strings.Contains(fields[0], "/") {
+		return netlink.ParseAddr(fields[0])
+	}
+	ip := net.ParseIP(fields[0])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", fields[0])
+	}
+	mask := ip.DefaultMask()
+	if len(fields) >= 3 && fields[1] == "netmask" {
+		m := net.ParseIP(fields[2]).To4()
+		if m == nil {
+			return nil, fmt.Errorf("invalid netmask %s", fields[2])
+		}
+		mask = net.IPMask(m)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		mask = net.CIDRMask(128, 128)
+	}
+	return &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: mask}}, nil
+}
+
+func (ds *devSetup) ensureBridge(br string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(br)
+	if err == nil {
+		if _, ok := link.(*netlink.Bridge); !ok {
+			return nil, fmt.Errorf("%s exists, but it isn't a bridge", br)
+		}
+		return link, nil
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		return nil, err
+	}
+	bridge := &netlink.Bridge{LinkAttrs: netlink.NewLinkAttrs()}
+	bridge.Name = br
+	if err = netlink.LinkAdd(bridge); err != nil {
+		return nil, fmt.Errorf("add bridge %s: %s", br, err.Error())
+	}
+	ds.pushUndo(func() error { return netlink.LinkDel(bridge) })
+	return netlink.LinkByName(br)
+}
+
+func (ds *devSetup) setAddr(link netlink.Link, ipstr string) error {
+	addr, err := parseDevAddr(ipstr)
+	if err != nil {
+		return err
+	}
+	if err = netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("set %s addr %s: %s", link.Attrs().Name, addr.String(), err.Error())
+	}
+	ds.pushUndo(func() error { return netlink.AddrDel(link, addr) })
+	return nil
+}
+
+func (ds *devSetup) setMac(link netlink.Link, mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	old := link.Attrs().HardwareAddr
+	if err = netlink.LinkSetHardwareAddr(link, hw); err != nil {
+		return fmt.Errorf("set %s mac %s: %s", link.Attrs().Name, mac, err.Error())
+	}
+	ds.pushUndo(func() error { return netlink.LinkSetHardwareAddr(link, old) })
+	return nil
+}
+
+func (ds *devSetup) setUp(link netlink.Link) error {
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("set %s up: %s", link.Attrs().Name, err.Error())
+	}
+	ds.pushUndo(func() error { return netlink.LinkSetDown(link) })
+	return nil
+}
+
+// setupDev configures the device tunname which has been opened: bridge,
+// address, mac, mtu and queue length; it is rolled back on error.
+func setupDev(tunname string, br string, ipstr string, mac string, mtu int, isTap bool) (err error) {
+	ds := &devSetup{}
+	defer func() {
+		if err != nil {
+			ds.rollback()
+		}
+	}()
+
+	link, err := netlink.LinkByName(tunname)
+	if err != nil {
+		return fmt.Errorf("find dev %s: %s", tunname, err.Error())
+	}
+	if mtu > 0 {
+		if err = netlink.LinkSetMTU(link, mtu); err != nil {
+			return fmt.Errorf("set %s mtu %d: %s", tunname, mtu, err.Error())
+		}
+	}
+	if err = netlink.LinkSetTxQLen(link, DefTxQueueLen); err != nil {
+		return fmt.Errorf("set %s txqueuelen %d: %s", tunname, DefTxQueueLen, err.Error())
+	}
+	if err = ds.setUp(link); err != nil {
+		return err
+	}
+
+	//the address and mac are set on the bridge if the tap is added to one
+	target := link
+	if br != "" {
+		if !isTap {
+			return fmt.Errorf("br=%s can't addif %s, it isn't tap", br, tunname)
+		}
+		if target, err = ds.ensureBridge(br); err != nil {
+			return err
+		}
+		if err = netlink.LinkSetMaster(link, target); err != nil {
+			return fmt.Errorf("add %s to bridge %s: %s", tunname, br, err.Error())
+		}
+		ds.pushUndo(func() error { return netlink.LinkSetNoMaster(link) })
+		if err = ds.setUp(target); err != nil {
+			return err
+		}
+	}
+	if ipstr != "" {
+		if err = ds.setAddr(target, ipstr); err != nil {
+			return err
+		}
+	}
+	if mac != "" && (isTap || br != "") {
+		if err = ds.setMac(target, mac); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func delDev(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(link)
+}
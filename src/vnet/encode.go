@@ -22,6 +22,10 @@ const (
 	FdbIdsMsg     = byte(0x04)
 	MultiLinkData = byte(0x05)
 	CryptoData    = byte(0x06)
+	HandshakeMsg  = byte(0x07)
+	RouteMsg      = byte(0x08)
+	StpMsg        = byte(0x09)
+	ArpMsg        = byte(0x0a)
 )
 
 type PktHeader struct {
@@ -45,6 +49,14 @@ func pktHandlersReg() {
 	pktHandles[HearbeatRpl] = HearbeatPktHandle
 
 	pktHandles[FdbIdsMsg] = FdbIdsMsgPktHandle
+
+	pktHandles[HandshakeMsg] = HandshakePktHandle
+
+	pktHandles[RouteMsg] = RouteMsgPktHandle
+
+	pktHandles[StpMsg] = StpMsgPktHandle
+
+	pktHandles[ArpMsg] = ArpMsgPktHandle
 }
 
 func assembleUserPkt(data []byte) ([]byte, error) {
@@ -109,6 +121,10 @@ func parsePktHeader(data []byte, ph *PktHeader) {
 	ph.pktCrypt = data[5]
 }
 
+func setPktLen(data []byte, pktLen int) {
+	binary.BigEndian.PutUint16(data[1:], uint16(pktLen))
+}
+
 func setCryptoType(data []byte, cryptoType byte) {
 	data[5] = cryptoType
 	// t := data[0]
@@ -0,0 +1,146 @@
+package vnet
+
+import (
+	"encoding/json"
+	"fdb"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// bindStatic binds c to the static macs of its port in the fdbs it joined
+func (c *Client) bindStatic() {
+	match := func(port string) bool { return clientNameIs(c, port) }
+	c.RLock()
+	for _, fp := range c.fdbJoined {
+		fp.fdb.BindStatic(c, match)
+	}
+	c.RUnlock()
+}
+
+// SetFdbConfs applies the mac learning configs of the vids, the static macs
+// are bound to the ports up now, the other ones when they join.
+func SetFdbConfs(confs []fdb.FdbConf) error {
+	if err := fdb.SetFdbConfs(confs); err != nil {
+		return err
+	}
+	var clients []*Client
+	ConnClientsLock.Lock()
+	for _, c := range ConnClients {
+		if c.master == nil {
+			clients = append(clients, c)
+		}
+	}
+	for _, c := range TunClients {
+		clients = append(clients, c)
+	}
+	ConnClientsLock.Unlock()
+	ClientMasterLock.Lock()
+	for _, c := range ClientMaster {
+		if _, ok := c.cio.(*backupLink); ok {
+			clients = append(clients, c)
+		}
+	}
+	ClientMasterLock.Unlock()
+	for _, c := range clients {
+		c.bindStatic()
+	}
+	return nil
+}
+
+// showFdb shows the macs of the fdbs, or edits them:
+// /fdb?vid=3&port=tap1
+// /fdb?op=flush&vid=3, /fdb?op=flush&vid=3&port=10.0.0.1:7878
+// /fdb?op=add&vid=3&mac=00:11:22:33:44:55&port=tap1, /fdb?op=del&vid=3&mac=00:11:22:33:44:55
+// the macs added are static, the ones of the config replace them on reload.
+func showFdb(w http.ResponseWriter, req *http.Request) {
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	op, port := query.Get("op"), query.Get("port")
+	if op == "" && query.Get("vid") == "" {
+		ids := fdb.GetFdbIds()
+		sort.Ints(ids)
+		infos := make([]fdb.FdbInfo, 0, len(ids))
+		for _, vid := range ids {
+			if f, ok := fdb.GetFdbById(vid); ok {
+				infos = append(infos, f.ShowFdb(vid, port))
+			}
+		}
+		buf, err := json.MarshalIndent(infos, "", "\t")
+		if err != nil {
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write(buf)
+		return
+	}
+
+	vid, err := strconv.Atoi(query.Get("vid"))
+	if err != nil {
+		fmt.Fprintf(w, "invalid vid %s\n", query.Get("vid"))
+		return
+	}
+	f, ok := fdb.GetFdbById(vid)
+	if !ok {
+		fmt.Fprintf(w, "no fdb of vid %d\n", vid)
+		return
+	}
+	switch op {
+	case "":
+		buf, err := json.MarshalIndent(f.ShowFdb(vid, port), "", "\t")
+		if err != nil {
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write(buf)
+		return
+	case "flush":
+		if port == "" {
+			f.Flush()
+			break
+		}
+		c := findClient(port)
+		if c == nil {
+			err = fmt.Errorf("no port %s", port)
+			break
+		}
+		f.DelFmnByPortIO(c)
+	case "add":
+		m, e := fdb.ParseMac(query.Get("mac"))
+		if e != nil {
+			err = e
+			break
+		}
+		if port == "" {
+			err = fmt.Errorf("no port of mac %s", query.Get("mac"))
+			break
+		}
+		if c := findClient(port); c != nil {
+			if _, ok := c.GetFdbById(vid); ok {
+				f.AddStatic(m, port, c)
+				break
+			}
+		}
+		//bound when the port joins
+		f.AddStatic(m, port, nil)
+	case "del":
+		m, e := fdb.ParseMac(query.Get("mac"))
+		if e != nil {
+			err = e
+			break
+		}
+		f.Del(m)
+	default:
+		err = fmt.Errorf("unknown op %s, op=flush|add|del", op)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err.Error())
+		return
+	}
+	fmt.Fprintf(w, "fdb vid=%d %s success\n", vid, op)
+}
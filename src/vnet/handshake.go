@@ -0,0 +1,385 @@
+package vnet
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mylog"
+	"packet"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	AuthNone    = ""
+	AuthPsk     = "psk"
+	AuthEd25519 = "ed25519"
+
+	hsInit    = byte(1)
+	hsResp    = byte(2)
+	hsConfirm = byte(3)
+
+	hsRandomSize = 16
+	hsBodySize   = 2 + curve25519.PointSize + hsRandomSize //type, crypt, ephemeral key, random
+	hsMacSize    = sha256.Size
+	hsMaxMsgSize = hsBodySize + ed25519.PublicKeySize + ed25519.SignatureSize
+
+	HandshakeTimeout = 10 //second
+)
+
+var (
+	authMode       string
+	authPsk        []byte
+	nodeKey        ed25519.PrivateKey
+	authorizedKeys map[string]bool
+
+	errNotAuthed           = errors.New("peer is not authenticated")
+	errUnexpectedHandshake = errors.New("unexpected handshake message")
+	errHandshakeAuth       = errors.New("handshake authentication fail")
+)
+
+// handshake is the state of the key exchange of one Client:
+// init(initiator) -> resp(responder) -> confirm(initiator), the initiator is
+// the side which dialed. Both sides authenticate with the psk or their ed25519
+// node key, the session keys come from the x25519 ephemeral keys.
+type handshake struct {
+	initiator  bool
+	ct         byte
+	ephPriv    []byte
+	ephPub     []byte
+	initMsg    []byte
+	respMsg    []byte
+	txKey      []byte
+	rxKey      []byte
+	confirmKey []byte
+}
+
+type deadlineSetter interface {
+	setDeadline(t time.Time) error
+}
+
+// SetAuth enables the handshake, mode is "psk" or "ed25519", nodeKeyStr is the
+// base64 ed25519 seed of this node, and keys are the base64 public keys of the
+// nodes allowed to connect.
+func SetAuth(mode string, psk string, nodeKeyStr string, keys []string) {
+	switch mode {
+	case AuthNone:
+		return
+	case AuthPsk:
+		if psk == "" {
+			log.Panicf("auth mode %s need AuthPsk\n", mode)
+		}
+		authPsk = []byte(psk)
+	case AuthEd25519:
+		seed, err := base64.StdEncoding.DecodeString(nodeKeyStr)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			log.Panicf("NodeKey must be a base64 ed25519 seed(%d bytes), err=%v\n", ed25519.SeedSize, err)
+		}
+		nodeKey = ed25519.NewKeyFromSeed(seed)
+		authorizedKeys = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			pub, err := base64.StdEncoding.DecodeString(k)
+			if err != nil || len(pub) != ed25519.PublicKeySize {
+				log.Panicf("invalid authorized key %s, err=%v\n", k, err)
+			}
+			authorizedKeys[string(pub)] = true
+		}
+	default:
+		log.Panicf("no support auth mode %s, just support %s, %s\n", mode, AuthPsk, AuthEd25519)
+	}
+	authMode = mode
+	log.Printf("=========set auth mode %s ok, node id=%s==========\n", mode, NodeId())
+}
+
+func authEnabled() bool {
+	return authMode != AuthNone
+}
+
+// NodeId returns the base64 ed25519 public key of this node
+func NodeId() string {
+	if nodeKey == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(nodeKey.Public().(ed25519.PublicKey))
+}
+
+// GenNodeKey generates a new ed25519 node key, returns the base64 seed and public key
+func GenNodeKey() (seed string, pub string, err error) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	seed = base64.StdEncoding.EncodeToString(privKey.Seed())
+	pub = base64.StdEncoding.EncodeToString(pubKey)
+	return
+}
+
+func newHandshake(initiator bool) (*handshake, error) {
+	hs := &handshake{initiator: initiator}
+	hs.ephPriv = make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, hs.ephPriv); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(hs.ephPriv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	hs.ephPub = pub
+	return hs, nil
+}
+
+// authenticate runs the handshake on a conn client before it starts working,
+// no packet but handshake is accepted until it is done.
+func (c *Client) authenticate(initiator bool) (err error) {
+	if !authEnabled() {
+		return nil
+	}
+	if ds, ok := c.cio.(deadlineSetter); ok {
+		ds.setDeadline(time.Now().Add(time.Second * HandshakeTimeout))
+		defer ds.setDeadline(time.Time{})
+	}
+
+	c.hs, err = newHandshake(initiator)
+	if err != nil {
+		return
+	}
+	defer func() { c.hs = nil }()
+
+	if initiator {
+		if err = c.sendHandshake(c.hs.buildInit()); err != nil {
+			return
+		}
+	}
+
+	for !c.authed {
+		pb := c.getPktBuf()
+		_, err = c.cio.Read(pb)
+		putPktBuf(pb)
+		if err != nil {
+			return fmt.Errorf("%s handshake fail: %s", c.String(), err.Error())
+		}
+	}
+	mylog.Notice("%s handshake ok, peer id=%s, crypt type=%s\n", c.String(), c.peerId, CRYtoString[c.cryptType])
+	return nil
+}
+
+func (c *Client) sendHandshake(msg []byte) error {
+	pb := c.getPktBuf()
+	defer putPktBuf(pb)
+	buf := pb.LoadBuf()
+	assemblePktHead(HandshakeMsg, buf[:PktHeaderSize], len(msg), 0)
+	copy(buf[PktHeaderSize:], msg)
+	pb.SetDataLen(PktHeaderSize + len(msg))
+	pb.SetUserDataOff(PktHeaderSize)
+	_, err := c.cio.Write(pb)
+	return err
+}
+
+func HandshakePktHandle(c *Client, cr io.Reader, pb *packet.PktBuf, ph *PktHeader) (rn int, err error) {
+	pktLen := ph.pktLen
+	if c.hs == nil || c.authed {
+		err = errUnexpectedHandshake
+		return
+	}
+	if int(pktLen) > hsMaxMsgSize {
+		err = fmt.Errorf("HandshakePktHandle: recv pktLen =%d is invalid", pktLen)
+		return
+	}
+	msg := pb.LoadAndUseBuf(pktLen)
+	rn, err = io.ReadFull(cr, msg)
+	if err != nil {
+		mylog.Error("ReadFull fail: %s, rn=%d, want=%d\n", err.Error(), rn, pktLen)
+		return
+	}
+	if len(msg) == 0 {
+		err = errUnexpectedHandshake
+		return
+	}
+
+	hs := c.hs
+	switch {
+	case msg[0] == hsInit && !hs.initiator && hs.initMsg == nil:
+		err = c.handleHsInit(msg)
+	case msg[0] == hsResp && hs.initiator && hs.respMsg == nil:
+		err = c.handleHsResp(msg)
+	case msg[0] == hsConfirm && !hs.initiator && hs.respMsg != nil:
+		err = c.handleHsConfirm(msg)
+	default:
+		err = errUnexpectedHandshake
+	}
+	return
+}
+
+func (hs *handshake) body(msgType byte) []byte {
+	body := make([]byte, hsBodySize, hsMaxMsgSize)
+	body[0] = msgType
+	body[1] = hs.ct
+	copy(body[2:], hs.ephPub)
+	io.ReadFull(rand.Reader, body[2+curve25519.PointSize:])
+	return body
+}
+
+func (hs *handshake) buildInit() []byte {
+	hs.ct = CryptType
+	if !isAeadType(hs.ct) {
+		hs.ct = CRY_AESGCM
+	}
+	hs.initMsg = signHsMsg(hs.body(hsInit), nil)
+	return hs.initMsg
+}
+
+func (c *Client) handleHsInit(msg []byte) error {
+	if len(msg) < hsBodySize {
+		return errHandshakeAuth
+	}
+	peerId, err := verifyHsMsg(msg, nil)
+	if err != nil {
+		return err
+	}
+	hs := c.hs
+	hs.initMsg = append([]byte(nil), msg...)
+	// the initiator chose the cipher, keep it if it is aead
+	hs.ct = msg[1]
+	if !isAeadType(hs.ct) {
+		hs.ct = CRY_AESGCM
+	}
+	hs.respMsg = signHsMsg(hs.body(hsResp), hs.initMsg)
+	if err = hs.deriveKeys(msg[2 : 2+curve25519.PointSize]); err != nil {
+		return err
+	}
+	c.peerId = peerId
+	return c.sendHandshake(hs.respMsg)
+}
+
+func (c *Client) handleHsResp(msg []byte) error {
+	hs := c.hs
+	if len(msg) < hsBodySize || msg[1] != hs.ct {
+		return errHandshakeAuth
+	}
+	peerId, err := verifyHsMsg(msg, hs.initMsg)
+	if err != nil {
+		return err
+	}
+	hs.respMsg = append([]byte(nil), msg...)
+	if err = hs.deriveKeys(msg[2 : 2+curve25519.PointSize]); err != nil {
+		return err
+	}
+	c.peerId = peerId
+	confirm := append([]byte{hsConfirm}, hs.confirmMac()...)
+	if err = c.sendHandshake(confirm); err != nil {
+		return err
+	}
+	return c.installSession()
+}
+
+func (c *Client) handleHsConfirm(msg []byte) error {
+	if !hmac.Equal(msg[1:], c.hs.confirmMac()) {
+		return errHandshakeAuth
+	}
+	return c.installSession()
+}
+
+func (c *Client) installSession() error {
+	hs := c.hs
+	ac, err := newSessionAead(hs.ct, hs.txKey, hs.rxKey)
+	if err != nil {
+		return err
+	}
+	c.aead = ac
+	c.cryptType = hs.ct
+	c.authed = true
+	return nil
+}
+
+func (hs *handshake) deriveKeys(peerEphPub []byte) error {
+	shared, err := curve25519.X25519(hs.ephPriv, peerEphPub)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	h.Write(hs.initMsg)
+	h.Write(hs.respMsg)
+	salt := h.Sum(nil)
+	secret := append(shared, authPsk...)
+
+	i2r := deriveKey(secret, salt, "govnet session i2r "+CRYtoString[hs.ct])
+	r2i := deriveKey(secret, salt, "govnet session r2i "+CRYtoString[hs.ct])
+	hs.confirmKey = deriveKey(secret, salt, "govnet session confirm")
+	if hs.initiator {
+		hs.txKey, hs.rxKey = i2r, r2i
+	} else {
+		hs.txKey, hs.rxKey = r2i, i2r
+	}
+	return nil
+}
+
+func (hs *handshake) confirmMac() []byte {
+	mac := hmac.New(sha256.New, hs.confirmKey)
+	mac.Write(hs.initMsg)
+	mac.Write(hs.respMsg)
+	return mac.Sum(nil)
+}
+
+// signHsMsg appends the authenticator of body: a hmac with the psk, or the
+// node public key and the signature. prev is the message this one answers.
+func signHsMsg(body []byte, prev []byte) []byte {
+	switch authMode {
+	case AuthPsk:
+		mac := hmac.New(sha256.New, authPsk)
+		mac.Write(prev)
+		mac.Write(body)
+		return append(body, mac.Sum(nil)...)
+	case AuthEd25519:
+		body = append(body, nodeKey.Public().(ed25519.PublicKey)...)
+		signed := append(append([]byte(nil), prev...), body...)
+		return append(body, ed25519.Sign(nodeKey, signed)...)
+	}
+	return body
+}
+
+// verifyHsMsg checks the authenticator of msg and returns the peer id
+func verifyHsMsg(msg []byte, prev []byte) (peerId string, err error) {
+	body := msg[:hsBodySize]
+	switch authMode {
+	case AuthPsk:
+		if len(msg) != hsBodySize+hsMacSize {
+			return "", errHandshakeAuth
+		}
+		mac := hmac.New(sha256.New, authPsk)
+		mac.Write(prev)
+		mac.Write(body)
+		if !hmac.Equal(msg[hsBodySize:], mac.Sum(nil)) {
+			return "", errHandshakeAuth
+		}
+		return AuthPsk, nil
+	case AuthEd25519:
+		if len(msg) != hsMaxMsgSize {
+			return "", errHandshakeAuth
+		}
+		pub := msg[hsBodySize : hsBodySize+ed25519.PublicKeySize]
+		if !authorizedKeys[string(pub)] {
+			return "", fmt.Errorf("node %s is not authorized", base64.StdEncoding.EncodeToString(pub))
+		}
+		signed := append(append([]byte(nil), prev...), msg[:hsBodySize+ed25519.PublicKeySize]...)
+		if !ed25519.Verify(ed25519.PublicKey(pub), signed, msg[hsBodySize+ed25519.PublicKeySize:]) {
+			return "", errHandshakeAuth
+		}
+		return base64.StdEncoding.EncodeToString(pub), nil
+	}
+	return "", errHandshakeAuth
+}
+
+// checkAuthed rejects everything but handshake from a client which isn't authenticated
+func (c *Client) checkAuthed(ph *PktHeader) error {
+	if !authEnabled() || c.authed || ph.pktType == HandshakeMsg {
+		return nil
+	}
+	return errNotAuthed
+}
@@ -24,13 +24,15 @@ var (
 	HeartbeatIntv = 5
 )
 
+// heartBeat is written by the reader of the client, hbDelay and hbDelayAvg
+// are read by others too, they are atomic and first for 64-bit alignment.
 type heartBeat struct {
+	hbDelay    int64 //time.Duration
+	hbDelayAvg int64 //time.Duration
 	hbTimer    *time.Timer
 	hbID       uint16
 	hbReqTime  time.Time
-	hbDelay    time.Duration
 	hbDelaySum time.Duration
-	hbDelayAvg time.Duration
 }
 
 func SetHeartbeat(idle, count, intv int) {
@@ -72,25 +74,34 @@ func (c *Client) heartBeatUpdate() {
 
 func (c *Client) heartBeatDelayCalc() {
 	if c.hb != nil {
-		c.hb.hbDelay = time.Now().Sub(c.hb.hbReqTime)
-		c.hb.hbDelaySum += c.hb.hbDelay
+		delay := time.Now().Sub(c.hb.hbReqTime)
+		atomic.StoreInt64(&c.hb.hbDelay, int64(delay))
+		c.hb.hbDelaySum += delay
 		if c.hb.hbID != 0 {
-			c.hb.hbDelayAvg = c.hb.hbDelaySum / time.Duration(c.hb.hbID)
+			atomic.StoreInt64(&c.hb.hbDelayAvg, int64(c.hb.hbDelaySum/time.Duration(c.hb.hbID)))
 		}
 	}
 }
 
+func (hb *heartBeat) delay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&hb.hbDelay))
+}
+
+func (hb *heartBeat) delayAvg() time.Duration {
+	return time.Duration(atomic.LoadInt64(&hb.hbDelayAvg))
+}
+
 //get last delay
 func (c *Client) heartBeatDelay() time.Duration {
-	if c.hb != nil {
-		return c.hb.hbDelay / time.Millisecond
+	if hb := c.hb; hb != nil {
+		return hb.delay() / time.Millisecond
 	}
 	return 0
 }
 
 func (c *Client) heartBeatDelayAvg() time.Duration {
-	if c.hb != nil {
-		return c.hb.hbDelayAvg
+	if hb := c.hb; hb != nil {
+		return hb.delayAvg()
 	}
 	return 0
 }
@@ -114,7 +125,7 @@ func (c *Client) checkHeartBeat(pkt []byte) bool {
 			c.valid = true
 			c.heartBeatDelayCalc()
 			mylog.Info("ok,recv a heartbeat reply id:%d on %s, delay=%d(%d ms), heartBeatDelayAvg()=%d(%d ms)\n", id, c.String(),
-				c.hb.hbDelay, c.hb.hbDelay/time.Millisecond, c.heartBeatDelayAvg(), c.heartBeatDelayAvg()/time.Millisecond)
+				c.hb.delay(), c.hb.delay()/time.Millisecond, c.heartBeatDelayAvg(), c.heartBeatDelayAvg()/time.Millisecond)
 		} else {
 			mylog.Notice("Notice ,%s recv a heartbeat reply id:%d ,but c.hb.hbID=%d\n", c.String(), id, c.hb.hbID)
 			// if first heartbeat is fail, reture false and close client
@@ -130,7 +141,7 @@ func (c *Client) checkHeartBeat(pkt []byte) bool {
 }
 
 func (c *Client) HeartBeat() {
-	if _, ok := c.cio.(*vnetConn); ok {
+	if c.isConnIO() {
 		c.hb = &heartBeat{} //TODO, should do it advance
 		timeout_count := 0
 		c.hb.hbTimer = time.NewTimer(time.Second * 5)
@@ -0,0 +1,53 @@
+package vnet
+
+import (
+	"encoding/json"
+	"fdb"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// IgmpSnoopingInfo is the igmp snooping of a vid
+type IgmpSnoopingInfo struct {
+	Vid int
+	fdb.IgmpInfo
+}
+
+// showIgmp shows the groups and the queriers of the vids of igmp snooping:
+// /igmp, /igmp?vid=3
+func showIgmp(w http.ResponseWriter, req *http.Request) {
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var ids []int
+	if s := query.Get("vid"); s != "" {
+		vid, err := strconv.Atoi(s)
+		if err != nil {
+			fmt.Fprintf(w, "invalid vid %s\n", s)
+			return
+		}
+		ids = []int{vid}
+	} else {
+		ids = fdb.GetFdbIds()
+		sort.Ints(ids)
+	}
+	infos := make([]IgmpSnoopingInfo, 0, len(ids))
+	for _, vid := range ids {
+		f, ok := fdb.GetFdbById(vid)
+		if !ok || !f.IsIgmpSnooping() {
+			continue
+		}
+		infos = append(infos, IgmpSnoopingInfo{Vid: vid, IgmpInfo: f.ShowIgmp()})
+	}
+	buf, err := json.MarshalIndent(infos, "", "\t")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(buf)
+}
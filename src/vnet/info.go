@@ -92,6 +92,66 @@ var regHandlers = []httpHandlers{
 		path:    "/mylog",
 		handler: showLogInfo,
 	},
+	httpHandlers{
+		path:    "/rtstate",
+		handler: showRouteState,
+	},
+	httpHandlers{
+		path:    "/routes",
+		handler: showRoutes,
+	},
+	httpHandlers{
+		path:    "/cryptStat",
+		handler: showCryptStat,
+	},
+	httpHandlers{
+		path:    "/reload",
+		handler: reloadConfig,
+	},
+	httpHandlers{
+		path:    "/metrics",
+		handler: showMetrics,
+	},
+	httpHandlers{
+		path:    "/natct",
+		handler: showNatConntrack,
+	},
+	httpHandlers{
+		path:    "/dnat",
+		handler: showDnatRules,
+	},
+	httpHandlers{
+		path:    "/natfrag",
+		handler: showNatFragStats,
+	},
+	httpHandlers{
+		path:    "/acl",
+		handler: showAcl,
+	},
+	httpHandlers{
+		path:    "/capture",
+		handler: showCapture,
+	},
+	httpHandlers{
+		path:    "/mirror",
+		handler: showMirror,
+	},
+	httpHandlers{
+		path:    "/stp",
+		handler: showStp,
+	},
+	httpHandlers{
+		path:    "/fdb",
+		handler: showFdb,
+	},
+	httpHandlers{
+		path:    "/arp",
+		handler: showArp,
+	},
+	httpHandlers{
+		path:    "/igmp",
+		handler: showIgmp,
+	},
 }
 
 func showLogInfo(w http.ResponseWriter, req *http.Request) {
@@ -213,6 +273,19 @@ func ShowPktInfo(pkt []byte, ss string) {
 			}
 			fmt.Printf("%s: %s\n", ss, iphdr.String())
 		}
+		if ether.IsIp6Pkt() {
+			ip6hdr, err := packet.ParseIPv6Header(pkt[packet.EtherSize:])
+			if err != nil {
+				log.Printf("%s, ParseIPv6Header err: %s\n", ss, err.Error())
+			}
+			fmt.Printf("%s: %s\n", ss, ip6hdr.String())
+		}
+	} else if len(pkt) > 0 && pkt[0]>>4 == packet.Version6 {
+		ip6hdr, err := packet.ParseIPv6Header(pkt)
+		if err != nil {
+			log.Printf("%s,ParseIPv6Header err: %s\n", ss, err.Error())
+		}
+		fmt.Printf("%s: %s\n", ss, ip6hdr.String())
 	} else {
 		iphdr, err := packet.ParseIPHeader(pkt)
 		if err != nil {
@@ -0,0 +1,252 @@
+package vnet
+
+import (
+	"acl"
+	"fdb"
+	"fmt"
+	"io"
+	"nat"
+	"net/http"
+	"netstat"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// metricFamily is one metric in the prometheus text format, its samples are
+// written after the HELP and TYPE lines.
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples []string
+}
+
+type metricSet struct {
+	families []*metricFamily
+	index    map[string]*metricFamily
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{index: make(map[string]*metricFamily)}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// add adds a sample of the metric name, labels are name value pairs
+func (ms *metricSet) add(name, typ, help string, value float64, labels ...string) {
+	mf, ok := ms.index[name]
+	if !ok {
+		mf = &metricFamily{name: name, help: help, typ: typ}
+		ms.index[name] = mf
+		ms.families = append(ms.families, mf)
+	}
+	sample := name
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+		}
+		sample += "{" + strings.Join(pairs, ",") + "}"
+	}
+	mf.samples = append(mf.samples, fmt.Sprintf("%s %v", sample, value))
+}
+
+func (ms *metricSet) counter(name, help string, value uint64, labels ...string) {
+	ms.add(name, "counter", help, float64(value), labels...)
+}
+
+func (ms *metricSet) gauge(name, help string, value float64, labels ...string) {
+	ms.add(name, "gauge", help, value, labels...)
+}
+
+func (ms *metricSet) writeTo(w io.Writer) {
+	for _, mf := range ms.families {
+		fmt.Fprintf(w, "# HELP %s %s\n", mf.name, mf.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", mf.name, mf.typ)
+		for _, s := range mf.samples {
+			fmt.Fprintf(w, "%s\n", s)
+		}
+	}
+}
+
+func clientKind(c *Client) string {
+	switch c.cio.(type) {
+	case *mytun:
+		return "tun"
+	case *backupLink:
+		return "backup"
+	}
+	if c.master != nil {
+		return "slave"
+	}
+	if c.isClient {
+		return "client"
+	}
+	return "server"
+}
+
+// metricsClients returns the conn, tun and backup link clients sorted by name
+func metricsClients() []*Client {
+	seen := make(map[*Client]bool)
+	var clients []*Client
+	addClients := func(m map[string]*Client) {
+		for _, c := range m {
+			if !seen[c] {
+				seen[c] = true
+				clients = append(clients, c)
+			}
+		}
+	}
+	ConnClientsLock.Lock()
+	addClients(ConnClients)
+	addClients(TunClients)
+	ConnClientsLock.Unlock()
+	ClientMasterLock.Lock()
+	addClients(ClientMaster)
+	ClientMasterLock.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].String() < clients[j].String() })
+	return clients
+}
+
+func collectClientMetrics(ms *metricSet) {
+	for _, c := range metricsClients() {
+		name := c.String()
+		kind := clientKind(c)
+		ms.counter("vnet_client_rx_bytes_total", "Bytes received by the client.", atomic.LoadUint64(&c.rx_bytes), "client", name, "kind", kind)
+		ms.counter("vnet_client_tx_bytes_total", "Bytes sent by the client.", atomic.LoadUint64(&c.tx_bytes), "client", name, "kind", kind)
+		ms.counter("vnet_client_rx_packets_total", "Packets received by the client.", atomic.LoadUint64(&c.rx_pkts), "client", name, "kind", kind)
+		ms.counter("vnet_client_tx_packets_total", "Packets sent by the client.", atomic.LoadUint64(&c.tx_pkts), "client", name, "kind", kind)
+		ms.counter("vnet_client_crypt_drops_total", "Frames dropped because they failed to decrypt or authenticate.", atomic.LoadUint64(&c.cryptDrops), "client", name, "kind", kind)
+		ms.counter("vnet_client_replay_drops_total", "Frames dropped by the replay filter.", atomic.LoadUint64(&c.replayDrops), "client", name, "kind", kind)
+		if hb := c.hb; hb != nil {
+			ms.gauge("vnet_client_heartbeat_rtt_seconds", "Round trip time of the last heartbeat.", hb.delay().Seconds(), "client", name, "kind", kind)
+			ms.gauge("vnet_client_heartbeat_rtt_avg_seconds", "Average round trip time of the heartbeats.", hb.delayAvg().Seconds(), "client", name, "kind", kind)
+		}
+		if bl, ok := c.cio.(*backupLink); ok {
+			ms.counter("vnet_backup_link_failovers_total", "Times the backup link switched to another access.", atomic.LoadUint64(&bl.failovers), "client", name)
+			ms.counter("vnet_backup_link_tx_drop_bytes_total", "Bytes dropped because there was no active access.", atomic.LoadUint64(&bl.txDropBytes), "client", name)
+			ms.counter("vnet_backup_link_rx_drop_bytes_total", "Bytes dropped on receive by the backup link.", atomic.LoadUint64(&bl.rxDropBytes), "client", name)
+			active := 0.0
+			if bl.activeSlave != nil {
+				active = 1
+			}
+			ms.gauge("vnet_backup_link_active", "Whether the backup link has an active access.", active, "client", name)
+		}
+	}
+}
+
+func collectFdbMetrics(ms *metricSet) {
+	stats := fdb.FdbStats()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Vid < stats[j].Vid })
+	for _, st := range stats {
+		vid := fmt.Sprint(st.Vid)
+		ms.gauge("vnet_fdb_macs", "Mac entries of the fdb.", float64(st.Macs), "vid", vid)
+		ms.gauge("vnet_fdb_ports", "Ports joined the fdb.", float64(st.Ports), "vid", vid)
+		ms.gauge("vnet_fdb_routes", "Route prefixes of a routed fdb.", float64(st.Routes), "vid", vid)
+		ms.counter("vnet_fdb_floods_total", "Packets flooded to all ports of the fdb.", st.Floods, "vid", vid)
+		ms.counter("vnet_fdb_mac_violations_total", "Macs dropped as a port has the max macs.", st.Violations, "vid", vid)
+		ms.counter("vnet_fdb_storm_dropped_total", "Flooded packets dropped by the storm control.", st.Storm.Broadcast, "vid", vid, "type", "broadcast")
+		ms.counter("vnet_fdb_storm_dropped_total", "Flooded packets dropped by the storm control.", st.Storm.Unknown, "vid", vid, "type", "unknown")
+		ms.counter("vnet_fdb_storm_dropped_total", "Flooded packets dropped by the storm control.", st.Storm.Multicast, "vid", vid, "type", "multicast")
+		ms.counter("vnet_fdb_storm_dropped_total", "Flooded packets dropped by the storm control.", st.Storm.Suspended, "vid", vid, "type", "suspended")
+		ms.counter("vnet_fdb_storm_suspends_total", "Ports suspended by the storm control.", st.Storm.Suspends, "vid", vid)
+		ms.gauge("vnet_fdb_arp_entries", "Entries of the arp proxy.", float64(st.Arps), "vid", vid)
+		ms.counter("vnet_fdb_arp_requests_total", "Arp requests seen by the arp proxy.", st.ArpReplies, "vid", vid, "result", "answered")
+		ms.counter("vnet_fdb_arp_requests_total", "Arp requests seen by the arp proxy.", st.ArpMisses, "vid", vid, "result", "flooded")
+		ms.gauge("vnet_fdb_igmp_groups", "Multicast groups with members of the igmp snooping.", float64(st.IgmpGroups), "vid", vid)
+		ms.counter("vnet_fdb_igmp_msgs_total", "Igmp msgs snooped.", st.Igmp.Queries, "vid", vid, "type", "query")
+		ms.counter("vnet_fdb_igmp_msgs_total", "Igmp msgs snooped.", st.Igmp.Reports, "vid", vid, "type", "report")
+		ms.counter("vnet_fdb_igmp_msgs_total", "Igmp msgs snooped.", st.Igmp.Leaves, "vid", vid, "type", "leave")
+		ms.counter("vnet_fdb_igmp_multicast_total", "Ipv4 multicast packets by the igmp snooping.", st.Igmp.Forwarded, "vid", vid, "result", "forwarded")
+		ms.counter("vnet_fdb_igmp_multicast_total", "Ipv4 multicast packets by the igmp snooping.", st.Igmp.Flooded, "vid", vid, "result", "flooded")
+		ms.counter("vnet_fdb_igmp_multicast_total", "Ipv4 multicast packets by the igmp snooping.", st.Igmp.Dropped, "vid", vid, "result", "dropped")
+	}
+}
+
+func collectConntrackMetrics(ms *metricSet) {
+	if !netstat.IsEnable() {
+		return
+	}
+	counts := netstat.ConntrackCounts()
+	zones := make([]int, 0, len(counts))
+	for zone := range counts {
+		zones = append(zones, int(zone))
+	}
+	sort.Ints(zones)
+	for _, zone := range zones {
+		ms.gauge("vnet_conntrack_entries", "Conntrack entries of the zone.", float64(counts[uint16(zone)]), "zone", fmt.Sprint(zone))
+	}
+}
+
+func collectNatMetrics(ms *metricSet) {
+	ms.counter("vnet_nat_drops_total", "Packets dropped by nat.", atomic.LoadUint64(&natDrops))
+	fragStats := nat.ShowFragStats()
+	zones := make([]int, 0, len(fragStats))
+	for zone := range fragStats {
+		zones = append(zones, int(zone))
+	}
+	sort.Ints(zones)
+	for _, zone := range zones {
+		st, z := fragStats[uint16(zone)], fmt.Sprint(zone)
+		ms.gauge("vnet_nat_frag_queues", "Datagrams being reassembled in the zone.", float64(st.Queues), "zone", z)
+		ms.gauge("vnet_nat_frag_bytes", "Bytes of the fragments held in the zone.", float64(st.Bytes), "zone", z)
+		ms.counter("vnet_nat_frag_reassembled_total", "Datagrams reassembled in the zone.", st.Reassembled, "zone", z)
+		ms.counter("vnet_nat_frag_timeouts_total", "Datagrams dropped by reassembly timeout.", st.Timeouts, "zone", z)
+		ms.counter("vnet_nat_frag_evicted_total", "Datagrams evicted by the queue or bytes limit.", st.Evicted, "zone", z)
+		ms.counter("vnet_nat_frag_overlaps_total", "Overlapping fragments.", st.Overlaps, "zone", z)
+		ms.counter("vnet_nat_frag_dropped_total", "Invalid or duplicate fragments dropped.", st.Dropped, "zone", z)
+	}
+}
+
+func collectFlowExportMetrics(ms *metricSet) {
+	st := netstat.ShowFlowExportStats()
+	ms.counter("vnet_flow_export_records_total", "Flow records sent to the collector.", st.Records)
+	ms.counter("vnet_flow_export_messages_total", "IPFIX or NetFlow v9 messages sent to the collector.", st.Messages)
+	ms.counter("vnet_flow_export_dropped_total", "Flow records dropped as the exporter queue is full.", st.Dropped)
+	ms.counter("vnet_flow_export_send_errors_total", "Messages failed to send to the collector.", st.SendErrors)
+}
+
+func collectAclMetrics(ms *metricSet) {
+	for _, info := range acl.ShowAcls() {
+		vid := fmt.Sprint(info.Vid)
+		ms.counter("vnet_acl_allowed_total", "Packets allowed by the acl of the vid.", info.Allowed, "vid", vid)
+		ms.counter("vnet_acl_dropped_total", "Packets dropped by the acl of the vid.", info.Dropped, "vid", vid)
+	}
+}
+
+func collectMirrorMetrics(ms *metricSet) {
+	for _, info := range ShowMirrors() {
+		ms.counter("vnet_mirror_packets_total", "Frames copied to the mirror destination.", info.Mirrored, "mirror", info.Name)
+		ms.counter("vnet_mirror_dropped_total", "Frames not copied as the mirror queue is full or the destination is down.", info.Dropped, "mirror", info.Name)
+	}
+}
+
+func collectStpMetrics(ms *metricSet) {
+	for _, info := range ShowStp() {
+		vid := fmt.Sprint(info.Vid)
+		blocked := 0
+		for _, p := range info.Ports {
+			if !p.Forwarding {
+				blocked++
+			}
+		}
+		ms.gauge("vnet_stp_blocked_ports", "Ports of the vid blocked by the spanning tree.", float64(blocked), "vid", vid)
+		ms.gauge("vnet_stp_root_cost", "Cost of the vid to the root of the spanning tree.", float64(info.RootCost), "vid", vid)
+		ms.counter("vnet_stp_topology_changes_total", "Topology changes of the vid, the macs are flushed on each.", info.TopologyChanges, "vid", vid)
+	}
+}
+
+func showMetrics(w http.ResponseWriter, req *http.Request) {
+	ms := newMetricSet()
+	collectClientMetrics(ms)
+	collectFdbMetrics(ms)
+	collectConntrackMetrics(ms)
+	collectNatMetrics(ms)
+	collectAclMetrics(ms)
+	collectFlowExportMetrics(ms)
+	collectMirrorMetrics(ms)
+	collectStpMetrics(ms)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	ms.writeTo(w)
+}
@@ -0,0 +1,477 @@
+package vnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"mylog"
+	"nat"
+	"net/http"
+	"net/url"
+	"packet"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lab11/go-tuntap/tuntap"
+)
+
+const (
+	mirrorQueueLen     = 4096
+	mirrorResolveEvery = time.Second
+)
+
+// MirrorConf copies the frames of Vids, or of Clients, to Dst or Dev. Dst is
+// a client: the name of a tun dev, a remote addr or a peer id, the frames
+// keep their vid. Dev is a tap device opened for the mirror, like an IDS
+// sensor listens on.
+type MirrorConf struct {
+	Name    string   `toml:"name"`
+	Vids    []int    `toml:"vids"`
+	Clients []string `toml:"clients"` //the frames received from them
+	Dst     string   `toml:"dst"`
+	Dev     string   `toml:"dev"`
+	Disable bool     `toml:"disable"`
+}
+
+// MirrorInfo is a mirror and its counters
+type MirrorInfo struct {
+	MirrorConf
+	Enable   bool
+	DstReady bool
+	Mirrored uint64
+	Dropped  uint64
+}
+
+// mirror queues the frames held by HoldPktBuf, the forwarding path never
+// waits for it, a frame is dropped if the queue is full.
+type mirror struct {
+	conf     MirrorConf
+	vids     map[int]bool
+	clients  sync.Map //*Client -> bool, matched the clients of conf or not
+	enable   int32
+	queue    chan *packet.PktBuf
+	quit     chan struct{}
+	done     chan struct{}
+	dev      *tuntap.Interface
+	dst      atomic.Value //*Client
+	mirrored uint64
+	dropped  uint64
+}
+
+var mirrorLock sync.Mutex
+var mirrors = make(map[string]*mirror)
+var mirrorValue atomic.Value //[]*mirror for the forwarding path
+
+// clientNameIs reports whether name is c: its tun dev, remote addr, peer id
+// or the name of it in /clientMaster.
+func clientNameIs(c *Client, name string) bool {
+	if name == c.peerId || name == c.String() {
+		return true
+	}
+	if tun, ok := c.cio.(*mytun); ok {
+		return tun.tund != nil && name == tun.Name()
+	}
+	return name == c.RemoteAddr()
+}
+
+// findClient returns the client named name, a tun client first
+func findClient(name string) *Client {
+	ConnClientsLock.Lock()
+	defer ConnClientsLock.Unlock()
+	for _, c := range TunClients {
+		if clientNameIs(c, name) {
+			return c
+		}
+	}
+	for _, c := range ConnClients {
+		if clientNameIs(c, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+func checkMirrorConf(conf MirrorConf) error {
+	if conf.Name == "" {
+		return fmt.Errorf("mirror without name")
+	}
+	if len(conf.Vids) == 0 && len(conf.Clients) == 0 {
+		return fmt.Errorf("mirror %s: no vids or clients to mirror", conf.Name)
+	}
+	if (conf.Dst == "") == (conf.Dev == "") {
+		return fmt.Errorf("mirror %s: one of dst and dev is needed", conf.Name)
+	}
+	for _, vid := range conf.Vids {
+		if vid < 0 || vid > 4095 {
+			return fmt.Errorf("mirror %s: invalid vid %d", conf.Name, vid)
+		}
+	}
+	return nil
+}
+
+func newMirror(conf MirrorConf) (*mirror, error) {
+	m := &mirror{
+		conf:  conf,
+		vids:  make(map[int]bool, len(conf.Vids)),
+		queue: make(chan *packet.PktBuf, mirrorQueueLen),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for _, vid := range conf.Vids {
+		m.vids[vid] = true
+	}
+	if !conf.Disable {
+		m.enable = 1
+	}
+	if conf.Dev != "" {
+		dev, err := tuntap.Open(conf.Dev, tuntap.DevTap, false)
+		if err != nil {
+			return nil, fmt.Errorf("mirror %s: open dev %s: %s", conf.Name, conf.Dev, err.Error())
+		}
+		if err = setupDev(dev.Name(), "", "", "", 0, true); err != nil {
+			dev.Close()
+			return nil, fmt.Errorf("mirror %s: setup dev %s: %s", conf.Name, conf.Dev, err.Error())
+		}
+		m.dev = dev
+	}
+	go m.run()
+	return m, nil
+}
+
+// match reports whether the frame of vid received from c is mirrored
+func (m *mirror) match(c *Client, vid int) bool {
+	if atomic.LoadInt32(&m.enable) == 0 {
+		return false
+	}
+	if dst, _ := m.dst.Load().(*Client); dst == c {
+		//the frames of the destination are never mirrored back to it
+		return false
+	}
+	if m.vids[vid] {
+		return true
+	}
+	if len(m.conf.Clients) == 0 {
+		return false
+	}
+	if matched, ok := m.clients.Load(c); ok {
+		return matched.(bool)
+	}
+	matched := false
+	for _, name := range m.conf.Clients {
+		if clientNameIs(c, name) {
+			matched = true
+			break
+		}
+	}
+	m.clients.Store(c, matched)
+	return matched
+}
+
+// resolveDst returns the destination client, it is looked up again when the
+// one found is closed.
+func (m *mirror) resolveDst(lastTry *time.Time) *Client {
+	dst, _ := m.dst.Load().(*Client)
+	if dst != nil && !dst.IsClose() {
+		return dst
+	}
+	if time.Since(*lastTry) < mirrorResolveEvery {
+		return nil
+	}
+	*lastTry = time.Now()
+	dst = findClient(m.conf.Dst)
+	if dst != nil {
+		mylog.Info("mirror %s: dst %s\n", m.conf.Name, dst.String())
+	}
+	m.dst.Store(dst)
+	return dst
+}
+
+func (m *mirror) send(pkt *packet.PktBuf, lastTry *time.Time) {
+	defer packet.PutPktToPool(pkt)
+	if m.dev != nil {
+		if err := m.dev.WritePacket(&tuntap.Packet{Packet: pkt.LoadUserData()}); err != nil {
+			atomic.AddUint64(&m.dropped, 1)
+			mylog.Debug("mirror %s: write %s: %s\n", m.conf.Name, m.conf.Dev, err.Error())
+			return
+		}
+		atomic.AddUint64(&m.mirrored, 1)
+		return
+	}
+	dst := m.resolveDst(lastTry)
+	if dst == nil {
+		atomic.AddUint64(&m.dropped, 1)
+		return
+	}
+	dst.PutPktToChan(pkt)
+	atomic.AddUint64(&m.mirrored, 1)
+}
+
+func (m *mirror) run() {
+	defer close(m.done)
+	var lastTry time.Time
+	for {
+		select {
+		case pkt := <-m.queue:
+			m.send(pkt, &lastTry)
+		case <-m.quit:
+			for {
+				select {
+				case pkt := <-m.queue:
+					packet.PutPktToPool(pkt)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// stop stops m, it has been taken off the forwarding path
+func (m *mirror) stop() {
+	close(m.quit)
+	<-m.done
+	if m.dev != nil {
+		//the dev isn't persistent, closing it deletes it
+		m.dev.Close()
+	}
+}
+
+// storeMirrors publishes mirrors to the forwarding path, the caller holds
+// mirrorLock.
+func storeMirrors() {
+	ms := make([]*mirror, 0, len(mirrors))
+	for _, m := range mirrors {
+		ms = append(ms, m)
+	}
+	mirrorValue.Store(ms)
+}
+
+// mirrorTap queues pkt to the mirrors it matches, it is called by ForwardPkt
+// for every frame. The frames of a nat zone or a routed vid are rewritten in
+// place on the forwarding path, the mirrors get a copy of them.
+func mirrorTap(c *Client, pkt *packet.PktBuf) {
+	ms, _ := mirrorValue.Load().([]*mirror)
+	if len(ms) == 0 {
+		return
+	}
+	vid := int(pkt.GetPktVid())
+	mpkt := pkt
+	checked := false
+	for _, m := range ms {
+		if !m.match(c, vid) {
+			continue
+		}
+		if !checked {
+			checked = true
+			if _, ok := routedFdb(vid); ok || nat.IsNatZone(uint16(vid)) {
+				//held by the mirrors only, released below
+				mpkt = pkt.Clone()
+			}
+		}
+		mpkt.HoldPktBuf()
+		select {
+		case m.queue <- mpkt:
+		default:
+			packet.PutPktToPool(mpkt)
+			atomic.AddUint64(&m.dropped, 1)
+		}
+	}
+	if mpkt != pkt {
+		packet.PutPktToPool(mpkt)
+	}
+}
+
+// mirrorClientClosed forgets c in the mirrors, a client reconnects as a new
+// one.
+func mirrorClientClosed(c *Client) {
+	ms, _ := mirrorValue.Load().([]*mirror)
+	for _, m := range ms {
+		m.clients.Delete(c)
+	}
+}
+
+// SetMirror adds the mirror of conf, or replaces the one of the same name
+func SetMirror(conf MirrorConf) error {
+	if err := checkMirrorConf(conf); err != nil {
+		return err
+	}
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+	old, ok := mirrors[conf.Name]
+	if ok {
+		delete(mirrors, conf.Name)
+		storeMirrors()
+		//the dev of the old one must be closed before it is opened again
+		old.stop()
+	}
+	m, err := newMirror(conf)
+	if err != nil {
+		return err
+	}
+	mirrors[conf.Name] = m
+	storeMirrors()
+	mylog.Info("mirror %s: vids %v, clients %v to dst %s dev %s, enable %v\n", conf.Name, conf.Vids, conf.Clients, conf.Dst, conf.Dev, !conf.Disable)
+	return nil
+}
+
+// SetMirrors replaces all the mirrors, the ones not in confs are deleted
+func SetMirrors(confs []MirrorConf) error {
+	names := make(map[string]bool, len(confs))
+	for _, conf := range confs {
+		if err := checkMirrorConf(conf); err != nil {
+			return err
+		}
+		if names[conf.Name] {
+			return fmt.Errorf("mirror %s is duplicated", conf.Name)
+		}
+		names[conf.Name] = true
+	}
+	mirrorLock.Lock()
+	var unchanged []string
+	for name, m := range mirrors {
+		if !names[name] {
+			delete(mirrors, name)
+			storeMirrors()
+			m.stop()
+		}
+	}
+	for _, conf := range confs {
+		if m, ok := mirrors[conf.Name]; ok && reflect.DeepEqual(m.conf, conf) {
+			unchanged = append(unchanged, conf.Name)
+		}
+	}
+	mirrorLock.Unlock()
+
+	keep := make(map[string]bool, len(unchanged))
+	for _, name := range unchanged {
+		keep[name] = true
+	}
+	for _, conf := range confs {
+		if keep[conf.Name] {
+			continue
+		}
+		if err := SetMirror(conf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DelMirror deletes the mirror name
+func DelMirror(name string) error {
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+	m, ok := mirrors[name]
+	if !ok {
+		return fmt.Errorf("no mirror %s", name)
+	}
+	delete(mirrors, name)
+	storeMirrors()
+	m.stop()
+	mylog.Info("mirror %s deleted\n", name)
+	return nil
+}
+
+// EnableMirror starts or stops copying the frames to the mirror name
+func EnableMirror(name string, enable bool) error {
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+	m, ok := mirrors[name]
+	if !ok {
+		return fmt.Errorf("no mirror %s", name)
+	}
+	if enable {
+		atomic.StoreInt32(&m.enable, 1)
+	} else {
+		atomic.StoreInt32(&m.enable, 0)
+	}
+	m.conf.Disable = !enable
+	mylog.Info("mirror %s enable %v\n", name, enable)
+	return nil
+}
+
+// ShowMirrors returns the mirrors sorted by name
+func ShowMirrors() []MirrorInfo {
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+	infos := make([]MirrorInfo, 0, len(mirrors))
+	for _, m := range mirrors {
+		dst, _ := m.dst.Load().(*Client)
+		infos = append(infos, MirrorInfo{
+			MirrorConf: m.conf,
+			Enable:     atomic.LoadInt32(&m.enable) != 0,
+			DstReady:   m.dev != nil || (dst != nil && !dst.IsClose()),
+			Mirrored:   atomic.LoadUint64(&m.mirrored),
+			Dropped:    atomic.LoadUint64(&m.dropped),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// splitQuery splits the comma separated list of key in query
+func splitQuery(query url.Values, key string) []string {
+	var list []string
+	for _, s := range strings.Split(query.Get(key), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// showMirror shows the mirrors, or edits them:
+// /mirror?op=add&name=ids&vids=3,4&clients=10.0.0.1:7878&dst=tap1
+// /mirror?op=add&name=ids&vids=3&dev=span0
+// /mirror?op=enable&name=ids, /mirror?op=disable&name=ids, /mirror?op=del&name=ids
+func showMirror(w http.ResponseWriter, req *http.Request) {
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	op, name := query.Get("op"), query.Get("name")
+	switch op {
+	case "":
+		infos, err := json.MarshalIndent(ShowMirrors(), "", "\t")
+		if err != nil {
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write(infos)
+		return
+	case "add":
+		conf := MirrorConf{
+			Name:    name,
+			Clients: splitQuery(query, "clients"),
+			Dst:     query.Get("dst"),
+			Dev:     query.Get("dev"),
+		}
+		for _, s := range splitQuery(query, "vids") {
+			vid, err := strconv.Atoi(s)
+			if err != nil {
+				fmt.Fprintf(w, "invalid vid %s\n", s)
+				return
+			}
+			conf.Vids = append(conf.Vids, vid)
+		}
+		err = SetMirror(conf)
+	case "del":
+		err = DelMirror(name)
+	case "enable":
+		err = EnableMirror(name, true)
+	case "disable":
+		err = EnableMirror(name, false)
+	default:
+		err = fmt.Errorf("unknown op %s, op=add|del|enable|disable", op)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err.Error())
+		return
+	}
+	fmt.Fprintf(w, "mirror %s %s success\n", op, name)
+}
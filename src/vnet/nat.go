@@ -0,0 +1,66 @@
+package vnet
+
+import (
+	"encoding/json"
+	"nat"
+	"net/http"
+	"packet"
+	"sync/atomic"
+)
+
+var natDrops uint64
+
+// natForward forwards pkt after nat of its zone, if it completes a fragmented
+// datagram, all the fragments are forwarded in order.
+func natForward(c *Client, fp fdbPort, pkt *packet.PktBuf) {
+	head := pkt
+	switch nat.DoNat(&head) {
+	case nat.STOLEN:
+		//nat holds the fragment until the datagram completes
+		return
+	case nat.DROP:
+		atomic.AddUint64(&natDrops, 1)
+		return
+	}
+	if head.Next() == nil {
+		fdbForward(c, fp, head)
+		return
+	}
+	for p := head; p != nil; {
+		next := p.Next()
+		p.SetNext(nil)
+		fdbForward(c, fp, p)
+		putPktBuf(p) //the one nat held
+		p = next
+	}
+}
+
+func showDnatRules(w http.ResponseWriter, req *http.Request) {
+	rules := nat.ShowDnatRules()
+	rulesInfo, err := json.MarshalIndent(rules, "", "\t")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(rulesInfo)
+}
+
+func showNatFragStats(w http.ResponseWriter, req *http.Request) {
+	stats := nat.ShowFragStats()
+	statsInfo, err := json.MarshalIndent(stats, "", "\t")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(statsInfo)
+}
+
+func showNatConntrack(w http.ResponseWriter, req *http.Request) {
+	ctInfo := nat.ShowConntrack()
+	natInfo, err := json.MarshalIndent(ctInfo, "", "\t")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(natInfo)
+}
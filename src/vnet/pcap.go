@@ -0,0 +1,174 @@
+package vnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101 //ip packets without link header
+
+	pcapMagic   = 0xa1b2c3d4
+	pcapngSHB   = 0x0a0d0d0a
+	pcapngIDB   = 1
+	pcapngEPB   = 6
+	pcapngMagic = 0x1a2b3c4d
+
+	shbOptUserAppl = 4
+	idbOptName     = 2
+	idbOptDesc     = 3
+	epbOptFlags    = 2
+
+	epbInbound  = 1
+	epbOutbound = 2
+)
+
+// captureIf is an interface of a capture: the packets of a client in a vid
+type captureIf struct {
+	client   string
+	vid      int
+	linkType uint16
+}
+
+// captureEncoder encodes the packets of a capture as a file, encode returns
+// the bytes of a packet, with the headers the packet needs before it, nil if
+// it can't be in the file.
+type captureEncoder interface {
+	header() []byte
+	encode(rec *captureRecord) []byte
+	fileName() string
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// pcapngBlock builds a block of type with body, the total length is before
+// and after the body.
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	total := 12 + pad4(len(body))
+	b := make([]byte, total)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], uint32(total))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[total-4:], uint32(total))
+	return b
+}
+
+// appendOpt appends the option code with value, padded to 4 bytes
+func appendOpt(b []byte, code uint16, value []byte) []byte {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint16(hdr[0:], code)
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(value)))
+	b = append(b, hdr[:]...)
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value))-len(value))...)
+}
+
+func appendOptEnd(b []byte) []byte {
+	return append(b, 0, 0, 0, 0)
+}
+
+// pcapngEncoder writes an interface description block for every interface
+// before its first packet, the direction of a packet is in epb_flags.
+type pcapngEncoder struct {
+	snapLen int
+	ifs     map[captureIf]uint32
+}
+
+func newPcapngEncoder(snapLen int) *pcapngEncoder {
+	return &pcapngEncoder{snapLen: snapLen, ifs: make(map[captureIf]uint32)}
+}
+
+func (e *pcapngEncoder) fileName() string {
+	return "govnet.pcapng"
+}
+
+func (e *pcapngEncoder) header() []byte {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], pcapngMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1)
+	binary.LittleEndian.PutUint16(body[6:], 0)
+	//the section length isn't known
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0))
+	body = appendOpt(body, shbOptUserAppl, []byte("govnet "+version))
+	body = appendOptEnd(body)
+	return pcapngBlock(pcapngSHB, body)
+}
+
+func (e *pcapngEncoder) encode(rec *captureRecord) []byte {
+	var b []byte
+	id, ok := e.ifs[rec.ifc]
+	if !ok {
+		id = uint32(len(e.ifs))
+		e.ifs[rec.ifc] = id
+		body := make([]byte, 8)
+		binary.LittleEndian.PutUint16(body[0:], rec.ifc.linkType)
+		binary.LittleEndian.PutUint32(body[4:], uint32(e.snapLen))
+		body = appendOpt(body, idbOptName, []byte(rec.ifc.client))
+		body = appendOpt(body, idbOptDesc, []byte(fmt.Sprintf("vid=%d", rec.ifc.vid)))
+		body = appendOptEnd(body)
+		b = pcapngBlock(pcapngIDB, body)
+	}
+
+	//the timestamp is in microseconds, the default if_tsresol
+	ts := uint64(rec.ts.UnixNano() / int64(time.Microsecond))
+	body := make([]byte, 20, 20+pad4(len(rec.data))+12)
+	binary.LittleEndian.PutUint32(body[0:], id)
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(rec.data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(rec.origLen))
+	body = append(body, rec.data...)
+	body = append(body, make([]byte, pad4(len(rec.data))-len(rec.data))...)
+	flags := make([]byte, 4)
+	if rec.outBound {
+		binary.LittleEndian.PutUint32(flags, epbOutbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, epbInbound)
+	}
+	body = appendOpt(body, epbOptFlags, flags)
+	body = appendOptEnd(body)
+	return append(b, pcapngBlock(pcapngEPB, body)...)
+}
+
+// pcapEncoder writes the classic pcap, it has one link type only, which is
+// known before the first packet, the packets of the other link type are left
+// out. The interface and the direction aren't in the file.
+type pcapEncoder struct {
+	snapLen  int
+	linkType uint16
+}
+
+func newPcapEncoder(snapLen int, linkType uint16) *pcapEncoder {
+	return &pcapEncoder{snapLen: snapLen, linkType: linkType}
+}
+
+func (e *pcapEncoder) fileName() string {
+	return "govnet.pcap"
+}
+
+// header is written up front, a capture without packets is a valid file too
+func (e *pcapEncoder) header() []byte {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(b[4:], 2)
+	binary.LittleEndian.PutUint16(b[6:], 4)
+	binary.LittleEndian.PutUint32(b[16:], uint32(e.snapLen))
+	binary.LittleEndian.PutUint32(b[20:], uint32(e.linkType))
+	return b
+}
+
+func (e *pcapEncoder) encode(rec *captureRecord) []byte {
+	if e.linkType != rec.ifc.linkType {
+		return nil
+	}
+	b := make([]byte, 16, 16+len(rec.data))
+	binary.LittleEndian.PutUint32(b[0:], uint32(rec.ts.Unix()))
+	binary.LittleEndian.PutUint32(b[4:], uint32(rec.ts.Nanosecond()/int(time.Microsecond)))
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(rec.data)))
+	binary.LittleEndian.PutUint32(b[12:], uint32(rec.origLen))
+	return append(b, rec.data...)
+}
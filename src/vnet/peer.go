@@ -0,0 +1,87 @@
+package vnet
+
+import (
+	"fmt"
+	"mylog"
+	"sync"
+	"sync/atomic"
+)
+
+// peerLink is a peer the node keeps connecting to until it is deleted
+type peerLink struct {
+	sync.Mutex
+	addr    string
+	stopped int32
+	c       *Client
+}
+
+var peerLinksLock sync.Mutex
+var peerLinks = make(map[string]*peerLink)
+
+func (pl *peerLink) isStopped() bool {
+	return atomic.LoadInt32(&pl.stopped) == 1
+}
+
+// setClient records the working client of the peer, false if it is deleted
+func (pl *peerLink) setClient(c *Client) bool {
+	pl.Lock()
+	defer pl.Unlock()
+	if pl.isStopped() {
+		return false
+	}
+	pl.c = c
+	return true
+}
+
+func (pl *peerLink) stop() {
+	pl.Lock()
+	atomic.StoreInt32(&pl.stopped, 1)
+	c := pl.c
+	pl.Unlock()
+	if c != nil {
+		c.Reconnect()
+	}
+}
+
+// AddPeer connects to the peer dialInfo and reconnects when the conn is closed
+func AddPeer(dialInfo interface{}, dialer Dialer) {
+	addr := fmt.Sprint(dialInfo)
+	peerLinksLock.Lock()
+	if _, ok := peerLinks[addr]; ok {
+		peerLinksLock.Unlock()
+		mylog.Warning("peer %s exist already\n", addr)
+		return
+	}
+	pl := &peerLink{addr: addr}
+	peerLinks[addr] = pl
+	peerLinksLock.Unlock()
+
+	mylog.Info("======add peer %s =======\n", addr)
+	go func() {
+		for !pl.isStopped() {
+			conn := dialer.Connect(dialInfo)
+			if pl.isStopped() {
+				conn.Close()
+				break
+			}
+			handleConn(conn, true, pl)
+		}
+		mylog.Info("======peer %s is deleted, stop connecting=======\n", addr)
+	}()
+}
+
+// DelPeer closes the conn to the peer dialInfo and stops reconnecting,
+// the dialer may still be trying, the conn is closed when it returns.
+func DelPeer(dialInfo interface{}) {
+	addr := fmt.Sprint(dialInfo)
+	peerLinksLock.Lock()
+	pl, ok := peerLinks[addr]
+	delete(peerLinks, addr)
+	peerLinksLock.Unlock()
+	if !ok {
+		mylog.Warning("peer %s isn't exist\n", addr)
+		return
+	}
+	mylog.Info("======del peer %s =======\n", addr)
+	pl.stop()
+}
@@ -0,0 +1,79 @@
+package vnet
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/juju/ratelimit"
+)
+
+// limitBucket wraps the bucket, atomic.Value can't store a nil one
+type limitBucket struct {
+	bk *ratelimit.Bucket
+}
+
+func newLimitBucket(rate int64) limitBucket {
+	if rate == 0 {
+		return limitBucket{}
+	}
+	return limitBucket{ratelimit.NewBucketWithRate(float64(rate), rate)}
+}
+
+// connLimit is the up/down rate limit of one conn, unlike ratelimit.Reader
+// and ratelimit.Writer it can be changed while the conn is working.
+type connLimit struct {
+	up   atomic.Value
+	down atomic.Value
+}
+
+type rateLimiter interface {
+	setRateLimit(up, down int64)
+}
+
+func newConnLimit() *connLimit {
+	cl := &connLimit{}
+	cl.set(*UpRateLimit, *DownRateLimit)
+	return cl
+}
+
+func (cl *connLimit) set(up, down int64) {
+	cl.up.Store(newLimitBucket(up))
+	cl.down.Store(newLimitBucket(down))
+}
+
+type limitReader struct {
+	r  io.Reader
+	cl *connLimit
+}
+
+// Read calls r.Read once, so datagram boundaries are kept
+func (lr *limitReader) Read(b []byte) (int, error) {
+	n, err := lr.r.Read(b)
+	if bk := lr.cl.down.Load().(limitBucket).bk; bk != nil && n > 0 {
+		bk.Wait(int64(n))
+	}
+	return n, err
+}
+
+type limitWriter struct {
+	w  io.Writer
+	cl *connLimit
+}
+
+func (lw *limitWriter) Write(b []byte) (int, error) {
+	if bk := lw.cl.up.Load().(limitBucket).bk; bk != nil {
+		bk.Wait(int64(len(b)))
+	}
+	return lw.w.Write(b)
+}
+
+// applyRateLimit changes the rate limit of all working conns
+func applyRateLimit() {
+	ConnClientsLock.Lock()
+	for _, c := range ConnClients {
+		if rl, ok := c.cio.(rateLimiter); ok {
+			rl.setRateLimit(*UpRateLimit, *DownRateLimit)
+		}
+	}
+	ConnClientsLock.Unlock()
+}
@@ -0,0 +1,32 @@
+package vnet
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+var reloadFunc func() ([]string, error)
+
+// SetReloadFunc sets what "/reload" calls, it re-reads the config file and
+// returns the changes applied.
+func SetReloadFunc(f func() ([]string, error)) {
+	reloadFunc = f
+}
+
+func reloadConfig(w http.ResponseWriter, req *http.Request) {
+	if reloadFunc == nil {
+		fmt.Fprintf(w, "reload isn't supported\n")
+		return
+	}
+	changes, err := reloadFunc()
+	for _, change := range changes {
+		fmt.Fprintf(w, "%s\n", change)
+	}
+	if err != nil {
+		log.Printf("reload config err: %s\n", err.Error())
+		fmt.Fprintf(w, "reload config err: %s\n", err.Error())
+		return
+	}
+	fmt.Fprintf(w, "reload config success, %d changes\n", len(changes))
+}
@@ -0,0 +1,109 @@
+package vnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	replayWindowWords = 32
+	replayWindowSize  = (replayWindowWords - 1) * 64 //the newest word is partly used
+)
+
+// replayFilter is a sliding window over the counters of the aead nonces from
+// one peer: every counter is accepted once, and counters older than the
+// window are dropped. The sender's nonce salt is pinned by the first frame,
+// frames of another sender (replayed from an older conn) are dropped too.
+// It is only used by the reader of the client, so there is no lock.
+type replayFilter struct {
+	salt    [aeadSaltSize]byte
+	saltSet bool
+	last    uint64
+	bitmap  [replayWindowWords]uint64
+}
+
+func nonceSeq(nonce []byte) uint64 {
+	return binary.BigEndian.Uint64(nonce[aeadSaltSize:aeadNonceSize])
+}
+
+func (rf *replayFilter) accept(nonce []byte) bool {
+	if !rf.saltSet {
+		copy(rf.salt[:], nonce[:aeadSaltSize])
+		rf.saltSet = true
+	} else if !bytes.Equal(rf.salt[:], nonce[:aeadSaltSize]) {
+		return false
+	}
+
+	seq := nonceSeq(nonce)
+	if seq == 0 {
+		//seal starts at 1
+		return false
+	}
+	word := seq >> 6
+	if seq > rf.last {
+		cur := rf.last >> 6
+		diff := word - cur
+		if diff > replayWindowWords {
+			diff = replayWindowWords
+		}
+		for i := uint64(1); i <= diff; i++ {
+			rf.bitmap[(cur+i)%replayWindowWords] = 0
+		}
+		rf.last = seq
+	} else if rf.last-seq >= replayWindowSize {
+		return false
+	}
+
+	word %= replayWindowWords
+	bit := uint64(1) << (seq & 63)
+	if rf.bitmap[word]&bit != 0 {
+		return false
+	}
+	rf.bitmap[word] |= bit
+	return true
+}
+
+// isReflected reports a frame sealed by any client of this node with the
+// static key and sent back to it, sessions have a key per direction so only
+// the static key needs it.
+func (c *Client) isReflected(payload []byte) bool {
+	if (c.aead != nil && c.aead.session) || len(payload) < aeadNonceSize {
+		return false
+	}
+	return isStaticSalt(payload[:aeadSaltSize])
+}
+
+type cryptStat struct {
+	Client      string
+	PeerId      string
+	CryptType   string
+	CryptDrops  uint64
+	ReplayDrops uint64
+}
+
+func showCryptStat(w http.ResponseWriter, req *http.Request) {
+	var stats []cryptStat
+	ConnClientsLock.Lock()
+	for name, c := range ConnClients {
+		stats = append(stats, cryptStat{
+			Client:      name,
+			PeerId:      c.peerId,
+			CryptType:   CRYtoString[c.cryptType],
+			CryptDrops:  atomic.LoadUint64(&c.cryptDrops),
+			ReplayDrops: atomic.LoadUint64(&c.replayDrops),
+		})
+	}
+	ConnClientsLock.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Client < stats[j].Client })
+
+	buf, err := json.MarshalIndent(stats, "", "\t")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(buf)
+}
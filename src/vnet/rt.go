@@ -2,22 +2,44 @@ package vnet
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"log"
 	"mylog"
+	"net"
+	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	DefRouteTable = 5588
 )
 
 var routeLock sync.Mutex
 var routeConf string = "rt.txt"
+var routeTable int = DefRouteTable
+var rtState routeState
+
+// routeState is what the last setRoute applied to the kernel
+type routeState struct {
+	Table    int
+	Routes   []string
+	Added    []string
+	Deleted  []string
+	Errors   []string
+	LastTime time.Time
+}
 
 func vnetRoute() {
-	setRtSig := make(chan os.Signal)
+	setRtSig := make(chan os.Signal, 1)
 	signal.Notify(setRtSig, syscall.SIGUSR1)
 	for {
 		//time.Sleep(time.Minute)
@@ -33,55 +55,289 @@ func SetRouteConf(rc string) {
 	log.Printf("=====SetRouteConf : rc=%s, routeConf=%s====\n", rc, routeConf)
 }
 
+func SetRouteTable(table int) {
+	if table > 0 {
+		routeTable = table
+	}
+	log.Printf("=====SetRouteTable : table=%d, routeTable=%d====\n", table, routeTable)
+}
+
+// routeFamily is the family of r, a default route of the conf has no dst, it
+// is ipv6 by its gw.
+func routeFamily(r *netlink.Route) int {
+	if r.Family == netlink.FAMILY_V6 {
+		return netlink.FAMILY_V6
+	}
+	if r.Dst != nil && r.Dst.IP.To4() == nil || r.Dst == nil && r.Gw != nil && r.Gw.To4() == nil {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+// routeKey is the dst of r, the default route is 0.0.0.0/0 or ::/0 by its
+// family: a conf line has no dst, the kernel lists it with the zero one.
+func routeKey(r *netlink.Route) string {
+	if r.Dst == nil || r.Dst.IP.IsUnspecified() {
+		if ones, _ := maskSize(r.Dst); ones == 0 {
+			if routeFamily(r) == netlink.FAMILY_V6 {
+				return "::/0"
+			}
+			return "0.0.0.0/0"
+		}
+	}
+	return r.Dst.String()
+}
+
+func maskSize(dst *net.IPNet) (int, int) {
+	if dst == nil {
+		return 0, 0
+	}
+	return dst.Mask.Size()
+}
+
+func routeString(r *netlink.Route) string {
+	s := routeKey(r)
+	if r.Gw != nil {
+		s += " via " + r.Gw.String()
+	}
+	if r.LinkIndex != 0 {
+		if link, err := netlink.LinkByIndex(r.LinkIndex); err == nil {
+			s += " dev " + link.Attrs().Name
+		}
+	}
+	return fmt.Sprintf("%s table %d", s, r.Table)
+}
+
+// parseRouteDst parses the dst of a line of routeConf, nil for default
+func parseRouteDst(s string) (*net.IPNet, error) {
+	if s == "default" {
+		return nil, nil
+	}
+	_, dst, err := net.ParseCIDR(s)
+	if err == nil {
+		return dst, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid dst %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
+
+// failedRouteKey is the key of the line which fails to parse, if its dst is
+// valid, so the route in the kernel isn't deleted as stale.
+func failedRouteKey(line string) (string, bool) {
+	rt := strings.Split(line, ",")
+	dst, err := parseRouteDst(strings.TrimSpace(rt[0]))
+	if err != nil {
+		return "", false
+	}
+	r := &netlink.Route{Dst: dst}
+	if len(rt) > 1 {
+		r.Gw = net.ParseIP(strings.TrimSpace(rt[1]))
+	}
+	return routeKey(r), true
+}
+
+// parseRouteLine parses one line of routeConf: "dst", "dst,gw" or "dst,gw,dev",
+// dst only means the route is through the tun, it is NOARP in p2p mode.
+func parseRouteLine(line string) (*netlink.Route, error) {
+	rt := strings.Split(line, ",")
+	for i := range rt {
+		rt[i] = strings.TrimSpace(rt[i])
+	}
+	r := &netlink.Route{Table: routeTable}
+	dst, err := parseRouteDst(rt[0])
+	if err != nil {
+		return nil, err
+	}
+	r.Dst = dst
+
+	dev := ""
+	switch len(rt) {
+	case 1:
+		dev = *TunName
+	case 2:
+		r.Gw = net.ParseIP(rt[1])
+	default:
+		r.Gw = net.ParseIP(rt[1])
+		dev = rt[2]
+	}
+	if len(rt) > 1 && r.Gw == nil {
+		return nil, fmt.Errorf("invalid gw %s", rt[1])
+	}
+	if dev != "" {
+		link, err := netlink.LinkByName(dev)
+		if err != nil {
+			return nil, fmt.Errorf("dev %s: %s", dev, err.Error())
+		}
+		r.LinkIndex = link.Attrs().Index
+	}
+	return r, nil
+}
+
+// loadRouteConf returns the routes of routeConf by key, the errors of the
+// lines which fail to parse and the keys of them.
+func loadRouteConf() (map[string]*netlink.Route, []string, map[string]bool, error) {
+	var errs []string
+	failed := make(map[string]bool)
+	rtFile, err := os.Open(routeConf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rtFile.Close()
+
+	desired := make(map[string]*netlink.Route)
+	scanner := bufio.NewScanner(rtFile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRouteLine(line)
+		if err != nil {
+			mylog.Error("route conf %s, line=%s, err:%s\n", routeConf, line, err.Error())
+			errs = append(errs, fmt.Sprintf("%s: %s", line, err.Error()))
+			if key, ok := failedRouteKey(line); ok {
+				failed[key] = true
+			}
+			continue
+		}
+		desired[routeKey(r)] = r
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errs, failed, err
+	}
+	return desired, errs, failed, nil
+}
+
+func sameRoute(want, have *netlink.Route) bool {
+	if !want.Gw.Equal(have.Gw) {
+		return false
+	}
+	//the kernel fills the dev of a route via gw
+	return want.LinkIndex == 0 || want.LinkIndex == have.LinkIndex
+}
+
+// ensureRouteRule keeps exactly one "from all lookup routeTable" rule
+func ensureRouteRule(family int) error {
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range rules {
+		if rules[i].Table != routeTable || rules[i].Src != nil || rules[i].Dst != nil {
+			continue
+		}
+		if found {
+			if err = netlink.RuleDel(&rules[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		found = true
+	}
+	if found {
+		return nil
+	}
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Table = routeTable
+	return netlink.RuleAdd(rule)
+}
+
+// setRoute makes the kernel table routeTable the same as routeConf: routes
+// which changed are replaced in place, the stale ones are deleted. The route
+// of a line which fails to parse is kept if its dst is valid.
 func setRoute() {
-	var cmd string
-	log.Printf("====================== set route begin, *TunName=%s=================\n", *TunName)
+	log.Printf("====================== set route begin, *TunName=%s, table=%d=================\n", *TunName, routeTable)
 	routeLock.Lock()
 	defer routeLock.Unlock()
-	rtFile, err := os.Open(routeConf)
+
+	state := routeState{Table: routeTable, LastTime: time.Now()}
+	defer func() { rtState = state }()
+
+	desired, errs, failed, err := loadRouteConf()
+	state.Errors = errs
 	if err != nil {
-		mylog.Error("open err:%s \n", err.Error())
+		mylog.Error("load route conf err:%s \n", err.Error())
+		state.Errors = append(state.Errors, err.Error())
 		return
 	}
-	//ensure there is no rules about 5588 table when add
-	for i := 0; i < 100; i++ {
-		err = exec.Command("sh", "-c", "ip ru del from all table 5588").Run()
-		if err != nil {
-			log.Printf("ip ru del ,time=%d, err=%s \n", i+1, err.Error())
+
+	families := []int{netlink.FAMILY_V4}
+	for _, r := range desired {
+		if routeFamily(r) == netlink.FAMILY_V6 {
+			families = append(families, netlink.FAMILY_V6)
 			break
 		}
 	}
-	err = exec.Command("sh", "-c", "ip ru add from all table 5588").Run()
+	for _, family := range families {
+		if err = ensureRouteRule(family); err != nil {
+			mylog.Error("ensure rule of table %d err:%s \n", routeTable, err.Error())
+			state.Errors = append(state.Errors, err.Error())
+			return
+		}
+	}
+
+	have, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: routeTable}, netlink.RT_FILTER_TABLE)
 	if err != nil {
-		mylog.Error("ip ru add from all table 5588 err:%s \n", err.Error())
+		mylog.Error("list table %d err:%s \n", routeTable, err.Error())
+		state.Errors = append(state.Errors, err.Error())
 		return
 	}
+	haveMap := make(map[string]*netlink.Route, len(have))
+	for i := range have {
+		haveMap[routeKey(&have[i])] = &have[i]
+	}
 
-	scanner := bufio.NewScanner(rtFile)
-	err = exec.Command("sh", "-c", "ip route flush table 5588").Run()
-	if err != nil {
-		mylog.Error("flush 5588 err:%s \n", err.Error())
+	for key, r := range desired {
+		if h, ok := haveMap[key]; ok && sameRoute(r, h) {
+			continue
+		}
+		if err = netlink.RouteReplace(r); err != nil {
+			mylog.Error("route replace %s err:%s \n", routeString(r), err.Error())
+			state.Errors = append(state.Errors, fmt.Sprintf("replace %s: %s", routeString(r), err.Error()))
+			continue
+		}
+		state.Added = append(state.Added, routeString(r))
 	}
-	for scanner.Scan() {
-		line := scanner.Text()
-		rt := strings.Split(line, ",")
-		fmt.Println(rt)
-		if len(rt) == 1 { // for ec tun point to point mode,it is NOARP
-			cmd = fmt.Sprintf("ip route add %s dev %s table 5588", rt[0], *TunName)
-		} else if len(rt) == 2 {
-			//cmd = fmt.Sprintf("ip route add %s via %s dev %s table 5588", rt[0], rt[1], *TunName)
-			cmd = fmt.Sprintf("ip route add %s via %s table 5588", rt[0], rt[1])
-		} else {
-			cmd = fmt.Sprintf("ip route add %s via %s dev %s table 5588", rt[0], rt[1], rt[2])
+	if len(errs) > 0 {
+		mylog.Warning("route conf %s has %d invalid lines, keep their routes\n", routeConf, len(errs))
+	}
+	for key, h := range haveMap {
+		if _, ok := desired[key]; ok || failed[key] {
+			continue
 		}
-		err = exec.Command("sh", "-c", cmd).Run()
-		if err != nil {
-			mylog.Error("err:%s, cmd = %s \n", err.Error(), cmd)
+		if err = netlink.RouteDel(h); err != nil {
+			mylog.Error("route del %s err:%s \n", routeString(h), err.Error())
+			state.Errors = append(state.Errors, fmt.Sprintf("del %s: %s", routeString(h), err.Error()))
+			continue
 		}
+		state.Deleted = append(state.Deleted, routeString(h))
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "error:", err)
-		//os.Exit(1)
+
+	if applied, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: routeTable}, netlink.RT_FILTER_TABLE); err == nil {
+		for i := range applied {
+			state.Routes = append(state.Routes, routeString(&applied[i]))
+		}
+		sort.Strings(state.Routes)
+	}
+	log.Printf("---------------set route over, add %d, del %d, err %d ------------------\n", len(state.Added), len(state.Deleted), len(state.Errors))
+}
+
+func showRouteState(w http.ResponseWriter, req *http.Request) {
+	routeLock.Lock()
+	state := rtState
+	routeLock.Unlock()
+	buf, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
 	}
-	log.Println("---------------set route over ------------------")
+	w.Write(buf)
 }
@@ -0,0 +1,694 @@
+package vnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fdb"
+	"fmt"
+	"io"
+	"mylog"
+	"net/http"
+	"packet"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	stpVersion      = 1
+	stpMsgSize      = 26
+	stpFlagTc       = 0x01 //topology change, the macs must be learned again
+	stpMaxHops      = 20   //the msg of the root is dropped after, no count to infinity
+	stpPortPriority = 128
+
+	defStpPriority     = 32768
+	defStpHelloTime    = 2
+	defStpMaxAge       = 6
+	defStpForwardDelay = 6
+	defStpPortCost     = 100
+)
+
+const (
+	stpRoleDesignated = iota
+	stpRoleRoot
+	stpRoleAlternate
+)
+
+var stpRoleNames = []string{"designated", "root", "alternate"}
+
+// StpConf is the loop prevention between the conns: a spanning tree of every
+// bridged vid, computed over the StpMsg of the nodes. The node of the lowest
+// Priority, then bridge id, is the root, the ports of the redundant links
+// are blocked. The tuns are edge ports, they are never blocked. Every node
+// of the mesh must enable it, a node without it forwards on all its ports.
+type StpConf struct {
+	Enable       bool  `toml:"enable"`
+	Priority     int   `toml:"priority"`     //0-65535, the lowest is the root
+	HelloTime    int   `toml:"hellotime"`    //second, between the StpMsg
+	MaxAge       int   `toml:"maxage"`       //second, the msg of a peer is kept
+	ForwardDelay int   `toml:"forwarddelay"` //second, a designated port discards before forwarding
+	PortCost     int   `toml:"portcost"`
+	Vids         []int `toml:"vids"` //all the bridged vids if empty
+}
+
+// bridgeId is the priority and then the address of a node
+type bridgeId [8]byte
+
+func (id bridgeId) String() string {
+	return fmt.Sprintf("%d.%x", binary.BigEndian.Uint16(id[:2]), id[2:])
+}
+
+// stpVector is what a port advertises: the root, the cost to it, and the
+// bridge and port which send it, the lower one is the better one.
+type stpVector struct {
+	root   bridgeId
+	cost   uint32
+	bridge bridgeId
+	port   uint16
+}
+
+func (v *stpVector) cmp(o *stpVector) int {
+	if c := bytes.Compare(v.root[:], o.root[:]); c != 0 {
+		return c
+	}
+	if v.cost != o.cost {
+		if v.cost < o.cost {
+			return -1
+		}
+		return 1
+	}
+	if c := bytes.Compare(v.bridge[:], o.bridge[:]); c != 0 {
+		return c
+	}
+	if v.port != o.port {
+		if v.port < o.port {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// stpPort is a conn in the spanning tree of a vid, msg is the last StpMsg of
+// the peer, none if msgTime is zero.
+type stpPort struct {
+	c          *Client
+	id         uint16
+	msg        stpVector
+	msgHops    uint8
+	msgTime    time.Time
+	role       int
+	forwarding bool
+	fwdAt      time.Time //when a discarding designated port forwards
+	tcUntil    time.Time //send the topology change until
+	rxMsgs     uint64
+	txMsgs     uint64
+}
+
+type stpBridge struct {
+	vid      int
+	f        *fdb.FDB
+	ports    map[*Client]*stpPort
+	root     stpVector
+	rootPort *stpPort
+	changed  bool //send the StpMsg now
+	tcs      uint64
+	lastTc   time.Time
+	helloAt  time.Time
+}
+
+// stpSend is a StpMsg to send after the stpLock is released
+type stpSend struct {
+	c   *Client
+	vid int
+	msg [stpMsgSize]byte
+}
+
+var stpLock sync.Mutex
+var stpBridges = make(map[int]*stpBridge)
+var stpSelf bridgeId
+var stpAddr []byte
+var stpConfValue atomic.Value //StpConf, read by the joining clients
+var stpChan = make(chan struct{}, 1)
+var stpOnce sync.Once
+
+// stpRejoins are the ports which joined a vid again, the stpPort of the last
+// join may be still forwarding, stpSync adds them again discarding. It isn't
+// under stpLock, stpJoin holds the lock of the client.
+var stpRejoinLock sync.Mutex
+var stpRejoins = make(map[stpRejoin]bool)
+
+type stpRejoin struct {
+	c   *Client
+	vid int
+}
+
+func triggerStp() {
+	select {
+	case stpChan <- struct{}{}:
+	default:
+	}
+}
+
+func getStpConf() StpConf {
+	conf, _ := stpConfValue.Load().(StpConf)
+	return conf
+}
+
+// stpVidEnabled reports whether the ports of vid are in a spanning tree
+func stpVidEnabled(conf *StpConf, vid int, f *fdb.FDB) bool {
+	if !conf.Enable || f.IsRouted() {
+		return false
+	}
+	if len(conf.Vids) == 0 {
+		return true
+	}
+	for _, v := range conf.Vids {
+		if v == vid {
+			return true
+		}
+	}
+	return false
+}
+
+// isStpPort reports whether c is a port of the spanning tree, a conn or a
+// backup link.
+func (c *Client) isStpPort() bool {
+	if c.p2pFwd || c.master != nil {
+		return false
+	}
+	if _, ok := c.cio.(*backupLink); ok {
+		return true
+	}
+	return c.isConnIO()
+}
+
+// stpJoin blocks the port c joins in f until the spanning tree lets it
+// forward, it is before c is a port of f, so nothing is forwarded before.
+func stpJoin(c *Client, vid int, f *fdb.FDB) {
+	conf := getStpConf()
+	if !c.isStpPort() || !stpVidEnabled(&conf, vid, f) {
+		return
+	}
+	f.SetPortBlocked(c, true)
+	stpRejoinLock.Lock()
+	stpRejoins[stpRejoin{c: c, vid: vid}] = true
+	stpRejoinLock.Unlock()
+	triggerStp()
+}
+
+func checkStpConf(conf *StpConf) error {
+	if conf.Priority == 0 {
+		conf.Priority = defStpPriority
+	}
+	if conf.HelloTime == 0 {
+		conf.HelloTime = defStpHelloTime
+	}
+	if conf.MaxAge == 0 {
+		conf.MaxAge = defStpMaxAge
+	}
+	if conf.ForwardDelay == 0 {
+		conf.ForwardDelay = defStpForwardDelay
+	}
+	if conf.PortCost == 0 {
+		conf.PortCost = defStpPortCost
+	}
+	if conf.Priority < 0 || conf.Priority > 65535 {
+		return fmt.Errorf("priority %d is invalid, it is 0-65535", conf.Priority)
+	}
+	if conf.HelloTime < 1 || conf.HelloTime > 10 {
+		return fmt.Errorf("hellotime %d is invalid, it is 1-10", conf.HelloTime)
+	}
+	if conf.MaxAge < 2*conf.HelloTime || conf.MaxAge > 60 {
+		return fmt.Errorf("maxage %d is invalid, it is %d-60", conf.MaxAge, 2*conf.HelloTime)
+	}
+	if conf.ForwardDelay < 1 || conf.ForwardDelay > 30 {
+		return fmt.Errorf("forwarddelay %d is invalid, it is 1-30", conf.ForwardDelay)
+	}
+	if conf.PortCost < 1 || conf.PortCost > 65535 {
+		return fmt.Errorf("portcost %d is invalid, it is 1-65535", conf.PortCost)
+	}
+	for _, vid := range conf.Vids {
+		if vid < 0 || vid > 4095 {
+			return fmt.Errorf("vid %d is invalid", vid)
+		}
+	}
+	return nil
+}
+
+// SetStp applies conf, the ports start discarding when it is enabled, and
+// forward when it is disabled. The address of the bridge id is of the node
+// id, or random without auth.
+func SetStp(conf StpConf) error {
+	if err := checkStpConf(&conf); err != nil {
+		return err
+	}
+	stpLock.Lock()
+	if stpAddr == nil {
+		if id := NodeId(); id != "" {
+			sum := sha256.Sum256([]byte(id))
+			stpAddr = sum[:6]
+		} else {
+			stpAddr = make([]byte, 6)
+			rand.Read(stpAddr)
+		}
+	}
+	binary.BigEndian.PutUint16(stpSelf[:2], uint16(conf.Priority))
+	copy(stpSelf[2:], stpAddr)
+	self := stpSelf
+	stpConfValue.Store(conf)
+	for _, b := range stpBridges {
+		b.changed = true
+	}
+	stpLock.Unlock()
+	mylog.Info("stp enable %v, bridge id %s, vids %v\n", conf.Enable, self.String(), conf.Vids)
+	stpOnce.Do(func() { go stpRun() })
+	triggerStp()
+	return nil
+}
+
+// stpClients returns the clients which may be ports of the spanning tree
+func stpClients() []*Client {
+	var clients []*Client
+	ConnClientsLock.Lock()
+	for _, c := range ConnClients {
+		if c.isStpPort() {
+			clients = append(clients, c)
+		}
+	}
+	ConnClientsLock.Unlock()
+	ClientMasterLock.Lock()
+	for _, c := range ClientMaster {
+		if _, ok := c.cio.(*backupLink); ok {
+			clients = append(clients, c)
+		}
+	}
+	ClientMasterLock.Unlock()
+	return clients
+}
+
+// stpSync adds the ports joined and removes the ones gone, the bridges of
+// the vids without spanning tree forward on all their ports.
+func stpSync(conf *StpConf, now time.Time) {
+	clients := stpClients()
+	stpRejoinLock.Lock()
+	rejoins := stpRejoins
+	stpRejoins = make(map[stpRejoin]bool)
+	stpRejoinLock.Unlock()
+	vids := make(map[int]bool)
+	for _, vid := range fdb.GetFdbIds() {
+		f, ok := fdb.GetFdbById(vid)
+		if !ok {
+			continue
+		}
+		b := stpBridges[vid]
+		if !stpVidEnabled(conf, vid, f) {
+			if b != nil || f.BlockedPortNum() > 0 {
+				for _, c := range clients {
+					f.SetPortBlocked(c, false)
+				}
+			}
+			continue
+		}
+		vids[vid] = true
+		if b == nil || b.f != f {
+			b = &stpBridge{vid: vid, f: f, ports: make(map[*Client]*stpPort), changed: true}
+			stpBridges[vid] = b
+		}
+		joined := make(map[*Client]bool, len(clients))
+		for _, c := range clients {
+			fp, ok := c.GetFdbById(vid)
+			if !ok || fp.fdb != f {
+				continue
+			}
+			joined[c] = true
+			if rejoins[stpRejoin{c: c, vid: vid}] {
+				b.removePort(c, now)
+			}
+			if _, ok := b.ports[c]; !ok {
+				f.SetPortBlocked(c, true)
+				b.ports[c] = &stpPort{
+					c:  c,
+					id: stpPortPriority<<8 | uint16(fp.fdbPortId),
+				}
+				b.changed = true
+			}
+		}
+		for c := range b.ports {
+			if !joined[c] {
+				b.removePort(c, now)
+			}
+		}
+	}
+	for vid := range stpBridges {
+		if !vids[vid] {
+			delete(stpBridges, vid)
+		}
+	}
+}
+
+func (b *stpBridge) removePort(c *Client, now time.Time) {
+	p, ok := b.ports[c]
+	if !ok {
+		return
+	}
+	delete(b.ports, c)
+	if b.rootPort == p {
+		b.rootPort = nil
+	}
+	if p.forwarding {
+		b.topologyChange(now, nil)
+	}
+	b.changed = true
+}
+
+// sortedPorts returns the ports by id, the ties are broken by it
+func (b *stpBridge) sortedPorts() []*stpPort {
+	ports := make([]*stpPort, 0, len(b.ports))
+	for _, p := range b.ports {
+		ports = append(ports, p)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].id < ports[j].id })
+	return ports
+}
+
+// topologyChange flushes the macs and sends the topology change on the
+// forwarding ports but from, for two hellos.
+func (b *stpBridge) topologyChange(now time.Time, from *stpPort) {
+	conf := getStpConf()
+	b.f.Flush()
+	b.tcs++
+	b.lastTc = now
+	until := now.Add(time.Second * time.Duration(2*conf.HelloTime))
+	for _, p := range b.ports {
+		if p != from && p.forwarding && !now.Before(p.tcUntil) {
+			p.tcUntil = until
+		}
+	}
+	b.changed = true
+}
+
+// update computes the root and the roles of the ports like rstp: the port of
+// the best msg to the root is the root port, a port whose peer advertises a
+// better msg than this bridge is alternate and discards, the others are
+// designated. The root port forwards at once, a designated port after
+// ForwardDelay.
+func (b *stpBridge) update(conf *StpConf, now time.Time) {
+	maxAge := time.Second * time.Duration(conf.MaxAge)
+	ports := b.sortedPorts()
+	for _, p := range ports {
+		if !p.msgTime.IsZero() && now.Sub(p.msgTime) > maxAge {
+			mylog.Notice("stp vid=%d, msg of %s is aged out\n", b.vid, p.c.String())
+			p.msgTime = time.Time{}
+		}
+	}
+
+	root := stpVector{root: stpSelf, bridge: stpSelf}
+	var rootPort *stpPort
+	for _, p := range ports {
+		if p.msgTime.IsZero() || p.msg.bridge == stpSelf {
+			continue
+		}
+		v := p.msg
+		v.cost += uint32(conf.PortCost)
+		if v.cmp(&root) < 0 {
+			root, rootPort = v, p
+		}
+	}
+	if root.root != b.root.root || root.cost != b.root.cost || rootPort != b.rootPort {
+		mylog.Notice("stp vid=%d, root %s cost %d\n", b.vid, root.root.String(), root.cost)
+		b.changed = true
+	}
+	b.root, b.rootPort = root, rootPort
+
+	for _, p := range ports {
+		role := stpRoleDesignated
+		designated := stpVector{root: root.root, cost: root.cost, bridge: stpSelf, port: p.id}
+		if p == rootPort {
+			role = stpRoleRoot
+		} else if !p.msgTime.IsZero() && p.msg.cmp(&designated) < 0 {
+			role = stpRoleAlternate
+		}
+		if role != p.role {
+			p.role = role
+			b.changed = true
+		}
+
+		forwarding := false
+		switch role {
+		case stpRoleRoot:
+			forwarding = true
+		case stpRoleDesignated:
+			if p.forwarding {
+				forwarding = true
+			} else if p.fwdAt.IsZero() {
+				p.fwdAt = now.Add(time.Second * time.Duration(conf.ForwardDelay))
+			} else {
+				forwarding = !now.Before(p.fwdAt)
+			}
+		}
+		if role != stpRoleDesignated || forwarding {
+			p.fwdAt = time.Time{}
+		}
+		if forwarding != p.forwarding {
+			p.forwarding = forwarding
+			b.f.SetPortBlocked(p.c, !forwarding)
+			mylog.Notice("stp vid=%d, port %s is %s, forwarding %v\n", b.vid, p.c.String(), stpRoleNames[role], forwarding)
+			b.topologyChange(now, nil)
+		}
+	}
+}
+
+// hops returns the hops of the msg this bridge sends, the root sends 0
+func (b *stpBridge) hops() uint8 {
+	if b.rootPort == nil {
+		return 0
+	}
+	return b.rootPort.msgHops + 1
+}
+
+// msgs returns the StpMsg of every port, at every hello or on change
+func (b *stpBridge) msgs(conf *StpConf, now time.Time) []stpSend {
+	if !b.changed && now.Before(b.helloAt) {
+		return nil
+	}
+	b.changed = false
+	b.helloAt = now.Add(time.Second * time.Duration(conf.HelloTime))
+	sends := make([]stpSend, 0, len(b.ports))
+	for _, p := range b.ports {
+		s := stpSend{c: p.c, vid: b.vid}
+		m := s.msg[:]
+		m[0] = stpVersion
+		if now.Before(p.tcUntil) {
+			m[1] |= stpFlagTc
+		}
+		m[2] = b.hops()
+		copy(m[4:], b.root.root[:])
+		binary.BigEndian.PutUint32(m[12:], b.root.cost)
+		copy(m[16:], stpSelf[:])
+		binary.BigEndian.PutUint16(m[24:], p.id)
+		p.txMsgs++
+		sends = append(sends, s)
+	}
+	return sends
+}
+
+func (c *Client) sendStpMsg(vid int, msg []byte) {
+	pb := c.getPktBuf()
+	buf := pb.LoadBuf()
+	copy(buf[PktHeaderSize:], msg)
+	assemblePktHead(StpMsg, buf[:PktHeaderSize], len(msg), vid)
+	pb.SetDataLen(PktHeaderSize + len(msg))
+	pb.SetUserDataOff(PktHeaderSize)
+	c.PutPktToChan2(pb)
+	putPktBuf(pb)
+}
+
+// stpRun computes the spanning trees every second, and whenever a port or a
+// msg changes.
+func stpRun() {
+	tick := time.Tick(time.Second)
+	for {
+		select {
+		case <-tick:
+		case <-stpChan:
+		}
+		conf := getStpConf()
+		now := time.Now()
+		var sends []stpSend
+		stpLock.Lock()
+		stpSync(&conf, now)
+		for _, b := range stpBridges {
+			b.update(&conf, now)
+			sends = append(sends, b.msgs(&conf, now)...)
+		}
+		stpLock.Unlock()
+		for i := range sends {
+			sends[i].c.sendStpMsg(sends[i].vid, sends[i].msg[:])
+		}
+	}
+}
+
+// stpClientClosed removes c from the spanning trees, they converge at once
+func stpClientClosed(c *Client) {
+	if !c.isStpPort() {
+		return
+	}
+	now := time.Now()
+	stpLock.Lock()
+	for _, b := range stpBridges {
+		b.removePort(c, now)
+	}
+	stpLock.Unlock()
+	triggerStp()
+}
+
+func (c *Client) handleStpMsg(vid int, msg []byte) error {
+	if len(msg) < stpMsgSize {
+		return fmt.Errorf("len(msg)=%d < %d", len(msg), stpMsgSize)
+	}
+	if msg[0] != stpVersion {
+		return fmt.Errorf("stp version %d isn't supported", msg[0])
+	}
+	port := c
+	if c.master != nil {
+		port = c.master
+	}
+	var v stpVector
+	copy(v.root[:], msg[4:12])
+	v.cost = binary.BigEndian.Uint32(msg[12:])
+	copy(v.bridge[:], msg[16:24])
+	v.port = binary.BigEndian.Uint16(msg[24:])
+	hops := msg[2]
+
+	now := time.Now()
+	stpLock.Lock()
+	defer stpLock.Unlock()
+	b, ok := stpBridges[vid]
+	if !ok {
+		return nil
+	}
+	p, ok := b.ports[port]
+	if !ok {
+		//the port is added by the next stpSync, the peer sends it again
+		return nil
+	}
+	p.rxMsgs++
+	if hops >= stpMaxHops {
+		if !p.msgTime.IsZero() {
+			p.msgTime = time.Time{}
+			triggerStp()
+		}
+		return nil
+	}
+	if p.msgTime.IsZero() || p.msg != v || p.msgHops != hops {
+		triggerStp()
+	}
+	p.msg, p.msgHops, p.msgTime = v, hops, now
+	if msg[1]&stpFlagTc != 0 && p.forwarding {
+		b.topologyChange(now, p)
+		triggerStp()
+	}
+	return nil
+}
+
+func StpMsgPktHandle(c *Client, cr io.Reader, pb *packet.PktBuf, ph *PktHeader) (rn int, err error) {
+	pktLen := ph.pktLen
+	if int(pktLen) > L2PktMaxSize+aeadOverhead {
+		err = fmt.Errorf("StpMsgPktHandle: recv pktLen =%d is invalid", pktLen)
+		return
+	}
+
+	pkt, _, err := c.readPayload(cr, pb, ph)
+	if err != nil || pkt == nil {
+		return
+	}
+	rn = int(pktLen)
+
+	if err = c.handleStpMsg(int(ph.vid), pkt); err != nil {
+		mylog.Error("handleStpMsg: %s \n", err.Error())
+		return
+	}
+	return
+}
+
+// StpPortInfo is a port of a spanning tree, Designated is the msg of its
+// peer, empty if there is none.
+type StpPortInfo struct {
+	Client         string
+	PortId         int
+	Role           string
+	Forwarding     bool
+	DesignatedRoot string
+	DesignatedCost uint32
+	DesignatedBy   string
+	RxMsgs         uint64
+	TxMsgs         uint64
+}
+
+// StpInfo is the spanning tree of a vid
+type StpInfo struct {
+	Vid             int
+	BridgeId        string
+	RootId          string
+	RootCost        uint32
+	RootPort        string
+	TopologyChanges uint64
+	LastChange      string
+	Ports           []StpPortInfo
+}
+
+// ShowStp returns the spanning trees sorted by vid
+func ShowStp() []StpInfo {
+	stpLock.Lock()
+	defer stpLock.Unlock()
+	infos := make([]StpInfo, 0, len(stpBridges))
+	for vid, b := range stpBridges {
+		info := StpInfo{
+			Vid:             vid,
+			BridgeId:        stpSelf.String(),
+			RootId:          b.root.root.String(),
+			RootCost:        b.root.cost,
+			TopologyChanges: b.tcs,
+		}
+		if b.rootPort != nil {
+			info.RootPort = b.rootPort.c.String()
+		}
+		if !b.lastTc.IsZero() {
+			info.LastChange = b.lastTc.Format(time.RFC3339)
+		}
+		for _, p := range b.sortedPorts() {
+			pi := StpPortInfo{
+				Client:     p.c.String(),
+				PortId:     int(p.id),
+				Role:       stpRoleNames[p.role],
+				Forwarding: p.forwarding,
+				RxMsgs:     p.rxMsgs,
+				TxMsgs:     p.txMsgs,
+			}
+			if !p.msgTime.IsZero() {
+				pi.DesignatedRoot = p.msg.root.String()
+				pi.DesignatedCost = p.msg.cost
+				pi.DesignatedBy = p.msg.bridge.String()
+			}
+			info.Ports = append(info.Ports, pi)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Vid < infos[j].Vid })
+	return infos
+}
+
+// showStp shows the spanning tree of every vid
+func showStp(w http.ResponseWriter, req *http.Request) {
+	infos, err := json.MarshalIndent(ShowStp(), "", "\t")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(infos)
+}
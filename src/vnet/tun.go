@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"mylog"
-	"os"
 	"os/exec"
 	"packet"
 	"strconv"
@@ -25,6 +24,7 @@ var (
 	Ipstr       = flag.String("ipstr", "", "set tun/tap or br ip address")
 	Mac         = flag.String("mac", "", "set tun/tap or br mac address")
 	Vid         = flag.Int("vid", 0, "set tun/tap vid")
+	Mtu         = flag.Int("mtu", 0, "set tun/tap mtu, 0 means default")
 	//HQMode      = flag.Bool("hq", false, "HQ mode ,default false")
 )
 
@@ -35,6 +35,9 @@ type TunConf struct {
 	Ipstr   string `toml:"ipstr"`
 	Mac     string `toml:"mac"`
 	Vid     int    `toml:"vid"`
+	Mtu     int    `toml:"mtu"`
+	//routed mode(tun): prefixes behind the tun, advertised to the peers
+	Routes []string `toml:"routes"`
 }
 
 const (
@@ -92,7 +95,7 @@ func (tun *mytun) Name() string {
 	return tun.tund.Name()
 }
 
-func OpenTun(br string, tunname string, tuntype int, ipstr string, mac string, vid int, auto bool) (tun *mytun, err error) {
+func OpenTun(br string, tunname string, tuntype int, ipstr string, mac string, mtu int, vid int, auto bool) (tun *mytun, err error) {
 	tun = NewTun(tuntype, vid)
 	if auto {
 		tunname = tunname + strconv.Itoa(tun.devId)
@@ -103,35 +106,16 @@ func OpenTun(br string, tunname string, tuntype int, ipstr string, mac string, v
 	tun.tund, err = tuntap.Open(tunname, tuntap.DevKind(tuntype), false)
 	if err != nil {
 		mylog.Error("tun/tap open err:%s, tunname = %s \n", err.Error(), tunname)
+		putDevId(tun.devId)
 		return nil, err
 	}
 
-	confs := fmt.Sprintf("ifconfig %s up\n", tunname)
-	if br != "" { //must be tap
-		if tuntype != int(tuntap.DevTap) {
-			log.Panicf("br=%s can't not addif tuntype=%d(tap:%d,tun:%d)\n", br, tuntype, int(tuntap.DevTap), int(tuntap.DevTun))
-		}
-		confs += fmt.Sprintf("brctl addbr %s\n", br)
-		confs += fmt.Sprintf("brctl addif %s %s\n", br, tunname)
-		if ipstr != "" {
-			confs += fmt.Sprintf("ifconfig %s %s\n", br, ipstr)
-		}
-		if mac != "" {
-			confs += fmt.Sprintf("ifconfig %s hw ether %s\n", br, mac)
-		}
-	} else { // maybe tun or tap
-		if ipstr != "" {
-			confs += fmt.Sprintf("ifconfig %s %s\n", tunname, ipstr)
-		}
-		if mac != "" && tuntype == int(tuntap.DevTap) {
-			confs += fmt.Sprintf("ifconfig %s hw ether %s\n", tunname, mac)
-		}
-	}
-
-	confs += fmt.Sprintf("ifconfig %s txqueuelen 5000\n", tunname)
-	err = exec.Command("sh", "-c", confs).Run()
+	err = setupDev(tun.tund.Name(), br, ipstr, mac, mtu, tuntype == int(tuntap.DevTap))
 	if err != nil {
-		mylog.Error("open err:%s, confs = %s \n", err.Error(), confs)
+		mylog.Error("setup dev %s err:%s\n", tunname, err.Error())
+		//the dev isn't persistent, closing it deletes it
+		tun.tund.Close()
+		putDevId(tun.devId)
 		return nil, err
 	}
 	//l3 ec
@@ -175,7 +159,7 @@ ReRead:
 			log.Printf("dst mac :%s", ether.DstMac.String())
 			log.Printf("src mac :%s", ether.SrcMac.String())
 		}
-		if !ether.IsArp() && !ether.IsIpPtk() {
+		if !ether.IsArp() && !ether.IsIpPtk() && !ether.IsIp6Pkt() {
 			//mylog.Warning(" not arp ,and not ip packet, ether type =0x%0x%0x ===============\n", ether.Proto[0], ether.Proto[1])
 			goto ReRead
 			//err = errors.New("vnetFilter")
@@ -188,6 +172,13 @@ ReRead:
 			}
 			log.Println("tun read ", iphdr.String())
 		}
+		if *DebugEn && ether.IsIp6Pkt() {
+			ip6hdr, err := packet.ParseIPv6Header(inpkt.Packet[packet.EtherSize:])
+			if err != nil {
+				log.Printf("ParseIPv6Header err: %s\n", err.Error())
+			}
+			log.Println("tun read ", ip6hdr.String())
+		}
 	} else {
 		if n < 28 || n > 1500 {
 			log.Printf("======tun read len=%d out of range =======\n", n)
@@ -224,7 +215,7 @@ func (tun *mytun) Write(pb *packet.PktBuf) (n int, err error) {
 	if checkTunPkt {
 		if tun.devType == int(tuntap.DevTap) {
 			ether := packet.TranEther(userData)
-			if !ether.IsArp() && !ether.IsIpPtk() {
+			if !ether.IsArp() && !ether.IsIpPtk() && !ether.IsIp6Pkt() {
 				mylog.Warning("====== not arp and not ip packet, ether proto=%d=======\n", ether.GetProto())
 				return 0, nil
 			}
@@ -252,30 +243,27 @@ func RunCmd(cmd string, args ...string) (string, error) {
 
 func (tun *mytun) Close() error {
 	mylog.Notice("=====close dev =%s \n", tun.Name())
-	// cmd := fmt.Sprintf(`ip link delete %s`, tun.Name())
-	ipPath, err := exec.LookPath("ip")
-	if err != nil {
-		log.Fatal("lookpath error: ", err)
-	}
-
-	//log.Printf("tun.Name() = [%x]", tun.Name())
-	out, err := RunCmd(ipPath, "link", "delete", tun.Name())
-	if err != nil {
-		mylog.Error("cmd run err: %s, cmd＝ip link delete %s\n", err.Error(), tun.Name())
-		log.Println(out)
-		os.Exit(1)
+	name := tun.Name()
+	delErr := delDev(name)
+	if delErr != nil {
+		mylog.Error("delete dev %s err: %s\n", name, delErr.Error())
+	} else {
+		mylog.Info("delete dev %s over\n", name) //route will delelte
 	}
-	mylog.Info("ip link delete %s over\n", tun.Name()) //route will delelte
 
-	cmd := fmt.Sprintf(`./vnetDevDown.sh %s`, tun.Name())
+	cmd := fmt.Sprintf(`./vnetDevDown.sh %s`, name)
 	output, err := exec.Command("sh", "-c", cmd).CombinedOutput()
 	if err != nil {
 		mylog.Error("open err:%s,out=%s\n", err.Error(), string(output))
 	}
 
 	putDevId(tun.devId)
-	delete(tcMap, tun.Name())
-	return tun.tund.Close()
+	delete(tcMap, name)
+	err = tun.tund.Close()
+	if delErr != nil {
+		return fmt.Errorf("delete dev %s: %s", name, delErr.Error())
+	}
+	return err
 }
 
 func (tun *mytun) String() string {
@@ -0,0 +1,351 @@
+package vnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mylog"
+	"net"
+	"packet"
+	"sync"
+	"time"
+)
+
+const (
+	udpMaxDatagram = frameBufSize
+	udpSockBufSize = 4 * 1024 * 1024
+	udpAcceptQueue = 64
+)
+
+var (
+	errUdpListenerClosed = errors.New("udp listener is closed")
+	errUdpConnClosed     = errors.New("udp conn is closed")
+	errUdpTimeout        = &udpTimeoutError{}
+)
+
+type udpTimeoutError struct{}
+
+func (e *udpTimeoutError) Error() string   { return "udp read timeout" }
+func (e *udpTimeoutError) Timeout() bool   { return true }
+func (e *udpTimeoutError) Temporary() bool { return true }
+
+// vnetUdpConn is the datagram version of vnetConn: every PktBuf (PktHeader +
+// payload) is carried in exactly one datagram, so a lost datagram only loses
+// that packet instead of stalling the whole stream.
+type vnetUdpConn struct {
+	conn  net.Conn
+	cr    io.Reader
+	cw    io.Writer
+	c     *Client
+	limit *connLimit
+	rd    bytes.Reader
+	wbuf  [frameBufSize]byte
+}
+
+func NewVnetUdpConn(conn net.Conn) *vnetUdpConn {
+	//limitReader/limitWriter call Read/Write once per buffer, so datagram boundaries are kept
+	limit := newConnLimit()
+	setUdpSockOpt(conn)
+	return &vnetUdpConn{
+		conn:  conn,
+		cr:    &limitReader{r: conn, cl: limit},
+		cw:    &limitWriter{w: conn, cl: limit},
+		limit: limit,
+	}
+}
+
+func (vc *vnetUdpConn) setClient(c *Client) {
+	vc.c = c
+}
+
+func (vc *vnetUdpConn) Read(pb *packet.PktBuf) (rn int, err error) {
+	var ph PktHeader
+	buf := pb.LoadBuf()
+
+	n, err := vc.cr.Read(buf)
+	if err != nil {
+		mylog.Error("\n ----%s read datagram fail: %s-----\n", vc.String(), err.Error())
+		return
+	}
+	if n < PktHeaderSize {
+		mylog.Warning("%s drop datagram, len=%d < PktHeaderSize=%d\n", vc.String(), n, PktHeaderSize)
+		return
+	}
+
+	pkt := pb.LoadAndUseBuf(PktHeaderSize)
+	parsePktHeader(pkt, &ph)
+	if int(ph.pktLen) != n-PktHeaderSize {
+		mylog.Warning("%s drop datagram, len=%d, but pktLen=%d\n", vc.String(), n, ph.pktLen)
+		pb.SetDataLen(0)
+		return
+	}
+
+	if err = vc.c.checkAuthed(&ph); err != nil {
+		return
+	}
+	if handlePkt, ok := pktHandles[ph.pktType]; ok {
+		// the payload is already in place, handlers ReadFull it onto itself
+		vc.rd.Reset(buf[PktHeaderSize:n])
+		if rn, err = handlePkt(vc.c, &vc.rd, pb, &ph); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (vc *vnetUdpConn) Write(pb *packet.PktBuf) (n int, err error) {
+	frame, err := vc.c.encodeFrame(pb, vc.wbuf[:])
+	if err != nil {
+		return
+	}
+	return vc.cw.Write(frame)
+}
+
+func (vc *vnetUdpConn) setRateLimit(up, down int64) {
+	vc.limit.set(up, down)
+}
+
+func (vc *vnetUdpConn) setDeadline(t time.Time) error {
+	return vc.conn.SetDeadline(t)
+}
+
+func (vc *vnetUdpConn) Close() error {
+	return vc.conn.Close()
+}
+
+func (vc *vnetUdpConn) String() string {
+	return fmt.Sprintf("udp:%s-%s", vc.conn.LocalAddr().String(), vc.conn.RemoteAddr().String())
+}
+
+func (vc *vnetUdpConn) RemoteAddr() string {
+	return vc.conn.RemoteAddr().String()
+}
+
+func (vc *vnetUdpConn) PutToRecvQueue(pb *packet.PktBuf, slave *Client) {
+	return
+}
+
+func setUdpSockOpt(conn net.Conn) {
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		udpConn.SetReadBuffer(udpSockBufSize)
+		udpConn.SetWriteBuffer(udpSockBufSize)
+	}
+}
+
+func isPacketConn(conn net.Conn) bool {
+	switch conn.(type) {
+	case *net.UDPConn, *udpPeerConn:
+		return true
+	}
+	return false
+}
+
+type udpDatagram struct {
+	buf *[udpMaxDatagram]byte
+	n   int
+}
+
+var udpBufPool = sync.Pool{
+	New: func() interface{} {
+		return new([udpMaxDatagram]byte)
+	},
+}
+
+// udpListener demultiplexes the datagrams of one listening socket by remote
+// address, every new remote address is handed out by Accept as a udpPeerConn.
+type udpListener struct {
+	conn *net.UDPConn
+	sync.Mutex
+	peers      map[string]*udpPeerConn
+	acceptChan chan *udpPeerConn
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func ListenUdp(addr string) (net.Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return nil, err
+	}
+	setUdpSockOpt(conn)
+	ln := &udpListener{
+		conn:       conn,
+		peers:      make(map[string]*udpPeerConn),
+		acceptChan: make(chan *udpPeerConn, udpAcceptQueue),
+		done:       make(chan struct{}),
+	}
+	go ln.recvLoop()
+	return ln, nil
+}
+
+func (ln *udpListener) recvLoop() {
+	defer ln.Close()
+	for {
+		buf := udpBufPool.Get().(*[udpMaxDatagram]byte)
+		n, raddr, err := ln.conn.ReadFromUDP(buf[:])
+		if err != nil {
+			udpBufPool.Put(buf)
+			log.Printf("udp listener %s read err: %s\n", ln.conn.LocalAddr().String(), err.Error())
+			return
+		}
+
+		peer, isNew := ln.getPeer(raddr)
+		if isNew {
+			select {
+			case ln.acceptChan <- peer:
+			default:
+				mylog.Warning("udp listener accept queue is full, drop peer %s\n", raddr.String())
+				ln.delPeer(peer)
+				udpBufPool.Put(buf)
+				continue
+			}
+		}
+
+		select {
+		case peer.recvQueue <- udpDatagram{buf: buf, n: n}:
+		case <-peer.done:
+			udpBufPool.Put(buf)
+		default:
+			//peer is too slow, drop it like a full socket buffer does
+			udpBufPool.Put(buf)
+		}
+	}
+}
+
+func (ln *udpListener) getPeer(raddr *net.UDPAddr) (peer *udpPeerConn, isNew bool) {
+	key := raddr.String()
+	ln.Lock()
+	peer, ok := ln.peers[key]
+	if !ok {
+		peer = newUdpPeerConn(ln, raddr)
+		ln.peers[key] = peer
+		isNew = true
+	}
+	ln.Unlock()
+	return
+}
+
+func (ln *udpListener) delPeer(peer *udpPeerConn) {
+	key := peer.raddr.String()
+	ln.Lock()
+	if p, ok := ln.peers[key]; ok && p == peer {
+		delete(ln.peers, key)
+	}
+	ln.Unlock()
+}
+
+func (ln *udpListener) Accept() (net.Conn, error) {
+	select {
+	case peer := <-ln.acceptChan:
+		return peer, nil
+	case <-ln.done:
+		return nil, errUdpListenerClosed
+	}
+}
+
+func (ln *udpListener) Close() error {
+	var err error
+	ln.closeOnce.Do(func() {
+		close(ln.done)
+		err = ln.conn.Close()
+	})
+	return err
+}
+
+func (ln *udpListener) Addr() net.Addr {
+	return ln.conn.LocalAddr()
+}
+
+// udpPeerConn is the server side net.Conn of one remote udp address,
+// Read returns one datagram at a time.
+type udpPeerConn struct {
+	ln        *udpListener
+	raddr     *net.UDPAddr
+	recvQueue chan udpDatagram
+	done      chan struct{}
+	closeOnce sync.Once
+	sync.Mutex
+	readDeadline time.Time
+}
+
+func newUdpPeerConn(ln *udpListener, raddr *net.UDPAddr) *udpPeerConn {
+	return &udpPeerConn{
+		ln:        ln,
+		raddr:     raddr,
+		recvQueue: make(chan udpDatagram, *ChanSize),
+		done:      make(chan struct{}),
+	}
+}
+
+func (pc *udpPeerConn) Read(b []byte) (int, error) {
+	var timeout <-chan time.Time
+	pc.Lock()
+	deadline := pc.readDeadline
+	pc.Unlock()
+	if !deadline.IsZero() {
+		d := deadline.Sub(time.Now())
+		if d <= 0 {
+			return 0, errUdpTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case dg := <-pc.recvQueue:
+		n := copy(b, dg.buf[:dg.n])
+		udpBufPool.Put(dg.buf)
+		return n, nil
+	case <-pc.done:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, errUdpTimeout
+	}
+}
+
+func (pc *udpPeerConn) Write(b []byte) (int, error) {
+	select {
+	case <-pc.done:
+		return 0, errUdpConnClosed
+	default:
+	}
+	return pc.ln.conn.WriteToUDP(b, pc.raddr)
+}
+
+func (pc *udpPeerConn) Close() error {
+	pc.closeOnce.Do(func() {
+		close(pc.done)
+		pc.ln.delPeer(pc)
+	})
+	return nil
+}
+
+func (pc *udpPeerConn) LocalAddr() net.Addr {
+	return pc.ln.conn.LocalAddr()
+}
+
+func (pc *udpPeerConn) RemoteAddr() net.Addr {
+	return pc.raddr
+}
+
+func (pc *udpPeerConn) SetDeadline(t time.Time) error {
+	return pc.SetReadDeadline(t)
+}
+
+func (pc *udpPeerConn) SetReadDeadline(t time.Time) error {
+	pc.Lock()
+	pc.readDeadline = t
+	pc.Unlock()
+	return nil
+}
+
+func (pc *udpPeerConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"mylog"
 	"packet"
+	"sync"
 )
 
 type fdbPort struct {
@@ -16,15 +17,28 @@ type fdbPort struct {
 	fdbPortId int
 }
 
+// vidsLock guards Vids, it is read by the recv goroutines of the conns
+var vidsLock sync.RWMutex
+
 func SetVids(vidset []int) {
 	if len(vidset) == 0 {
 		return
 	}
-	Vids = vidset
-	mylog.Info("=====Vids: %v ==================\n", Vids)
-	for _, vid := range Vids {
+	for _, vid := range vidset {
 		fdb.NewFdb(vid)
 	}
+	vidsLock.Lock()
+	Vids = vidset
+	vidsLock.Unlock()
+	mylog.Info("=====Vids: %v ==================\n", vidset)
+}
+
+// getVids returns Vids, empty if the vids are dynamic
+func getVids() []int {
+	vidsLock.RLock()
+	vids := Vids
+	vidsLock.RUnlock()
+	return vids
 }
 
 func (c *Client) JoinAllFdb() {
@@ -36,18 +50,24 @@ func (c *Client) joinFdbById(id int) error {
 	f := fdb.NewFdb(id)
 	fp := fdbPort{}
 	fp.fdb = f
+	stpJoin(c, id, f)
 	fp.fdbPortId = f.JoinFwdPort(c, !c.isClient)
 	if fp.fdbPortId == 0 {
+		f.SetPortBlocked(c, false)
 		mylog.Warning("fdb id=%d is full====================\n", id)
 		return fmt.Errorf("fdb (id=%d) is full", id)
 	}
 	c.fdbJoined[id] = fp
+	f.BindStatic(c, func(port string) bool { return clientNameIs(c, port) })
 	return nil
 }
 
 func (c *Client) joinFdbByIds(ids []int) {
 	c.Lock()
 	for _, id := range ids {
+		if _, ok := c.fdbJoined[id]; ok {
+			continue
+		}
 		c.joinFdbById(id)
 	}
 	c.Unlock()
@@ -59,7 +79,7 @@ func (c *Client) quitFdbByIds(ids []int) {
 		if fp, ok := c.fdbJoined[id]; ok {
 			fp.fdb.ReleaseFwdPort(fp.fdbPortId, !c.isClient)
 			delete(c.fdbJoined, id)
-			if len(Vids) == 0 {
+			if len(getVids()) == 0 {
 				fdb.TryToDelFdbById(id)
 			}
 		}
@@ -72,7 +92,7 @@ func (c *Client) quitAllFdb() {
 	for fpid, fp := range c.fdbJoined {
 		fp.fdb.ReleaseFwdPort(fp.fdbPortId, !c.isClient)
 		delete(c.fdbJoined, fpid)
-		if len(Vids) == 0 {
+		if len(getVids()) == 0 {
 			fdb.TryToDelFdbById(fpid)
 		}
 	}
@@ -119,7 +139,7 @@ func (c *Client) handleFdbIds(NewVids []int) {
 
 func (c *Client) handleFdbIdsMsg(msg []byte) error {
 	var vid uint16
-	var MsgVids, vids []int
+	var MsgVids []int
 	var err error
 	if len(msg)%2 != 0 {
 		return fmt.Errorf("len(msg)=%d,  %2 != 0 ", len(msg))
@@ -133,9 +153,29 @@ func (c *Client) handleFdbIdsMsg(msg []byte) error {
 		MsgVids = append(MsgVids, int(vid))
 	}
 	log.Println("======================== handleFdbIdsMsg vids :", MsgVids)
-	if len(Vids) > 0 {
+	c.Lock()
+	c.peerVids = MsgVids
+	c.Unlock()
+	c.applyPeerVids()
+	if len(getVids()) == 0 {
+		//go updateMasterFdb()
+		updateMasterFdb() //只有动态模式才需要更新MasterFdb
+	}
+	c.reportRouteMsg()
+	c.reportArpMsg()
+
+	return nil
+}
+
+// applyPeerVids joins the fdbs the peer reported, just the ones in Vids if it is set
+func (c *Client) applyPeerVids() {
+	var vids []int
+	c.RLock()
+	peerVids := c.peerVids
+	c.RUnlock()
+	if len(getVids()) > 0 {
 		//check if MsgVids in the Vids
-		for _, id := range MsgVids {
+		for _, id := range peerVids {
 			if _, ok := fdb.GetFdbById(id); ok {
 				vids = append(vids, id)
 			}
@@ -143,11 +183,82 @@ func (c *Client) handleFdbIdsMsg(msg []byte) error {
 		log.Println("========================have set Vids, so finnal vids :", vids)
 		c.handleFdbIds(vids)
 	} else {
-		c.handleFdbIds(MsgVids)
-		//go updateMasterFdb()
-		updateMasterFdb() //只有动态模式才需要更新MasterFdb
+		c.handleFdbIds(peerVids)
+	}
+}
+
+// UpdateVids changes Vids while the conns are working: the conns quit the
+// removed vids, the dialing ones join the added vids and report them, and
+// the others join the new vids their peer reported.
+func UpdateVids(vidset []int) error {
+	oldVids := getVids()
+	if len(oldVids) == 0 || len(vidset) == 0 {
+		return fmt.Errorf("can't switch between dynamic vids and Vids=%v without restart", vidset)
 	}
+	var removed, added []int
+	newVidMap := make(map[int]bool, len(vidset))
+	for _, vid := range vidset {
+		newVidMap[vid] = true
+	}
+	oldVidMap := make(map[int]bool, len(oldVids))
+	for _, vid := range oldVids {
+		oldVidMap[vid] = true
+		if !newVidMap[vid] {
+			removed = append(removed, vid)
+		}
+	}
+	for _, vid := range vidset {
+		if !oldVidMap[vid] {
+			added = append(added, vid)
+		}
+	}
+	SetVids(vidset)
+
+	ConnClientsLock.Lock()
+	clients := make([]*Client, 0, len(ConnClients))
+	for _, c := range ConnClients {
+		if c.master == nil {
+			clients = append(clients, c)
+		}
+	}
+	ConnClientsLock.Unlock()
+	//the masters of backup links dial too, but they aren't isClient
+	var backups []*Client
+	ClientMasterLock.Lock()
+	for _, c := range ClientMaster {
+		if _, ok := c.cio.(*backupLink); ok {
+			backups = append(backups, c)
+		}
+	}
+	ClientMasterLock.Unlock()
 
+	if len(removed) > 0 {
+		for _, c := range clients {
+			c.quitFdbByIds(removed)
+		}
+		for _, c := range backups {
+			c.quitFdbByIds(removed)
+		}
+		//the fdb is kept if a tun is still in it
+		for _, vid := range removed {
+			fdb.TryToDelFdbById(vid)
+		}
+	}
+	for _, c := range clients {
+		if c.isClient {
+			c.joinFdbByIds(added)
+			c.reportFdbMsg()
+		} else {
+			c.applyPeerVids()
+		}
+		c.reportRouteMsg()
+	}
+	for _, c := range backups {
+		c.joinFdbByIds(added)
+		c.reportFdbMsg()
+		c.reportRouteMsg()
+	}
+	updateMasterFdb()
 	return nil
 }
 
@@ -204,30 +315,16 @@ func updateMasterFdb() {
 
 func FdbIdsMsgPktHandle(c *Client, cr io.Reader, pb *packet.PktBuf, ph *PktHeader) (rn int, err error) {
 	pktLen := ph.pktLen
-	if int(pktLen) > c.maxSize {
+	if int(pktLen) > c.maxSize+aeadOverhead {
 		err = fmt.Errorf("FdbIdsMsgPktHandle: recv pktLen =%d is invalid", pktLen)
 		return
 	}
 
-	pkt := pb.LoadAndUseBuf(pktLen)
-
-	rn, err = io.ReadFull(cr, pkt)
-	if err != nil {
-		mylog.Error("ReadFull fail: %s, rn=%d, want=%d\n", err.Error(), rn, pktLen)
+	pkt, _, err := c.readPayload(cr, pb, ph)
+	if err != nil || pkt == nil {
 		return
 	}
-
-	if ph.pktCrypt != 0 {
-		log.Printf("ph.pktCrypt=%d\n", ph.pktCrypt)
-		block, ok := crypts[ph.pktCrypt]
-		if !ok {
-			err = fmt.Errorf("crypType =%d, not support\n", ph.pktCrypt)
-			return
-		}
-		cryptLock.Lock()
-		block.Decrypt(pkt, pkt)
-		cryptLock.Unlock()
-	}
+	rn = int(pktLen)
 
 	if err = c.handleFdbIdsMsg(pkt); err != nil {
 		mylog.Error("handleFdbIdsMsg: %s \n", err.Error())
@@ -0,0 +1,210 @@
+package vnet
+
+import (
+	"encoding/json"
+	"fdb"
+	"fmt"
+	"io"
+	"mylog"
+	"net"
+	"net/http"
+	"packet"
+	"strings"
+	"time"
+)
+
+const (
+	RouteAdvIntv       = 30 //second
+	routeEntrySize     = 6  //ip, prefix len, metric
+	routeMsgMaxEntries = L2PktMaxSize / routeEntrySize
+	L3PktMinSize       = packet.HeaderLen
+	L3PktMaxSize       = L2PktMaxSize - 14 //no ether header
+)
+
+var routeAdvChan = make(chan struct{}, 1)
+
+// routedFdb returns the fdb of vid if it forwards by ip prefix
+func routedFdb(vid int) (*fdb.FDB, bool) {
+	f, ok := fdb.GetFdbById(vid)
+	if !ok || !f.IsRouted() {
+		return nil, false
+	}
+	return f, true
+}
+
+// setTunRoutes makes the vid of a tun device routed, the prefixes behind the
+// tun are its own address and the configured routes.
+func setTunRoutes(tc *Client, tunconf TunConf) {
+	f := fdb.NewFdb(tunconf.Vid)
+	f.SetRouted()
+
+	prefixes := tunconf.Routes
+	if fields := strings.Fields(tunconf.Ipstr); len(fields) > 0 {
+		ipstr := strings.Split(fields[0], "/")[0]
+		if ip := net.ParseIP(ipstr); ip != nil && ip.To4() != nil {
+			prefixes = append(prefixes, ipstr+"/32")
+		}
+	}
+	for _, p := range prefixes {
+		_, prefix, err := net.ParseCIDR(p)
+		if err != nil {
+			mylog.Error("tun %s route %s is invalid: %s\n", tunconf.TunName, p, err.Error())
+			continue
+		}
+		if err = f.AddLocalRoute(prefix, tc); err != nil {
+			mylog.Error("tun %s add route %s fail: %s\n", tunconf.TunName, p, err.Error())
+			continue
+		}
+		mylog.Info("vid=%d, add local route %s dev %s\n", tunconf.Vid, prefix.String(), tunconf.TunName)
+	}
+	triggerRouteAdv()
+}
+
+func triggerRouteAdv() {
+	select {
+	case routeAdvChan <- struct{}{}:
+	default:
+	}
+}
+
+// routeAdvertise sends the routes to all conn clients periodically, and
+// whenever a routed fdb changes.
+func routeAdvertise() {
+	tick := time.Tick(time.Second * RouteAdvIntv)
+	for {
+		select {
+		case <-tick:
+		case <-routeAdvChan:
+		}
+		ConnClientsLock.Lock()
+		clients := make([]*Client, 0, len(ConnClients))
+		for _, c := range ConnClients {
+			clients = append(clients, c)
+		}
+		ConnClientsLock.Unlock()
+		for _, c := range clients {
+			c.reportRouteMsg()
+		}
+	}
+}
+
+// reportRouteMsg advertises the best routes of every routed fdb the client
+// joined, one RouteMsg per vid, an empty one withdraws all routes of the vid.
+func (c *Client) reportRouteMsg() {
+	master := c
+	if c.master != nil {
+		master = c.master
+	}
+	master.RLock()
+	var fps []fdbPort
+	var vids []int
+	for vid, fp := range master.fdbJoined {
+		if fp.fdb.IsRouted() {
+			fps = append(fps, fp)
+			vids = append(vids, vid)
+		}
+	}
+	master.RUnlock()
+
+	for i, fp := range fps {
+		entries := fp.fdb.ExportRoutes(master)
+		if len(entries) > routeMsgMaxEntries {
+			mylog.Warning("vid=%d has %d routes, just advertise %d\n", vids[i], len(entries), routeMsgMaxEntries)
+			entries = entries[:routeMsgMaxEntries]
+		}
+		pb := c.getPktBuf()
+		buf := pb.LoadBuf()
+		msg := buf[PktHeaderSize:PktHeaderSize]
+		for _, e := range entries {
+			plen, _ := e.Prefix.Mask.Size()
+			msg = append(msg, e.Prefix.IP.To4()...)
+			msg = append(msg, byte(plen), byte(e.Metric))
+		}
+		assemblePktHead(RouteMsg, buf[:PktHeaderSize], len(msg), vids[i])
+		pb.SetDataLen(PktHeaderSize + len(msg))
+		pb.SetUserDataOff(PktHeaderSize)
+		c.PutPktToChan2(pb)
+		putPktBuf(pb)
+	}
+}
+
+func (c *Client) handleRouteMsg(vid int, msg []byte) error {
+	if len(msg)%routeEntrySize != 0 {
+		return fmt.Errorf("len(msg)=%d,  %%%d != 0 ", len(msg), routeEntrySize)
+	}
+	port := c
+	if c.master != nil {
+		port = c.master
+	}
+	fp, ok := port.GetFdbById(vid)
+	if !ok {
+		mylog.Warning("%s advertise routes of vid=%d, but it don't join\n", c.String(), vid)
+		return nil
+	}
+	//only a tun of the node makes a vid routed, a peer can't switch an l2 vid
+	if !fp.fdb.IsRouted() {
+		mylog.Warning("%s advertise routes of vid=%d, but it isn't routed here, drop them\n", c.String(), vid)
+		return nil
+	}
+
+	entries := make([]fdb.RouteEntry, 0, len(msg)/routeEntrySize)
+	for off := 0; off < len(msg); off += routeEntrySize {
+		e := msg[off : off+routeEntrySize]
+		plen := int(e[4])
+		if plen > 32 {
+			return fmt.Errorf("prefix len %d is invalid", plen)
+		}
+		ip := net.IPv4(e[0], e[1], e[2], e[3]).To4()
+		entries = append(entries, fdb.RouteEntry{
+			Prefix: net.IPNet{IP: ip.Mask(net.CIDRMask(plen, 32)), Mask: net.CIDRMask(plen, 32)},
+			Metric: int(e[5]) + 1,
+		})
+	}
+
+	if fp.fdb.SetPortRoutes(port, entries) {
+		mylog.Info("vid=%d routes from %s changed, %d routes\n", vid, c.String(), len(entries))
+		triggerRouteAdv()
+	}
+	return nil
+}
+
+func RouteMsgPktHandle(c *Client, cr io.Reader, pb *packet.PktBuf, ph *PktHeader) (rn int, err error) {
+	pktLen := ph.pktLen
+	if int(pktLen) > L2PktMaxSize+aeadOverhead {
+		err = fmt.Errorf("RouteMsgPktHandle: recv pktLen =%d is invalid", pktLen)
+		return
+	}
+
+	pkt, _, err := c.readPayload(cr, pb, ph)
+	if err != nil || pkt == nil {
+		return
+	}
+	rn = int(pktLen)
+
+	if err = c.handleRouteMsg(int(ph.vid), pkt); err != nil {
+		mylog.Error("handleRouteMsg: %s \n", err.Error())
+		return
+	}
+	return
+}
+
+// pktRange returns the valid user data size of vid, the packets of a routed
+// vid are ip packets without ether header.
+func (c *Client) pktRange(vid uint16) (int, int) {
+	if !c.p2pFwd {
+		if _, ok := routedFdb(int(vid)); ok {
+			return L3PktMinSize, L3PktMaxSize
+		}
+	}
+	return c.minSize, c.maxSize
+}
+
+func showRoutes(w http.ResponseWriter, req *http.Request) {
+	rts := fdb.ShowRoutes()
+	rtBuf, err := json.MarshalIndent(rts, "", "\t")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(rtBuf)
+}